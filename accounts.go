@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+)
+
+var (
+	awsRoleARNPattern   = regexp.MustCompile(`^arn:aws[a-z-]*:iam::\d{12}:role/.+$`)
+	awsAccountIDPattern = regexp.MustCompile(`^\d{12}$`)
+	awsRegionPattern    = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+)
+
+// parseAWSAccount parses an `account` or `account:region` entry of --aws-account-ids / awsaccount
+func parseAWSAccount(entry string) (string, string, error) {
+	id, region := entry, ""
+	if i := strings.Index(entry, ":"); i >= 0 {
+		id, region = entry[:i], entry[i+1:]
+		if !awsRegionPattern.MatchString(region) {
+			return "", "", fmt.Errorf("invalid AWS region '%s' for account %s", region, id)
+		}
+	}
+	if !awsAccountIDPattern.MatchString(id) {
+		return "", "", fmt.Errorf("invalid AWS account ID '%s', expected 12 digits", id)
+	}
+	return id, region, nil
+}
+
+// parseAWSAccounts validates and de-duplicates the account entries, returning the account IDs in order
+// and the region of every account that does not use the default region; invalid entries are skipped
+func parseAWSAccounts(entries []string) ([]string, map[string]string, []error) {
+	var ids []string
+	var errs []error
+	regions := map[string]string{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, region, err := parseAWSAccount(entry)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if stringSliceContains(ids, id) {
+			if region != "" && regions[id] != region {
+				errs = append(errs, fmt.Errorf("AWS account %s is listed with more than one region, using %s", id, regionOrDefault(regions[id])))
+			}
+			continue
+		}
+		ids = append(ids, id)
+		if region != "" {
+			regions[id] = region
+		}
+	}
+	return ids, regions, errs
+}
+
+// parseAWSAccountRoles validates the account=role-arn entries of --aws-account-roles; invalid entries are skipped
+func parseAWSAccountRoles(entries map[string]string) (map[string]string, []error) {
+	var errs []error
+	roles := map[string]string{}
+	for id, role := range entries {
+		id, role = strings.TrimSpace(id), strings.TrimSpace(role)
+		if !awsAccountIDPattern.MatchString(id) {
+			errs = append(errs, fmt.Errorf("invalid AWS account ID '%s', expected 12 digits", id))
+			continue
+		}
+		if !awsRoleARNPattern.MatchString(role) {
+			errs = append(errs, fmt.Errorf("invalid role ARN '%s' for account %s", role, id))
+			continue
+		}
+		roles[id] = role
+	}
+	return roles, errs
+}
+
+func regionOrDefault(region string) string {
+	if region == "" {
+		return *argAWSRegion
+	}
+	return region
+}
+
+// ecrClientFor returns the ECR client of a region and account role, creating it on first use; the clients are shared
+// by every account in the same region that assumes the same role
+func (c *controller) ecrClientFor(region, role string) ecrInterface {
+	c.reloadLock.RLock()
+	defer c.reloadLock.RUnlock()
+	if (region == c.config.awsSettings(c.defaults).Region && role == "") || c.newRegionalEcrClient == nil {
+		return c.ecrClient
+	}
+
+	key := region
+	if role != "" {
+		key += "|" + role
+	}
+	c.ecrClientsLock.Lock()
+	defer c.ecrClientsLock.Unlock()
+	client, ok := c.ecrClients[key]
+	if !ok {
+		client = c.newRegionalEcrClient(region, role)
+		c.ecrClients[key] = client
+	}
+	return client
+}
+
+// keepFailedAccounts distributes the tokens of the accounts that succeeded when others failed, instead of failing the
+// whole fetch. The previous tokens of a failed account are kept while they are valid, so its registry keeps working
+// until access is restored or they expire.
+func (c *controller) keepFailedAccounts(name, secretName string, tokens []AuthToken, partial *providers.PartialError) []AuthToken {
+	failed := partial.Accounts()
+	log.Warnf("Could not get the ECR tokens of account(s) %s, distributing the tokens of the other accounts: %s", strings.Join(failed, ", "), partial)
+
+	now := time.Now()
+	c.secretsLock.Lock()
+	previous := c.tokens[secretName]
+	c.secretsLock.Unlock()
+	for _, account := range failed {
+		if account == "" {
+			// the default registry's host is not known without a token
+			continue
+		}
+		for _, token := range previous {
+			if strings.HasPrefix(token.Host(), account+".") && token.ExpiresAt.After(now) {
+				log.Infof("Keeping the previous token of registry %s until it expires at %s", token.Host(), token.ExpiresAt.UTC().Format(time.RFC3339))
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	c.recordFailedAccounts(name, failed)
+	return providers.DedupeTokens(tokens)
+}
+
+// recordFailedAccounts publishes the accounts the last fetch of the ECR provider name failed for
+func (c *controller) recordFailedAccounts(name string, failed []string) {
+	c.secretsLock.Lock()
+	previous := c.ecrFailedAccounts[name]
+	if len(failed) == 0 {
+		delete(c.ecrFailedAccounts, name)
+	} else {
+		c.ecrFailedAccounts[name] = failed
+	}
+	c.secretsLock.Unlock()
+	for _, account := range previous {
+		ecrAccountFailed.DeleteLabelValues(name, account)
+	}
+	for _, account := range failed {
+		ecrAccountFailed.WithLabelValues(name, account).Set(1)
+	}
+}
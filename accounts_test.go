@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// regionEcrClient returns one token per requested registry, tagged with its region
+type regionEcrClient struct {
+	region string
+	// denied fails every request that includes one of these registries
+	denied map[string]bool
+}
+
+func (f *regionEcrClient) GetAuthorizationTokenWithContext(ctx aws.Context, input *ecr.GetAuthorizationTokenInput, opts ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+	for _, id := range input.RegistryIds {
+		if f.denied[*id] {
+			return nil, fmt.Errorf("access denied to registry %s", *id)
+		}
+	}
+	out := &ecr.GetAuthorizationTokenOutput{}
+	for _, id := range input.RegistryIds {
+		out.AuthorizationData = append(out.AuthorizationData, &ecr.AuthorizationData{
+			AuthorizationToken: aws.String("token-" + f.region),
+			ProxyEndpoint:      aws.String(fmt.Sprintf("https://%s.dkr.ecr.%s.amazonaws.com", *id, f.region)),
+			ExpiresAt:          aws.Time(time.Now().Add(12 * time.Hour)),
+		})
+	}
+	return out, nil
+}
+
+func TestParseAWSAccounts(t *testing.T) {
+	ids, regions, errs := parseAWSAccounts([]string{
+		"123456789012",
+		" 210987654321:eu-west-1 ",
+		"123456789012",
+		"12345",
+		"111111111111:not-a-region",
+		"",
+	})
+
+	assert.Equal(t, []string{"123456789012", "210987654321"}, ids)
+	assert.Equal(t, map[string]string{"210987654321": "eu-west-1"}, regions)
+	assert.Len(t, errs, 2)
+}
+
+func TestParseAWSAccountsConflictingRegion(t *testing.T) {
+	ids, regions, errs := parseAWSAccounts([]string{"210987654321:eu-west-1", "210987654321:us-gov-west-1"})
+
+	assert.Equal(t, []string{"210987654321"}, ids)
+	assert.Equal(t, "eu-west-1", regions["210987654321"])
+	assert.Len(t, errs, 1)
+}
+
+func TestGetECRAuthorizationKeyPerRegion(t *testing.T) {
+	c := newController(newKubeUtil(), &regionEcrClient{region: *argAWSRegion})
+	c.defaults.AccountIDs = []string{"123456789012", "210987654321", "333333333333"}
+	c.defaults.AccountRegions = map[string]string{"210987654321": "eu-west-1", "333333333333": "eu-west-1"}
+	created := 0
+	c.newRegionalEcrClient = func(region, role string) ecrInterface {
+		created++
+		return &regionEcrClient{region: region}
+	}
+
+	tokens, err := c.getECRAuthorizationKey(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 3)
+	assert.Equal(t, "token-"+*argAWSRegion, tokens[0].AccessToken)
+	assert.Equal(t, "https://210987654321.dkr.ecr.eu-west-1.amazonaws.com", tokens[1].Endpoint)
+	assert.Equal(t, "https://333333333333.dkr.ecr.eu-west-1.amazonaws.com", tokens[2].Endpoint)
+
+	// the regional client is reused across refreshes
+	_, err = c.getECRAuthorizationKey(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, created)
+}
+
+func TestGetECRAuthorizationKeyDedupesEndpoints(t *testing.T) {
+	// the default registry and the explicitly listed own account resolve to the same endpoint
+	c := newController(newKubeUtil(), &regionEcrClient{region: *argAWSRegion})
+	c.defaults.AccountIDs = []string{"123456789012", "123456789012"}
+	tokens, err := c.getECRAuthorizationKey(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 1)
+}
+
+func TestParseAWSAccountRoles(t *testing.T) {
+	roles, errs := parseAWSAccountRoles(map[string]string{
+		"123456789012": "arn:aws:iam::123456789012:role/registry-creds",
+		"210987654321": "registry-creds",
+		"12345":        "arn:aws:iam::123456789012:role/registry-creds",
+	})
+
+	assert.Equal(t, map[string]string{"123456789012": "arn:aws:iam::123456789012:role/registry-creds"}, roles)
+	assert.Len(t, errs, 2)
+}
+
+func TestGetECRAuthorizationKeyPerAccountRole(t *testing.T) {
+	c := newController(newKubeUtil(), &regionEcrClient{region: *argAWSRegion})
+	c.defaults.AccountIDs = []string{"123456789012", "210987654321", "333333333333"}
+	c.defaults.AccountRoles = map[string]string{
+		"210987654321": "arn:aws:iam::210987654321:role/registry-creds",
+		"333333333333": "arn:aws:iam::333333333333:role/registry-creds",
+	}
+	var roles []string
+	c.newRegionalEcrClient = func(region, role string) ecrInterface {
+		roles = append(roles, role)
+		return &regionEcrClient{region: region}
+	}
+
+	tokens, err := c.getECRAuthorizationKey(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 3)
+	assert.Equal(t, "https://123456789012.dkr.ecr.us-east-1.amazonaws.com", tokens[0].Endpoint)
+
+	// one client per role, reused across refreshes
+	_, err = c.getECRAuthorizationKey(context.TODO())
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{c.defaults.AccountRoles["210987654321"], c.defaults.AccountRoles["333333333333"]}, roles)
+}
+
+func TestGetECRAuthorizationKeyPartialFailure(t *testing.T) {
+	defer ecrAccountFailed.Reset()
+
+	client := &regionEcrClient{region: *argAWSRegion}
+	c := newController(newKubeUtil(), client)
+	c.defaults.AccountIDs = []string{"111111111111", "222222222222"}
+	tokens, err := c.getECRAuthorizationKey(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 2)
+	c.tokens[*argAWSSecretName] = tokens
+
+	// an account that revokes access keeps its previous, still valid token; the other one is refreshed
+	client.denied = map[string]bool{"222222222222": true}
+	tokens, err = c.getECRAuthorizationKey(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 2)
+	assert.Equal(t, "111111111111.dkr.ecr."+*argAWSRegion+".amazonaws.com", tokens[0].Host())
+	assert.Equal(t, "222222222222.dkr.ecr."+*argAWSRegion+".amazonaws.com", tokens[1].Host())
+	assert.Equal(t, []string{"222222222222"}, c.ecrFailedAccounts[providerECR])
+	assert.Equal(t, float64(1), testutil.ToFloat64(ecrAccountFailed.WithLabelValues(providerECR, "222222222222")))
+
+	// once the previous token expired only the working account is distributed
+	c.tokens[*argAWSSecretName][1].ExpiresAt = time.Now().Add(-time.Minute)
+	tokens, err = c.getECRAuthorizationKey(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 1)
+
+	client.denied = nil
+	_, err = c.getECRAuthorizationKey(context.TODO())
+	assert.Nil(t, err)
+	assert.Empty(t, c.ecrFailedAccounts)
+	assert.Equal(t, 0, testutil.CollectAndCount(ecrAccountFailed))
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// outputAgent is --output=agent: the namespaces get no secrets, the nodes fetch the credentials from --agent-address
+	outputAgent = "agent"
+
+	// agentPath is where the agent answers CredentialProviderRequests
+	agentPath = "/credentialprovider"
+	// unixSocketPrefix marks an --agent-address that is a unix socket path
+	unixSocketPrefix = "unix://"
+
+	credentialProviderGroup      = "credentialprovider.kubelet.k8s.io"
+	credentialProviderAPIVersion = credentialProviderGroup + "/v1"
+
+	// agentCacheMargin is how long before their expiry the kubelet stops using cached credentials
+	agentCacheMargin = 5 * time.Minute
+)
+
+// credentialProviderRequest is what the kubelet sends an image credential provider, see
+// https://kubernetes.io/docs/reference/config-api/kubelet-credentialprovider.v1/
+type credentialProviderRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Image      string `json:"image"`
+}
+
+// credentialProviderResponse is the answer to a credentialProviderRequest
+type credentialProviderResponse struct {
+	APIVersion    string                            `json:"apiVersion"`
+	Kind          string                            `json:"kind"`
+	CacheKeyType  string                            `json:"cacheKeyType"`
+	CacheDuration *metav1.Duration                  `json:"cacheDuration,omitempty"`
+	Auth          map[string]credentialProviderAuth `json:"auth,omitempty"`
+}
+
+type credentialProviderAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// agentOutput is --output=agent: the credentials only go to the nodes through the agent endpoint
+type agentOutput struct{}
+
+func (agentOutput) write(context.Context, string, *v1.Secret) error {
+	return nil
+}
+
+// validAgentAddress checks that --agent-address is a unix socket or a loopback address: the endpoint hands out
+// credentials without authentication, so only the node itself may reach it
+func validAgentAddress(addr string) error {
+	if strings.HasPrefix(addr, unixSocketPrefix) {
+		if !strings.HasPrefix(strings.TrimPrefix(addr, unixSocketPrefix), "/") {
+			return errors.New("the socket path must be absolute")
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.New("the agent serves credentials without authentication, so it must listen on a unix socket or a loopback address")
+	}
+	return nil
+}
+
+// listenAgent opens the listener of --agent-address, replacing a socket left behind by a previous run
+func listenAgent(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, unixSocketPrefix)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// only the kubelet, running as root, needs to connect
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// startAgent serves the cached credentials to the kubelet in the background; an empty address disables it
+func startAgent(addr string, c *controller) {
+	if addr == "" {
+		return
+	}
+	listener, err := listenAgent(addr)
+	if err != nil {
+		log.Fatalf("Could not listen on the agent address! [Err: %s]", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(agentPath, c.agentHandler)
+	go func() {
+		log.Infof("Serving kubelet credentials on %s", addr)
+		if err := http.Serve(listener, mux); err != nil {
+			log.Fatalf("Agent server failed! [Err: %s]", err)
+		}
+	}()
+}
+
+// agentHandler answers a CredentialProviderRequest with the cached credentials of the image's registry
+func (c *controller) agentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request credentialProviderRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request); err != nil {
+		agentRequests.WithLabelValues("error").Inc()
+		http.Error(w, fmt.Sprintf("could not decode the CredentialProviderRequest: %s", err), http.StatusBadRequest)
+		return
+	}
+	if request.Image == "" {
+		agentRequests.WithLabelValues("error").Inc()
+		http.Error(w, "the CredentialProviderRequest has no image", http.StatusBadRequest)
+		return
+	}
+
+	response := c.credentialProviderResponse(request, time.Now())
+	result := "miss"
+	if len(response.Auth) > 0 {
+		result = "hit"
+	}
+	agentRequests.WithLabelValues(result).Inc()
+	log.Debugf("Agent request for image %s: %s", request.Image, result)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// credentialProviderResponse returns the unexpired cached credentials of the image's registry, in the API version of
+// the request; without any the kubelet pulls anonymously or with the pod's imagePullSecrets
+func (c *controller) credentialProviderResponse(request credentialProviderRequest, now time.Time) credentialProviderResponse {
+	response := credentialProviderResponse{
+		APIVersion:   credentialProviderAPIVersion,
+		Kind:         "CredentialProviderResponse",
+		CacheKeyType: "Registry",
+	}
+	if strings.HasPrefix(request.APIVersion, credentialProviderGroup+"/") {
+		response.APIVersion = request.APIVersion
+	}
+
+	registry := imageHost(request.Image)
+	c.secretsLock.Lock()
+	defer c.secretsLock.Unlock()
+	secretNames := make([]string, 0, len(c.tokens))
+	for name := range c.tokens {
+		secretNames = append(secretNames, name)
+	}
+	sort.Strings(secretNames)
+	for _, name := range secretNames {
+		for _, token := range c.tokens[name] {
+			if !token.ExpiresAt.IsZero() && !token.ExpiresAt.After(now) {
+				continue
+			}
+			if canonicalRegistry(token.Host()) != registry {
+				continue
+			}
+			user, password, err := token.Credentials()
+			if err != nil {
+				continue
+			}
+			response.Auth = map[string]credentialProviderAuth{registry: {Username: user, Password: password}}
+			cache := time.Duration(*argRefreshMinutes) * time.Minute
+			if !token.ExpiresAt.IsZero() {
+				cache = token.ExpiresAt.Sub(now) - agentCacheMargin
+			}
+			if cache > 0 {
+				response.CacheDuration = &metav1.Duration{Duration: cache}
+			}
+			return response
+		}
+	}
+	return response
+}
+
+// runCredentialProvider is the credential-provider subcommand the kubelet executes: it forwards the
+// CredentialProviderRequest on in to the agent at addr and writes the response to out
+func runCredentialProvider(in io.Reader, out io.Writer, addr string) error {
+	if addr == "" {
+		return errors.New("--agent-address is required")
+	}
+	request, err := io.ReadAll(io.LimitReader(in, 1<<20))
+	if err != nil {
+		return fmt.Errorf("could not read the CredentialProviderRequest: %w", err)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	url := "http://" + addr + agentPath
+	if strings.HasPrefix(addr, unixSocketPrefix) {
+		path := strings.TrimPrefix(addr, unixSocketPrefix)
+		client.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		}}
+		url = "http://agent" + agentPath
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(request))
+	if err != nil {
+		return fmt.Errorf("could not reach the agent: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read the agent response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the agent answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	_, err = out.Write(body)
+	return err
+}
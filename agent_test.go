@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageHostIsCanonical(t *testing.T) {
+	for image, registry := range map[string]string{
+		"nginx":                         "docker.io",
+		"library/nginx:1.25":            "docker.io",
+		"docker.io/library/nginx":       "docker.io",
+		"index.docker.io/library/nginx": "docker.io",
+		"localhost/app":                 "localhost",
+		"localhost:5000/app":            "localhost:5000",
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:v1": "123456789012.dkr.ecr.eu-west-1.amazonaws.com",
+		"Registry.Example.com/team/app@sha256:abc":            "registry.example.com",
+	} {
+		assert.Equal(t, registry, imageHost(image), image)
+	}
+}
+
+func TestValidAgentAddress(t *testing.T) {
+	for _, addr := range []string{"unix:///var/run/registry-creds/agent.sock", "127.0.0.1:8095", "[::1]:8095", "localhost:8095"} {
+		assert.Nil(t, validAgentAddress(addr), addr)
+	}
+	for _, addr := range []string{"unix://agent.sock", ":8095", "0.0.0.0:8095", "10.0.0.1:8095", "127.0.0.1"} {
+		assert.NotNil(t, validAgentAddress(addr), addr)
+	}
+}
+
+func TestCredentialProviderResponse(t *testing.T) {
+	now := time.Date(2022, 9, 1, 10, 0, 0, 0, time.UTC)
+	c := newFakeController()
+	c.tokens = map[string][]AuthToken{
+		"awsecr-cred": {
+			{Endpoint: "https://123456789012.dkr.ecr.eu-west-1.amazonaws.com", Username: "AWS", Password: "ecr-password", ExpiresAt: now.Add(12 * time.Hour)},
+			{Endpoint: "https://expired.example.com", Username: "AWS", Password: "old", ExpiresAt: now.Add(-time.Minute)},
+		},
+		"dockerhub": {{Endpoint: "https://index.docker.io/v1/", Username: "robot", Password: "hub-password"}},
+	}
+
+	response := c.credentialProviderResponse(credentialProviderRequest{
+		APIVersion: "credentialprovider.kubelet.k8s.io/v1beta1",
+		Image:      "123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:v1",
+	}, now)
+	assert.Equal(t, "credentialprovider.kubelet.k8s.io/v1beta1", response.APIVersion)
+	assert.Equal(t, "CredentialProviderResponse", response.Kind)
+	assert.Equal(t, "Registry", response.CacheKeyType)
+	assert.Equal(t, map[string]credentialProviderAuth{
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com": {Username: "AWS", Password: "ecr-password"},
+	}, response.Auth)
+	assert.Equal(t, 12*time.Hour-agentCacheMargin, response.CacheDuration.Duration)
+
+	// tokens without an expiry are cached for the refresh interval
+	response = c.credentialProviderResponse(credentialProviderRequest{Image: "nginx"}, now)
+	assert.Equal(t, credentialProviderAPIVersion, response.APIVersion)
+	assert.Equal(t, credentialProviderAuth{Username: "robot", Password: "hub-password"}, response.Auth["docker.io"])
+	assert.Equal(t, time.Duration(*argRefreshMinutes)*time.Minute, response.CacheDuration.Duration)
+
+	// expired tokens and unknown registries get no credentials
+	for _, image := range []string{"expired.example.com/app", "quay.io/app"} {
+		response = c.credentialProviderResponse(credentialProviderRequest{Image: image}, now)
+		assert.Empty(t, response.Auth, image)
+		assert.Nil(t, response.CacheDuration, image)
+	}
+}
+
+func TestAgentHandler(t *testing.T) {
+	c := newFakeController()
+	c.tokens = map[string][]AuthToken{"fake": {{Endpoint: "https://registry.example.com", Username: "fake", Password: "secret"}}}
+	handler := http.HandlerFunc(c.agentHandler)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, agentPath, strings.NewReader(
+		`{"apiVersion": "credentialprovider.kubelet.k8s.io/v1", "kind": "CredentialProviderRequest", "image": "registry.example.com/app"}`)))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response credentialProviderResponse
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "secret", response.Auth["registry.example.com"].Password)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, agentPath, strings.NewReader(`{"kind": "CredentialProviderRequest"}`)))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, agentPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
+
+func TestRunCredentialProviderOverUnixSocket(t *testing.T) {
+	c := newFakeController()
+	c.tokens = map[string][]AuthToken{"fake": {{Endpoint: "https://registry.example.com", Username: "fake", Password: "secret"}}}
+	addr := unixSocketPrefix + filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := listenAgent(addr)
+	require.Nil(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(c.agentHandler)}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	var out bytes.Buffer
+	err = runCredentialProvider(strings.NewReader(`{"apiVersion": "credentialprovider.kubelet.k8s.io/v1", "kind": "CredentialProviderRequest", "image": "registry.example.com/app"}`), &out, addr)
+	assert.Nil(t, err)
+	var response credentialProviderResponse
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &response))
+	assert.Equal(t, credentialProviderAuth{Username: "fake", Password: "secret"}, response.Auth["registry.example.com"])
+
+	err = runCredentialProvider(strings.NewReader(`{}`), &out, addr)
+	assert.ErrorContains(t, err, "400 Bad Request")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+)
+
+// apiPrefix is the prefix of the read-only controller state API
+const apiPrefix = "/api/v1/"
+
+// providerState is a provider's entry in /api/v1/providers
+type providerState struct {
+	Name            string   `json:"name"`
+	Secrets         []string `json:"secrets"`
+	RefreshInterval string   `json:"refreshInterval"`
+	// Healthy is true once the provider's last token fetch succeeded
+	Healthy             bool       `json:"healthy"`
+	CircuitOpen         bool       `json:"circuitOpen"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastErrorTime       *time.Time `json:"lastErrorTime,omitempty"`
+	// Stale is true while the provider's refresh fails and its cached, unexpired tokens are served
+	Stale bool `json:"stale"`
+	// Registries are the hosts of the cached tokens; TokenExpiry is the earliest expiry among them, if known
+	Registries  []string   `json:"registries,omitempty"`
+	TokenExpiry *time.Time `json:"tokenExpiry,omitempty"`
+	// FailedAccounts are the AWS accounts whose tokens the last ECR fetch could not get while others succeeded
+	FailedAccounts []string `json:"failedAccounts,omitempty"`
+}
+
+// providerStates returns the state of every provider, in provider order
+func (c *controller) providerStates() []providerState {
+	generators := getSecretGenerators(c)
+	states := make([]providerState, 0, len(generators))
+	for _, sg := range generators {
+		circuit := c.circuit(sg.Name).state()
+		state := providerState{
+			Name:                sg.Name,
+			Secrets:             c.providerSecretNames([]SecretGenerator{sg}),
+			RefreshInterval:     sg.RefreshInterval.String(),
+			Healthy:             circuit.failures == 0 && !circuit.lastSuccess.IsZero(),
+			CircuitOpen:         circuit.open,
+			ConsecutiveFailures: circuit.failures,
+			LastSuccess:         timePtr(circuit.lastSuccess),
+			LastError:           circuit.lastError,
+			LastErrorTime:       timePtr(circuit.lastErrorTime),
+		}
+
+		c.secretsLock.Lock()
+		tokens := c.tokens[sg.SecretName]
+		state.Stale = c.stale[sg.Name]
+		state.FailedAccounts = c.ecrFailedAccounts[sg.Name]
+		c.secretsLock.Unlock()
+		for _, token := range tokens {
+			state.Registries = append(state.Registries, token.Host())
+		}
+		state.TokenExpiry = timePtr(providers.EarliestExpiry(tokens))
+		states = append(states, state)
+	}
+	return states
+}
+
+// timePtr returns nil for the zero time, so it is omitted from the JSON
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// apiHandler serves the read-only state API:
+//
+//	/api/v1/providers                  health, token expiry and registries of every provider
+//	/api/v1/namespaces                 sync state of every namespace
+//	/api/v1/namespaces/<name>/status   sync state of one namespace
+func (c *controller) apiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "providers":
+		writeJSON(w, c.providerStates())
+	case len(path) == 1 && path[0] == "namespaces":
+		writeJSON(w, c.status.snapshot())
+	case len(path) == 3 && path[0] == "namespaces" && path[2] == "status":
+		status, ok := c.status.snapshot()[path[1]]
+		if !ok {
+			http.Error(w, "namespace not synced", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, status)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func getJSON(t *testing.T, mux *http.ServeMux, path string, v interface{}) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code == http.StatusOK {
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+	return rec.Code
+}
+
+func TestAPIProviders(t *testing.T) {
+	c := newFakeController()
+	mux := newServeMux(c, "s3cret")
+
+	var states []providerState
+	assert.Equal(t, http.StatusOK, getJSON(t, mux, "/api/v1/providers", &states))
+	if assert.Len(t, states, 1) {
+		assert.Equal(t, providerECR, states[0].Name)
+		assert.False(t, states[0].Healthy)
+		assert.Nil(t, states[0].LastSuccess)
+	}
+
+	assert.Nil(t, handler(context.TODO(), c, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}))
+	assert.Equal(t, http.StatusOK, getJSON(t, mux, "/api/v1/providers", &states))
+	if assert.Len(t, states, 1) {
+		assert.True(t, states[0].Healthy)
+		assert.NotNil(t, states[0].LastSuccess)
+		assert.Equal(t, []string{*argAWSSecretName}, states[0].Secrets)
+		assert.NotEmpty(t, states[0].Registries)
+	}
+}
+
+func TestAPINamespaceStatus(t *testing.T) {
+	c := newFakeController()
+	mux := newServeMux(c, "s3cret")
+	assert.Nil(t, handler(context.TODO(), c, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}))
+
+	var status namespaceStatus
+	assert.Equal(t, http.StatusOK, getJSON(t, mux, "/api/v1/namespaces/namespace1/status", &status))
+	assert.NotNil(t, status.LastSuccess)
+	assert.Contains(t, status.SecretHashes, *argAWSSecretName)
+
+	var all map[string]namespaceStatus
+	assert.Equal(t, http.StatusOK, getJSON(t, mux, "/api/v1/namespaces", &all))
+	assert.Contains(t, all, "namespace1")
+
+	assert.Equal(t, http.StatusNotFound, getJSON(t, mux, "/api/v1/namespaces/namespace2/status", &status))
+	assert.Equal(t, http.StatusNotFound, getJSON(t, mux, "/api/v1/secrets", &status))
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(mux, http.MethodPost, "/api/v1/providers", "s3cret"))
+	assert.Equal(t, http.StatusUnauthorized, serve(mux, http.MethodGet, "/api/v1/providers", ""))
+	assert.Equal(t, http.StatusForbidden, serve(newServeMux(c, ""), http.MethodGet, "/api/v1/providers", ""))
+}
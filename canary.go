@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/doddle/registry-creds/k8sutil"
+)
+
+// pullAuthFailures are substrings of the kubelet's image pull errors that point at the credentials rather than at
+// a missing image or tag
+var pullAuthFailures = []string{"unauthorized", "no basic auth credentials", "authentication required", "denied", "forbidden"}
+
+// splitCanaries returns the targets listed in --canary-namespaces and the others
+func splitCanaries(targets []*v1.Namespace) (canaries, rest []*v1.Namespace) {
+	for _, ns := range targets {
+		if stringSliceContains(*argCanaryNamespaces, ns.Name) {
+			canaries = append(canaries, ns)
+		} else {
+			rest = append(rest, ns)
+		}
+	}
+	return canaries, rest
+}
+
+// setCanarySecrets records the secrets of a provider's rotation while the canary namespaces verify them, nil once they
+// are done; the reconciler writes them into the canaries instead of the committed ones
+func (c *controller) setCanarySecrets(secretName string, secrets []*v1.Secret) {
+	c.secretsLock.Lock()
+	defer c.secretsLock.Unlock()
+	if secrets == nil {
+		delete(c.canarySecrets, secretName)
+		return
+	}
+	c.canarySecrets[secretName] = secrets
+}
+
+// namespaceSecrets returns the secrets of the providers for namespace like generateProviderSecrets, but a canary
+// namespace keeps the secrets of a rotation it is verifying
+func (c *controller) namespaceSecrets(ctx context.Context, namespace string, secretGenerators []SecretGenerator) []*v1.Secret {
+	if !stringSliceContains(*argCanaryNamespaces, namespace) {
+		return c.generateProviderSecrets(ctx, secretGenerators)
+	}
+	var secrets []*v1.Secret
+	for _, secretGenerator := range secretGenerators {
+		c.secretsLock.Lock()
+		verifying := c.canarySecrets[secretGenerator.SecretName]
+		c.secretsLock.Unlock()
+		if verifying != nil {
+			secrets = append(secrets, verifying...)
+			continue
+		}
+		secrets = append(secrets, c.generateProviderSecrets(ctx, []SecretGenerator{secretGenerator})...)
+	}
+	return secrets
+}
+
+// registryVerifier checks that a registry accepts a token
+type registryVerifier func(ctx context.Context, token AuthToken) error
+
+// newRegistryVerifier logs in to the registry's Docker Registry HTTP API V2 base endpoint, which every registry
+// answers with 401 for credentials it does not accept
+func newRegistryVerifier(client *http.Client) registryVerifier {
+	return func(ctx context.Context, token AuthToken) error {
+		user, password, err := token.Credentials()
+		if err != nil {
+			return err
+		}
+		url := "https://" + token.Host() + "/v2/"
+		ctx, cancel := providerContext(ctx)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(user, password)
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("could not reach %s: %v", url, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s rejected the credentials: %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// verifyCanaries decides whether a rotation that reached the canary namespaces may roll out to the rest: every canary
+// was written, every registry accepts the new tokens and, after --canary-soak, no pod in a canary namespace fails to
+// pull from the provider's registries for lack of credentials
+func (c *controller) verifyCanaries(ctx context.Context, secretGenerator SecretGenerator, tokens []AuthToken, canaries []*v1.Namespace, failed []string) error {
+	if len(failed) > 0 {
+		return fmt.Errorf("could not write canary namespaces %s", strings.Join(failed, ","))
+	}
+
+	if c.verifyRegistry != nil && c.fake == nil {
+		for _, token := range tokens {
+			if err := c.verifyRegistry(ctx, token); err != nil {
+				return err
+			}
+		}
+	}
+
+	if *argCanarySoak > 0 {
+		log.Infof("Waiting %s for the canary namespaces of provider %s to pull images", *argCanarySoak, secretGenerator.Name)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(*argCanarySoak):
+		}
+	}
+
+	hosts := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		hosts = append(hosts, token.Host())
+	}
+	var failures []string
+	for _, ns := range canaries {
+		pods, err := c.k8sutil.ListPods(ctx, ns.Name)
+		if k8sutil.IsForbidden(err) {
+			log.Warnf("Not allowed to list pods; the canary rotation of provider %s is only verified against the registries", secretGenerator.Name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		failures = append(failures, imagePullFailures(pods.Items, hosts)...)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("image pulls failed in canary namespaces: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// imagePullFailures lists the containers that cannot pull an image from one of hosts because of its credentials
+func imagePullFailures(pods []v1.Pod, hosts []string) []string {
+	var failures []string
+	for i := range pods {
+		for _, failure := range podPullFailures(&pods[i], hosts) {
+			failures = append(failures, fmt.Sprintf("%s/%s: %s", pods[i].Namespace, pods[i].Name, failure.image))
+		}
+	}
+	return failures
+}
+
+// imageHost returns the canonical registry host of an image reference, "docker.io" for images without one
+func imageHost(image string) string {
+	host, _, found := strings.Cut(image, "/")
+	if !found || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		return "docker.io"
+	}
+	return canonicalRegistry(host)
+}
+
+// canonicalRegistry lowercases a registry host, strips any path and maps the Docker Hub aliases to docker.io
+func canonicalRegistry(host string) string {
+	host, _, _ = strings.Cut(strings.ToLower(host), "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return host
+}
+
+// registryListed reports whether the canonical host is one of hosts
+func registryListed(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if canonicalRegistry(h) == host {
+			return true
+		}
+	}
+	return false
+}
+
+func authFailure(message string) bool {
+	message = strings.ToLower(message)
+	for _, s := range pullAuthFailures {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// abortRotation puts the previous secrets back into the canary namespaces, so they do not keep using credentials that
+// failed verification; the rejected rotation was never committed, so the cache, the sinks and the token store still
+// hold the previous ones
+func (c *controller) abortRotation(ctx context.Context, secretGenerator SecretGenerator, canaries []*v1.Namespace, previous []*v1.Secret) {
+	if len(previous) == 0 {
+		log.Warnf("No previous secrets of provider %s to restore in the canary namespaces", secretGenerator.Name)
+		return
+	}
+	_, failed := c.syncTargets(ctx, canaries, previous)
+	if len(failed) > 0 {
+		log.Errorf("Could not restore the previous secrets of provider %s in canary namespaces %s!", secretGenerator.Name, strings.Join(failed, ","))
+	}
+}
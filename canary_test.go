@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestImagePullFailures(t *testing.T) {
+	waiting := func(image, reason, message string) v1.ContainerStatus {
+		return v1.ContainerStatus{Image: image, State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: reason, Message: message}}}
+	}
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "canary", Name: "app"},
+		Status: v1.PodStatus{
+			InitContainerStatuses: []v1.ContainerStatus{
+				waiting("123456789012.dkr.ecr.us-east-1.amazonaws.com/init:1", "ErrImagePull", "pull access denied"),
+			},
+			ContainerStatuses: []v1.ContainerStatus{
+				waiting("123456789012.dkr.ecr.us-east-1.amazonaws.com/app:missing", "ErrImagePull", "manifest unknown"),
+				waiting("nginx:latest", "ImagePullBackOff", "unauthorized"),
+				waiting("123456789012.dkr.ecr.us-east-1.amazonaws.com/app:1", "ContainerCreating", ""),
+			},
+		},
+	}
+	assert.Equal(t, []string{"canary/app: 123456789012.dkr.ecr.us-east-1.amazonaws.com/init:1"},
+		imagePullFailures([]v1.Pod{pod}, []string{"123456789012.dkr.ecr.us-east-1.amazonaws.com"}))
+
+	assert.Equal(t, "docker.io", imageHost("nginx"))
+	assert.Equal(t, "docker.io", imageHost("library/nginx"))
+	assert.Equal(t, "localhost:5000", imageHost("localhost:5000/app"))
+}
+
+func TestRegistryVerifier(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if r.URL.Path != "/v2/" || user != "AWS" || password != "good" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	verify := newRegistryVerifier(server.Client())
+
+	assert.Nil(t, verify(context.TODO(), AuthToken{Endpoint: server.URL, Username: "AWS", Password: "good"}))
+	assert.NotNil(t, verify(context.TODO(), AuthToken{Endpoint: server.URL, Username: "AWS", Password: "bad"}))
+}
+
+func TestCanaryRotation(t *testing.T) {
+	defer func() { *argCanaryNamespaces = nil }()
+	*argCanaryNamespaces = []string{"namespace1"}
+	c := newFakeController()
+	sg := getSecretGenerators(c)[0]
+
+	c.verifyRegistry = func(context.Context, AuthToken) error { return nil }
+	c.refreshProvider(context.TODO(), sg)
+	assertAllExpectedSecrets(t, c)
+}
+
+func TestCanaryRotationStopsOnRejectedToken(t *testing.T) {
+	defer func() { *argCanaryNamespaces = nil }()
+	*argCanaryNamespaces = []string{"namespace1"}
+	c := newFakeController()
+	sg := getSecretGenerators(c)[0]
+	previous := []*v1.Secret{{ObjectMeta: metav1.ObjectMeta{Name: sg.SecretName}, Data: map[string][]byte{".dockerconfigjson": []byte("{}")}}}
+	c.secrets[sg.SecretName] = previous
+	failures := testutil.ToFloat64(canaryFailures.WithLabelValues(sg.Name))
+
+	c.verifyRegistry = func(context.Context, AuthToken) error { return errors.New("rejected") }
+	c.refreshProvider(context.TODO(), sg)
+
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace2", sg.SecretName)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	canary, err := c.k8sutil.GetSecret(context.TODO(), "namespace1", sg.SecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, previous[0].Data, canary.Data)
+	assert.Equal(t, previous, c.cachedSecrets(sg.SecretName))
+	assert.Equal(t, failures+1, testutil.ToFloat64(canaryFailures.WithLabelValues(sg.Name)))
+}
+
+func TestCanaryRotationHoldsBackUnverifiedSecrets(t *testing.T) {
+	defer func() { *argCanaryNamespaces = nil }()
+	*argCanaryNamespaces = []string{"namespace1"}
+	c := newFakeController()
+	sg := getSecretGenerators(c)[0]
+	previous := []*v1.Secret{{ObjectMeta: metav1.ObjectMeta{Name: sg.SecretName}, Data: map[string][]byte{".dockerconfigjson": []byte("{}")}}}
+	previousTokens := []AuthToken{{Endpoint: "https://123456789012.dkr.ecr.us-east-1.amazonaws.com", AccessToken: "previous"}}
+	c.secrets[sg.SecretName] = previous
+	c.tokens[sg.SecretName] = previousTokens
+
+	var synced, canary *v1.Secret
+	c.verifyRegistry = func(ctx context.Context, _ AuthToken) error {
+		// namespaces the reconciler syncs while the canaries verify the rotation
+		require.Nil(t, handler(ctx, c, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace2"}}))
+		require.Nil(t, handler(ctx, c, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}))
+		synced, _ = c.k8sutil.GetSecret(ctx, "namespace2", sg.SecretName)
+		canary, _ = c.k8sutil.GetSecret(ctx, "namespace1", sg.SecretName)
+		return errors.New("rejected")
+	}
+	c.refreshProvider(context.TODO(), sg)
+
+	require.NotNil(t, synced)
+	assert.Equal(t, previous[0].Data, synced.Data)
+	assert.NotEqual(t, previous[0].Data, canary.Data)
+	// the rejected rotation never replaced the previous tokens
+	assert.Equal(t, previous, c.cachedSecrets(sg.SecretName))
+	assert.Equal(t, previousTokens, c.tokens[sg.SecretName])
+	assert.Empty(t, c.canarySecrets)
+}
+
+func TestCanaryRotationStopsOnFailedPulls(t *testing.T) {
+	defer func(soak time.Duration) {
+		*argCanaryNamespaces = nil
+		*argCanarySoak = soak
+	}(*argCanarySoak)
+	*argCanaryNamespaces = []string{"namespace1"}
+	*argCanarySoak = time.Millisecond
+	c := newFakeController()
+	c.fake = &providers.Fake{Registries: []string{"https://registry.example.com"}, Expiry: time.Hour}
+	defer syncCycleDuration.DeleteLabelValues(providerFake)
+	defer canaryFailures.DeleteLabelValues(providerFake)
+	sg := getSecretGenerators(c)[0]
+
+	c.k8sutil.Kclient.Pods("namespace1").(*fakePods).store = []v1.Pod{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace1", Name: "app"},
+		Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{
+			Image: "registry.example.com/app:1",
+			State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "no basic auth credentials"}},
+		}}},
+	}}
+	c.refreshProvider(context.TODO(), sg)
+
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace2", sg.SecretName)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
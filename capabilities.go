@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/doddle/registry-creds/k8sutil"
+)
+
+// capabilities are the optional parts of the controller the RBAC of its ServiceAccount allows; anything that cannot be
+// probed is assumed to be allowed
+type capabilities struct {
+	// writeSecrets is create and update on secrets, needed by the secret and mirror outputs
+	writeSecrets bool
+	// updateServiceAccounts is get and update on serviceaccounts; without it the controller runs in secrets-only mode
+	updateServiceAccounts bool
+	// createServiceAccounts is create on serviceaccounts, needed by --create-service-accounts
+	createServiceAccounts bool
+	// deleteSecrets is needed to clean up excluded namespaces
+	deleteSecrets bool
+	// writeStatus is get, create and update on configmaps in the status namespace
+	writeStatus bool
+	// createEvents is create on events in the controller's namespace
+	createEvents bool
+	// annotateNamespaces is patch on namespaces, needed to mark the registries covered by --node-credential-registries
+	annotateNamespaces bool
+	// watchPods is list and watch on pods, needed by --watch-pull-failures
+	watchPods bool
+}
+
+func allCapabilities() capabilities {
+	return capabilities{
+		writeSecrets:          true,
+		updateServiceAccounts: true,
+		createServiceAccounts: true,
+		deleteSecrets:         true,
+		writeStatus:           true,
+		createEvents:          true,
+		annotateNamespaces:    true,
+		watchPods:             true,
+	}
+}
+
+// canAll reports whether every verb on resource is allowed in namespace; a failed review counts as allowed, so a
+// flaky API server does not switch features off
+func canAll(ctx context.Context, util *k8sutil.KubeUtilInterface, resource, namespace string, verbs ...string) bool {
+	for _, verb := range verbs {
+		allowed, err := util.CanI(ctx, verb, resource, namespace)
+		if err != nil {
+			log.Warnf("Could not check whether %s on %s is allowed; assuming it is [Err: %s]", verb, resource, err)
+			continue
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// probeCapabilities asks the API server with SelfSubjectAccessReviews which optional features the controller may use
+func probeCapabilities(ctx context.Context, util *k8sutil.KubeUtilInterface) capabilities {
+	caps := capabilities{
+		writeSecrets:          canAll(ctx, util, "secrets", "", "create", "update"),
+		updateServiceAccounts: canAll(ctx, util, "serviceaccounts", "", "get", "update"),
+		createServiceAccounts: true,
+		deleteSecrets:         canAll(ctx, util, "secrets", "", "delete"),
+		writeStatus:           canAll(ctx, util, "configmaps", statusNamespace(), "get", "create", "update"),
+		createEvents:          true,
+		annotateNamespaces:    true,
+		watchPods:             true,
+	}
+	if *argCreateServiceAccounts {
+		caps.createServiceAccounts = canAll(ctx, util, "serviceaccounts", "", "create")
+	}
+	if *argOutput == outputYAML {
+		// the ServiceAccounts are only read, their manifests go to --output-dir
+		caps.updateServiceAccounts = canAll(ctx, util, "serviceaccounts", "", "get")
+		caps.createServiceAccounts = true
+	}
+	if len(*argNodeCredRegistries) > 0 {
+		caps.annotateNamespaces = canAll(ctx, util, "namespaces", "", "patch")
+	}
+	if *argWatchPullFailures {
+		caps.watchPods = canAll(ctx, util, "pods", "", "list", "watch")
+	}
+	if pod := podReference(); pod != nil {
+		caps.createEvents = canAll(ctx, util, "events", pod.Namespace, "create")
+	}
+	return caps
+}
+
+// applyCapabilities logs and switches off whatever the controller is not allowed to do, instead of failing every namespace
+func (c *controller) applyCapabilities(caps capabilities) {
+	c.caps = caps
+	if !caps.writeSecrets && (c.output == nil || *argOutput == outputMirror || *argOutput == outputKMSSecret) {
+		log.Errorf("Not allowed to create and update secrets! No namespace will get the pull secrets until the ClusterRole grants it")
+	}
+	if !caps.updateServiceAccounts {
+		log.Warnf("Not allowed to update serviceaccounts; running in secrets-only mode, the pull secrets have to be referenced by the workloads themselves")
+	}
+	if !caps.createServiceAccounts && caps.updateServiceAccounts && *argCreateServiceAccounts {
+		log.Warnf("Not allowed to create serviceaccounts; ignoring --create-service-accounts")
+	}
+	if !caps.deleteSecrets && (*argExcludedNSSelector != "" || *argCleanupExcluded) {
+		log.Warnf("Not allowed to delete secrets; the pull secrets are only detached from the ServiceAccounts of excluded namespaces")
+	}
+	if !caps.writeStatus && *argStatusConfigMap != "" {
+		log.Warnf("Not allowed to write configmaps in %s; disabling the status ConfigMap", statusNamespace())
+		*argStatusConfigMap = ""
+	}
+	if !caps.annotateNamespaces && len(*argNodeCredRegistries) > 0 {
+		log.Warnf("Not allowed to patch namespaces; the registries covered by the nodes are not marked on the namespaces")
+	}
+	if !caps.watchPods && *argWatchPullFailures {
+		log.Warnf("Not allowed to list and watch pods; ignoring --watch-pull-failures")
+		*argWatchPullFailures = false
+	}
+	if !caps.createEvents {
+		log.Warnf("Not allowed to create events; the controller will not record Events on its Pod")
+		c.recorder = nil
+	}
+}
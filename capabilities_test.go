@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProbeCapabilities(t *testing.T) {
+	c := newFakeController()
+	assert.Equal(t, allCapabilities(), probeCapabilities(context.TODO(), c.k8sutil))
+
+	c.k8sutil.Kclient.(*fakeKubeClient).deniedPermissions = []string{"update serviceaccounts", "delete secrets", "create configmaps"}
+	caps := probeCapabilities(context.TODO(), c.k8sutil)
+	assert.True(t, caps.writeSecrets)
+	assert.False(t, caps.updateServiceAccounts)
+	assert.False(t, caps.deleteSecrets)
+	assert.False(t, caps.writeStatus)
+	assert.True(t, caps.createEvents)
+}
+
+func TestApplyCapabilitiesDisablesStatusConfigMap(t *testing.T) {
+	defer func(name string) { *argStatusConfigMap = name }(*argStatusConfigMap)
+	*argStatusConfigMap = "registry-creds-status"
+
+	c := newFakeController()
+	caps := allCapabilities()
+	caps.writeStatus = false
+	c.applyCapabilities(caps)
+	assert.Equal(t, "", *argStatusConfigMap)
+}
+
+func TestSecretsOnlyMode(t *testing.T) {
+	c := newFakeController()
+	caps := allCapabilities()
+	caps.updateServiceAccounts = false
+	caps.deleteSecrets = false
+	c.applyCapabilities(caps)
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: *argAWSSecretName}}
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	sa, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	assert.Empty(t, sa.ImagePullSecrets)
+
+	// without delete the secret outlives the namespace's exclusion
+	assert.Nil(t, c.removeFromNamespace(context.TODO(), ns))
+	exists, err = c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
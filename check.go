@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/doddle/registry-creds/k8sutil"
+)
+
+type stsInterface interface {
+	GetCallerIdentityWithContext(ctx aws.Context, input *sts.GetCallerIdentityInput, opts ...request.Option) (*sts.GetCallerIdentityOutput, error)
+}
+
+// newStsClients returns an STS client for the base credentials and one using the assumed role (nil if none is configured)
+func newStsClients(opts awsClientOptions) (stsInterface, stsInterface, error) {
+	sess, err := newAWSSession(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	base := sts.New(sess)
+	if opts.AssumeRole == "" {
+		return base, nil, nil
+	}
+	return base, sts.New(sess, newAWSConfig(sess, opts)), nil
+}
+
+// checkResult is a single line of the preflight report
+type checkResult struct {
+	Name   string
+	Detail string
+	Err    error
+}
+
+// rbacCheck is a permission the controller needs on the Kubernetes API
+type rbacCheck struct {
+	Verb     string
+	Resource string
+}
+
+// requiredPermissions lists the API access the refresh loop relies on
+var requiredPermissions = []rbacCheck{
+	{"list", "namespaces"},
+	{"watch", "namespaces"},
+	{"get", "secrets"},
+	{"list", "secrets"},
+	{"watch", "secrets"},
+	{"create", "secrets"},
+	{"update", "secrets"},
+	{"get", "serviceaccounts"},
+	{"list", "serviceaccounts"},
+	{"watch", "serviceaccounts"},
+	{"update", "serviceaccounts"},
+}
+
+func callerIdentity(ctx context.Context, client stsInterface) (string, error) {
+	ctx, cancel := providerContext(ctx)
+	defer cancel()
+	out, err := client.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	return *out.Arn, nil
+}
+
+// runChecks validates the AWS (or fake or file provider) and Kubernetes configuration without writing anything
+func runChecks(ctx context.Context, c *controller, baseSts, assumedSts stsInterface) []checkResult {
+	var results []checkResult
+
+	if c.fake != nil {
+		tokens, err := c.fake.Tokens(ctx)
+		results = append(results, checkResult{Name: "Fake provider tokens", Detail: fmt.Sprintf("%d registries", len(tokens)), Err: err})
+		results = append(results, checkTokenExchange(ctx, c)...)
+		results = append(results, checkECRInstances(ctx, c)...)
+		return append(results, checkPermissions(ctx, c.k8sutil)...)
+	}
+	if c.tokenFiles != nil {
+		tokens, err := c.tokenFiles.Tokens(ctx)
+		results = append(results, checkResult{Name: "Token files", Detail: fmt.Sprintf("%d registries", len(tokens)), Err: err})
+		results = append(results, checkTokenExchange(ctx, c)...)
+		results = append(results, checkECRInstances(ctx, c)...)
+		return append(results, checkPermissions(ctx, c.k8sutil)...)
+	}
+
+	arn, err := callerIdentity(ctx, baseSts)
+	results = append(results, checkResult{Name: "AWS identity", Detail: arn, Err: err})
+
+	if assumedSts != nil {
+		arn, err := callerIdentity(ctx, assumedSts)
+		results = append(results, checkResult{Name: fmt.Sprintf("AWS assume role %s", c.currentConfig().awsSettings(c.defaults).AssumeRole), Detail: arn, Err: err})
+	}
+
+	tokens, err := c.getECRAuthorizationKey(ctx)
+	results = append(results, checkResult{Name: "ECR GetAuthorizationToken", Detail: fmt.Sprintf("%d registries", len(tokens)), Err: err})
+	results = append(results, checkTokenExchange(ctx, c)...)
+	results = append(results, checkECRInstances(ctx, c)...)
+
+	results = append(results, checkPermissions(ctx, c.k8sutil)...)
+	return results
+}
+
+// checkTokenExchange exchanges a ServiceAccount token if the token-exchange provider is configured
+func checkTokenExchange(ctx context.Context, c *controller) []checkResult {
+	settings := c.currentConfig().tokenExchange()
+	if settings == nil {
+		return nil
+	}
+	tokens, err := c.tokenExchangeTokens(ctx)
+	return []checkResult{{Name: fmt.Sprintf("Token exchange with %s", settings.URL), Detail: fmt.Sprintf("%d registries", len(tokens)), Err: err}}
+}
+
+// checkECRInstances fetches the tokens of every additional ECR provider
+func checkECRInstances(ctx context.Context, c *controller) []checkResult {
+	var results []checkResult
+	for _, p := range c.currentConfig().ecrInstances() {
+		tokens, err := c.ecrInstanceTokens(p.Name, p.ECR.SecretName)(ctx)
+		results = append(results, checkResult{Name: fmt.Sprintf("ECR GetAuthorizationToken of provider %s", p.Name), Detail: fmt.Sprintf("%d registries", len(tokens)), Err: err})
+	}
+	return results
+}
+
+func checkPermissions(ctx context.Context, util *k8sutil.KubeUtilInterface) []checkResult {
+	var results []checkResult
+	for _, p := range requiredPermissions {
+		name := fmt.Sprintf("Kubernetes RBAC: %s %s", p.Verb, p.Resource)
+		allowed, err := util.CanI(ctx, p.Verb, p.Resource, "")
+		if err == nil && !allowed {
+			err = fmt.Errorf("not allowed")
+		}
+		results = append(results, checkResult{Name: name, Err: err})
+	}
+
+	if *argExcludedNSSelector != "" || *argCleanupExcluded {
+		// secrets are removed from namespaces that start matching the selector
+		name := "Kubernetes RBAC: delete secrets"
+		allowed, err := util.CanI(ctx, "delete", "secrets", "")
+		if err == nil && !allowed {
+			err = fmt.Errorf("not allowed")
+		}
+		results = append(results, checkResult{Name: name, Err: err})
+	}
+
+	if *argVClusterSelector != "" {
+		// the vclusters are found by their control plane pods
+		name := "Kubernetes RBAC: list pods"
+		allowed, err := util.CanI(ctx, "list", "pods", "")
+		if err == nil && !allowed {
+			err = fmt.Errorf("not allowed")
+		}
+		results = append(results, checkResult{Name: name, Err: err})
+	}
+
+	if *argStatusConfigMap != "" {
+		namespace := statusNamespace()
+		for _, verb := range []string{"get", "create", "update"} {
+			name := fmt.Sprintf("Kubernetes RBAC: %s configmaps in %s", verb, namespace)
+			allowed, err := util.CanI(ctx, verb, "configmaps", namespace)
+			if err == nil && !allowed {
+				err = fmt.Errorf("not allowed")
+			}
+			results = append(results, checkResult{Name: name, Err: err})
+		}
+	}
+	return results
+}
+
+// printCheckReport writes the pass/fail report and returns true if every check passed
+func printCheckReport(w io.Writer, results []checkResult) bool {
+	ok := true
+	for _, r := range results {
+		if r.Err != nil {
+			ok = false
+			fmt.Fprintf(w, "[FAIL] %s: %s\n", r.Name, r.Err)
+			continue
+		}
+		if r.Detail != "" {
+			fmt.Fprintf(w, "[PASS] %s (%s)\n", r.Name, r.Detail)
+		} else {
+			fmt.Fprintf(w, "[PASS] %s\n", r.Name)
+		}
+	}
+	return ok
+}
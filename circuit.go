@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// circuitBreaker stops calling a provider whose refreshes keep failing, e.g. because its credentials were revoked,
+// so the controller does not lock the account out; while open the provider is only tried once per interval
+type circuitBreaker struct {
+	sync.Mutex
+	failures int
+	// openedAt is when the circuit opened or was last probed, zero while closed
+	openedAt time.Time
+
+	// the last results, for the provider API
+	lastSuccess   time.Time
+	lastError     string
+	lastErrorTime time.Time
+}
+
+// allow reports whether the provider may be called; an open circuit lets a single probe through once the interval passed
+func (b *circuitBreaker) allow(now time.Time, interval time.Duration) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.openedAt.IsZero() {
+		return true
+	}
+	if now.Sub(b.openedAt) < interval {
+		return false
+	}
+	b.openedAt = now
+	return true
+}
+
+// record counts a refresh result and reports whether it opened or closed the circuit; threshold 0 disables opening
+func (b *circuitBreaker) record(err error, now time.Time, threshold int) (opened, closed bool) {
+	b.Lock()
+	defer b.Unlock()
+	if err == nil {
+		b.lastSuccess = now
+		closed = !b.openedAt.IsZero()
+		b.failures = 0
+		b.openedAt = time.Time{}
+		return false, closed
+	}
+	b.failures++
+	b.lastError, b.lastErrorTime = err.Error(), now
+	if threshold > 0 && b.failures >= threshold && b.openedAt.IsZero() {
+		b.openedAt = now
+		return true, false
+	}
+	return false, false
+}
+
+// circuitState is a copy of a circuit breaker's state
+type circuitState struct {
+	open          bool
+	failures      int
+	lastSuccess   time.Time
+	lastError     string
+	lastErrorTime time.Time
+}
+
+func (b *circuitBreaker) state() circuitState {
+	b.Lock()
+	defer b.Unlock()
+	return circuitState{
+		open:          !b.openedAt.IsZero(),
+		failures:      b.failures,
+		lastSuccess:   b.lastSuccess,
+		lastError:     b.lastError,
+		lastErrorTime: b.lastErrorTime,
+	}
+}
+
+func (b *circuitBreaker) isOpen() bool {
+	b.Lock()
+	defer b.Unlock()
+	return !b.openedAt.IsZero()
+}
+
+// circuit returns the circuit breaker of a provider
+func (c *controller) circuit(provider string) *circuitBreaker {
+	c.circuitsLock.Lock()
+	defer c.circuitsLock.Unlock()
+	if c.circuits == nil {
+		c.circuits = map[string]*circuitBreaker{}
+	}
+	b, ok := c.circuits[provider]
+	if !ok {
+		b = &circuitBreaker{}
+		c.circuits[provider] = b
+	}
+	return b
+}
+
+// recordProviderResult feeds a token fetch result into the provider's circuit breaker and reports state changes
+func (c *controller) recordProviderResult(provider string, err error) {
+	opened, closed := c.circuit(provider).record(err, time.Now(), *argCircuitBreakerFailures)
+	switch {
+	case opened:
+		providerCircuitOpen.WithLabelValues(provider).Set(1)
+		log.Errorf("Provider %s failed %d refreshes in a row; opening its circuit and only retrying every %s [Err: %s]",
+			provider, *argCircuitBreakerFailures, *argCircuitBreakerInterval, err)
+		c.eventf(v1.EventTypeWarning, reasonCircuitOpened, "Provider %s failed %d refreshes in a row, retrying every %s: %v",
+			provider, *argCircuitBreakerFailures, *argCircuitBreakerInterval, err)
+	case closed:
+		providerCircuitOpen.WithLabelValues(provider).Set(0)
+		log.Infof("Provider %s recovered; closing its circuit", provider)
+		c.eventf(v1.EventTypeNormal, reasonCircuitClosed, "Provider %s recovered", provider)
+	}
+}
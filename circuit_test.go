@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		opened, _ := b.record(errors.New("boom"), now, 3)
+		assert.False(t, opened)
+		assert.True(t, b.allow(now, time.Hour))
+	}
+	opened, _ := b.record(errors.New("boom"), now, 3)
+	assert.True(t, opened)
+	assert.False(t, b.allow(now.Add(time.Minute), time.Hour))
+
+	// a single probe is let through per interval
+	assert.True(t, b.allow(now.Add(time.Hour), time.Hour))
+	assert.False(t, b.allow(now.Add(time.Hour+time.Minute), time.Hour))
+	opened, _ = b.record(errors.New("boom"), now.Add(time.Hour), 3)
+	assert.False(t, opened, "already open")
+
+	_, closed := b.record(nil, now.Add(2*time.Hour), 3)
+	assert.True(t, closed)
+	assert.False(t, b.isOpen())
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := &circuitBreaker{}
+	for i := 0; i < 10; i++ {
+		opened, _ := b.record(errors.New("boom"), time.Now(), 0)
+		assert.False(t, opened)
+	}
+	assert.True(t, b.allow(time.Now(), time.Hour))
+}
+
+func TestRefreshSecretOpensCircuit(t *testing.T) {
+	defer func(n int) { *argCircuitBreakerFailures = n }(*argCircuitBreakerFailures)
+	*argCircuitBreakerFailures = 2
+	t.Setenv("POD_NAME", "registry-creds-0")
+	t.Setenv("POD_NAMESPACE", "kube-system")
+
+	c := newFakeController()
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	calls := 0
+	sg := SecretGenerator{
+		Name:       "failing",
+		SecretName: "failing-creds",
+		IsJSONCfg:  true,
+		TokenGenFxn: func(ctx context.Context) ([]AuthToken, error) {
+			calls++
+			return nil, errors.New("access denied")
+		},
+	}
+
+	for i := 0; i < 4; i++ {
+		_, ok, err := c.refreshSecret(context.TODO(), sg)
+		assert.Nil(t, err)
+		assert.False(t, ok)
+	}
+
+	assert.Equal(t, 2, calls, "the provider is not called while the circuit is open")
+	assert.True(t, c.circuit("failing").isOpen())
+	assert.Contains(t, <-recorder.Events, reasonCircuitOpened)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+const (
+	// rotationEventType is the CloudEvents type of the event sent after a provider refresh distributed new credentials
+	rotationEventType = "io.github.doddle.registry-creds.secret.rotated"
+
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsTimeout     = 10 * time.Second
+)
+
+// rotationEvent is the data of a rotation CloudEvent
+type rotationEvent struct {
+	Provider string `json:"provider"`
+	// Accounts are the configured AWS account IDs of the ECR provider
+	Accounts   []string `json:"accounts,omitempty"`
+	Registries []string `json:"registries"`
+	Secrets    []string `json:"secrets"`
+	// ExpiresAt is the earliest expiry of the rotated tokens, if the provider reports one
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Namespaces were updated, FailedNamespaces could not be written and are retried by the reconciler
+	Namespaces       []string `json:"namespaces"`
+	FailedNamespaces []string `json:"failedNamespaces,omitempty"`
+}
+
+// cloudEventSink POSTs events in the CloudEvents HTTP binary content mode, e.g. to a Knative broker or an Argo Events webhook
+type cloudEventSink struct {
+	url    string
+	source string
+	client *http.Client
+}
+
+func newCloudEventSink(url, source string) *cloudEventSink {
+	return &cloudEventSink{url: url, source: source, client: &http.Client{Timeout: cloudEventsTimeout}}
+}
+
+// send delivers a single event; the subject is the provider name so consumers can filter on it
+func (s *cloudEventSink) send(ctx context.Context, event rotationEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Ce-Specversion", cloudEventsSpecVersion)
+	req.Header.Set("Ce-Id", string(uuid.NewUUID()))
+	req.Header.Set("Ce-Type", rotationEventType)
+	req.Header.Set("Ce-Source", s.source)
+	req.Header.Set("Ce-Subject", event.Provider)
+	req.Header.Set("Ce-Time", time.Now().UTC().Format(time.RFC3339Nano))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not send CloudEvent: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("could not send CloudEvent: %s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+// newRotationEvent describes a provider refresh that pushed secrets to the updated namespaces
+func (c *controller) newRotationEvent(secretGenerator SecretGenerator, secretNames, updated, failed []string) rotationEvent {
+	// the namespaces come in the order they were listed in, sort them so that events are stable
+	sort.Strings(updated)
+	sort.Strings(failed)
+	event := rotationEvent{
+		Provider:         secretGenerator.Name,
+		Secrets:          secretNames,
+		Namespaces:       updated,
+		FailedNamespaces: failed,
+	}
+	cfg := c.currentConfig()
+	if p := cfg.provider(secretGenerator.Name); secretGenerator.Name == providerECR || (p != nil && p.ECR != nil) {
+		for _, id := range cfg.providerAWSSettings(secretGenerator.Name, c.defaults).AccountIDs {
+			if id != "" {
+				event.Accounts = append(event.Accounts, id)
+			}
+		}
+	}
+
+	c.secretsLock.Lock()
+	tokens := c.tokens[secretGenerator.SecretName]
+	c.secretsLock.Unlock()
+	for _, token := range tokens {
+		event.Registries = append(event.Registries, token.Endpoint)
+	}
+	sort.Strings(event.Registries)
+	if expiry := providers.EarliestExpiry(tokens); !expiry.IsZero() {
+		event.ExpiresAt = &expiry
+	}
+	return event
+}
+
+// emitRotation sends the rotation event if --cloudevents-sink is set; failures are only logged
+func (c *controller) emitRotation(ctx context.Context, event rotationEvent) {
+	if c.events == nil {
+		return
+	}
+	if err := c.events.send(ctx, event); err != nil {
+		log.Errorf("Could not send the rotation event of provider %s! [Err: %s]", event.Provider, err)
+		return
+	}
+	log.Debugf("Sent the rotation event of provider %s for %d namespaces", event.Provider, len(event.Namespaces))
+}
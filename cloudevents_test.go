@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+)
+
+func TestRefreshProviderEmitsRotationEvent(t *testing.T) {
+	var headers http.Header
+	var event rotationEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		body, _ := io.ReadAll(r.Body)
+		assert.Nil(t, json.Unmarshal(body, &event))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	now := time.Date(2022, 9, 1, 10, 30, 0, 0, time.UTC)
+	c := newFakeController()
+	c.fake = &providers.Fake{Registries: []string{"https://registry.example.com"}, Expiry: time.Hour, Now: func() time.Time { return now }}
+	c.events = newCloudEventSink(server.URL, "test-source")
+	defer syncCycleDuration.DeleteLabelValues(providerFake)
+
+	c.refreshProvider(context.TODO(), getSecretGenerators(c)[0])
+
+	assert.Equal(t, "application/json", headers.Get("Content-Type"))
+	assert.Equal(t, "1.0", headers.Get("Ce-Specversion"))
+	assert.Equal(t, rotationEventType, headers.Get("Ce-Type"))
+	assert.Equal(t, "test-source", headers.Get("Ce-Source"))
+	assert.Equal(t, providerFake, headers.Get("Ce-Subject"))
+	assert.NotEmpty(t, headers.Get("Ce-Id"))
+
+	assert.Equal(t, providerFake, event.Provider)
+	assert.Empty(t, event.Accounts)
+	assert.Equal(t, []string{"https://registry.example.com"}, event.Registries)
+	assert.Equal(t, []string{*argFakeSecretName}, event.Secrets)
+	assert.Equal(t, []string{"namespace1", "namespace2"}, event.Namespaces)
+	if assert.NotNil(t, event.ExpiresAt) {
+		assert.Equal(t, time.Date(2022, 9, 1, 11, 0, 0, 0, time.UTC), event.ExpiresAt.UTC())
+	}
+}
+
+func TestRotationEventAccounts(t *testing.T) {
+	c := newFakeController()
+	c.defaults.AccountIDs = []string{"123456789012", ""}
+
+	event := c.newRotationEvent(getSecretGenerators(c)[0], nil, nil, []string{"namespace1"})
+	assert.Equal(t, providerECR, event.Provider)
+	assert.Equal(t, []string{"123456789012"}, event.Accounts)
+	assert.Equal(t, []string{"namespace1"}, event.FailedNamespaces)
+	assert.Nil(t, event.ExpiresAt)
+}
+
+func TestCloudEventSinkError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	err := newCloudEventSink(server.URL, "test").send(context.TODO(), rotationEvent{Provider: providerECR})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	providerECR  = providers.ECRName
+	providerFake = providers.FakeName
+	providerFile = providers.FileName
+)
+
+// Config is the optional configuration file passed via --config
+type Config struct {
+	Providers []ProviderConfig `json:"providers,omitempty"`
+
+	// checksum is the SHA-256 of the file the config was loaded from, telling the reloader whether it changed since
+	checksum [sha256.Size]byte
+}
+
+// ProviderConfig overrides the flag defaults for a single provider, matched by name
+type ProviderConfig struct {
+	Name string `json:"name"`
+	// RefreshInterval is how often the provider's token is fetched and pushed to every namespace, e.g. "6h"
+	RefreshInterval *metav1.Duration `json:"refreshInterval,omitempty"`
+	// RefreshJitter is the maximum fraction of RefreshInterval randomly added to each refresh
+	RefreshJitter *float64 `json:"refreshJitter,omitempty"`
+	// Retry overrides the --token-retry-* flags for this provider only
+	Retry *RetryOverrides `json:"retry,omitempty"`
+	// FetchTimeout bounds the provider's whole token fetch including retries, overriding --provider-fetch-timeout
+	FetchTimeout *metav1.Duration `json:"fetchTimeout,omitempty"`
+	// AWS overrides the region, assumed role and accounts of the ecr provider; unlike the flags and environment it
+	// is applied without a restart when the config file changes
+	AWS *AWSOverrides `json:"aws,omitempty"`
+	// Namespaces limits the namespaces that get the provider's secret; unset distributes it to every namespace
+	Namespaces *NamespaceSelector `json:"namespaces,omitempty"`
+	// CredentialsSecretRef reads the provider's own credentials from a Kubernetes secret instead of the environment
+	CredentialsSecretRef *SecretKeyRef `json:"credentialsSecretRef,omitempty"`
+	// TLS configures a client certificate presented to the provider's token APIs
+	TLS *ProviderTLS `json:"tls,omitempty"`
+	// DockerConfig customises the registry entries of the provider's secret
+	DockerConfig *DockerConfigOptions `json:"dockerConfig,omitempty"`
+	// Secret overrides the secret type and adds data keys for tools that do not read docker configs
+	Secret *SecretOptions `json:"secret,omitempty"`
+	// TokenExchange configures the token-exchange provider and is required by it
+	TokenExchange *TokenExchangeConfig `json:"tokenExchange,omitempty"`
+	// ECR makes a provider with a name of its own an additional ECR provider with its own secret
+	ECR *ECRInstanceConfig `json:"ecr,omitempty"`
+	// Renderers additionally write the tokens in other formats into a ConfigMap or Secret, e.g. for node DaemonSets
+	Renderers []RendererConfig `json:"renderers,omitempty"`
+}
+
+// ProviderTLS points at a client certificate and key, typically mounted from a secret
+type ProviderTLS struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+// AWSOverrides replace --aws-region, --aws_assume_role and --aws-account-ids; unset fields keep the flag values
+type AWSOverrides struct {
+	Region string `json:"region,omitempty"`
+	// AssumeRole is the ARN of the role to assume, "" assumes none
+	AssumeRole *string  `json:"assumeRole,omitempty"`
+	AccountIDs []string `json:"accountIDs,omitempty"`
+	// AccountRoles maps account IDs to the role assumed to fetch their token, replacing --aws-account-roles
+	AccountRoles map[string]string `json:"accountRoles,omitempty"`
+}
+
+// RetryOverrides are per-provider retry settings; unset fields keep the flag values
+type RetryOverrides struct {
+	Type            string           `json:"type,omitempty"`
+	Retries         *int             `json:"retries,omitempty"`
+	Delay           *metav1.Duration `json:"delay,omitempty"`
+	InitialInterval *metav1.Duration `json:"initialInterval,omitempty"`
+	Multiplier      *float64         `json:"multiplier,omitempty"`
+	MaxInterval     *metav1.Duration `json:"maxInterval,omitempty"`
+	MaxElapsedTime  *metav1.Duration `json:"maxElapsedTime,omitempty"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+	cfg.checksum = sha256.Sum256(data)
+
+	// every problem of the file is reported at once
+	var errs []error
+	for i, p := range cfg.Providers {
+		if !builtinProvider(p.Name) && p.ECR == nil {
+			errs = append(errs, fmt.Errorf("unknown provider '%s' in config file %s", p.Name, path))
+		}
+		if p.RefreshInterval != nil && p.RefreshInterval.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("refreshInterval of provider '%s' must be positive", p.Name))
+		}
+		if p.RefreshJitter != nil && *p.RefreshJitter < 0 {
+			errs = append(errs, fmt.Errorf("refreshJitter of provider '%s' cannot be negative", p.Name))
+		}
+		if p.FetchTimeout != nil && p.FetchTimeout.Duration < 0 {
+			errs = append(errs, fmt.Errorf("fetchTimeout of provider '%s' cannot be negative", p.Name))
+		}
+		if err := p.Retry.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid retry settings for provider '%s': %v", p.Name, err))
+		}
+		if p.DockerConfig != nil {
+			if err := p.DockerConfig.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("invalid dockerConfig for provider '%s': %v", p.Name, err))
+			}
+		}
+		if p.Secret != nil {
+			if err := p.Secret.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("invalid secret settings for provider '%s': %v", p.Name, err))
+			}
+		}
+		for _, r := range p.Renderers {
+			if err := r.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("invalid renderer for provider '%s': %v", p.Name, err))
+			}
+		}
+		if p.CredentialsSecretRef != nil {
+			if p.Name != providerECR && p.ECR == nil {
+				errs = append(errs, fmt.Errorf("provider '%s' has no credentials to read from a secret", p.Name))
+			}
+			if err := p.CredentialsSecretRef.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("invalid credentialsSecretRef of provider '%s': %v", p.Name, err))
+			}
+		}
+		if p.AWS != nil {
+			if p.Name != providerECR && p.ECR == nil {
+				errs = append(errs, fmt.Errorf("aws settings are only supported by provider '%s' and providers with ecr settings", providerECR))
+			}
+			if err := p.AWS.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("invalid aws settings of provider '%s': %v", p.Name, err))
+			}
+		}
+		if p.Namespaces != nil {
+			if err := p.Namespaces.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("invalid namespaces of provider '%s': %v", p.Name, err))
+			}
+		}
+		if p.Name == providerTokenExchange && p.TokenExchange == nil {
+			errs = append(errs, fmt.Errorf("provider '%s' needs tokenExchange settings", p.Name))
+		}
+		if p.TokenExchange != nil {
+			if p.Name != providerTokenExchange {
+				errs = append(errs, fmt.Errorf("tokenExchange settings are only supported by provider '%s'", providerTokenExchange))
+			}
+			if err := p.TokenExchange.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("invalid tokenExchange settings of provider '%s': %v", p.Name, err))
+			}
+			if err := validateSecretName(p.TokenExchange.secretName()); err != nil {
+				errs = append(errs, fmt.Errorf("invalid tokenExchange settings of provider '%s': %v", p.Name, err))
+			}
+		}
+		if p.ECR != nil {
+			errs = append(errs, validateECRInstance(cfg, i)...)
+		}
+		if p.TLS != nil && (p.TLS.CertFile == "" || p.TLS.KeyFile == "") {
+			errs = append(errs, fmt.Errorf("tls of provider '%s' needs both certFile and keyFile", p.Name))
+		}
+	}
+	errs = append(errs, validateSecretNames(cfg)...)
+	if len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) provider(name string) *ProviderConfig {
+	for i := range cfg.Providers {
+		if cfg.Providers[i].Name == name {
+			return &cfg.Providers[i]
+		}
+	}
+	return nil
+}
+
+// providerTLS returns the client certificate settings of a provider, nil if none are configured
+func (cfg *Config) providerTLS(name string) *ProviderTLS {
+	if p := cfg.provider(name); p != nil {
+		return p.TLS
+	}
+	return nil
+}
+
+// credentialsSecretRef returns the secret holding the provider's credentials, nil if they come from the environment
+func (cfg *Config) credentialsSecretRef(name string) *SecretKeyRef {
+	if p := cfg.provider(name); p != nil {
+		return p.CredentialsSecretRef
+	}
+	return nil
+}
+
+// awsSettings returns the AWS settings of the ecr provider: the flags and the defaults derived from them and the
+// environment, overridden by its aws section
+func (cfg *Config) awsSettings(defaults providerDefaults) awsSettings {
+	return cfg.providerAWSSettings(providerECR, defaults)
+}
+
+// providerAWSSettings returns the AWS settings of the ecr provider or an additional ECR provider, see awsSettings
+func (cfg *Config) providerAWSSettings(name string, defaults providerDefaults) awsSettings {
+	settings := awsSettings{
+		Region:         *argAWSRegion,
+		AssumeRole:     *argAWSAssumeRole,
+		AccountIDs:     defaults.AccountIDs,
+		AccountRegions: defaults.AccountRegions,
+		AccountRoles:   defaults.AccountRoles,
+	}
+	p := cfg.provider(name)
+	if p == nil || p.AWS == nil {
+		return settings
+	}
+	if p.AWS.Region != "" {
+		settings.Region = p.AWS.Region
+	}
+	if p.AWS.AssumeRole != nil {
+		settings.AssumeRole = *p.AWS.AssumeRole
+	}
+	if len(p.AWS.AccountIDs) > 0 {
+		settings.AccountIDs, settings.AccountRegions, _ = parseAWSAccounts(p.AWS.AccountIDs)
+	}
+	if p.AWS.AccountRoles != nil {
+		settings.AccountRoles, _ = parseAWSAccountRoles(p.AWS.AccountRoles)
+	}
+	return settings
+}
+
+// renderers returns the additional output formats of a provider
+func (cfg *Config) renderers(name string) []RendererConfig {
+	if p := cfg.provider(name); p != nil {
+		return p.Renderers
+	}
+	return nil
+}
+
+// applyTo overrides the generator's defaults with the provider's configured values
+func (cfg *Config) applyTo(secretGenerator *SecretGenerator) {
+	p := cfg.provider(secretGenerator.Name)
+	if p == nil {
+		return
+	}
+	if p.RefreshInterval != nil {
+		secretGenerator.RefreshInterval = p.RefreshInterval.Duration
+	}
+	if p.RefreshJitter != nil {
+		secretGenerator.RefreshJitter = *p.RefreshJitter
+	}
+	p.Retry.applyTo(&secretGenerator.Retry)
+	if p.FetchTimeout != nil {
+		secretGenerator.FetchTimeout = p.FetchTimeout.Duration
+	}
+	secretGenerator.Namespaces = p.Namespaces
+	if p.DockerConfig != nil {
+		secretGenerator.DockerConfig = *p.DockerConfig
+		secretGenerator.IsJSONCfg = p.DockerConfig.Format != formatDockercfg
+	}
+	if p.Secret != nil {
+		secretGenerator.Secret = *p.Secret
+	}
+}
+
+func (a *AWSOverrides) validate() error {
+	if a.Region != "" && !awsRegionPattern.MatchString(a.Region) {
+		return fmt.Errorf("invalid region '%s'", a.Region)
+	}
+	if _, _, errs := parseAWSAccounts(a.AccountIDs); len(errs) > 0 {
+		return errs[0]
+	}
+	if _, errs := parseAWSAccountRoles(a.AccountRoles); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func (r *RetryOverrides) validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.Type != "" && r.Type != retryTypeSimple && r.Type != retryTypeExponential {
+		return fmt.Errorf("unknown retry type '%s'", r.Type)
+	}
+	if r.Retries != nil && *r.Retries < 0 {
+		return fmt.Errorf("retries cannot be negative")
+	}
+	if r.Multiplier != nil && *r.Multiplier < 1 {
+		return fmt.Errorf("multiplier must be at least 1")
+	}
+	for _, d := range []*metav1.Duration{r.Delay, r.InitialInterval, r.MaxInterval, r.MaxElapsedTime} {
+		if d != nil && d.Duration < 0 {
+			return fmt.Errorf("durations cannot be negative")
+		}
+	}
+	// the simple retries wait whole seconds, like --token-retry-delay; 0s retries at once
+	if r.Delay != nil && r.Delay.Duration%time.Second != 0 {
+		return fmt.Errorf("delay must be a whole number of seconds")
+	}
+	return nil
+}
+
+func (r *RetryOverrides) applyTo(cfg *RetryConfig) {
+	if r == nil {
+		return
+	}
+	if r.Type != "" {
+		cfg.Type = r.Type
+	}
+	if r.Retries != nil {
+		cfg.NumberOfRetries = *r.Retries
+	}
+	if r.Delay != nil {
+		cfg.RetryDelayInSeconds = int(r.Delay.Seconds())
+	}
+	if r.InitialInterval != nil {
+		cfg.InitialInterval = r.InitialInterval.Duration
+	}
+	if r.Multiplier != nil {
+		cfg.Multiplier = *r.Multiplier
+	}
+	if r.MaxInterval != nil {
+		cfg.MaxInterval = r.MaxInterval.Duration
+	}
+	if r.MaxElapsedTime != nil {
+		cfg.MaxElapsedTime = r.MaxElapsedTime.Duration
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfigEmptyPath(t *testing.T) {
+	cfg, err := loadConfig("")
+	assert.Nil(t, err)
+	assert.Empty(t, cfg.Providers)
+}
+
+func TestLoadConfigRefreshInterval(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    refreshInterval: 6h
+`))
+	assert.Nil(t, err)
+
+	c := newFakeController()
+	c.config = cfg
+	generators := getSecretGenerators(c)
+	assert.Equal(t, 6*time.Hour, generators[0].RefreshInterval)
+}
+
+func TestLoadConfigRejectsInvalid(t *testing.T) {
+	_, err := loadConfig(writeConfig(t, `
+providers:
+  - name: gitlab
+`))
+	assert.NotNil(t, err)
+
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    refreshInterval: 0s
+`))
+	assert.NotNil(t, err)
+
+	_, err = loadConfig(writeConfig(t, `
+provider: []
+`))
+	assert.NotNil(t, err)
+
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    tls:
+      certFile: /etc/registry-creds/tls.crt
+`))
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigTLS(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    tls:
+      certFile: /etc/registry-creds/tls.crt
+      keyFile: /etc/registry-creds/tls.key
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, &ProviderTLS{CertFile: "/etc/registry-creds/tls.crt", KeyFile: "/etc/registry-creds/tls.key"}, cfg.providerTLS(providerECR))
+	assert.Nil(t, (&Config{}).providerTLS(providerECR))
+}
+
+func TestLoadConfigRetryOverrides(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    retry:
+      type: exponential
+      retries: 5
+      initialInterval: 2s
+      multiplier: 2
+`))
+	assert.Nil(t, err)
+
+	c := newFakeController()
+	c.config = cfg
+	retry := getSecretGenerators(c)[0].Retry
+	assert.Equal(t, retryTypeExponential, retry.Type)
+	assert.Equal(t, 5, retry.NumberOfRetries)
+	assert.Equal(t, 2*time.Second, retry.InitialInterval)
+	assert.Equal(t, 2.0, retry.Multiplier)
+	// unset values keep the defaults of the flags
+	assert.Equal(t, c.defaults.Retry.RetryDelayInSeconds, retry.RetryDelayInSeconds)
+
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    retry:
+      type: fibonacci
+`))
+	assert.NotNil(t, err)
+
+	// the simple retries wait whole seconds, 500ms would become no delay at all
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    retry:
+      delay: 500ms
+`))
+	assert.EqualError(t, err, "invalid retry settings for provider 'ecr': delay must be a whole number of seconds")
+
+	// like --token-retry-delay=0
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    retry:
+      delay: 0s
+`))
+	assert.Nil(t, err)
+}
+
+func TestLoadConfigRejectsInvalidAWS(t *testing.T) {
+	_, err := loadConfig(writeConfig(t, `
+providers:
+  - name: fake
+    aws:
+      region: eu-west-1
+`))
+	assert.NotNil(t, err)
+
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    aws:
+      region: europe
+`))
+	assert.NotNil(t, err)
+
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    aws:
+      accountIDs: ["12345"]
+`))
+	assert.NotNil(t, err)
+}
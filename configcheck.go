@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sources of a configProblem
+const (
+	sourceFlag = "flag"
+	sourceEnv  = "env"
+	sourceFile = "file"
+)
+
+// configProblem is an invalid setting found at startup, with where it came from and what is used instead
+type configProblem struct {
+	Source string
+	// Name is the flag without dashes, the environment variable or the config file
+	Name  string
+	Value string
+	// Problem says what is wrong with the value
+	Problem string
+	// Fallback says what the controller does instead, empty if it cannot start
+	Fallback string
+}
+
+func (p configProblem) String() string {
+	setting := p.Name
+	if p.Source == sourceFlag {
+		setting = "--" + setting
+	}
+	if p.Value != "" {
+		setting += "=" + p.Value
+	}
+	msg := fmt.Sprintf("%s %s: %s", p.Source, setting, p.Problem)
+	if p.Fallback != "" {
+		msg += "; " + p.Fallback
+	}
+	return msg
+}
+
+// configProblems collects every invalid setting, so they are reported at once instead of one per restart
+type configProblems []configProblem
+
+// flag adds a problem of a flag, attributed to the environment variable that set it if there is one
+func (ps *configProblems) flag(name string, value interface{}, problem, fallback string) {
+	source := sourceFlag
+	if env := envBindings[name]; env != "" {
+		source, name = sourceEnv, env
+	}
+	*ps = append(*ps, configProblem{Source: source, Name: name, Value: formatValue(value), Problem: problem, Fallback: fallback})
+}
+
+func (ps *configProblems) env(name, value, problem, fallback string) {
+	*ps = append(*ps, configProblem{Source: sourceEnv, Name: name, Value: formatValue(value), Problem: problem, Fallback: fallback})
+}
+
+func (ps *configProblems) file(path string, err error) {
+	*ps = append(*ps, configProblem{Source: sourceFile, Name: path, Problem: err.Error()})
+}
+
+// fatal reports whether a problem has no fallback
+func (ps configProblems) fatal() bool {
+	for _, p := range ps {
+		if p.Fallback == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// formatValue quotes strings so padded values stand out; an empty string omits the value, for problems that quote
+// the bad entry themselves
+func formatValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		if s == "" {
+			return ""
+		}
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprint(value)
+}
+
+// reportConfigProblems logs every problem and exits if one of them has no fallback or --strict-config is set
+func reportConfigProblems(problems configProblems) {
+	if len(problems) == 0 {
+		return
+	}
+	log.Errorf("Found %d configuration problem(s):", len(problems))
+	for _, p := range problems {
+		log.Errorf("  %s", p)
+	}
+	if *argStrictConfig {
+		log.Fatalf("Refusing to start with an invalid configuration because of --strict-config")
+	}
+	if problems.fatal() {
+		log.Fatalf("Refusing to start with an invalid configuration")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateParamsReportsEveryProblem(t *testing.T) {
+	defer func(jitter float64, interval time.Duration, output, level string) {
+		*argRefreshJitter, *argStatusInterval, *argOutput, *argLogLevel = jitter, interval, output, level
+	}(*argRefreshJitter, *argStatusInterval, *argOutput, *argLogLevel)
+	*argRefreshJitter = -1
+	*argStatusInterval = 0
+	*argOutput = "consul"
+	*argLogLevel = "verbose"
+	t.Setenv(tokenGenRetriesKey, "three")
+
+	_, problems := validateParams()
+
+	assert.Equal(t, []string{
+		`env TOKEN_RETRIES="three": not a valid int; keeping 3`,
+		`flag --log-level="verbose": unknown log level; defaulting to info`,
+		`flag --refresh-jitter=-1: cannot be negative; disabling jitter`,
+		`flag --output="consul": unknown output; defaulting to secret`,
+		`flag --status-interval=0s: must be positive; defaulting to 1m`,
+	}, problemStrings(problems))
+	assert.False(t, problems.fatal())
+	assert.Equal(t, float64(0), *argRefreshJitter)
+	assert.Equal(t, outputSecret, *argOutput)
+	assert.Equal(t, log.InfoLevel, log.GetLevel())
+}
+
+func TestValidateParamsAccountProvenance(t *testing.T) {
+	defer func(ids []string) { *argAWSAccountIDs = ids }(*argAWSAccountIDs)
+	defer os.Unsetenv("awsaccount")
+	*argAWSAccountIDs = []string{"12345", "210987654321:eu-west-1"}
+	_ = os.Setenv("awsaccount", "210987654321:us-east-2,abc")
+
+	defaults, problems := validateParams()
+
+	assert.Equal(t, []string{"210987654321"}, defaults.AccountIDs)
+	assert.Equal(t, map[string]string{"210987654321": "eu-west-1"}, defaults.AccountRegions)
+	assert.Equal(t, []string{
+		`flag --aws-account-ids: invalid AWS account ID '12345', expected 12 digits; ignoring the account`,
+		`env awsaccount: invalid AWS account ID 'abc', expected 12 digits; ignoring the account`,
+		`env awsaccount: AWS account 210987654321 is listed with more than one region, using eu-west-1; keeping the first region`,
+	}, problemStrings(problems))
+}
+
+func TestConfigProblemsFatal(t *testing.T) {
+	var problems configProblems
+	problems.flag("refresh-jitter", -1.0, "cannot be negative", "disabling jitter")
+	assert.False(t, problems.fatal())
+
+	problems.file("/etc/registry-creds/config.yaml", errors.New("unknown provider 'gitlab'"))
+	assert.True(t, problems.fatal())
+	assert.Equal(t, "file /etc/registry-creds/config.yaml: unknown provider 'gitlab'", problems[1].String())
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	_, err := loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    refreshInterval: 0s
+    refreshJitter: -1
+`))
+	assert.EqualError(t, err, "[refreshInterval of provider 'ecr' must be positive, refreshJitter of provider 'ecr' cannot be negative]")
+}
+
+func problemStrings(problems configProblems) []string {
+	var lines []string
+	for _, p := range problems {
+		lines = append(lines, p.String())
+	}
+	return lines
+}
+
+func TestValidateParamsAPIServer(t *testing.T) {
+	defer func(host string, port int) { *argAPIServerHost, *argAPIServerPort = host, port }(*argAPIServerHost, *argAPIServerPort)
+
+	for _, host := range []string{"10.0.0.10", "fd00::1", "[fd00::1]", "api.internal"} {
+		*argAPIServerHost = host
+		_, problems := validateParams()
+		assert.Empty(t, problemStrings(problems), host)
+		assert.Equal(t, host, *argAPIServerHost)
+	}
+
+	*argAPIServerHost = "https://10.0.0.10:6443"
+	*argAPIServerPort = 70000
+	_, problems := validateParams()
+	assert.Equal(t, []string{
+		`flag --apiserver-host="https://10.0.0.10:6443": expected a host name or IP address without scheme or port; using the detected API server`,
+		`flag --apiserver-port=70000: not a valid port; using the detected API server port`,
+	}, problemStrings(problems))
+	assert.Empty(t, *argAPIServerHost)
+	assert.Zero(t, *argAPIServerPort)
+}
+
+func TestValidateParamsKubeAPIWriteRetries(t *testing.T) {
+	defer func(retries int, backoff, maxBackoff time.Duration) {
+		*argKubeAPIWriteRetries, *argKubeAPIWriteBackoff, *argKubeAPIWriteMaxBackoff = retries, backoff, maxBackoff
+	}(*argKubeAPIWriteRetries, *argKubeAPIWriteBackoff, *argKubeAPIWriteMaxBackoff)
+	*argKubeAPIWriteRetries = -1
+	*argKubeAPIWriteBackoff = 10 * time.Second
+	*argKubeAPIWriteMaxBackoff = 5 * time.Second
+
+	_, problems := validateParams()
+	assert.Equal(t, []string{
+		`flag --kube-api-write-retries=-1: cannot be negative; not retrying failed writes`,
+		`flag --kube-api-write-max-backoff=5s: cannot be less than --kube-api-write-backoff; using --kube-api-write-backoff`,
+	}, problemStrings(problems))
+	assert.Zero(t, *argKubeAPIWriteRetries)
+	assert.Equal(t, 10*time.Second, *argKubeAPIWriteMaxBackoff)
+}
+
+func TestValidateParamsFileProvider(t *testing.T) {
+	defer func(provider string) { *argProvider = provider }(*argProvider)
+	*argProvider = providerFile
+
+	_, problems := validateParams()
+	assert.Equal(t, []string{`flag --token-files: the file provider needs at least one token file`}, problemStrings(problems))
+	assert.True(t, problems.fatal())
+}
+
+func TestValidateParamsAgent(t *testing.T) {
+	defer func(output, addr string) { *argOutput, *argAgentAddress = output, addr }(*argOutput, *argAgentAddress)
+	*argOutput = outputAgent
+	*argAgentAddress = "0.0.0.0:8095"
+
+	_, problems := validateParams()
+	assert.Equal(t, []string{
+		`flag --agent-address="0.0.0.0:8095": the agent serves credentials without authentication, so it must listen on a unix socket or a loopback address; disabling the agent`,
+		`flag --output="agent": needs --agent-address`,
+	}, problemStrings(problems))
+	assert.True(t, problems.fatal())
+}
+
+func TestValidateParamsAgentWithLeaderElection(t *testing.T) {
+	defer func(output, addr string, elect bool) {
+		*argOutput, *argAgentAddress, *argLeaderElect = output, addr, elect
+	}(*argOutput, *argAgentAddress, *argLeaderElect)
+	*argOutput = outputAgent
+	*argAgentAddress = "unix:///var/run/registry-creds/agent.sock"
+	*argLeaderElect = true
+
+	_, problems := validateParams()
+	assert.Equal(t, []string{
+		`flag --agent-address="unix:///var/run/registry-creds/agent.sock": cannot be combined with --leader-elect, under which only the leader fetches tokens and every other agent answers with a miss`,
+	}, problemStrings(problems))
+	assert.True(t, problems.fatal())
+}
+
+func TestValidateParamsKMSSecret(t *testing.T) {
+	defer func(output string) { *argOutput = output }(*argOutput)
+	*argOutput = outputKMSSecret
+
+	_, problems := validateParams()
+	assert.Equal(t, []string{`flag --output="kms-secret": needs --kms-key-id`}, problemStrings(problems))
+	assert.True(t, problems.fatal())
+}
+
+func TestValidateParamsYAMLOutput(t *testing.T) {
+	defer func(output string) { *argOutput = output }(*argOutput)
+	*argOutput = outputYAML
+
+	_, problems := validateParams()
+	assert.Equal(t, []string{`flag --output="yaml": needs --output-dir`}, problemStrings(problems))
+	assert.True(t, problems.fatal())
+}
+
+func TestValidateParamsWaitForInitialSync(t *testing.T) {
+	defer func(wait bool, addr string) { *argWaitForInitialSync, *argHealthProbeAddress = wait, addr }(*argWaitForInitialSync, *argHealthProbeAddress)
+	*argWaitForInitialSync = true
+	*argHealthProbeAddress = ""
+
+	_, problems := validateParams()
+	assert.Equal(t, []string{`flag --wait-for-initial-sync=true: needs --health-probe-address; ignoring it`}, problemStrings(problems))
+	assert.False(t, problems.fatal())
+	assert.False(t, *argWaitForInitialSync)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+
+	"github.com/doddle/registry-creds/k8sutil"
+)
+
+const (
+	// defaultAWSCredentialsKey is the key of the AWS shared credentials file in a credentialsSecretRef
+	defaultAWSCredentialsKey = "credentials"
+	// credentialsSecretProviderName is reported by the AWS SDK as the source of the credentials
+	credentialsSecretProviderName = "KubernetesSecretProvider"
+)
+
+// SecretKeyRef points at a key of a Kubernetes secret
+type SecretKeyRef struct {
+	// Namespace defaults to the status namespace
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	// Key defaults to the provider's usual key, e.g. "credentials" for ECR
+	Key string `json:"key,omitempty"`
+}
+
+func (r *SecretKeyRef) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	return nil
+}
+
+// namespace returns the namespace of the secret, the status namespace if none is given
+func (r *SecretKeyRef) namespace() string {
+	if r.Namespace != "" {
+		return r.Namespace
+	}
+	return statusNamespace()
+}
+
+// read returns the current value of the key. The secret is read from the API server on every call, so a rotated
+// secret is picked up by the next token fetch without a restart.
+func (r *SecretKeyRef) read(ctx context.Context, util *k8sutil.KubeUtilInterface, defaultKey string) ([]byte, error) {
+	key := r.Key
+	if key == "" {
+		key = defaultKey
+	}
+	secret, err := util.GetSecret(ctx, r.namespace(), r.Name)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no key %s", r.namespace(), r.Name, key)
+	}
+	return value, nil
+}
+
+// secretAWSCredentials provides AWS credentials from an AWS shared credentials file stored in a Kubernetes secret
+type secretAWSCredentials struct {
+	util *k8sutil.KubeUtilInterface
+	ref  *SecretKeyRef
+}
+
+// newSecretAWSCredentials returns credentials that are read from the secret whenever the SDK signs a request
+func newSecretAWSCredentials(util *k8sutil.KubeUtilInterface, ref *SecretKeyRef) *credentials.Credentials {
+	return credentials.NewCredentials(&secretAWSCredentials{util: util, ref: ref})
+}
+
+func (s *secretAWSCredentials) Retrieve() (credentials.Value, error) {
+	data, err := s.ref.read(context.Background(), s.util, defaultAWSCredentialsKey)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("could not read AWS credentials: %w", err)
+	}
+	value, err := parseAWSCredentials(data)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("invalid AWS credentials in secret %s/%s: %w", s.ref.namespace(), s.ref.Name, err)
+	}
+	value.ProviderName = credentialsSecretProviderName
+	return value, nil
+}
+
+// IsExpired always reports true, so every fetch picks up a rotated secret; a refresh makes a handful of calls at most
+func (s *secretAWSCredentials) IsExpired() bool {
+	return true
+}
+
+// parseAWSCredentials reads the default profile of an AWS shared credentials file; a file without sections is read
+// as the default profile
+func parseAWSCredentials(data []byte) (credentials.Value, error) {
+	var value credentials.Value
+	section := "default"
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok || section != "default" {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "aws_access_key_id":
+			value.AccessKeyID = strings.TrimSpace(val)
+		case "aws_secret_access_key":
+			value.SecretAccessKey = strings.TrimSpace(val)
+		case "aws_session_token":
+			value.SessionToken = strings.TrimSpace(val)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return value, err
+	}
+	if value.AccessKeyID == "" || value.SecretAccessKey == "" {
+		return value, fmt.Errorf("the default profile needs aws_access_key_id and aws_secret_access_key")
+	}
+	return value, nil
+}
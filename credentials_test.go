@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLoadConfigCredentialsSecretRef(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    credentialsSecretRef:
+      namespace: registry-creds
+      name: aws-credentials
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, &SecretKeyRef{Namespace: "registry-creds", Name: "aws-credentials"}, cfg.credentialsSecretRef(providerECR))
+
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    credentialsSecretRef:
+      key: credentials
+`))
+	assert.NotNil(t, err)
+
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: fake
+    credentialsSecretRef:
+      name: fake-credentials
+`))
+	assert.NotNil(t, err)
+}
+
+func TestParseAWSCredentials(t *testing.T) {
+	value, err := parseAWSCredentials([]byte(`
+# rotated by the platform team
+[other]
+aws_access_key_id = OTHER
+
+[default]
+aws_access_key_id = AKIAEXAMPLE
+aws_secret_access_key = secret
+aws_session_token = session
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, "AKIAEXAMPLE", value.AccessKeyID)
+	assert.Equal(t, "secret", value.SecretAccessKey)
+	assert.Equal(t, "session", value.SessionToken)
+
+	value, err = parseAWSCredentials([]byte("aws_access_key_id=AKIAEXAMPLE\naws_secret_access_key=secret\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "AKIAEXAMPLE", value.AccessKeyID)
+
+	_, err = parseAWSCredentials([]byte("[default]\naws_access_key_id=AKIAEXAMPLE\n"))
+	assert.NotNil(t, err)
+}
+
+func TestSecretAWSCredentialsPickUpRotation(t *testing.T) {
+	c := newFakeController()
+	secrets := c.k8sutil.Kclient.Secrets("namespace1").(*fakeSecrets)
+	write := func(id string) {
+		secrets.store["aws-credentials"] = &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "aws-credentials"},
+			Data:       map[string][]byte{"credentials": []byte("[default]\naws_access_key_id=" + id + "\naws_secret_access_key=secret\n")},
+		}
+	}
+	creds := newSecretAWSCredentials(c.k8sutil, &SecretKeyRef{Namespace: "namespace1", Name: "aws-credentials"})
+
+	_, err := creds.GetWithContext(context.TODO())
+	assert.NotNil(t, err)
+
+	write("FIRST")
+	value, err := creds.GetWithContext(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, "FIRST", value.AccessKeyID)
+	assert.Equal(t, credentialsSecretProviderName, value.ProviderName)
+
+	write("SECOND")
+	value, err = creds.GetWithContext(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, "SECOND", value.AccessKeyID)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+)
+
+// diffLogging reports whether the changes of updated secrets and ServiceAccounts are logged; reading the previous
+// objects costs an extra GET, so this only happens at debug level
+func diffLogging() bool {
+	return log.IsLevelEnabled(log.DebugLevel)
+}
+
+// secretRegistries returns the docker config entries of a secret by registry, nil if it is not a pull secret
+func secretRegistries(secret *v1.Secret) map[string]registryAuth {
+	if secret == nil {
+		return nil
+	}
+	if data, ok := secret.Data[v1.DockerConfigJsonKey]; ok {
+		var config dockerJSON
+		if json.Unmarshal(data, &config) == nil {
+			return config.Auths
+		}
+	}
+	if data, ok := secret.Data[v1.DockerConfigKey]; ok {
+		var auths map[string]registryAuth
+		if json.Unmarshal(data, &auths) == nil {
+			return auths
+		}
+	}
+	return nil
+}
+
+// secretDiff describes what writing updated over previous changes, without any credentials: the registries added,
+// removed and given new credentials, the change of the expiry annotation and, for secrets that are not pull secrets,
+// the data keys. It returns "" if nothing changes.
+func secretDiff(previous, updated *v1.Secret) string {
+	var changes []string
+	oldAuths, newAuths := secretRegistries(previous), secretRegistries(updated)
+	if oldAuths != nil || newAuths != nil {
+		var added, removed, rotated []string
+		for registry, auth := range newAuths {
+			old, ok := oldAuths[registry]
+			switch {
+			case !ok:
+				added = append(added, registry)
+			case old != auth:
+				rotated = append(rotated, registry)
+			}
+		}
+		for registry := range oldAuths {
+			if _, ok := newAuths[registry]; !ok {
+				removed = append(removed, registry)
+			}
+		}
+		changes = appendListChange(changes, "registries added", added)
+		changes = appendListChange(changes, "registries removed", removed)
+		changes = appendListChange(changes, "new credentials for", rotated)
+	} else {
+		var added, removed, changed []string
+		for key, value := range updated.Data {
+			old, ok := previous.Data[key]
+			switch {
+			case !ok:
+				added = append(added, key)
+			case string(old) != string(value):
+				changed = append(changed, key)
+			}
+		}
+		for key := range previous.Data {
+			if _, ok := updated.Data[key]; !ok {
+				removed = append(removed, key)
+			}
+		}
+		changes = appendListChange(changes, "keys added", added)
+		changes = appendListChange(changes, "keys removed", removed)
+		changes = appendListChange(changes, "keys changed", changed)
+	}
+
+	oldExpiry, newExpiry := previous.Annotations[expiresAtAnnotation], updated.Annotations[expiresAtAnnotation]
+	if oldExpiry != newExpiry {
+		changes = append(changes, fmt.Sprintf("expiry %s -> %s", orNone(oldExpiry), orNone(newExpiry)))
+	}
+	if previous.Type != updated.Type {
+		changes = append(changes, fmt.Sprintf("type %s -> %s", orNone(string(previous.Type)), orNone(string(updated.Type))))
+	}
+	return strings.Join(changes, "; ")
+}
+
+// serviceAccountDiff describes how updated changes the imagePullSecrets and secrets references of previous
+func serviceAccountDiff(previous, updated *v1.ServiceAccount) string {
+	var changes []string
+	oldPull, newPull := pullSecretRefs(previous.ImagePullSecrets), pullSecretRefs(updated.ImagePullSecrets)
+	changes = appendListChange(changes, "imagePullSecrets added", stringSliceDifference(newPull, oldPull))
+	changes = appendListChange(changes, "imagePullSecrets removed", stringSliceDifference(oldPull, newPull))
+	if len(changes) == 0 && strings.Join(oldPull, ",") != strings.Join(newPull, ",") {
+		changes = append(changes, fmt.Sprintf("imagePullSecrets reordered to %s", strings.Join(newPull, ", ")))
+	}
+	oldSecrets, newSecrets := objectRefs(previous.Secrets), objectRefs(updated.Secrets)
+	changes = appendListChange(changes, "secrets added", stringSliceDifference(newSecrets, oldSecrets))
+	changes = appendListChange(changes, "secrets removed", stringSliceDifference(oldSecrets, newSecrets))
+	return strings.Join(changes, "; ")
+}
+
+func pullSecretRefs(refs []v1.LocalObjectReference) []string {
+	names := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		names = append(names, ref.Name)
+	}
+	return names
+}
+
+func objectRefs(refs []v1.ObjectReference) []string {
+	names := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		names = append(names, ref.Name)
+	}
+	return names
+}
+
+// stringSliceDifference returns the entries of a that are not in b, in the order of a
+func stringSliceDifference(a, b []string) []string {
+	var diff []string
+	for _, s := range a {
+		if !stringSliceContains(b, s) {
+			diff = append(diff, s)
+		}
+	}
+	return diff
+}
+
+func appendListChange(changes []string, what string, names []string) []string {
+	if len(names) == 0 {
+		return changes
+	}
+	sort.Strings(names)
+	return append(changes, fmt.Sprintf("%s %s", what, strings.Join(names, ", ")))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// diffLoggingServiceAccounts remembers the ServiceAccount it last read and logs the changes when it is written back
+type diffLoggingServiceAccounts struct {
+	secretsync.ServiceAccountClient
+	previous *v1.ServiceAccount
+}
+
+func (d *diffLoggingServiceAccounts) GetServiceAccount(ctx context.Context, namespace, name string) (*v1.ServiceAccount, error) {
+	sa, err := d.ServiceAccountClient.GetServiceAccount(ctx, namespace, name)
+	if err == nil {
+		d.previous = sa.DeepCopy()
+	}
+	return sa, err
+}
+
+func (d *diffLoggingServiceAccounts) UpdateServiceAccount(ctx context.Context, namespace string, sa *v1.ServiceAccount) error {
+	err := d.ServiceAccountClient.UpdateServiceAccount(ctx, namespace, sa)
+	if err == nil && d.previous != nil {
+		if diff := serviceAccountDiff(d.previous, sa); diff != "" {
+			log.Debugf("Changed ServiceAccount %s in namespace %s: %s", sa.Name, namespace, diff)
+		}
+	}
+	return err
+}
+
+// serviceAccountClient returns the client ServiceAccounts are updated with, logging the changes at debug level; with
+// --output=yaml their manifests are written instead
+func (c *controller) serviceAccountClient() secretsync.ServiceAccountClient {
+	if output, ok := c.output.(*yamlOutput); ok {
+		return output
+	}
+	if !diffLogging() {
+		return c.k8sutil
+	}
+	return &diffLoggingServiceAccounts{ServiceAccountClient: c.k8sutil}
+}
+
+// previousSecret reads the secret an update is about to replace, for secretDiff; nil when the changes are not logged
+// or it cannot be read
+func (c *controller) previousSecret(ctx context.Context, namespace, name string) *v1.Secret {
+	if !diffLogging() {
+		return nil
+	}
+	secret, err := c.k8sutil.GetSecret(ctx, namespace, name)
+	if err != nil {
+		return nil
+	}
+	return secret
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newDockerConfigSecret(t *testing.T, auths map[string]registryAuth, expiresAt string) *v1.Secret {
+	data, err := json.Marshal(dockerJSON{Auths: auths})
+	assert.Nil(t, err)
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "awsecr-cred"},
+		Data:       map[string][]byte{v1.DockerConfigJsonKey: data},
+		Type:       v1.SecretTypeDockerConfigJson,
+	}
+	if expiresAt != "" {
+		secret.Annotations = map[string]string{expiresAtAnnotation: expiresAt}
+	}
+	return secret
+}
+
+func TestSecretDiff(t *testing.T) {
+	previous := newDockerConfigSecret(t, map[string]registryAuth{
+		"a.example.com": {Auth: "b2xkLWE="},
+		"b.example.com": {Auth: "b2xkLWI="},
+		"c.example.com": {Auth: "c2FtZQ=="},
+	}, "2026-10-17T10:00:00Z")
+	updated := newDockerConfigSecret(t, map[string]registryAuth{
+		"a.example.com": {Auth: "bmV3LWE="},
+		"c.example.com": {Auth: "c2FtZQ=="},
+		"d.example.com": {Auth: "bmV3LWQ="},
+	}, "2026-10-17T22:00:00Z")
+
+	diff := secretDiff(previous, updated)
+	assert.Equal(t, "registries added d.example.com; registries removed b.example.com; new credentials for a.example.com; expiry 2026-10-17T10:00:00Z -> 2026-10-17T22:00:00Z", diff)
+	assert.NotContains(t, diff, "bmV3")
+
+	assert.Empty(t, secretDiff(previous, previous))
+}
+
+func TestSecretDiffOfOtherSecrets(t *testing.T) {
+	previous := &v1.Secret{Data: map[string][]byte{"token": []byte("old"), "user": []byte("AWS"), "stale": nil}}
+	updated := &v1.Secret{Data: map[string][]byte{"token": []byte("new"), "user": []byte("AWS"), "endpoint": nil}}
+	assert.Equal(t, "keys added endpoint; keys removed stale; keys changed token", secretDiff(previous, updated))
+}
+
+func TestServiceAccountDiff(t *testing.T) {
+	previous := &v1.ServiceAccount{ImagePullSecrets: []v1.LocalObjectReference{{Name: "other"}, {Name: "gcr"}}}
+	updated := &v1.ServiceAccount{
+		ImagePullSecrets: []v1.LocalObjectReference{{Name: "other"}, {Name: "ecr"}},
+		Secrets:          []v1.ObjectReference{{Name: "ecr"}},
+	}
+	assert.Equal(t, "imagePullSecrets added ecr; imagePullSecrets removed gcr; secrets added ecr", serviceAccountDiff(previous, updated))
+
+	reordered := &v1.ServiceAccount{ImagePullSecrets: []v1.LocalObjectReference{{Name: "gcr"}, {Name: "other"}}}
+	assert.Equal(t, "imagePullSecrets reordered to gcr, other", serviceAccountDiff(previous, reordered))
+	assert.Empty(t, serviceAccountDiff(previous, previous))
+}
+
+func TestProcessNamespaceLogsChangesAtDebugLevel(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetLevel(log.DebugLevel)
+	defer func() {
+		log.SetOutput(io.Discard)
+		log.SetLevel(log.InfoLevel)
+	}()
+	c := newFakeController()
+	secret := c.generateSecrets(context.TODO())[0]
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	assert.Contains(t, out.String(), "Changed ServiceAccount default in namespace namespace1: imagePullSecrets added "+secret.Name)
+
+	out.Reset()
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	assert.Contains(t, out.String(), "Changes of secret "+secret.Name+" in namespace namespace1: none")
+	assert.NotContains(t, out.String(), "Changed ServiceAccount")
+}
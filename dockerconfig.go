@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/doddle/registry-creds/pkg/providers"
+	"text/template"
+)
+
+const (
+	defaultRegistryEmail = "none"
+
+	// Forms in which a registry endpoint is written into the docker config
+	endpointFormURL  = "url"
+	endpointFormHost = "host"
+	endpointFormBoth = "both"
+
+	// Formats of a provider's pull secret
+	formatDockerConfigJSON = "dockerconfigjson"
+	formatDockercfg        = "dockercfg"
+)
+
+// DockerConfigOptions customise the registry entries written into a provider's secret
+type DockerConfigOptions struct {
+	// Email is a Go template rendered for every registry with .Provider and .Endpoint, e.g. "ci+{{ .Provider }}@example.com";
+	// some registries reject the default "none"
+	Email string `json:"email,omitempty"`
+	// Username replaces the user name of the credentials returned by the provider
+	Username string `json:"username,omitempty"`
+	// UsernamePassword also writes the username and password keys next to auth, for tools that do not read auth
+	UsernamePassword bool `json:"usernamePassword,omitempty"`
+	// EndpointForm writes every registry as returned by the provider (url), as bare hostname (host) or both;
+	// defaults to --registry-endpoint-form
+	EndpointForm string `json:"endpointForm,omitempty"`
+	// Format is dockerconfigjson (default) for a kubernetes.io/dockerconfigjson secret, or dockercfg for the legacy
+	// kubernetes.io/dockercfg secret some older tools still read
+	Format string `json:"format,omitempty"`
+}
+
+// emailTemplateData is what the email template is rendered with
+type emailTemplateData struct {
+	Provider string
+	Endpoint string
+}
+
+// validate renders the email template once so unknown fields are reported at startup
+func (o DockerConfigOptions) validate() error {
+	if o.EndpointForm != "" && !validEndpointForm(o.EndpointForm) {
+		return fmt.Errorf("unknown endpoint form %q, must be %s, %s or %s", o.EndpointForm, endpointFormURL, endpointFormHost, endpointFormBoth)
+	}
+	if o.Format != "" && o.Format != formatDockerConfigJSON && o.Format != formatDockercfg {
+		return fmt.Errorf("unknown format %q, must be %s or %s", o.Format, formatDockerConfigJSON, formatDockercfg)
+	}
+	_, err := o.renderEmail(providerECR, AuthToken{Endpoint: "https://registry.example.com"})
+	return err
+}
+
+func validEndpointForm(form string) bool {
+	return form == endpointFormURL || form == endpointFormHost || form == endpointFormBoth
+}
+
+// endpoints returns the keys the registry is written under; some container runtimes only match the bare hostname
+func (o DockerConfigOptions) endpoints(endpoint string) []string {
+	form := o.EndpointForm
+	if form == "" {
+		form = *argEndpointForm
+	}
+	host := providers.RegistryHost(endpoint)
+	switch form {
+	case endpointFormHost:
+		return []string{host}
+	case endpointFormBoth:
+		url := endpoint
+		if url == host {
+			url = "https://" + host
+		}
+		return []string{url, host}
+	default:
+		return []string{endpoint}
+	}
+}
+
+func (o DockerConfigOptions) emailTemplate() (*template.Template, error) {
+	email := o.Email
+	if email == "" {
+		email = defaultRegistryEmail
+	}
+	tmpl, err := template.New("email").Option("missingkey=error").Parse(email)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// renderEmail returns the email of the registry entry for the token
+func (o DockerConfigOptions) renderEmail(provider string, token AuthToken) (string, error) {
+	tmpl, err := o.emailTemplate()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, emailTemplateData{Provider: provider, Endpoint: token.Endpoint}); err != nil {
+		return "", fmt.Errorf("could not render email template: %v", err)
+	}
+	return buf.String(), nil
+}
+
+// newRegistryAuth returns the .dockerconfigjson entry for the token
+func newRegistryAuth(provider string, token AuthToken, opts DockerConfigOptions) (registryAuth, error) {
+	email, err := opts.renderEmail(provider, token)
+	if err != nil {
+		return registryAuth{}, err
+	}
+
+	auth := registryAuth{Auth: token.AccessToken, Email: email}
+	if opts.Username != "" || opts.UsernamePassword || token.Username != "" || token.Password != "" {
+		user, password, err := token.Credentials()
+		if err != nil {
+			return registryAuth{}, err
+		}
+		if opts.Username != "" {
+			user = opts.Username
+		}
+		auth.Auth = base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+		if opts.UsernamePassword {
+			auth.Username = user
+			auth.Password = password
+		}
+	}
+
+	return auth, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+func decodeAuth(t *testing.T, auth registryAuth) string {
+	decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+	assert.Nil(t, err)
+	return string(decoded)
+}
+
+func TestNewRegistryAuthDefaults(t *testing.T) {
+	token := AuthToken{AccessToken: base64.StdEncoding.EncodeToString([]byte("AWS:secret")), Endpoint: "https://123456789012.dkr.ecr.us-east-1.amazonaws.com"}
+
+	auth, err := newRegistryAuth(providerECR, token, DockerConfigOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, token.AccessToken, auth.Auth)
+	assert.Equal(t, "none", auth.Email)
+}
+
+func TestNewRegistryAuthEmailTemplate(t *testing.T) {
+	token := AuthToken{AccessToken: "token", Endpoint: "https://123456789012.dkr.ecr.us-east-1.amazonaws.com"}
+	opts := DockerConfigOptions{Email: "ci+{{ .Provider }}@example.com"}
+
+	auth, err := newRegistryAuth(providerECR, token, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, "ci+ecr@example.com", auth.Email)
+	assert.Equal(t, "token", auth.Auth)
+
+	assert.NotNil(t, DockerConfigOptions{Email: "{{ .Namespace }}"}.validate())
+	assert.NotNil(t, DockerConfigOptions{Email: "{{ .Provider "}.validate())
+	assert.Nil(t, opts.validate())
+}
+
+func TestNewRegistryAuthUsername(t *testing.T) {
+	token := AuthToken{AccessToken: base64.StdEncoding.EncodeToString([]byte("AWS:secret")), Endpoint: "registry"}
+
+	auth, err := newRegistryAuth(providerECR, token, DockerConfigOptions{Username: "robot"})
+	assert.Nil(t, err)
+	assert.Equal(t, "robot:secret", decodeAuth(t, auth))
+
+	_, err = newRegistryAuth(providerECR, AuthToken{AccessToken: "not base64!", Endpoint: "registry"}, DockerConfigOptions{Username: "robot"})
+	assert.NotNil(t, err)
+}
+
+func TestNewRegistryAuthExplicitCredentials(t *testing.T) {
+	token := AuthToken{Username: "user", Password: "pass", Endpoint: "registry"}
+
+	auth, err := newRegistryAuth("harbor", token, DockerConfigOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "user:pass", decodeAuth(t, auth))
+}
+
+func TestLoadConfigDockerConfig(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    dockerConfig:
+      email: "{{ .Provider }}@example.com"
+`))
+	assert.Nil(t, err)
+
+	c := newFakeController()
+	c.config = cfg
+	secret := c.generateSecrets(context.TODO())[0]
+
+	d := dockerJSON{}
+	assert.Nil(t, json.Unmarshal(secret.Data[".dockerconfigjson"], &d))
+	assert.Equal(t, "ecr@example.com", d.Auths["fakeEndpoint"].Email)
+
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    dockerConfig:
+      email: "{{ .Nope }}"
+`))
+	assert.NotNil(t, err)
+}
+
+func TestNewRegistryAuthUsernamePassword(t *testing.T) {
+	token := AuthToken{AccessToken: base64.StdEncoding.EncodeToString([]byte("AWS:secret")), Endpoint: "registry"}
+
+	auth, err := newRegistryAuth(providerECR, token, DockerConfigOptions{UsernamePassword: true})
+	assert.Nil(t, err)
+	assert.Equal(t, token.AccessToken, auth.Auth)
+	assert.Equal(t, "AWS", auth.Username)
+	assert.Equal(t, "secret", auth.Password)
+
+	entry, err := json.Marshal(auth)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"auth":"`+token.AccessToken+`","email":"none","username":"AWS","password":"secret"}`, string(entry))
+
+	// without the option only auth is written
+	auth, err = newRegistryAuth(providerECR, token, DockerConfigOptions{})
+	assert.Nil(t, err)
+	entry, err = json.Marshal(auth)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"auth":"`+token.AccessToken+`","email":"none"}`, string(entry))
+}
+
+func TestDockerConfigEndpoints(t *testing.T) {
+	endpoint := "https://123456789012.dkr.ecr.us-east-1.amazonaws.com"
+	host := "123456789012.dkr.ecr.us-east-1.amazonaws.com"
+
+	assert.Equal(t, []string{endpoint}, DockerConfigOptions{}.endpoints(endpoint))
+	assert.Equal(t, []string{host}, DockerConfigOptions{EndpointForm: endpointFormHost}.endpoints(endpoint+"/"))
+	assert.Equal(t, []string{endpoint, host}, DockerConfigOptions{EndpointForm: endpointFormBoth}.endpoints(endpoint))
+	// bare endpoints get the scheme added for the url form
+	assert.Equal(t, []string{endpoint, host}, DockerConfigOptions{EndpointForm: endpointFormBoth}.endpoints(host))
+
+	assert.NotNil(t, DockerConfigOptions{EndpointForm: "bare"}.validate())
+}
+
+func TestGenerateSecretObjBothEndpointForms(t *testing.T) {
+	tokens := []AuthToken{{AccessToken: "token", Endpoint: "https://registry.example.com"}}
+	sg := SecretGenerator{Name: providerECR, SecretName: "creds", IsJSONCfg: true, DockerConfig: DockerConfigOptions{EndpointForm: endpointFormBoth}}
+
+	secret, err := generateSecretObj(tokens, sg)
+	assert.Nil(t, err)
+	d := dockerJSON{}
+	assert.Nil(t, json.Unmarshal(secret.Data[".dockerconfigjson"], &d))
+	assert.Len(t, d.Auths, 2)
+	assert.Equal(t, "token", d.Auths["https://registry.example.com"].Auth)
+	assert.Equal(t, "token", d.Auths["registry.example.com"].Auth)
+}
+
+func TestGenerateSecretObjDockercfg(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    dockerConfig:
+      format: dockercfg
+`))
+	assert.Nil(t, err)
+	sg := SecretGenerator{Name: providerECR, SecretName: "creds", IsJSONCfg: true}
+	cfg.applyTo(&sg)
+	assert.False(t, sg.IsJSONCfg)
+
+	// every registry of a multi-account provider gets its entry, like in the dockerconfigjson format
+	tokens := []AuthToken{
+		{AccessToken: "token-a", Endpoint: "https://111111111111.dkr.ecr.eu-west-1.amazonaws.com"},
+		{AccessToken: "token-b", Endpoint: "https://222222222222.dkr.ecr.eu-west-1.amazonaws.com"},
+	}
+	secret, err := generateSecretObj(tokens, sg)
+	assert.Nil(t, err)
+	assert.Equal(t, v1.SecretTypeDockercfg, secret.Type)
+	assert.NotContains(t, secret.Data, v1.DockerConfigJsonKey)
+	auths := map[string]registryAuth{}
+	assert.Nil(t, json.Unmarshal(secret.Data[v1.DockerConfigKey], &auths))
+	assert.Equal(t, map[string]registryAuth{
+		"https://111111111111.dkr.ecr.eu-west-1.amazonaws.com": {Auth: "token-a", Email: defaultRegistryEmail},
+		"https://222222222222.dkr.ecr.eu-west-1.amazonaws.com": {Auth: "token-b", Email: defaultRegistryEmail},
+	}, auths)
+	assert.Len(t, secretRegistries(secret), 2)
+
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    dockerConfig:
+      format: dockercfg.json
+`))
+	assert.ErrorContains(t, err, `unknown format "dockercfg.json", must be dockerconfigjson or dockercfg`)
+}
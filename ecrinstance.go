@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+)
+
+// ECRInstanceConfig makes a config file provider with a name of its own an additional ECR provider, e.g. for
+// ecr-prod-cred and ecr-dev-cred fetched with different roles. Its aws section sets the region, role and accounts;
+// unset fields keep the flag values like those of the ecr provider.
+type ECRInstanceConfig struct {
+	// SecretName of the distributed secret, required and distinct from every other provider's
+	SecretName string `json:"secretName"`
+}
+
+// builtinProvider reports whether name is one of the providers selected by --provider or configured by name
+func builtinProvider(name string) bool {
+	return name == providerECR || name == providerFake || name == providerFile || name == providerTokenExchange
+}
+
+// ecrInstances returns the additional ECR providers of the config file in file order
+func (cfg *Config) ecrInstances() []ProviderConfig {
+	var instances []ProviderConfig
+	for _, p := range cfg.Providers {
+		if p.ECR != nil {
+			instances = append(instances, p)
+		}
+	}
+	return instances
+}
+
+// ecrInstanceClientFor returns the client of an additional ECR provider for a region and account role, creating it
+// on first use; its clients are cached next to the ecr provider's under keys prefixed with its name
+func (c *controller) ecrInstanceClientFor(name, region, role string) ecrInterface {
+	c.reloadLock.RLock()
+	defer c.reloadLock.RUnlock()
+	if c.newInstanceEcrClient == nil {
+		return c.ecrClient
+	}
+	key := name + "/" + region
+	if role != "" {
+		key += "|" + role
+	}
+	c.ecrClientsLock.Lock()
+	defer c.ecrClientsLock.Unlock()
+	client, ok := c.ecrClients[key]
+	if !ok {
+		client = c.newInstanceEcrClient(c.config, name, region, role)
+		c.ecrClients[key] = client
+	}
+	return client
+}
+
+// ecrInstanceProvider returns the ECR provider of an additional instance with the settings of the current config
+func (c *controller) ecrInstanceProvider(name string) *providers.ECR {
+	settings := c.currentConfig().providerAWSSettings(name, c.defaults)
+	return &providers.ECR{
+		Client:         c.ecrInstanceClientFor(name, settings.Region, ""),
+		Region:         settings.Region,
+		AccountIDs:     settings.AccountIDs,
+		AccountRegions: settings.AccountRegions,
+		AccountRoles:   settings.AccountRoles,
+		ClientFor:      func(region string) ecrInterface { return c.ecrInstanceClientFor(name, region, "") },
+		ClientForRole:  func(region, role string) ecrInterface { return c.ecrInstanceClientFor(name, region, role) },
+		Concurrency:    *argECRConcurrency,
+		CallTimeout:    *argProviderTimeout,
+	}
+}
+
+// ecrInstanceTokens returns the token function of an additional ECR provider
+func (c *controller) ecrInstanceTokens(name, secretName string) func(ctx context.Context) ([]AuthToken, error) {
+	return func(ctx context.Context) ([]AuthToken, error) {
+		if p := c.currentConfig().provider(name); p == nil || p.ECR == nil {
+			return []AuthToken{}, fmt.Errorf("provider %s is no longer configured", name)
+		}
+		return c.ecrTokens(ctx, name, secretName, c.ecrInstanceProvider(name))
+	}
+}
+
+// validateECRInstance checks the name and secret of the additional ECR provider at index i of cfg.Providers; a name
+// used twice is reported once, by the later one. Clashing secret names are left to validateSecretNames.
+func validateECRInstance(cfg *Config, i int) []error {
+	p := cfg.Providers[i]
+	var errs []error
+	if p.Name == "" || builtinProvider(p.Name) {
+		errs = append(errs, fmt.Errorf("ecr settings need a provider name other than '%s', '%s', '%s' and '%s', not '%s'", providerECR, providerFake, providerFile, providerTokenExchange, p.Name))
+	}
+	if err := validateSecretName(p.ECR.SecretName); err != nil {
+		errs = append(errs, fmt.Errorf("invalid ecr settings of provider '%s': %v", p.Name, err))
+	}
+	for _, other := range cfg.Providers[:i] {
+		if other.Name == p.Name {
+			errs = append(errs, fmt.Errorf("provider '%s' is configured more than once", p.Name))
+		}
+	}
+	return errs
+}
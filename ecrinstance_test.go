@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const ecrInstancesConfig = `
+providers:
+  - name: ecr-prod
+    ecr:
+      secretName: ecr-prod-cred
+    aws:
+      assumeRole: arn:aws:iam::111111111111:role/prod
+      accountIDs: ["111111111111"]
+  - name: ecr-dev
+    ecr:
+      secretName: ecr-dev-cred
+    aws:
+      region: eu-west-1
+      assumeRole: arn:aws:iam::222222222222:role/dev
+      accountIDs: ["222222222222", "333333333333:eu-central-1"]
+`
+
+func TestLoadConfigECRInstances(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, ecrInstancesConfig))
+	assert.Nil(t, err)
+	assert.Len(t, cfg.ecrInstances(), 2)
+
+	prod := cfg.providerAWSSettings("ecr-prod", newProviderDefaults())
+	assert.Equal(t, *argAWSRegion, prod.Region)
+	assert.Equal(t, "arn:aws:iam::111111111111:role/prod", prod.AssumeRole)
+	assert.Equal(t, []string{"111111111111"}, prod.AccountIDs)
+	dev := cfg.providerAWSSettings("ecr-dev", newProviderDefaults())
+	assert.Equal(t, "eu-west-1", dev.Region)
+	assert.Equal(t, map[string]string{"333333333333": "eu-central-1"}, dev.AccountRegions)
+	// the ecr provider keeps the flag values
+	assert.Equal(t, *argAWSAssumeRole, cfg.awsSettings(newProviderDefaults()).AssumeRole)
+}
+
+func TestLoadConfigRejectsInvalidECRInstances(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown provider without ecr settings": `
+providers:
+  - name: ecr-prod
+    aws:
+      region: eu-west-1`,
+		"built-in name": `
+providers:
+  - name: fake
+    ecr:
+      secretName: ecr-prod-cred`,
+		"no secret name": `
+providers:
+  - name: ecr-prod
+    ecr: {}`,
+		"collides with the --provider secret": `
+providers:
+  - name: ecr-prod
+    ecr:
+      secretName: awsecr-cred`,
+		"collides with another instance": `
+providers:
+  - name: ecr-prod
+    ecr:
+      secretName: ecr-cred
+  - name: ecr-dev
+    ecr:
+      secretName: ecr-cred-1`,
+		"configured twice": `
+providers:
+  - name: ecr-prod
+    ecr:
+      secretName: ecr-prod-cred
+  - name: ecr-prod
+    ecr:
+      secretName: ecr-other-cred`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, content))
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestECRInstanceGenerators(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, ecrInstancesConfig))
+	assert.Nil(t, err)
+	c := newController(newKubeUtil(), &regionEcrClient{region: *argAWSRegion})
+	c.config = cfg
+	type clientKey struct{ name, region, role string }
+	var created []clientKey
+	c.newInstanceEcrClient = func(cfg *Config, name, region, role string) ecrInterface {
+		created = append(created, clientKey{name, region, cfg.providerAWSSettings(name, c.defaults).AssumeRole})
+		return &regionEcrClient{region: region}
+	}
+
+	generators := getSecretGenerators(c)
+	assert.Len(t, generators, 3)
+	assert.Equal(t, "ecr-prod", generators[1].Name)
+	assert.Equal(t, "ecr-prod-cred", generators[1].SecretName)
+	assert.Equal(t, "ecr-dev-cred", generators[2].SecretName)
+
+	tokens, err := generators[2].TokenGenFxn(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"222222222222.dkr.ecr.eu-west-1.amazonaws.com", "333333333333.dkr.ecr.eu-central-1.amazonaws.com"}, []string{tokens[0].Host(), tokens[1].Host()})
+	tokens, err = generators[1].TokenGenFxn(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, "111111111111.dkr.ecr."+*argAWSRegion+".amazonaws.com", tokens[0].Host())
+
+	// every instance gets clients of its own role, reused across refreshes
+	_, err = generators[1].TokenGenFxn(context.TODO())
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []clientKey{
+		{"ecr-dev", "eu-west-1", "arn:aws:iam::222222222222:role/dev"},
+		{"ecr-dev", "eu-central-1", "arn:aws:iam::222222222222:role/dev"},
+		{"ecr-prod", *argAWSRegion, "arn:aws:iam::111111111111:role/prod"},
+	}, created)
+
+	// a removed instance fails instead of fetching with the flag settings
+	c.config = &Config{}
+	_, err = generators[1].TokenGenFxn(context.TODO())
+	assert.EqualError(t, err, "provider ecr-prod is no longer configured")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+)
+
+// envPrefix is the prefix of the environment variable of every flag, e.g. REGISTRY_CREDS_AWS_REGION for --aws-region
+const envPrefix = "REGISTRY_CREDS_"
+
+// legacyEnvAWSAccounts is the deprecated variable of --aws-account-ids; unlike the others it is combined with the
+// flag instead of replacing it
+const legacyEnvAWSAccounts = "awsaccount"
+
+// legacyEnvVars are the deprecated environment variables and the flag each one sets. They override the command line,
+// as they always did, while the prefixed variables only replace the flag defaults.
+var legacyEnvVars = map[string]string{
+	"awsregion":           "aws-region",
+	"aws_assume_role":     "aws_assume_role",
+	tokenGenRetryTypeKey:  "token-retry-type",
+	tokenGenRetriesKey:    "token-retries",
+	tokenGenRetryDelayKey: "token-retry-delay",
+}
+
+// envBindings holds the environment variable that set a flag, for the provenance of configuration problems
+var envBindings = map[string]string{}
+
+// envName returns the prefixed environment variable of a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// bindEnv sets every flag that was not given on the command line from its prefixed environment variable, then
+// applies the legacy variables with a deprecation warning; empty variables are ignored
+func bindEnv(fs *flag.FlagSet, problems *configProblems) {
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		value := os.Getenv(name)
+		if value == "" || (f.Changed && envBindings[f.Name] == "") {
+			return
+		}
+		setFromEnv(f, name, value, problems)
+	})
+
+	legacy := make([]string, 0, len(legacyEnvVars))
+	for name := range legacyEnvVars {
+		legacy = append(legacy, name)
+	}
+	sort.Strings(legacy)
+	for _, name := range legacy {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		f := fs.Lookup(legacyEnvVars[name])
+		if f == nil {
+			continue
+		}
+		if os.Getenv(envName(f.Name)) != "" {
+			log.Warnf("Ignoring the deprecated environment variable %s, %s is set as well", name, envName(f.Name))
+			continue
+		}
+		log.Warnf("The environment variable %s is deprecated, use %s instead", name, envName(f.Name))
+		setFromEnv(f, name, value, problems)
+	}
+}
+
+// bindSubcommandEnv applies the environment variables for the subcommands that return before validateParams
+func bindSubcommandEnv() {
+	var problems configProblems
+	bindEnv(flags, &problems)
+	reportConfigProblems(problems)
+}
+
+func setFromEnv(f *flag.Flag, name, value string, problems *configProblems) {
+	if slice, ok := f.Value.(flag.SliceValue); ok {
+		_ = slice.Replace(strings.Split(value, ","))
+		envBindings[f.Name] = name
+		return
+	}
+	// a failed Set may still have changed the value
+	previous := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		_ = f.Value.Set(previous)
+		problems.env(name, value, "not a valid "+f.Value.Type(), "keeping "+previous)
+		return
+	}
+	envBindings[f.Name] = name
+}
+
+// legacyAWSAccounts returns the entries of the deprecated awsaccount variable, which are added to --aws-account-ids
+func legacyAWSAccounts() []string {
+	value := os.Getenv(legacyEnvAWSAccounts)
+	if value == "" {
+		return nil
+	}
+	log.Warnf("The environment variable %s is deprecated, use %s instead", legacyEnvAWSAccounts, envName("aws-account-ids"))
+	return strings.Split(value, ",")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	flag "github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+func newEnvTestFlags(t *testing.T) *flag.FlagSet {
+	bindings := envBindings
+	envBindings = map[string]string{}
+	t.Cleanup(func() { envBindings = bindings })
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.String("aws-region", "us-east-1", "")
+	fs.String("aws_assume_role", "", "")
+	fs.Int("token-retries", 3, "")
+	fs.StringSlice("aws-account-ids", nil, "")
+	return fs
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "REGISTRY_CREDS_AWS_REGION", envName("aws-region"))
+	assert.Equal(t, "REGISTRY_CREDS_AWS_ASSUME_ROLE", envName("aws_assume_role"))
+}
+
+func TestBindEnvPrefixed(t *testing.T) {
+	fs := newEnvTestFlags(t)
+	assert.Nil(t, fs.Parse([]string{"--aws-region=eu-west-1"}))
+	t.Setenv("REGISTRY_CREDS_AWS_REGION", "eu-central-1")
+	t.Setenv("REGISTRY_CREDS_AWS_ACCOUNT_IDS", "123456789012,210987654321")
+	t.Setenv("REGISTRY_CREDS_TOKEN_RETRIES", "5")
+
+	var problems configProblems
+	bindEnv(fs, &problems)
+
+	assert.Empty(t, problems)
+	// the command line wins over the prefixed variables
+	assert.Equal(t, "eu-west-1", fs.Lookup("aws-region").Value.String())
+	assert.Equal(t, "[123456789012,210987654321]", fs.Lookup("aws-account-ids").Value.String())
+	assert.Equal(t, "5", fs.Lookup("token-retries").Value.String())
+	assert.Equal(t, "REGISTRY_CREDS_TOKEN_RETRIES", envBindings["token-retries"])
+}
+
+func TestBindEnvLegacy(t *testing.T) {
+	fs := newEnvTestFlags(t)
+	assert.Nil(t, fs.Parse([]string{"--aws-region=eu-west-1"}))
+	t.Setenv("awsregion", "eu-central-1")
+	t.Setenv("aws_assume_role", "arn:aws:iam::123456789012:role/legacy")
+	t.Setenv("REGISTRY_CREDS_AWS_ASSUME_ROLE", "arn:aws:iam::123456789012:role/prefixed")
+
+	var problems configProblems
+	bindEnv(fs, &problems)
+
+	// the legacy variables still override the command line, but not the prefixed variables
+	assert.Equal(t, "eu-central-1", fs.Lookup("aws-region").Value.String())
+	assert.Equal(t, "arn:aws:iam::123456789012:role/prefixed", fs.Lookup("aws_assume_role").Value.String())
+	assert.Equal(t, "awsregion", envBindings["aws-region"])
+}
+
+func TestBindEnvInvalidValue(t *testing.T) {
+	fs := newEnvTestFlags(t)
+	t.Setenv("REGISTRY_CREDS_TOKEN_RETRIES", "many")
+
+	var problems configProblems
+	bindEnv(fs, &problems)
+
+	assert.Equal(t, []string{`env REGISTRY_CREDS_TOKEN_RETRIES="many": not a valid int; keeping 3`}, problemStrings(problems))
+	assert.Equal(t, "3", fs.Lookup("token-retries").Value.String())
+}
+
+func TestBindSubcommandEnv(t *testing.T) {
+	defer func(addr string) { *argAgentAddress = addr }(*argAgentAddress)
+	defer func(bindings map[string]string) { envBindings = bindings }(envBindings)
+	envBindings = map[string]string{}
+	t.Setenv("REGISTRY_CREDS_AGENT_ADDRESS", "unix:///var/run/registry-creds/agent.sock")
+
+	// credential-provider and decrypt return before validateParams
+	bindSubcommandEnv()
+	assert.Equal(t, "unix:///var/run/registry-creds/agent.sock", *argAgentAddress)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// Event reasons
+const (
+	reasonCircuitOpened = "ProviderCircuitOpened"
+	reasonCircuitClosed = "ProviderCircuitClosed"
+)
+
+// podReference returns the controller's own Pod from the POD_NAME and POD_NAMESPACE env vars, set through the downward
+// API; events are attached to it, so nil disables them
+func podReference() *v1.ObjectReference {
+	name, namespace := os.Getenv("POD_NAME"), os.Getenv("POD_NAMESPACE")
+	if name == "" || namespace == "" {
+		return nil
+	}
+	return &v1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: namespace, Name: name}
+}
+
+// eventf records an Event on the controller's Pod; it is a no-op without a recorder or outside a Pod
+func (c *controller) eventf(eventType, reason, messageFmt string, args ...interface{}) {
+	if c.recorder == nil {
+		return
+	}
+	if pod := podReference(); pod != nil {
+		c.recorder.Eventf(pod, eventType, reason, messageFmt, args...)
+	}
+}
+
+const (
+	// eventQPS and eventBurst bound the Events emitted by all of the controller's recorders together
+	eventQPS   = 0.5
+	eventBurst = 25
+)
+
+// eventAggregator wraps an EventRecorder so that repeated identical Events, with the same object, type, reason and
+// message, are emitted once per window; the repeats are counted and summarised in one more Event when the window
+// ends. Together with a rate limit this keeps a failure that hits every namespace from flooding the API server.
+type eventAggregator struct {
+	recorder record.EventRecorder
+	window   time.Duration
+	limiter  flowcontrol.RateLimiter
+
+	mu     sync.Mutex
+	events map[string]*aggregatedEvent
+}
+
+// aggregatedEvent is an Event emitted in the current window and the number of times it was repeated since
+type aggregatedEvent struct {
+	object      runtime.Object
+	annotations map[string]string
+	eventType   string
+	reason      string
+	message     string
+	repeats     int
+}
+
+var _ record.EventRecorder = &eventAggregator{}
+
+// newEventAggregator returns recorder wrapped in an eventAggregator; a window of 0 only rate-limits the Events
+func newEventAggregator(recorder record.EventRecorder, window time.Duration) *eventAggregator {
+	return &eventAggregator{
+		recorder: recorder,
+		window:   window,
+		limiter:  flowcontrol.NewTokenBucketRateLimiter(eventQPS, eventBurst),
+		events:   map[string]*aggregatedEvent{},
+	}
+}
+
+// Event implements record.EventRecorder
+func (a *eventAggregator) Event(object runtime.Object, eventType, reason, message string) {
+	a.AnnotatedEventf(object, nil, eventType, reason, "%s", message)
+}
+
+// Eventf implements record.EventRecorder
+func (a *eventAggregator) Eventf(object runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	a.AnnotatedEventf(object, nil, eventType, reason, messageFmt, args...)
+}
+
+// AnnotatedEventf implements record.EventRecorder
+func (a *eventAggregator) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventType, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	if a.window <= 0 {
+		a.emit(object, annotations, eventType, reason, message)
+		return
+	}
+
+	key := eventKey(object, eventType, reason, message)
+	a.mu.Lock()
+	if e, ok := a.events[key]; ok {
+		e.repeats++
+		a.mu.Unlock()
+		eventsSuppressed.WithLabelValues(reason).Inc()
+		return
+	}
+	a.events[key] = &aggregatedEvent{object: object, annotations: annotations, eventType: eventType, reason: reason, message: message}
+	a.mu.Unlock()
+
+	time.AfterFunc(a.window, func() { a.flush(key) })
+	a.emit(object, annotations, eventType, reason, message)
+}
+
+// flush ends the window of an Event, summarising its repeats if there were any
+func (a *eventAggregator) flush(key string) {
+	a.mu.Lock()
+	e := a.events[key]
+	delete(a.events, key)
+	a.mu.Unlock()
+	if e == nil || e.repeats == 0 {
+		return
+	}
+	a.emit(e.object, e.annotations, e.eventType, e.reason, fmt.Sprintf("%s (repeated %d more times in %s)", e.message, e.repeats, a.window))
+}
+
+// emit passes an Event on to the recorder unless the rate limit is exhausted
+func (a *eventAggregator) emit(object runtime.Object, annotations map[string]string, eventType, reason, message string) {
+	if !a.limiter.TryAccept() {
+		eventsSuppressed.WithLabelValues(reason).Inc()
+		log.Debugf("Dropped %s Event %s over the rate limit: %s", eventType, reason, message)
+		return
+	}
+	a.recorder.AnnotatedEventf(object, annotations, eventType, reason, "%s", message)
+}
+
+// eventKey identifies identical Events
+func eventKey(object runtime.Object, eventType, reason, message string) string {
+	target := fmt.Sprintf("%p", object)
+	if ref, err := reference.GetReference(scheme.Scheme, object); err == nil {
+		target = ref.Namespace + "/" + ref.Kind + "/" + ref.Name
+	}
+	return strings.Join([]string{target, eventType, reason, message}, "\x00")
+}
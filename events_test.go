@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// drainEvents returns the Events the fake recorder received so far
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case e := <-recorder.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventAggregatorAggregatesIdenticalEvents(t *testing.T) {
+	recorder := record.NewFakeRecorder(100)
+	aggregator := newEventAggregator(recorder, 50*time.Millisecond)
+	pod := &v1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "kube-system", Name: "registry-creds"}
+
+	for i := 0; i < 5; i++ {
+		aggregator.Eventf(pod, v1.EventTypeWarning, reasonCircuitOpened, "Provider %s failed", "ecr")
+	}
+	aggregator.Eventf(pod, v1.EventTypeWarning, reasonCircuitOpened, "Provider %s failed", "fake")
+	assert.Equal(t, []string{
+		"Warning ProviderCircuitOpened Provider ecr failed",
+		"Warning ProviderCircuitOpened Provider fake failed",
+	}, drainEvents(recorder))
+
+	// the repeats are summarised once the window ends, and the next Event starts a new window
+	var events []string
+	assert.Eventually(t, func() bool {
+		events = append(events, drainEvents(recorder)...)
+		return len(events) > 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"Warning ProviderCircuitOpened Provider ecr failed (repeated 4 more times in 50ms)"}, events)
+
+	aggregator.Eventf(pod, v1.EventTypeWarning, reasonCircuitOpened, "Provider %s failed", "ecr")
+	assert.Len(t, drainEvents(recorder), 1)
+}
+
+func TestEventAggregatorRateLimit(t *testing.T) {
+	recorder := record.NewFakeRecorder(100)
+	aggregator := newEventAggregator(recorder, 0)
+	pod := &v1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "kube-system", Name: "registry-creds"}
+
+	for i := 0; i < 2*eventBurst; i++ {
+		aggregator.Event(pod, v1.EventTypeNormal, reasonCircuitClosed, strings.Repeat("x", i))
+	}
+	assert.Len(t, drainEvents(recorder), eventBurst)
+}
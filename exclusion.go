@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+)
+
+// defaultSystemNamespaces are skipped unless --skip-system-namespaces is given
+var defaultSystemNamespaces = []string{"kube-system", "kube-public", "kube-node-lease", "openshift-*"}
+
+// systemNamespace reports whether the namespace matches a --skip-system-namespaces pattern. Unlike excluded
+// namespaces, system namespaces are never cleaned up, since the status ConfigMap and hub secrets may live there.
+func systemNamespace(name string) bool {
+	for _, pattern := range *argSkipSystemNamespaces {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validSystemNamespaces drops the malformed patterns and returns an error for each
+func validSystemNamespaces(patterns []string) ([]string, []error) {
+	valid := make([]string, 0, len(patterns))
+	var errs []error
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid system namespace pattern '%s': %v", pattern, err))
+			continue
+		}
+		valid = append(valid, pattern)
+	}
+	return valid, errs
+}
+
+// excludedNamespaceSelector matches the namespaces excluded by their labels, parsed from --excluded-namespace-selector
+var excludedNamespaceSelector = labels.Nothing()
+
+// parseExcludedNamespaceSelector parses a label selector; an empty selector excludes nothing
+func parseExcludedNamespaceSelector(selector string) (labels.Selector, error) {
+	if selector == "" {
+		return labels.Nothing(), nil
+	}
+	return labels.Parse(selector)
+}
+
+// excludedBySelector reports whether the namespace's current labels match --excluded-namespace-selector
+func excludedBySelector(ns *v1.Namespace) bool {
+	return excludedNamespaceSelector.Matches(labels.Set(ns.Labels))
+}
+
+// optInAnnotation opts a namespace in to the pull secrets under --require-namespace-opt-in
+const optInAnnotation = "registry-creds.k8s.io/enabled"
+
+// notOptedIn reports whether --require-namespace-opt-in is set and the namespace is not annotated
+// registry-creds.k8s.io/enabled: "true"
+func notOptedIn(ns *v1.Namespace) bool {
+	return *argRequireOptIn && ns.Annotations[optInAnnotation] != "true"
+}
+
+// namespaceExcluded reports whether the namespace is listed in --excluded-namespaces, matches
+// --excluded-namespace-selector or has not opted in; labels and annotations can change at any time, so this is
+// evaluated on every sync
+func (c *controller) namespaceExcluded(ns *v1.Namespace) bool {
+	return stringSliceContains(c.k8sutil.ExcludedNamespaces, ns.GetName()) || excludedBySelector(ns) || notOptedIn(ns)
+}
+
+// the reasons a refresh leaves a namespace alone, counted in registry_creds_cycle_namespaces
+const (
+	skipExcludedName  = "excluded_name"
+	skipExcludedLabel = "excluded_label"
+	skipNotOptedIn    = "not_opted_in"
+	skipSystem        = "system"
+	skipTerminating   = "terminating"
+)
+
+// skipReason returns why a refresh leaves the namespace alone, "" if it does not; a terminating namespace refuses
+// new secrets anyway
+func (c *controller) skipReason(ns *v1.Namespace) string {
+	switch {
+	case !ns.DeletionTimestamp.IsZero():
+		return skipTerminating
+	case stringSliceContains(c.k8sutil.ExcludedNamespaces, ns.GetName()):
+		return skipExcludedName
+	case excludedBySelector(ns):
+		return skipExcludedLabel
+	case notOptedIn(ns):
+		return skipNotOptedIn
+	case systemNamespace(ns.GetName()):
+		return skipSystem
+	}
+	return ""
+}
+
+// cleanupExcluded reports whether the managed secrets should be removed from an excluded namespace: always when it
+// matches the selector, and with --cleanup-excluded-namespaces when it is excluded by name or has not opted in
+func (c *controller) cleanupExcluded(ns *v1.Namespace) bool {
+	if excludedBySelector(ns) {
+		return true
+	}
+	return *argCleanupExcluded && (stringSliceContains(c.k8sutil.ExcludedNamespaces, ns.GetName()) || notOptedIn(ns))
+}
+
+// removeFromNamespace deletes the managed secrets from a namespace and detaches them from its ServiceAccounts
+func (c *controller) removeFromNamespace(ctx context.Context, ns *v1.Namespace) error {
+	return c.removeSecrets(ctx, ns, c.managedSecretNames())
+}
+
+// removeSecrets deletes the named managed secrets from a namespace and detaches them from its ServiceAccounts
+func (c *controller) removeSecrets(ctx context.Context, ns *v1.Namespace, managed []string) error {
+	logw := log.WithField("function", "removeSecrets")
+
+	var errs []error
+	names := serviceAccountNames(ns)
+	if !c.caps.updateServiceAccounts {
+		names = nil
+	}
+	for _, name := range names {
+		updated, err := secretsync.DetachFromServiceAccount(ctx, c.serviceAccountClient(), ns.GetName(), name, managed, currentPullSecretOptions())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not detach secrets from ServiceAccount: %w", err))
+			continue
+		}
+		if updated {
+			logw.Infof("Removed managed secrets from ServiceAccount %s in namespace %s", name, ns.GetName())
+		}
+	}
+
+	if mirror, ok := c.output.(*mirrorOutput); ok && ns.GetName() == mirror.hubNamespace {
+		// the hub secrets are the source of every mirror
+		return utilerrors.NewAggregate(errs)
+	} else if c.output != nil && !ok {
+		// the secrets are not written through the Kubernetes API, so there is nothing the controller may delete
+		return utilerrors.NewAggregate(errs)
+	}
+	if !c.caps.deleteSecrets {
+		// logged at startup
+		return utilerrors.NewAggregate(errs)
+	}
+	for _, name := range managed {
+		existing, err := c.k8sutil.GetSecretMetadata(ctx, ns.GetName(), name)
+		if k8sutil.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		owned, err := c.ownsSecret(ctx, ns.GetName(), existing)
+		if err != nil && !k8sutil.IsNotFound(err) {
+			errs = append(errs, err)
+			continue
+		}
+		if !owned {
+			logw.Infof("Not deleting secret %s from namespace %s, it was not written by registry-creds", name, ns.GetName())
+			continue
+		}
+		err = c.k8sutil.DeleteSecret(ctx, ns.GetName(), name)
+		if err != nil && !k8sutil.IsNotFound(err) {
+			errs = append(errs, err)
+			continue
+		}
+		logw.Infof("Deleted secret %s from namespace %s", name, ns.GetName())
+	}
+	return utilerrors.NewAggregate(errs)
+}
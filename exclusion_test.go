@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestParseExcludedNamespaceSelector(t *testing.T) {
+	selector, err := parseExcludedNamespaceSelector("")
+	assert.Nil(t, err)
+	assert.False(t, selector.Matches(labels.Set{}))
+
+	selector, err = parseExcludedNamespaceSelector("env=sandbox")
+	assert.Nil(t, err)
+	assert.True(t, selector.Matches(labels.Set{"env": "sandbox"}))
+	assert.False(t, selector.Matches(labels.Set{"env": "prod"}))
+
+	_, err = parseExcludedNamespaceSelector("env==,")
+	assert.NotNil(t, err)
+}
+
+func TestHandlerRemovesSecretsWhenNamespaceBecomesExcluded(t *testing.T) {
+	selector, _ := parseExcludedNamespaceSelector("env=sandbox")
+	excludedNamespaceSelector = selector
+	defer func() { excludedNamespaceSelector = labels.Nothing() }()
+
+	c := newFakeController()
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	sa, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	sa.ImagePullSecrets = []v1.LocalObjectReference{{Name: "someOtherSecret"}}
+	assert.Nil(t, c.k8sutil.UpdateServiceAccount(context.TODO(), "namespace1", sa))
+
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	// relabelling the namespace excludes it on the next sync
+	ns.Labels = map[string]string{"env": "sandbox"}
+	assert.Nil(t, handler(context.TODO(), c, ns))
+
+	for _, name := range c.managedSecretNames() {
+		exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", name)
+		assert.Nil(t, err)
+		assert.False(t, exists, name)
+	}
+	sa, err = c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	assert.Equal(t, []v1.LocalObjectReference{{Name: "someOtherSecret"}}, sa.ImagePullSecrets)
+	assert.NotContains(t, sa.Annotations, secretsync.ManagedPullSecretsAnnotation)
+
+	// an excluded namespace without secrets is left alone
+	assert.Nil(t, handler(context.TODO(), c, ns))
+}
+
+func TestHandlerCleansUpNamespacesExcludedByName(t *testing.T) {
+	c := newFakeController()
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	assert.Nil(t, handler(context.TODO(), c, ns))
+
+	// by default a namespace added to --excluded-namespaces keeps its secret
+	c.k8sutil.ExcludedNamespaces = []string{"namespace1"}
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	*argCleanupExcluded = true
+	defer func() { *argCleanupExcluded = false }()
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	exists, err = c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	sa, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	assert.False(t, secretsync.HasPullSecret(sa, *argAWSSecretName))
+}
+
+func TestSystemNamespace(t *testing.T) {
+	defer func(patterns []string) { *argSkipSystemNamespaces = patterns }(*argSkipSystemNamespaces)
+
+	for _, name := range []string{"kube-system", "kube-public", "kube-node-lease", "openshift-monitoring"} {
+		assert.True(t, systemNamespace(name), name)
+	}
+	for _, name := range []string{"default", "openshift", "my-kube-system"} {
+		assert.False(t, systemNamespace(name), name)
+	}
+
+	*argSkipSystemNamespaces = nil
+	assert.False(t, systemNamespace("kube-system"))
+}
+
+func TestValidateParamsSystemNamespaces(t *testing.T) {
+	defer func(patterns []string, skip bool) {
+		*argSkipSystemNamespaces = patterns
+		*argSkipKubeSystem = skip
+	}(*argSkipSystemNamespaces, *argSkipKubeSystem)
+
+	*argSkipSystemNamespaces = []string{"kube-system", "team-[", "ci-*"}
+	*argSkipKubeSystem = false
+	validateParams()
+	assert.Equal(t, []string{"ci-*"}, *argSkipSystemNamespaces)
+}
+
+func TestHandlerSkipsSystemNamespaces(t *testing.T) {
+	c := newFakeController()
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-public"}}
+	c.k8sutil.Kclient.(*fakeKubeClient).secrets["kube-public"] = &fakeSecrets{store: map[string]*v1.Secret{}}
+
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	assert.Empty(t, c.k8sutil.Kclient.(*fakeKubeClient).secrets["kube-public"].store)
+	assert.Empty(t, c.status.snapshot())
+}
+
+func TestHandlerRequiresNamespaceOptIn(t *testing.T) {
+	*argRequireOptIn = true
+	defer func() { *argRequireOptIn = false }()
+
+	c := newFakeController()
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	ns.Annotations = map[string]string{optInAnnotation: "true"}
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	exists, err = c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	// dropping the annotation only stops the updates, unless --cleanup-excluded-namespaces is set
+	ns.Annotations = map[string]string{optInAnnotation: "false"}
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	exists, err = c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	*argCleanupExcluded = true
+	defer func() { *argCleanupExcluded = false }()
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	exists, err = c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
+
+func TestRemoveSecretsKeepsUnmanagedSecrets(t *testing.T) {
+	*argCleanupExcluded = true
+	defer func() { *argCleanupExcluded = false }()
+	c, secret, _ := newUnmanagedSecretController()
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+
+	// the secret of the managed name was created by someone else, so excluding the namespace leaves it
+	c.k8sutil.ExcludedNamespaces = []string{"namespace1"}
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", secret.Name)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	// one written by the release before the managed-by label is still removed
+	setExistingRegistries(t, c, secret, "")
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	exists, err = c.k8sutil.SecretExists(context.TODO(), "namespace1", secret.Name)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
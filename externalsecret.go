@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/doddle/registry-creds/k8sutil"
+)
+
+const outputExternalSecret = "external-secret"
+
+var externalSecretGVK = schema.GroupVersionKind{Group: "external-secrets.io", Version: "v1beta1", Kind: "ExternalSecret"}
+
+// externalSecretOutput keeps a single source secret per provider up to date and leaves the fan-out to the External
+// Secrets Operator: every namespace gets an ExternalSecret that pulls the source secret through a ClusterSecretStore
+type externalSecretOutput struct {
+	util            *k8sutil.KubeUtilInterface
+	client          client.Client
+	sourceNamespace string
+	store           string
+	refreshInterval time.Duration
+
+	// written holds the data last written to each source secret, so it is only updated once per refresh
+	writtenLock sync.Mutex
+	written     map[string]map[string][]byte
+}
+
+func newExternalSecretOutput(util *k8sutil.KubeUtilInterface, c client.Client, sourceNamespace, store string, refreshInterval time.Duration) (*externalSecretOutput, error) {
+	if store == "" {
+		return nil, fmt.Errorf("--eso-store is required with --output=%s", outputExternalSecret)
+	}
+	return &externalSecretOutput{
+		util:            util,
+		client:          c,
+		sourceNamespace: sourceNamespace,
+		store:           store,
+		refreshInterval: refreshInterval,
+		written:         map[string]map[string][]byte{},
+	}, nil
+}
+
+func (o *externalSecretOutput) write(ctx context.Context, namespace string, secret *v1.Secret) error {
+	if err := o.writeSource(ctx, secret); err != nil {
+		return err
+	}
+	if namespace == o.sourceNamespace {
+		// the source secret already is the pull secret of its own namespace
+		return nil
+	}
+	return o.writeExternalSecret(ctx, namespace, secret)
+}
+
+// writeSource creates or updates the source secret the ExternalSecrets read from
+func (o *externalSecretOutput) writeSource(ctx context.Context, secret *v1.Secret) error {
+	o.writtenLock.Lock()
+	defer o.writtenLock.Unlock()
+	if reflect.DeepEqual(o.written[secret.Name], secret.Data) {
+		return nil
+	}
+
+	exists, err := o.util.SecretExists(ctx, o.sourceNamespace, secret.Name)
+	if err != nil {
+		return fmt.Errorf("could not check source Secret: %w", err)
+	}
+	source := secret.DeepCopy()
+	source.Namespace = o.sourceNamespace
+	if exists {
+		err = o.util.UpdateSecret(ctx, o.sourceNamespace, source)
+	} else {
+		err = o.util.CreateSecret(ctx, o.sourceNamespace, source)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write source Secret: %w", err)
+	}
+	log.Infof("Updated source secret %s in namespace %s", secret.Name, o.sourceNamespace)
+	o.written[secret.Name] = secret.Data
+	return nil
+}
+
+// externalSecretSpec returns the spec of the ExternalSecret that recreates secret from the source secret
+func (o *externalSecretOutput) externalSecretSpec(secret *v1.Secret) map[string]interface{} {
+	secretType := string(secret.Type)
+	if secretType == "" {
+		secretType = string(v1.SecretTypeOpaque)
+	}
+	return map[string]interface{}{
+		"refreshInterval": o.refreshInterval.String(),
+		"secretStoreRef": map[string]interface{}{
+			"kind": "ClusterSecretStore",
+			"name": o.store,
+		},
+		"target": map[string]interface{}{
+			"name":           secret.Name,
+			"creationPolicy": "Owner",
+			"template": map[string]interface{}{
+				"type": secretType,
+			},
+		},
+		"dataFrom": []interface{}{
+			map[string]interface{}{
+				"extract": map[string]interface{}{"key": secret.Name},
+			},
+		},
+	}
+}
+
+// writeExternalSecret creates or updates the ExternalSecret of secret in namespace
+func (o *externalSecretOutput) writeExternalSecret(ctx context.Context, namespace string, secret *v1.Secret) error {
+	return applyManagedObject(ctx, o.util, o.client, externalSecretGVK, namespace, secret.Name, o.externalSecretSpec(secret))
+}
+
+// applyManagedObject creates or updates a custom resource with the given spec and the managed labels and annotations,
+// leaving it alone if it is up to date. The writes go through c, but wait for the write limit and throttling of util
+// and are retried like its own.
+func applyManagedObject(ctx context.Context, util *k8sutil.KubeUtilInterface, c client.Client, gvk schema.GroupVersionKind, namespace, name string, spec map[string]interface{}) error {
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(gvk)
+	err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, existing)
+	if client.IgnoreNotFound(err) != nil {
+		return fmt.Errorf("could not get %s: %w", gvk.Kind, err)
+	}
+	if err != nil {
+		created := &unstructured.Unstructured{}
+		created.SetGroupVersionKind(gvk)
+		created.SetNamespace(namespace)
+		created.SetName(name)
+		created.SetLabels(managedLabels())
+		created.SetAnnotations(managedAnnotations())
+		created.Object["spec"] = spec
+		if err := util.CreateObject(ctx, c, created); err != nil {
+			return fmt.Errorf("could not create %s: %w", gvk.Kind, err)
+		}
+		log.Infof("Created %s %s in namespace %s", gvk.Kind, name, namespace)
+		return nil
+	}
+
+	labels, annotations := managedLabels(), managedAnnotations()
+	if reflect.DeepEqual(existing.Object["spec"], spec) &&
+		containsStringMap(existing.GetLabels(), labels) && containsStringMap(existing.GetAnnotations(), annotations) {
+		return nil
+	}
+	existing.Object["spec"] = spec
+	existing.SetLabels(mergeStringMaps(existing.GetLabels(), labels))
+	existing.SetAnnotations(mergeStringMaps(existing.GetAnnotations(), annotations))
+	if err := util.UpdateObject(ctx, c, existing); err != nil {
+		return fmt.Errorf("could not update %s: %w", gvk.Kind, err)
+	}
+	log.Infof("Updated %s %s in namespace %s", gvk.Kind, name, namespace)
+	return nil
+}
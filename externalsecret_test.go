@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestExternalSecretOutput(t *testing.T) {
+	util := newKubeUtil()
+	cl := fake.NewClientBuilder().Build()
+	output, err := newExternalSecretOutput(util, cl, "namespace1", "registry-creds", time.Hour)
+	assert.Nil(t, err)
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "awsecr-cred"},
+		Data:       map[string][]byte{v1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+		Type:       v1.SecretTypeDockerConfigJson,
+	}
+	assert.Nil(t, output.write(context.TODO(), "namespace2", secret))
+
+	source, err := util.GetSecret(context.TODO(), "namespace1", "awsecr-cred")
+	assert.Nil(t, err)
+	assert.Equal(t, secret.Data, source.Data)
+
+	es := &unstructured.Unstructured{}
+	es.SetGroupVersionKind(externalSecretGVK)
+	assert.Nil(t, cl.Get(context.TODO(), types.NamespacedName{Namespace: "namespace2", Name: "awsecr-cred"}, es))
+	store, _, _ := unstructured.NestedString(es.Object, "spec", "secretStoreRef", "name")
+	assert.Equal(t, "registry-creds", store)
+	secretType, _, _ := unstructured.NestedString(es.Object, "spec", "target", "template", "type")
+	assert.Equal(t, string(v1.SecretTypeDockerConfigJson), secretType)
+
+	// a second write with the same data is a no-op, the source namespace gets no ExternalSecret
+	assert.Nil(t, output.write(context.TODO(), "namespace2", secret))
+	assert.Nil(t, output.write(context.TODO(), "namespace1", secret))
+	err = cl.Get(context.TODO(), types.NamespacedName{Namespace: "namespace1", Name: "awsecr-cred"}, es)
+	assert.NotNil(t, err)
+
+	_, err = newExternalSecretOutput(util, cl, "namespace1", "", time.Hour)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// initialSync tracks the namespaces synced since startup for --wait-for-initial-sync; once every managed namespace was
+// synced it stays done, later failures are the business of the status and metrics, not of the readiness probe
+type initialSync struct {
+	lock   sync.Mutex
+	synced map[string]bool
+	done   bool
+}
+
+func newInitialSync() *initialSync {
+	return &initialSync{synced: map[string]bool{}}
+}
+
+// record marks a namespace that got the secrets of all its providers
+func (s *initialSync) record(namespace string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.done {
+		s.synced[namespace] = true
+	}
+}
+
+// servesAll reports whether every provider has secrets to serve, so a namespace synced while one of them failed is not
+// counted as synced
+func (c *controller) servesAll(secretGenerators []SecretGenerator) bool {
+	for _, secretGenerator := range secretGenerators {
+		if c.servableSecrets(secretGenerator.SecretName, time.Now()) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// pending returns the managed namespaces not synced yet, nil once the initial sync is done
+func (s *initialSync) pending(c *controller, namespaces []v1.Namespace) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done {
+		return nil
+	}
+	var pending []string
+	for i := range namespaces {
+		ns := &namespaces[i]
+		if !ns.DeletionTimestamp.IsZero() || c.namespaceExcluded(ns) || systemNamespace(ns.Name) || s.synced[ns.Name] {
+			continue
+		}
+		pending = append(pending, ns.Name)
+	}
+	if len(pending) == 0 {
+		log.Infof("Initial sync of %d namespaces complete; reporting ready", len(s.synced))
+		s.done = true
+		s.synced = nil
+	}
+	return pending
+}
+
+// initialSyncCheck is the readiness check of --wait-for-initial-sync: it fails until every namespace that is not
+// excluded has been synced once. A standby replica of --leader-elect syncs nothing and is ready right away, the
+// elected one gates the rollout.
+func (c *controller) initialSyncCheck(reader client.Reader, elected <-chan struct{}) healthz.Checker {
+	return func(req *http.Request) error {
+		select {
+		case <-elected:
+		default:
+			return nil
+		}
+		namespaces := &v1.NamespaceList{}
+		if err := reader.List(context.Background(), namespaces); err != nil {
+			return fmt.Errorf("could not list namespaces: %w", err)
+		}
+		if pending := c.initialSync.pending(c, namespaces.Items); len(pending) > 0 {
+			return fmt.Errorf("%d namespaces not synced yet, e.g. %s", len(pending), pending[0])
+		}
+		return nil
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestInitialSyncCheck(t *testing.T) {
+	c := newFakeController()
+	c.k8sutil.ExcludedNamespaces = []string{"namespace2"}
+	c.initialSync = newInitialSync()
+	reader := fake.NewClientBuilder().WithObjects(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace2"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}},
+	).Build()
+	elected := make(chan struct{})
+	check := c.initialSyncCheck(reader, elected)
+	req := &http.Request{}
+
+	// a standby replica syncs nothing and does not hold up the rollout
+	assert.Nil(t, check(req))
+
+	close(elected)
+	assert.EqualError(t, check(req), "1 namespaces not synced yet, e.g. namespace1")
+
+	// the excluded namespace is never synced, and a sync without the secrets of every provider does not count
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	ecrClient := c.ecrClient
+	c.ecrClient = &fakeFailingEcrClient{}
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	assert.NotNil(t, check(req))
+
+	c.ecrClient = ecrClient
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	assert.Nil(t, check(req))
+
+	// once ready, new namespaces do not make the replica unready again
+	assert.Nil(t, reader.Create(context.TODO(), &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace3"}}))
+	assert.Nil(t, check(req))
+}
@@ -0,0 +1,214 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	"github.com/doddle/registry-creds/pkg/providers"
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+)
+
+// The integration tests run the controller against a real API server: envtest when KUBEBUILDER_ASSETS points at the
+// etcd and kube-apiserver binaries (setup-envtest use -p path), or the cluster of $KUBECONFIG, e.g. kind, with
+// USE_EXISTING_CLUSTER=true. Run them with: go test -tags integration -run Integration .
+
+var integrationConfig *rest.Config
+
+func TestMain(m *testing.M) {
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" && os.Getenv("USE_EXISTING_CLUSTER") != "true" {
+		os.Exit(m.Run())
+	}
+
+	env := &envtest.Environment{}
+	cfg, err := env.Start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not start the test API server: %s\n", err)
+		os.Exit(1)
+	}
+	integrationConfig = cfg
+
+	code := m.Run()
+	if err := env.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not stop the test API server: %s\n", err)
+	}
+	os.Exit(code)
+}
+
+// newIntegrationController returns a controller with the fake provider that talks to the test API server as cfg
+func newIntegrationController(t *testing.T, cfg *rest.Config) *controller {
+	if integrationConfig == nil {
+		t.Skip("set KUBEBUILDER_ASSETS or USE_EXISTING_CLUSTER=true to run the integration tests")
+	}
+	util, err := k8sutil.NewForConfig(cfg, nil, k8sutil.ClientOptions{Timeout: 10 * time.Second})
+	require.Nil(t, err)
+	c := newController(util, newFakeEcrClient())
+	c.fake = &providers.Fake{Registries: []string{"https://registry.example.com"}}
+	return c
+}
+
+// createIntegrationNamespace creates a namespace with a generated name and its default ServiceAccount, which envtest
+// does not create since it runs no controller-manager
+func createIntegrationNamespace(t *testing.T, c *controller) *v1.Namespace {
+	ctx := context.Background()
+	ns, err := c.k8sutil.Kclient.Namespaces().Create(ctx, &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "registry-creds-"},
+	}, metav1.CreateOptions{})
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		_ = c.k8sutil.Kclient.Namespaces().Delete(context.Background(), ns.Name, metav1.DeleteOptions{})
+	})
+
+	_, err = c.k8sutil.Kclient.ServiceAccounts(ns.Name).Create(ctx, &v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: defaultServiceAccount},
+	}, metav1.CreateOptions{})
+	if !k8sutil.IsAlreadyExists(err) {
+		require.Nil(t, err)
+	}
+	return ns
+}
+
+func assertIntegrationSynced(t *testing.T, c *controller, namespace string) {
+	secret, err := c.k8sutil.GetSecret(context.Background(), namespace, *argFakeSecretName)
+	if assert.Nil(t, err) {
+		assert.Equal(t, v1.SecretTypeDockerConfigJson, secret.Type)
+		assert.Contains(t, string(secret.Data[v1.DockerConfigJsonKey]), "https://registry.example.com")
+	}
+	sa, err := c.k8sutil.GetServiceAccount(context.Background(), namespace, defaultServiceAccount)
+	if assert.Nil(t, err) {
+		assert.True(t, secretsync.HasPullSecret(sa, *argFakeSecretName))
+	}
+}
+
+func TestIntegrationCreateAndUpdate(t *testing.T) {
+	c := newIntegrationController(t, integrationConfig)
+	ns := createIntegrationNamespace(t, c)
+	ctx := context.Background()
+
+	assert.Nil(t, handler(ctx, c, ns))
+	assertIntegrationSynced(t, c, ns.Name)
+
+	// a secret changed behind the controller's back is overwritten, and syncing again is idempotent
+	secret, err := c.k8sutil.GetSecret(ctx, ns.Name, *argFakeSecretName)
+	require.Nil(t, err)
+	secret.Data[v1.DockerConfigJsonKey] = []byte(`{"auths":{}}`)
+	require.Nil(t, c.k8sutil.UpdateSecret(ctx, ns.Name, secret))
+
+	assert.Nil(t, handler(ctx, c, ns))
+	assert.Nil(t, handler(ctx, c, ns))
+	assertIntegrationSynced(t, c, ns.Name)
+	sa, err := c.k8sutil.GetServiceAccount(ctx, ns.Name, defaultServiceAccount)
+	require.Nil(t, err)
+	assert.Len(t, sa.ImagePullSecrets, 1)
+}
+
+// conflictingServiceAccounts changes the ServiceAccount between the controller's read and its first update
+type conflictingServiceAccounts struct {
+	*k8sutil.KubeUtilInterface
+	conflicted bool
+}
+
+func (c *conflictingServiceAccounts) UpdateServiceAccount(ctx context.Context, namespace string, sa *v1.ServiceAccount) error {
+	if !c.conflicted {
+		c.conflicted = true
+		other, err := c.GetServiceAccount(ctx, namespace, sa.Name)
+		if err != nil {
+			return err
+		}
+		other.Labels = map[string]string{"changed": "true"}
+		if err := c.KubeUtilInterface.UpdateServiceAccount(ctx, namespace, other); err != nil {
+			return err
+		}
+	}
+	return c.KubeUtilInterface.UpdateServiceAccount(ctx, namespace, sa)
+}
+
+func TestIntegrationServiceAccountConflict(t *testing.T) {
+	c := newIntegrationController(t, integrationConfig)
+	ns := createIntegrationNamespace(t, c)
+	client := &conflictingServiceAccounts{KubeUtilInterface: c.k8sutil}
+
+	err := secretsync.AttachToServiceAccount(context.Background(), client, ns.Name, defaultServiceAccount,
+		"creds", []string{"creds"}, secretsync.PullSecretOptions{Order: secretsync.OrderKeep})
+	assert.Nil(t, err)
+	assert.True(t, client.conflicted)
+
+	sa, err := c.k8sutil.GetServiceAccount(context.Background(), ns.Name, defaultServiceAccount)
+	require.Nil(t, err)
+	assert.True(t, secretsync.HasPullSecret(sa, "creds"))
+	assert.Equal(t, "true", sa.Labels["changed"])
+}
+
+func TestIntegrationForbidden(t *testing.T) {
+	admin := newIntegrationController(t, integrationConfig)
+	ns := createIntegrationNamespace(t, admin)
+
+	// a user without any RBAC bindings
+	cfg := rest.CopyConfig(integrationConfig)
+	cfg.Impersonate = rest.ImpersonationConfig{UserName: "registry-creds-unprivileged"}
+	c := newIntegrationController(t, cfg)
+
+	err := handler(context.Background(), c, ns)
+	assert.True(t, k8sutil.IsForbidden(err), "unexpected error %v", err)
+	_, err = admin.k8sutil.GetSecret(context.Background(), ns.Name, *argFakeSecretName)
+	assert.True(t, k8sutil.IsNotFound(err))
+
+	for _, result := range checkPermissions(context.Background(), c.k8sutil) {
+		assert.NotNil(t, result.Err, result.Name)
+	}
+}
+
+func TestIntegrationReconciler(t *testing.T) {
+	c := newIntegrationController(t, integrationConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mgr, err := ctrl.NewManager(integrationConfig, ctrl.Options{MetricsBindAddress: "0"})
+	require.Nil(t, err)
+	c.k8sutil.Cache = mgr.GetCache()
+	require.Nil(t, c.setupReconciler(mgr))
+	go func() {
+		_ = mgr.Start(ctx)
+	}()
+
+	// a new namespace is picked up by the informer
+	ns := createIntegrationNamespace(t, newIntegrationController(t, integrationConfig))
+	assert.Eventually(t, func() bool {
+		_, err := c.k8sutil.GetSecret(ctx, ns.Name, *argFakeSecretName)
+		return err == nil
+	}, 30*time.Second, 100*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		sa, err := c.k8sutil.GetServiceAccount(ctx, ns.Name, defaultServiceAccount)
+		return err == nil && secretsync.HasPullSecret(sa, *argFakeSecretName)
+	}, 30*time.Second, 100*time.Millisecond)
+
+	// a deleted managed secret is recreated
+	require.Nil(t, c.k8sutil.DeleteSecret(ctx, ns.Name, *argFakeSecretName))
+	assert.Eventually(t, func() bool {
+		_, err := c.k8sutil.GetSecret(ctx, ns.Name, *argFakeSecretName)
+		return err == nil
+	}, 30*time.Second, 100*time.Millisecond)
+
+	// a ServiceAccount that lost its pull secret gets it back
+	sa, err := c.k8sutil.GetServiceAccount(ctx, ns.Name, defaultServiceAccount)
+	require.Nil(t, err)
+	sa.ImagePullSecrets = nil
+	require.Nil(t, c.k8sutil.UpdateServiceAccount(ctx, ns.Name, sa))
+	assert.Eventually(t, func() bool {
+		sa, err := c.k8sutil.GetServiceAccount(ctx, ns.Name, defaultServiceAccount)
+		return err == nil && secretsync.HasPullSecret(sa, *argFakeSecretName)
+	}, 30*time.Second, 100*time.Millisecond)
+}
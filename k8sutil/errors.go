@@ -0,0 +1,56 @@
+package k8sutil
+
+import (
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Error describes a failed Kubernetes API call; the API status error is kept so callers can branch on it with
+// IsNotFound, IsConflict, IsAlreadyExists and IsForbidden
+type Error struct {
+	Verb      string
+	Resource  string
+	Namespace string
+	Name      string
+	Err       error
+}
+
+func newError(verb, resource, namespace, name string, err error) *Error {
+	return &Error{Verb: verb, Resource: resource, Namespace: namespace, Name: name, Err: err}
+}
+
+func (e *Error) Error() string {
+	target := e.Resource
+	if e.Name != "" {
+		target += " " + e.Name
+	}
+	if e.Namespace != "" {
+		target += " in namespace " + e.Namespace
+	}
+	return fmt.Sprintf("could not %s %s: %v", e.Verb, target, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsNotFound reports whether the object does not exist
+func IsNotFound(err error) bool {
+	return apierrors.IsNotFound(err)
+}
+
+// IsAlreadyExists reports whether a create failed because the object exists already
+func IsAlreadyExists(err error) bool {
+	return apierrors.IsAlreadyExists(err)
+}
+
+// IsConflict reports whether an update was based on an outdated version of the object
+func IsConflict(err error) bool {
+	return apierrors.IsConflict(err)
+}
+
+// IsForbidden reports whether RBAC denied the call
+func IsForbidden(err error) bool {
+	return apierrors.IsForbidden(err)
+}
@@ -2,22 +2,31 @@ package k8sutil
 
 import (
 	"context"
-	"k8s.io/apimachinery/pkg/fields"
+	"encoding/json"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"fmt"
 	"github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	authorizationType "k8s.io/client-go/kubernetes/typed/authorization/v1"
 	coreType "k8s.io/client-go/kubernetes/typed/core/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth" // allow support for all auth types for users running this locally
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/client-go/util/homedir"
 	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 // KubeInterface abstracts the k8s api
@@ -25,17 +34,58 @@ type KubeInterface interface {
 	Secrets(namespace string) coreType.SecretInterface
 	Namespaces() coreType.NamespaceInterface
 	ServiceAccounts(namespace string) coreType.ServiceAccountInterface
-	Core() coreType.CoreV1Interface
+	ConfigMaps(namespace string) coreType.ConfigMapInterface
+	Pods(namespace string) coreType.PodInterface
+	SelfSubjectAccessReviews() authorizationType.SelfSubjectAccessReviewInterface
 }
 
 type KubeUtilInterface struct {
 	Kclient            KubeInterface
 	ExcludedNamespaces []string
+
+	// Timeout bounds every call, including reads from Cache; zero means no timeout
+	Timeout time.Duration
+
+	// WriteLimiter, if set, throttles every create, update and delete so a refresh of many namespaces cannot starve the API server
+	WriteLimiter flowcontrol.RateLimiter
+
+	// Throttle, if set, backs off and retries the writes the API server answers with 429 Too Many Requests
+	Throttle *Throttle
+
+	// WriteRetry, if set, retries the writes that fail with a transient error
+	WriteRetry *WriteRetry
+
+	// Cache, if set, serves namespace, ServiceAccount and secret existence reads from the shared informer cache instead of the API server
+	Cache client.Reader
+}
+
+// ClientOptions tunes the rate limits and timeouts of the Kubernetes client
+type ClientOptions struct {
+	// QPS and Burst override the client-go rate limiter defaults when positive
+	QPS   float32
+	Burst int
+	// RateLimiter, if set, replaces the token bucket of QPS and Burst, so several clients can share one, see
+	// NewRateLimiter
+	RateLimiter flowcontrol.RateLimiter
+	// Timeout bounds every request of the client returned by New; watches use NewRestConfig, which has no timeout
+	Timeout time.Duration
+	// Throttle, if set, is shared by the writes of the KubeUtilInterface and reports the client-side rate limiting
+	Throttle *Throttle
+	// WriteRetry, if set, retries the writes of the KubeUtilInterface that fail with a transient error
+	WriteRetry *WriteRetry
+	// UserAgent, if set, replaces the client-go default so audit logs can attribute the requests
+	UserAgent string
+	// APIServerHost and APIServerPort, if set, replace the host and port of the API server found by NewRestConfig, for
+	// networks where the address of KUBERNETES_SERVICE_HOST is not reachable; IPv6 addresses may be bracketed or not
+	APIServerHost string
+	APIServerPort int
+	// TLSServerName, if set, is sent with SNI and checked against the API server certificate instead of the host
+	TLSServerName string
 }
 
 // New creates a new instance of k8sutil
-func New(excludedNamespaces []string) (*KubeUtilInterface, error) {
-	client, err := newKubeClient()
+func New(excludedNamespaces []string, opts ClientOptions) (*KubeUtilInterface, error) {
+	client, err := newKubeClient(opts)
 
 	if err != nil {
 		logrus.Fatalf("Could not init Kubernetes client! [%s]", err)
@@ -44,11 +94,30 @@ func New(excludedNamespaces []string) (*KubeUtilInterface, error) {
 	k := &KubeUtilInterface{
 		Kclient:            client,
 		ExcludedNamespaces: excludedNamespaces,
+		Timeout:            opts.Timeout,
+		Throttle:           opts.Throttle,
+		WriteRetry:         opts.WriteRetry,
 	}
 
 	return k, nil
 }
 
+// NewForConfig creates a new instance of k8sutil talking to the cluster of cfg, e.g. a test API server
+func NewForConfig(cfg *rest.Config, excludedNamespaces []string, opts ClientOptions) (*KubeUtilInterface, error) {
+	client, err := newKubeClientForConfig(rest.CopyConfig(cfg), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KubeUtilInterface{
+		Kclient:            client,
+		ExcludedNamespaces: excludedNamespaces,
+		Timeout:            opts.Timeout,
+		Throttle:           opts.Throttle,
+		WriteRetry:         opts.WriteRetry,
+	}, nil
+}
+
 func envVarExists(key string) bool {
 	_, exists := os.LookupEnv(key)
 	return exists
@@ -81,143 +150,493 @@ func (f LegacyInterfaceWrapper) ServiceAccounts(namespace string) coreType.Servi
 	return f.CoreV1().ServiceAccounts(namespace)
 }
 
-func (f LegacyInterfaceWrapper) Core() coreType.CoreV1Interface {
-	return f.CoreV1()
+func (f LegacyInterfaceWrapper) ConfigMaps(namespace string) coreType.ConfigMapInterface {
+	return f.CoreV1().ConfigMaps(namespace)
 }
 
-func newKubeClient() (KubeInterface, error) {
-	var client *kubernetes.Clientset
+func (f LegacyInterfaceWrapper) Pods(namespace string) coreType.PodInterface {
+	return f.CoreV1().Pods(namespace)
+}
+
+func (f LegacyInterfaceWrapper) SelfSubjectAccessReviews() authorizationType.SelfSubjectAccessReviewInterface {
+	return f.AuthorizationV1().SelfSubjectAccessReviews()
+}
+
+// NewRestConfig returns the config of the cluster the controller runs in, or else of $KUBECONFIG, with the rate limits of opts;
+// it carries no request timeout so it can be used for long-running watches
+func NewRestConfig(opts ClientOptions) (*rest.Config, error) {
+	var cfg *rest.Config
+	var err error
 
 	// we will automatically decide if this is running inside the cluster or on someones laptop
 	// if the ENV vars KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT exist
 	// then we can assume this app is running inside a k8s cluster
 	if envVarExists("KUBERNETES_SERVICE_HOST") && envVarExists("KUBERNETES_SERVICE_PORT") {
 		logrus.Info("Using InCluster k8s config")
-		cfg, err := rest.InClusterConfig()
-
-		if err != nil {
-			return nil, err
-		}
-
-		client, err = kubernetes.NewForConfig(cfg)
+		cfg, err = rest.InClusterConfig()
 
 		if err != nil {
 			return nil, err
 		}
 	} else {
 		logrus.Infof("using KUBECONFIG to determine your kubernetes connection")
-		cfg, err := clientcmd.BuildConfigFromFlags("", findKubeConfig())
+		cfg, err = clientcmd.BuildConfigFromFlags("", findKubeConfig())
 
 		if err != nil {
 			logrus.Error("Got error trying to create client: ", err)
 			return nil, err
 		}
+	}
 
-		client, err = kubernetes.NewForConfig(cfg)
+	if opts.QPS > 0 {
+		cfg.QPS = opts.QPS
+	}
+	if opts.Burst > 0 {
+		cfg.Burst = opts.Burst
+	}
+	if opts.RateLimiter != nil {
+		cfg.RateLimiter = opts.RateLimiter
+	}
+	if opts.UserAgent != "" {
+		cfg.UserAgent = opts.UserAgent
+	}
+	if err := overrideAPIServer(cfg, opts); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
 
-		if err != nil {
-			return nil, err
+// overrideAPIServer points cfg at the APIServerHost and APIServerPort of opts, keeping the scheme and whichever of the
+// two is not overridden, and sets the TLSServerName
+func overrideAPIServer(cfg *rest.Config, opts ClientOptions) error {
+	if opts.TLSServerName != "" {
+		cfg.TLSClientConfig.ServerName = opts.TLSServerName
+	}
+	if opts.APIServerHost == "" && opts.APIServerPort == 0 {
+		return nil
+	}
+
+	address := cfg.Host
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+	server, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("could not parse the API server address %q: %w", cfg.Host, err)
+	}
+	host, port := server.Hostname(), server.Port()
+	if port == "" {
+		port = "443"
+		if server.Scheme == "http" {
+			port = "80"
 		}
 	}
+	if opts.APIServerHost != "" {
+		host = strings.TrimSuffix(strings.TrimPrefix(opts.APIServerHost, "["), "]")
+	}
+	if opts.APIServerPort != 0 {
+		port = strconv.Itoa(opts.APIServerPort)
+	}
+	// JoinHostPort brackets IPv6 addresses
+	server.Host = net.JoinHostPort(host, port)
+	cfg.Host = server.String()
+	logrus.Infof("Using the API server at %s", cfg.Host)
+	return nil
+}
+
+func newKubeClient(opts ClientOptions) (KubeInterface, error) {
+	cfg, err := NewRestConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return newKubeClientForConfig(cfg, opts)
+}
+
+func newKubeClientForConfig(cfg *rest.Config, opts ClientOptions) (KubeInterface, error) {
+	if opts.QPS > 0 {
+		cfg.QPS = opts.QPS
+	}
+	if opts.Burst > 0 {
+		cfg.Burst = opts.Burst
+	}
+	if opts.UserAgent != "" {
+		cfg.UserAgent = opts.UserAgent
+	}
+	cfg.Timeout = opts.Timeout
+	if opts.RateLimiter != nil {
+		cfg.RateLimiter = opts.RateLimiter
+	} else if opts.Throttle != nil {
+		// the limits of cfg, which opts only override when set
+		limits := opts
+		limits.QPS, limits.Burst = cfg.QPS, cfg.Burst
+		cfg.RateLimiter = NewRateLimiter(limits)
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	return LegacyInterfaceWrapper{
-		client,
+		Clientset: client,
 	}, nil
 }
 
+// NewRateLimiter returns the token bucket of opts' QPS and Burst, or the client-go defaults, reporting the requests it
+// holds back to opts' Throttle. Passed as RateLimiter to several clients, it caps their requests together.
+func NewRateLimiter(opts ClientOptions) flowcontrol.RateLimiter {
+	qps, burst := opts.QPS, opts.Burst
+	if qps <= 0 {
+		qps = rest.DefaultQPS
+	}
+	if burst <= 0 {
+		burst = rest.DefaultBurst
+	}
+	limiter := flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+	if opts.Throttle == nil {
+		return limiter
+	}
+	return opts.Throttle.RateLimiter(limiter)
+}
+
+// waitForWrite blocks until the Throttle and the WriteLimiter admit another write, or ctx is done
+func (k *KubeUtilInterface) waitForWrite(ctx context.Context) error {
+	if err := k.Throttle.wait(ctx); err != nil {
+		return err
+	}
+	if k.WriteLimiter == nil {
+		return nil
+	}
+	return k.WriteLimiter.Wait(ctx)
+}
+
+// withTimeout derives the context of a single call
+func (k *KubeUtilInterface) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if k.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, k.Timeout)
+}
+
 // GetNamespaces returns all namespaces
-func (k *KubeUtilInterface) GetNamespaces() (*v1.NamespaceList, error) {
-	namespaces, err := k.Kclient.Namespaces().List(context.TODO(), metav1.ListOptions{})
+func (k *KubeUtilInterface) GetNamespaces(ctx context.Context) (*v1.NamespaceList, error) {
+	ctx, cancel := k.withTimeout(ctx)
+	defer cancel()
+
+	if k.Cache != nil {
+		namespaces := &v1.NamespaceList{}
+		if err := k.Cache.List(ctx, namespaces); err != nil {
+			logrus.Error("Error getting namespaces: ", err)
+			return nil, newError("list", "namespaces", "", "", err)
+		}
+		return namespaces, nil
+	}
+
+	namespaces, err := k.Kclient.Namespaces().List(ctx, metav1.ListOptions{})
 	if err != nil {
 		logrus.Error("Error getting namespaces: ", err)
-		return nil, err
+		return nil, newError("list", "namespaces", "", "", err)
 	}
 
 	return namespaces, nil
 }
 
+// AnnotateNamespace sets an annotation of a namespace with a merge patch; an empty value removes it
+func (k *KubeUtilInterface) AnnotateNamespace(ctx context.Context, name, key, value string) error {
+	var annotation interface{}
+	if value != "" {
+		annotation = value
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{key: annotation}},
+	})
+	if err != nil {
+		return newError("annotate", "namespace", "", name, err)
+	}
+	err = k.write(ctx, func(ctx context.Context) error {
+		_, err := k.Kclient.Namespaces().Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+	if err != nil {
+		logrus.Error("Error annotating namespace: ", err)
+		return newError("annotate", "namespace", "", name, err)
+	}
+	return nil
+}
+
+// ListPods returns the pods of a namespace; pods are never read from Cache, which does not watch them
+func (k *KubeUtilInterface) ListPods(ctx context.Context, namespace string) (*v1.PodList, error) {
+	ctx, cancel := k.withTimeout(ctx)
+	defer cancel()
+
+	pods, err := k.Kclient.Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		logrus.Error("Error listing pods: ", err)
+		return nil, newError("list", "pods", namespace, "", err)
+	}
+
+	return pods, nil
+}
+
+// ListPodsMatching returns the pods matching a label selector in a namespace, or in all namespaces if it is empty
+func (k *KubeUtilInterface) ListPodsMatching(ctx context.Context, namespace, selector string) (*v1.PodList, error) {
+	ctx, cancel := k.withTimeout(ctx)
+	defer cancel()
+
+	pods, err := k.Kclient.Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		logrus.Error("Error listing pods: ", err)
+		return nil, newError("list", "pods", namespace, "", err)
+	}
+
+	return pods, nil
+}
+
 // GetSecret get a secret
-func (k *KubeUtilInterface) GetSecret(namespace, name string) (*v1.Secret, error) {
-	secret, err := k.Kclient.Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+func (k *KubeUtilInterface) GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	ctx, cancel := k.withTimeout(ctx)
+	defer cancel()
+
+	secret, err := k.Kclient.Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
 		logrus.Error("Error getting secret: ", err)
-		return nil, err
+		return nil, newError("get", "secret", namespace, name, err)
 	}
 
 	return secret, nil
 }
 
-// CreateSecret creates a secret
-func (k *KubeUtilInterface) CreateSecret(namespace string, secret *v1.Secret) error {
-	_, err := k.Kclient.Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+// GetSecretMetadata returns a secret without its data, reading only the metadata from the cache when there is one
+func (k *KubeUtilInterface) GetSecretMetadata(ctx context.Context, namespace, name string) (*metav1.PartialObjectMetadata, error) {
+	ctx, cancel := k.withTimeout(ctx)
+	defer cancel()
 
+	secret := &metav1.PartialObjectMetadata{}
+	secret.SetGroupVersionKind(v1.SchemeGroupVersion.WithKind("Secret"))
+	if k.Cache != nil {
+		if err := k.Cache.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, secret); err != nil {
+			return nil, newError("get", "secret", namespace, name, err)
+		}
+		return secret, nil
+	}
+	full, err := k.Kclient.Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
-		logrus.Error("Error creating secret: ", err)
+		return nil, newError("get", "secret", namespace, name, err)
+	}
+	secret.ObjectMeta = full.ObjectMeta
+	return secret, nil
+}
+
+// SecretExists checks whether a secret exists, using only its metadata when reading from the cache
+func (k *KubeUtilInterface) SecretExists(ctx context.Context, namespace, name string) (bool, error) {
+	ctx, cancel := k.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	if k.Cache != nil {
+		secret := &metav1.PartialObjectMetadata{}
+		secret.SetGroupVersionKind(v1.SchemeGroupVersion.WithKind("Secret"))
+		err = k.Cache.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, secret)
+	} else {
+		_, err = k.Kclient.Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		logrus.Error("Error getting secret: ", err)
+		return false, newError("get", "secret", namespace, name, err)
+	}
+	return true, nil
+}
+
+// CreateObject creates obj through c, e.g. the controller manager's client for custom resources, subject to the same
+// write limit, throttling and retries as the other writes
+func (k *KubeUtilInterface) CreateObject(ctx context.Context, c client.Client, obj client.Object) error {
+	return k.write(ctx, func(ctx context.Context) error {
+		return c.Create(ctx, obj)
+	})
+}
+
+// UpdateObject updates obj through c like CreateObject
+func (k *KubeUtilInterface) UpdateObject(ctx context.Context, c client.Client, obj client.Object) error {
+	return k.write(ctx, func(ctx context.Context) error {
+		return c.Update(ctx, obj)
+	})
+}
+
+// CreateSecret creates a secret
+func (k *KubeUtilInterface) CreateSecret(ctx context.Context, namespace string, secret *v1.Secret) error {
+	err := k.write(ctx, func(ctx context.Context) error {
+		_, err := k.Kclient.Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
 		return err
+	})
+	if err != nil {
+		logrus.Error("Error creating secret: ", err)
+		return newError("create", "secret", namespace, secret.Name, err)
 	}
 
 	return nil
 }
 
 // UpdateSecret updates a secret
-func (k *KubeUtilInterface) UpdateSecret(namespace string, secret *v1.Secret) error {
-	_, err := k.Kclient.Secrets(namespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
-
+func (k *KubeUtilInterface) UpdateSecret(ctx context.Context, namespace string, secret *v1.Secret) error {
+	err := k.write(ctx, func(ctx context.Context) error {
+		_, err := k.Kclient.Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
 	if err != nil {
 		logrus.Error("Error updating secret: ", err)
-		return err
+		return newError("update", "secret", namespace, secret.Name, err)
 	}
 
 	return nil
 }
 
-// GetServiceAccount updates a secret
-func (k *KubeUtilInterface) GetServiceAccount(namespace, name string) (*v1.ServiceAccount, error) {
-	sa, err := k.Kclient.ServiceAccounts(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+// DeleteSecret deletes a secret
+func (k *KubeUtilInterface) DeleteSecret(ctx context.Context, namespace, name string) error {
+	err := k.write(ctx, func(ctx context.Context) error {
+		return k.Kclient.Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	})
+	if err != nil {
+		logrus.Error("Error deleting secret: ", err)
+		return newError("delete", "secret", namespace, name, err)
+	}
+
+	return nil
+}
+
+// GetServiceAccount gets a service account; the result may be modified by the caller, also when read from the cache
+func (k *KubeUtilInterface) GetServiceAccount(ctx context.Context, namespace, name string) (*v1.ServiceAccount, error) {
+	ctx, cancel := k.withTimeout(ctx)
+	defer cancel()
+
+	if k.Cache != nil {
+		sa := &v1.ServiceAccount{}
+		if err := k.Cache.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, sa); err != nil {
+			logrus.Error("Error getting service account: ", err)
+			return nil, newError("get", "service account", namespace, name, err)
+		}
+		return sa, nil
+	}
+
+	sa, err := k.Kclient.ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
 
 	if err != nil {
 		logrus.Error("Error getting service account: ", err)
-		return nil, err
+		return nil, newError("get", "service account", namespace, name, err)
 	}
 
 	return sa, nil
 }
 
-// UpdateServiceAccount updates a secret
-func (k *KubeUtilInterface) UpdateServiceAccount(namespace string, sa *v1.ServiceAccount) error {
-	_, err := k.Kclient.ServiceAccounts(namespace).Update(context.TODO(), sa, metav1.UpdateOptions{})
+// CreateServiceAccount creates a service account
+func (k *KubeUtilInterface) CreateServiceAccount(ctx context.Context, namespace string, sa *v1.ServiceAccount) error {
+	err := k.write(ctx, func(ctx context.Context) error {
+		_, err := k.Kclient.ServiceAccounts(namespace).Create(ctx, sa, metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		logrus.Error("Error creating service account: ", err)
+		return newError("create", "service account", namespace, sa.Name, err)
+	}
 
+	return nil
+}
+
+// UpdateServiceAccount updates a service account
+func (k *KubeUtilInterface) UpdateServiceAccount(ctx context.Context, namespace string, sa *v1.ServiceAccount) error {
+	err := k.write(ctx, func(ctx context.Context) error {
+		_, err := k.Kclient.ServiceAccounts(namespace).Update(ctx, sa, metav1.UpdateOptions{})
+		return err
+	})
 	if err != nil {
 		logrus.Error("Error updating service account: ", err)
+		return newError("update", "service account", namespace, sa.Name, err)
+	}
+
+	return nil
+}
+
+// CreateServiceAccountToken requests a token of the service account for audience through the TokenRequest API,
+// valid for expiration; the token is not bound to a Pod or Secret
+func (k *KubeUtilInterface) CreateServiceAccountToken(ctx context.Context, namespace, name, audience string, expiration time.Duration) (*authenticationv1.TokenRequestStatus, error) {
+	ctx, cancel := k.withTimeout(ctx)
+	defer cancel()
+
+	seconds := int64(expiration.Seconds())
+	request := &authenticationv1.TokenRequest{Spec: authenticationv1.TokenRequestSpec{
+		Audiences:         []string{audience},
+		ExpirationSeconds: &seconds,
+	}}
+	result, err := k.Kclient.ServiceAccounts(namespace).CreateToken(ctx, name, request, metav1.CreateOptions{})
+	if err != nil {
+		logrus.Error("Error requesting service account token: ", err)
+		return nil, newError("create token for", "service account", namespace, name, err)
+	}
+	return &result.Status, nil
+}
+
+// GetConfigMap gets a config map
+func (k *KubeUtilInterface) GetConfigMap(ctx context.Context, namespace, name string) (*v1.ConfigMap, error) {
+	ctx, cancel := k.withTimeout(ctx)
+	defer cancel()
+
+	cm, err := k.Kclient.ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		logrus.Error("Error getting config map: ", err)
+		return nil, newError("get", "config map", namespace, name, err)
+	}
+
+	return cm, nil
+}
+
+// CreateConfigMap creates a config map
+func (k *KubeUtilInterface) CreateConfigMap(ctx context.Context, namespace string, cm *v1.ConfigMap) error {
+	err := k.write(ctx, func(ctx context.Context) error {
+		_, err := k.Kclient.ConfigMaps(namespace).Create(ctx, cm, metav1.CreateOptions{})
 		return err
+	})
+	if err != nil {
+		logrus.Error("Error creating config map: ", err)
+		return newError("create", "config map", namespace, cm.Name, err)
 	}
 
 	return nil
 }
 
-func (k *KubeUtilInterface) WatchNamespaces(resyncPeriod time.Duration, handler func(*v1.Namespace) error) {
-	stopC := make(chan struct{})
-	_, c := cache.NewInformer(
-		cache.NewListWatchFromClient(
-			k.Kclient.Core().RESTClient(),
-			"namespaces",
-			v1.NamespaceAll,
-			fields.Everything(),
-		),
-		&v1.Namespace{},
-		resyncPeriod,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				if err := handler(obj.(*v1.Namespace)); err != nil {
-					logrus.Fatal(err)
-				}
-			},
-			UpdateFunc: func(_ interface{}, obj interface{}) {
-				if err := handler(obj.(*v1.Namespace)); err != nil {
-					logrus.Fatal(err)
-				}
+// UpdateConfigMap updates a config map
+func (k *KubeUtilInterface) UpdateConfigMap(ctx context.Context, namespace string, cm *v1.ConfigMap) error {
+	err := k.write(ctx, func(ctx context.Context) error {
+		_, err := k.Kclient.ConfigMaps(namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		logrus.Error("Error updating config map: ", err)
+		return newError("update", "config map", namespace, cm.Name, err)
+	}
+
+	return nil
+}
+
+// CanI checks whether the controller's identity may perform verb on resource in namespace (empty for all namespaces)
+func (k *KubeUtilInterface) CanI(ctx context.Context, verb, resource, namespace string) (bool, error) {
+	ctx, cancel := k.withTimeout(ctx)
+	defer cancel()
+
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Resource:  resource,
 			},
 		},
-	)
-	c.Run(stopC)
+	}
+	result, err := k.Kclient.SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		logrus.Error("Error creating self subject access review: ", err)
+		return false, newError("create", "selfsubjectaccessreview", "", "", err)
+	}
+
+	return result.Status.Allowed, nil
 }
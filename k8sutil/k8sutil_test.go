@@ -0,0 +1,50 @@
+package k8sutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/rest"
+)
+
+func TestOverrideAPIServer(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		host string
+		opts ClientOptions
+		want string
+	}{
+		{name: "no override", host: "https://10.96.0.1:443", want: "https://10.96.0.1:443"},
+		{name: "IPv6 host keeps the port", host: "https://10.96.0.1:443", opts: ClientOptions{APIServerHost: "fd00::1"}, want: "https://[fd00::1]:443"},
+		{name: "bracketed IPv6 host", host: "https://[fd00::1]:6443", opts: ClientOptions{APIServerHost: "[fd00::2]"}, want: "https://[fd00::2]:6443"},
+		{name: "port keeps the IPv6 host", host: "https://[fd00::1]:443", opts: ClientOptions{APIServerPort: 6443}, want: "https://[fd00::1]:6443"},
+		{name: "kubeconfig server without port", host: "https://api.example.com", opts: ClientOptions{APIServerHost: "10.0.0.10"}, want: "https://10.0.0.10:443"},
+		{name: "server without scheme", host: "api.example.com:6443", opts: ClientOptions{APIServerHost: "api.internal"}, want: "https://api.internal:6443"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &rest.Config{Host: tc.host}
+			assert.Nil(t, overrideAPIServer(cfg, tc.opts))
+			assert.Equal(t, tc.want, cfg.Host)
+		})
+	}
+}
+
+func TestOverrideAPIServerTLSServerName(t *testing.T) {
+	cfg := &rest.Config{Host: "https://10.96.0.1:443", TLSClientConfig: rest.TLSClientConfig{CAFile: "/ca.crt"}}
+	assert.Nil(t, overrideAPIServer(cfg, ClientOptions{APIServerHost: "fd00::1", TLSServerName: "kubernetes.default.svc"}))
+	assert.Equal(t, "kubernetes.default.svc", cfg.TLSClientConfig.ServerName)
+	assert.Equal(t, "/ca.crt", cfg.TLSClientConfig.CAFile)
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	assert.Equal(t, rest.DefaultQPS, NewRateLimiter(ClientOptions{}).QPS())
+	assert.Equal(t, float32(50), NewRateLimiter(ClientOptions{QPS: 50, Burst: 100}).QPS())
+
+	// a shared limiter is used as is, whatever the QPS of the client
+	limiter := NewRateLimiter(ClientOptions{QPS: 20, Throttle: &Throttle{}})
+	cfg := &rest.Config{Host: "https://10.96.0.1:443"}
+	_, err := newKubeClientForConfig(cfg, ClientOptions{QPS: 100, RateLimiter: limiter})
+	assert.Nil(t, err)
+	assert.Same(t, limiter, cfg.RateLimiter)
+	assert.Equal(t, float32(20), cfg.RateLimiter.QPS())
+}
@@ -0,0 +1,74 @@
+package k8sutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+)
+
+// WriteRetry retries the writes that fail with a transient error, e.g. a timed out call or an API server that is
+// restarting, with a backoff of its own; writes throttled with 429 Too Many Requests are retried by Throttle instead
+type WriteRetry struct {
+	// Retries is how often a failed write is retried before its error is returned
+	Retries int
+	// InitialBackoff is the wait before the first retry, doubling with every further one up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// OnRetry, if set, is called for every retried write with the error it failed with
+	OnRetry func(err error)
+}
+
+// IsTransient reports whether a write failed in a way that a retry of the same request may succeed: a server error,
+// a timeout or a broken connection. Rejected requests, such as conflicts or RBAC denials, fail again.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		return status.Status().Code >= 500 || apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err)
+	}
+	if errors.Is(err, context.DeadlineExceeded) || utilnet.IsConnectionReset(err) || utilnet.IsConnectionRefused(err) || utilnet.IsProbableEOF(err) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retry reports whether the write that failed with err for the retries-th time is retried, after waiting for its
+// backoff; it is not once ctx is done
+func (r *WriteRetry) retry(ctx context.Context, err error, retries int) bool {
+	if r == nil || retries >= r.Retries || ctx.Err() != nil || !IsTransient(err) {
+		return false
+	}
+	delay := r.backoff(retries)
+	logrus.Warnf("Kubernetes write failed, retrying in %s: %s", delay, err)
+	if r.OnRetry != nil {
+		r.OnRetry(err)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// backoff returns the wait before the retry following the given number of earlier ones
+func (r *WriteRetry) backoff(retries int) time.Duration {
+	delay := r.InitialBackoff
+	for i := 0; i < retries && (r.MaxBackoff <= 0 || delay < r.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if r.MaxBackoff > 0 && delay > r.MaxBackoff {
+		delay = r.MaxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,65 @@
+package k8sutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestIsTransient(t *testing.T) {
+	secrets := schema.GroupResource{Resource: "secrets"}
+	for _, err := range []error{
+		apierrors.NewInternalError(errors.New("etcdserver: leader changed")),
+		apierrors.NewServiceUnavailable("apiserver is shutting down"),
+		apierrors.NewServerTimeout(secrets, "create", 1),
+		apierrors.NewTimeoutError("request did not complete", 1),
+		apierrors.NewGenericServerResponse(502, "create", secrets, "awsecr-cred", "bad gateway", 0, true),
+		context.DeadlineExceeded,
+		fmt.Errorf("post: %w", syscall.ECONNREFUSED),
+		fmt.Errorf("post: %w", syscall.ECONNRESET),
+		newError("create", "secret", "namespace1", "awsecr-cred", apierrors.NewServiceUnavailable("unavailable")),
+	} {
+		assert.True(t, IsTransient(err), err.Error())
+	}
+	for _, err := range []error{
+		nil,
+		apierrors.NewConflict(secrets, "awsecr-cred", errors.New("the object has been modified")),
+		apierrors.NewForbidden(secrets, "awsecr-cred", errors.New("RBAC")),
+		apierrors.NewAlreadyExists(secrets, "awsecr-cred"),
+		apierrors.NewInvalid(schema.GroupKind{Kind: "Secret"}, "awsecr-cred", nil),
+		context.Canceled,
+	} {
+		assert.False(t, IsTransient(err), fmt.Sprint(err))
+	}
+}
+
+func TestWriteRetryBackoff(t *testing.T) {
+	r := &WriteRetry{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	var delays []time.Duration
+	for retries := 0; retries < 5; retries++ {
+		delays = append(delays, r.backoff(retries))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, delays)
+}
+
+func TestWriteRetryStops(t *testing.T) {
+	unavailable := apierrors.NewServiceUnavailable("unavailable")
+	var retried []error
+	r := &WriteRetry{Retries: 1, InitialBackoff: time.Millisecond, OnRetry: func(err error) { retried = append(retried, err) }}
+
+	assert.True(t, r.retry(context.TODO(), unavailable, 0))
+	assert.False(t, r.retry(context.TODO(), unavailable, 1), "retries used up")
+	assert.False(t, r.retry(context.TODO(), apierrors.NewConflict(schema.GroupResource{}, "", nil), 0), "not transient")
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	assert.False(t, r.retry(ctx, unavailable, 0), "context done")
+	assert.False(t, (*WriteRetry)(nil).retry(context.TODO(), unavailable, 0), "disabled")
+	assert.Equal(t, []error{unavailable}, retried)
+}
@@ -0,0 +1,149 @@
+package k8sutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// Throttle sources passed to OnThrottle
+const (
+	ThrottledByServer = "server"
+	ThrottledByClient = "client"
+)
+
+const (
+	// minThrottleBackoff is the first backoff after a 429 without a Retry-After header
+	minThrottleBackoff = time.Second
+	// clientThrottleThreshold is how long the client-side rate limiter holds a request before it counts as throttled,
+	// the same threshold at which client-go logs the wait
+	clientThrottleThreshold = time.Second
+)
+
+// Throttle backs off every write of a KubeUtilInterface once the API server answered one with 429 Too Many Requests,
+// instead of letting the other writes of the cycle keep pushing
+type Throttle struct {
+	// Retries is how often a throttled write is retried before its error is returned
+	Retries int
+	// MaxBackoff caps the doubling backoff of consecutive 429s without a Retry-After header
+	MaxBackoff time.Duration
+	// OnThrottle, if set, is called for every throttled request with the time it is held back
+	OnThrottle func(source string, delay time.Duration)
+
+	lock    sync.Mutex
+	until   time.Time
+	backoff time.Duration
+}
+
+// wait blocks until the backoff of the last 429 has passed, or ctx is done
+func (t *Throttle) wait(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	delay := time.Until(t.until)
+	t.lock.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// observe records the result of a write and reports whether the API server throttled it. A 429 backs off all writes
+// for its Retry-After, or for a backoff doubling with every consecutive 429; a write that went through resets it.
+func (t *Throttle) observe(err error) bool {
+	if t == nil {
+		return false
+	}
+	if !apierrors.IsTooManyRequests(err) {
+		if err == nil {
+			t.lock.Lock()
+			t.backoff = 0
+			t.lock.Unlock()
+		}
+		return false
+	}
+
+	t.lock.Lock()
+	if t.backoff == 0 {
+		t.backoff = minThrottleBackoff
+	} else {
+		t.backoff *= 2
+	}
+	if t.MaxBackoff > 0 && t.backoff > t.MaxBackoff {
+		t.backoff = t.MaxBackoff
+	}
+	delay := t.backoff
+	if seconds, ok := apierrors.SuggestsClientDelay(err); ok && time.Duration(seconds)*time.Second > delay {
+		delay = time.Duration(seconds) * time.Second
+	}
+	if until := time.Now().Add(delay); until.After(t.until) {
+		t.until = until
+	}
+	t.lock.Unlock()
+
+	logrus.Warnf("The Kubernetes API server is throttling the controller; pausing all writes for %s", delay)
+	t.report(ThrottledByServer, delay)
+	return true
+}
+
+func (t *Throttle) report(source string, delay time.Duration) {
+	if t.OnThrottle != nil {
+		t.OnThrottle(source, delay)
+	}
+}
+
+// RateLimiter wraps the client-side rate limiter of the Kubernetes client, so requests it holds back are reported
+func (t *Throttle) RateLimiter(limiter flowcontrol.RateLimiter) flowcontrol.RateLimiter {
+	return &observedRateLimiter{RateLimiter: limiter, throttle: t}
+}
+
+type observedRateLimiter struct {
+	flowcontrol.RateLimiter
+	throttle *Throttle
+}
+
+func (l *observedRateLimiter) Wait(ctx context.Context) error {
+	start := time.Now()
+	err := l.RateLimiter.Wait(ctx)
+	if waited := time.Since(start); waited >= clientThrottleThreshold {
+		l.throttle.report(ThrottledByClient, waited)
+	}
+	return err
+}
+
+// write runs a create, update, patch or delete once the WriteLimiter and Throttle admit it, retrying it up to
+// Throttle.Retries times while the API server throttles it and up to WriteRetry.Retries times after transient errors
+func (k *KubeUtilInterface) write(ctx context.Context, call func(ctx context.Context) error) error {
+	throttled, failed := 0, 0
+	for {
+		if err := k.waitForWrite(ctx); err != nil {
+			return err
+		}
+		callCtx, cancel := k.withTimeout(ctx)
+		err := call(callCtx)
+		cancel()
+		if k.Throttle.observe(err) {
+			if throttled >= k.Throttle.Retries {
+				return err
+			}
+			throttled++
+			continue
+		}
+		if !k.WriteRetry.retry(ctx, err, failed) {
+			return err
+		}
+		failed++
+	}
+}
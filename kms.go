@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+)
+
+const (
+	// outputKMSSecret is --output=kms-secret: the secrets are envelope-encrypted with --kms-key-id before they are
+	// written, and the decrypt subcommand turns them back into a docker config inside the pod
+	outputKMSSecret = "kms-secret"
+
+	// kmsSecretType is the type of an encrypted secret, which no kubelet or tool mistakes for a docker config
+	kmsSecretType v1.SecretType = "registry-creds.k8s.io/kms-envelope"
+
+	// the data keys of an encrypted secret
+	kmsKeyIDData      = "keyId"
+	kmsDataKeyData    = "encryptedKey"
+	kmsCiphertextData = "ciphertext"
+	kmsContextData    = "encryptionContext"
+
+	// kmsContextNamespace and kmsContextSecret bind the ciphertext to the secret's namespace and name through the
+	// KMS encryption context, so key policies can limit who decrypts which secret
+	kmsContextNamespace = annotationPrefix + "namespace"
+	kmsContextSecret    = annotationPrefix + "secret"
+
+	// dockerConfigFile is the name the docker CLI and most registry clients read in $DOCKER_CONFIG
+	dockerConfigFile = "config.json"
+)
+
+// kmsInterface is the part of the KMS API the kms-secret output and the decrypt subcommand use
+type kmsInterface interface {
+	GenerateDataKeyWithContext(ctx aws.Context, input *kms.GenerateDataKeyInput, opts ...request.Option) (*kms.GenerateDataKeyOutput, error)
+	DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error)
+}
+
+// kmsPayload is the plaintext sealed into an encrypted secret: the type and data of the pull secret
+type kmsPayload struct {
+	Type v1.SecretType     `json:"type"`
+	Data map[string][]byte `json:"data"`
+}
+
+// kmsOutput writes every pull secret encrypted with a fresh AES-256-GCM data key, which KMS encrypts with the
+// configured key, so the registry tokens never reach etcd in plaintext
+type kmsOutput struct {
+	util  *k8sutil.KubeUtilInterface
+	kms   kmsInterface
+	keyID string
+
+	// encrypted caches the last encryption of every namespace's secret with the digest of its plaintext, so a
+	// resync with unchanged tokens neither calls KMS nor rewrites the secret
+	encryptedLock sync.Mutex
+	encrypted     map[string]kmsEncryption
+}
+
+type kmsEncryption struct {
+	digest [sha256.Size]byte
+	data   map[string][]byte
+}
+
+func newKMSOutput(util *k8sutil.KubeUtilInterface, client kmsInterface, keyID string) *kmsOutput {
+	return &kmsOutput{util: util, kms: client, keyID: keyID, encrypted: map[string]kmsEncryption{}}
+}
+
+// newKMSClient returns a KMS client of the region of keyID, or of --aws-region if keyID is not an ARN
+func newKMSClient(keyID string, opts awsClientOptions) (kmsInterface, error) {
+	sess, err := newAWSSession(opts)
+	if err != nil {
+		return nil, err
+	}
+	return kms.New(sess, newAWSConfig(sess, opts).WithRegion(kmsRegion(keyID))), nil
+}
+
+// kmsRegion returns the region of a KMS key ARN, --aws-region for a key ID or alias
+func kmsRegion(keyID string) string {
+	if parts := strings.Split(keyID, ":"); len(parts) >= 6 && parts[0] == "arn" && parts[3] != "" {
+		return parts[3]
+	}
+	return *argAWSRegion
+}
+
+func (o *kmsOutput) write(ctx context.Context, namespace string, secret *v1.Secret) error {
+	data, err := o.encrypt(ctx, namespace, secret)
+	if err != nil {
+		return fmt.Errorf("could not encrypt secret %s: %w", secret.Name, err)
+	}
+	encrypted := secret.DeepCopy()
+	encrypted.Type = kmsSecretType
+	encrypted.Data = data
+	encrypted.StringData = nil
+	_, err = secretsync.EnsureSecret(ctx, o.util, namespace, encrypted)
+	return err
+}
+
+// encrypt returns the data of the encrypted secret, reusing the last encryption while the plaintext is unchanged
+func (o *kmsOutput) encrypt(ctx context.Context, namespace string, secret *v1.Secret) (map[string][]byte, error) {
+	payload, err := json.Marshal(kmsPayload{Type: secret.Type, Data: secret.Data})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(payload)
+	cacheKey := namespace + "/" + secret.Name
+	o.encryptedLock.Lock()
+	cached, ok := o.encrypted[cacheKey]
+	o.encryptedLock.Unlock()
+	if ok && cached.digest == digest {
+		return cached.data, nil
+	}
+
+	encryptionContext := map[string]string{kmsContextNamespace: namespace, kmsContextSecret: secret.Name}
+	contextJSON, err := json.Marshal(encryptionContext)
+	if err != nil {
+		return nil, err
+	}
+	out, err := o.kms.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:             aws.String(o.keyID),
+		KeySpec:           aws.String(kms.DataKeySpecAes256),
+		EncryptionContext: aws.StringMap(encryptionContext),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not generate a data key with KMS key %s: %w", o.keyID, err)
+	}
+	defer zeroBytes(out.Plaintext)
+	gcm, err := newDataKeyCipher(out.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	data := map[string][]byte{
+		kmsKeyIDData:      []byte(aws.StringValue(out.KeyId)),
+		kmsDataKeyData:    out.CiphertextBlob,
+		kmsCiphertextData: gcm.Seal(nonce, nonce, payload, contextJSON),
+		kmsContextData:    contextJSON,
+	}
+
+	o.encryptedLock.Lock()
+	o.encrypted[cacheKey] = kmsEncryption{digest: digest, data: data}
+	o.encryptedLock.Unlock()
+	return data, nil
+}
+
+// decryptKMSSecret decrypts the data of an encrypted secret with the KMS client of its key's region
+func decryptKMSSecret(ctx context.Context, newClient func(keyID string) kmsInterface, data map[string][]byte) (kmsPayload, error) {
+	var payload kmsPayload
+	for _, key := range []string{kmsKeyIDData, kmsDataKeyData, kmsCiphertextData, kmsContextData} {
+		if len(data[key]) == 0 {
+			return payload, fmt.Errorf("the encrypted secret has no %s", key)
+		}
+	}
+	var encryptionContext map[string]string
+	if err := json.Unmarshal(data[kmsContextData], &encryptionContext); err != nil {
+		return payload, fmt.Errorf("invalid %s: %w", kmsContextData, err)
+	}
+
+	keyID := string(data[kmsKeyIDData])
+	out, err := newClient(keyID).DecryptWithContext(ctx, &kms.DecryptInput{
+		KeyId:             aws.String(keyID),
+		CiphertextBlob:    data[kmsDataKeyData],
+		EncryptionContext: aws.StringMap(encryptionContext),
+	})
+	if err != nil {
+		return payload, fmt.Errorf("could not decrypt the data key with KMS key %s: %w", keyID, err)
+	}
+	defer zeroBytes(out.Plaintext)
+	gcm, err := newDataKeyCipher(out.Plaintext)
+	if err != nil {
+		return payload, err
+	}
+	sealed := data[kmsCiphertextData]
+	if len(sealed) < gcm.NonceSize() {
+		return payload, errors.New("the ciphertext is truncated")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], data[kmsContextData])
+	if err != nil {
+		return payload, fmt.Errorf("could not decrypt the ciphertext: %w", err)
+	}
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return payload, fmt.Errorf("invalid payload: %w", err)
+	}
+	return payload, nil
+}
+
+// runDecrypt is the decrypt subcommand, run as an initContainer: it decrypts the encrypted secret mounted at from
+// and writes every key of the pull secret as a file into to, the docker config also as config.json
+func runDecrypt(ctx context.Context, newClient func(keyID string) kmsInterface, from, to string) error {
+	data := map[string][]byte{}
+	for _, key := range []string{kmsKeyIDData, kmsDataKeyData, kmsCiphertextData, kmsContextData} {
+		value, err := os.ReadFile(filepath.Join(from, key))
+		if err != nil {
+			return fmt.Errorf("could not read the encrypted secret: %w", err)
+		}
+		data[key] = value
+	}
+	payload, err := decryptKMSSecret(ctx, newClient, data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(to, 0o700); err != nil {
+		return err
+	}
+	files := map[string][]byte{}
+	for key, value := range payload.Data {
+		files[key] = value
+	}
+	if config, ok := payload.Data[v1.DockerConfigJsonKey]; ok {
+		files[dockerConfigFile] = config
+	}
+	for name, value := range files {
+		if err := os.WriteFile(filepath.Join(to, name), value, 0o600); err != nil {
+			return fmt.Errorf("could not write the decrypted secret: %w", err)
+		}
+	}
+	log.Infof("Decrypted %d keys of the pull secret into %s", len(payload.Data), to)
+	return nil
+}
+
+// newDataKeyCipher returns the AES-256-GCM cipher of a plaintext data key
+func newDataKeyCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// zeroBytes overwrites a plaintext data key once it is no longer needed
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
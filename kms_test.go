@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeKMS "encrypts" data keys by prefixing them with the encryption context, so a decryption with another context
+// fails like it does with KMS
+type fakeKMS struct {
+	generated int
+}
+
+func (f *fakeKMS) GenerateDataKeyWithContext(ctx aws.Context, input *kms.GenerateDataKeyInput, opts ...request.Option) (*kms.GenerateDataKeyOutput, error) {
+	f.generated++
+	key := make([]byte, 32)
+	key[0] = byte(f.generated)
+	blob := append([]byte(fakeKMSContext(input.EncryptionContext)), key...)
+	return &kms.GenerateDataKeyOutput{KeyId: aws.String("arn:aws:kms:eu-west-1:123456789012:key/test"), Plaintext: append([]byte{}, key...), CiphertextBlob: blob}, nil
+}
+
+func (f *fakeKMS) DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error) {
+	prefix := fakeKMSContext(input.EncryptionContext)
+	if len(input.CiphertextBlob) != len(prefix)+32 || string(input.CiphertextBlob[:len(prefix)]) != prefix {
+		return nil, errors.New("InvalidCiphertextException")
+	}
+	return &kms.DecryptOutput{KeyId: input.KeyId, Plaintext: append([]byte{}, input.CiphertextBlob[len(prefix):]...)}, nil
+}
+
+func fakeKMSContext(encryptionContext map[string]*string) string {
+	return aws.StringValue(encryptionContext[kmsContextNamespace]) + "/" + aws.StringValue(encryptionContext[kmsContextSecret])
+}
+
+func newKMSTestSecret() *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "awsecr-cred"},
+		Data:       map[string][]byte{v1.DockerConfigJsonKey: []byte(`{"auths":{"registry.example.com":{"auth":"dXNlcjpwYXNz"}}}`)},
+		Type:       v1.SecretTypeDockerConfigJson,
+	}
+}
+
+func TestKMSOutputRoundTrip(t *testing.T) {
+	util := newKubeUtil()
+	client := &fakeKMS{}
+	output := newKMSOutput(util, client, "alias/registry-creds")
+	secret := newKMSTestSecret()
+
+	require.Nil(t, output.write(context.TODO(), "namespace1", secret))
+	written, err := util.GetSecret(context.TODO(), "namespace1", "awsecr-cred")
+	require.Nil(t, err)
+	assert.Equal(t, kmsSecretType, written.Type)
+	assert.NotContains(t, written.Data, v1.DockerConfigJsonKey)
+	assert.NotContains(t, string(written.Data[kmsCiphertextData]), "dXNlcjpwYXNz")
+	assert.Equal(t, `{"registry-creds.k8s.io/namespace":"namespace1","registry-creds.k8s.io/secret":"awsecr-cred"}`, string(written.Data[kmsContextData]))
+
+	newClient := func(keyID string) kmsInterface {
+		assert.Equal(t, "arn:aws:kms:eu-west-1:123456789012:key/test", keyID)
+		return client
+	}
+	payload, err := decryptKMSSecret(context.TODO(), newClient, written.Data)
+	require.Nil(t, err)
+	assert.Equal(t, secret.Type, payload.Type)
+	assert.Equal(t, secret.Data, payload.Data)
+
+	// a resync with the same tokens neither generates a data key nor changes the secret
+	require.Nil(t, output.write(context.TODO(), "namespace1", secret))
+	assert.Equal(t, 1, client.generated)
+	again, err := util.GetSecret(context.TODO(), "namespace1", "awsecr-cred")
+	require.Nil(t, err)
+	assert.Equal(t, written.Data, again.Data)
+
+	// new tokens are encrypted with a new data key
+	secret.Data[v1.DockerConfigJsonKey] = []byte(`{"auths":{}}`)
+	require.Nil(t, output.write(context.TODO(), "namespace1", secret))
+	assert.Equal(t, 2, client.generated)
+}
+
+func TestDecryptKMSSecretChecksContext(t *testing.T) {
+	client := &fakeKMS{}
+	output := newKMSOutput(newKubeUtil(), client, "alias/registry-creds")
+	newClient := func(string) kmsInterface { return client }
+	data, err := output.encrypt(context.TODO(), "namespace1", newKMSTestSecret())
+	require.Nil(t, err)
+
+	// a secret copied into another namespace does not decrypt
+	moved := map[string][]byte{}
+	for key, value := range data {
+		moved[key] = value
+	}
+	moved[kmsContextData] = []byte(`{"registry-creds.k8s.io/namespace":"namespace2","registry-creds.k8s.io/secret":"awsecr-cred"}`)
+	_, err = decryptKMSSecret(context.TODO(), newClient, moved)
+	assert.ErrorContains(t, err, "could not decrypt the data key")
+
+	// neither does tampered ciphertext
+	tampered := map[string][]byte{}
+	for key, value := range data {
+		tampered[key] = value
+	}
+	tampered[kmsCiphertextData] = append([]byte{}, data[kmsCiphertextData]...)
+	tampered[kmsCiphertextData][len(tampered[kmsCiphertextData])-1] ^= 1
+	_, err = decryptKMSSecret(context.TODO(), newClient, tampered)
+	assert.ErrorContains(t, err, "could not decrypt the ciphertext")
+
+	delete(tampered, kmsDataKeyData)
+	_, err = decryptKMSSecret(context.TODO(), newClient, tampered)
+	assert.EqualError(t, err, "the encrypted secret has no encryptedKey")
+}
+
+func TestRunDecrypt(t *testing.T) {
+	client := &fakeKMS{}
+	output := newKMSOutput(newKubeUtil(), client, "alias/registry-creds")
+	secret := newKMSTestSecret()
+	data, err := output.encrypt(context.TODO(), "namespace1", secret)
+	require.Nil(t, err)
+
+	from, to := t.TempDir(), filepath.Join(t.TempDir(), "decrypted")
+	for key, value := range data {
+		require.Nil(t, os.WriteFile(filepath.Join(from, key), value, 0o600))
+	}
+	require.Nil(t, runDecrypt(context.TODO(), func(string) kmsInterface { return client }, from, to))
+	for _, name := range []string{v1.DockerConfigJsonKey, dockerConfigFile} {
+		config, err := os.ReadFile(filepath.Join(to, name))
+		require.Nil(t, err)
+		assert.Equal(t, secret.Data[v1.DockerConfigJsonKey], config)
+	}
+
+	assert.ErrorContains(t, runDecrypt(context.TODO(), func(string) kmsInterface { return client }, t.TempDir(), to), "could not read the encrypted secret")
+}
+
+func TestKMSRegion(t *testing.T) {
+	defer func(region string) { *argAWSRegion = region }(*argAWSRegion)
+	*argAWSRegion = "us-east-1"
+
+	assert.Equal(t, "eu-west-1", kmsRegion("arn:aws:kms:eu-west-1:123456789012:key/1234abcd"))
+	assert.Equal(t, "us-east-1", kmsRegion("alias/registry-creds"))
+	assert.Equal(t, "us-east-1", kmsRegion("1234abcd-12ab-34cd-56ef-1234567890ab"))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+	log "github.com/sirupsen/logrus"
+)
+
+// logrusSink routes the logr output of controller-runtime and client-go into logrus
+type logrusSink struct {
+	entry *log.Entry
+	name  string
+}
+
+func newLogrusLogger() logr.Logger {
+	return logr.New(&logrusSink{entry: log.NewEntry(log.StandardLogger())})
+}
+
+func (s *logrusSink) Init(logr.RuntimeInfo) {}
+
+// Enabled maps logr's verbosity levels to logrus: V(0) is info, anything more verbose is debug
+func (s *logrusSink) Enabled(level int) bool {
+	if level > 0 {
+		return log.IsLevelEnabled(log.DebugLevel)
+	}
+	return log.IsLevelEnabled(log.InfoLevel)
+}
+
+func (s *logrusSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	entry := s.withValues(keysAndValues)
+	if level > 0 {
+		entry.Debug(msg)
+		return
+	}
+	entry.Info(msg)
+}
+
+func (s *logrusSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	s.withValues(keysAndValues).WithError(err).Error(msg)
+}
+
+func (s *logrusSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return &logrusSink{entry: s.withValues(keysAndValues), name: s.name}
+}
+
+func (s *logrusSink) WithName(name string) logr.LogSink {
+	if s.name != "" {
+		name = s.name + "." + name
+	}
+	return &logrusSink{entry: s.entry.WithField("logger", name), name: name}
+}
+
+func (s *logrusSink) withValues(keysAndValues []interface{}) *log.Entry {
+	fields := log.Fields{}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[fmt.Sprint(keysAndValues[i])] = keysAndValues[i+1]
+	}
+	return s.entry.WithFields(fields)
+}
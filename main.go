@@ -25,25 +25,40 @@ ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/cenkalti/backoff"
 	"github.com/doddle/registry-creds/k8sutil"
+	"github.com/doddle/registry-creds/pkg/providers"
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
 	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 )
 
 func init() {
@@ -58,6 +73,8 @@ func init() {
 			return fmt.Sprintf("%s()", f.Function), fmt.Sprintf("%s:%d", filename, f.Line)
 		},
 	})
+
+	_ = flags.MarkDeprecated("skip-kube-system", "use --skip-system-namespaces instead")
 }
 
 const (
@@ -65,51 +82,300 @@ const (
 	retryTypeSimple      = "simple"
 	retryTypeExponential = "exponential"
 
-	dockerCfgTemplate         = `{"%s":{"username":"oauth2accesstoken","password":"%s","email":"none"}}`
 	tokenGenRetryTypeKey      = "TOKEN_RETRY_TYPE"
 	tokenGenRetriesKey        = "TOKEN_RETRIES"
 	tokenGenRetryDelayKey     = "TOKEN_RETRY_DELAY"
 	defaultTokenGenRetries    = 3
 	defaultTokenGenRetryDelay = 5 // in seconds
 	defaultTokenGenRetryType  = retryTypeSimple
+
+	leaderElectionID = "registry-creds"
 )
 
 var (
-	flags                    = flag.NewFlagSet("", flag.ContinueOnError)
-	argExcludedNamespaces    = flags.String("excluded-namespaces", "", `Comma seperated list of namespaces that do NOT need updated secrets`)
-	argAWSSecretName         = flags.String("aws-secret-name", "awsecr-cred", `Default AWS secret name`)
-	argAWSRegion             = flags.String("aws-region", "us-east-1", `Default AWS region`)
-	argRefreshMinutes        = flags.Int("refresh-mins", 60, `Default time to wait before refreshing (60 minutes)`)
-	argSkipKubeSystem        = flags.Bool("skip-kube-system", true, `If true, will not attempt to set ImagePullSecrets on the kube-system namespace`)
-	argAWSAssumeRole         = flags.String("aws_assume_role", "", `If specified AWS will assume this role and use it to retrieve tokens`)
-	argTokenGenFxnRetryType  = flags.String("token-retry-type", defaultTokenGenRetryType, `The type of retry timer to use when generating a secret token; either simple or exponential (simple)`)
-	argTokenGenFxnRetries    = flags.Int("token-retries", defaultTokenGenRetries, `Default number of times to retry generating a secret token (3)`)
-	argTokenGenFxnRetryDelay = flags.Int("token-retry-delay", defaultTokenGenRetryDelay, `Default number of seconds to wait before retrying secret token generation (5 seconds)`)
+	flags                     = flag.NewFlagSet("", flag.ContinueOnError)
+	argExcludedNamespaces     = flags.String("excluded-namespaces", "", `Comma seperated list of namespaces that do NOT need updated secrets`)
+	argExcludedNSSelector     = flags.String("excluded-namespace-selector", "", `Label selector of namespaces that do NOT need updated secrets, e.g. env=sandbox; re-evaluated when labels change and the managed secrets are removed from namespaces that start matching`)
+	argRequireOptIn           = flags.Bool("require-namespace-opt-in", false, `If true, only namespaces annotated registry-creds.k8s.io/enabled: "true" get the pull secrets`)
+	argCleanupExcluded        = flags.Bool("cleanup-excluded-namespaces", false, `If true, also delete the managed secrets from namespaces listed in --excluded-namespaces, or that have not opted in under --require-namespace-opt-in, and remove them from their ServiceAccounts`)
+	argProvider               = flags.String("provider", providerECR, `Registry credentials provider: ecr, file to only distribute the tokens of --token-files without calling any cloud API, or fake for deterministic tokens without cloud credentials (end-to-end tests and demos)`)
+	argFakeRegistries         = flags.StringSlice("fake-registries", []string{"https://registry.example.com"}, `Registry endpoints the fake provider returns tokens for; may be repeated`)
+	argFakeSecretName         = flags.String("fake-secret-name", "fake-registry-creds", `Secret name of the fake provider`)
+	argFakeTokenExpiry        = flags.Duration("fake-token-expiry", 12*time.Hour, `How long a fake token stays the same before the fake provider hands out a new one; 0 never rotates it (12h)`)
+	argTokenFiles             = flags.StringSlice("token-files", nil, `Docker config files the file provider reads the tokens from on every refresh, kept up to date by e.g. a sidecar; may be repeated`)
+	argTokenFileMaxAge        = flags.Duration("token-file-max-age", 0, `Fail a file provider refresh when a token file was last written longer ago, e.g. because its sidecar stopped; 0 disables the check`)
+	argTokenFileSecretName    = flags.String("token-file-secret-name", "file-registry-creds", `Secret name of the file provider`)
+	argFakeFailEvery          = flags.Int("fake-fail-every", 0, `Make every n-th fake provider call fail, to exercise retries and the circuit breaker; 0 never fails`)
+	argKMSKeyID               = flags.String("kms-key-id", "", `AWS KMS key ID, ARN or alias that --output=kms-secret envelope-encrypts the secrets with`)
+	argDecryptFrom            = flags.String("decrypt-from", "/etc/registry-creds/encrypted", `Directory the decrypt subcommand reads the mounted encrypted secret from`)
+	argVerifyProviderName     = flags.String("verify-provider-name", "", `Provider the verify-provider subcommand fetches the tokens of, e.g. an ECR provider or token-exchange of the config file; defaults to --provider`)
+	argVerifyRegistry         = flags.Bool("verify-registry", false, `Have the verify-provider subcommand also log in to each registry with the fetched tokens`)
+	argDecryptTo              = flags.String("decrypt-to", "/etc/registry-creds/decrypted", `Directory the decrypt subcommand writes the decrypted pull secret to, with the docker config as config.json for DOCKER_CONFIG`)
+	argFakeMinRefresh         = flags.Duration("fake-min-refresh", 0, `Minimum refresh interval the fake provider declares, like a rate-limited registry, to try out how shorter refresh intervals are raised; 0 declares none`)
+	argUnmanagedSecrets       = flags.String("unmanaged-secrets", unmanagedOverwrite, `What to do about an existing secret of a managed name that registry-creds did not write, i.e. without its managed-by label: overwrite it, adopt it (replace the data, keep its labels and annotations) or skip the namespace (overwrite)`)
+	argOwnership              = flags.String("ownership", ownershipController, `Ownership strategy of the objects the controller writes: controller (only the managed-by label) or gitops (also annotations that stop Argo CD and Flux from pruning or reverting them)`)
+	argManagedLabels          = flags.StringToString("managed-labels", nil, `Extra labels of every object the controller writes, e.g. team=platform`)
+	argManagedAnnotations     = flags.StringToString("managed-annotations", nil, `Extra annotations of every object the controller writes, e.g. argocd.argoproj.io/compare-options=IgnoreExtraneous`)
+	argOutput                 = flags.String("output", outputSecret, `Where the pull secrets go: secret (Secret objects), sealed-secret (SealedSecret manifests PUT to --output-url), external-secret (one source secret distributed by ExternalSecrets) mirror (one hub secret copied into every namespace), karmada (Secrets with a Karmada PropagationPolicy each), fleet (Fleet Bundles in --fleet-workspace), vault (only the Vault path of --vault-addr, no cluster Secrets), yaml (Secret and ServiceAccount manifests in --output-dir, nothing applied), agent (only the kubelet credentials of --agent-address, no cluster Secrets) or kms-secret (Secrets envelope-encrypted with --kms-key-id, for the decrypt subcommand)`)
+	argMirrorHubNamespace     = flags.String("mirror-hub-namespace", "", `Namespace of the hub secrets with --output=mirror (defaults to --status-namespace)`)
+	argOutputURL              = flags.String("output-url", "", `Base URL the SealedSecret manifests are PUT to as <url>/<namespace>/<secret>.yaml`)
+	argOutputDir              = flags.String("output-dir", "", `Directory --output=yaml writes the manifests to as <dir>/<namespace>/secret-<name>.yaml and serviceaccount-<name>.yaml`)
+	argOutputTokenFile        = flags.String("output-token-file", "", `File containing a bearer token sent to --output-url`)
+	argSealedSecretsCert      = flags.String("sealed-secrets-cert", "", `Certificate of the sealed-secrets controller (kubeseal --fetch-cert) used to seal the pull secrets`)
+	argVaultAddr              = flags.String("vault-addr", "", `Address of a Vault server the credentials of every refresh are also written to, e.g. https://vault.example.com:8200; empty disables it unless --output=vault`)
+	argVaultKVMount           = flags.String("vault-kv-mount", "secret", `Mount of the KV version 2 secrets engine the credentials are written to (secret)`)
+	argVaultPath              = flags.String("vault-path", "registry-creds", `Path below --vault-kv-mount; every provider secret is written to <path>/<secret name> (registry-creds)`)
+	argVaultTokenFile         = flags.String("vault-token-file", "", `File containing the Vault token, re-read for every write, e.g. one rendered by the Vault agent`)
+	argVaultRole              = flags.String("vault-role", "", `Role of Vault's Kubernetes auth method to log in as with the controller's ServiceAccount token, if --vault-token-file is not set`)
+	argVaultAuthMount         = flags.String("vault-auth-mount", "kubernetes", `Mount of the Kubernetes auth method used with --vault-role (kubernetes)`)
+	argESOStore               = flags.String("eso-store", "", `ClusterSecretStore the ExternalSecrets read the source secrets through, with --output=external-secret`)
+	argPropagationClusters    = flags.StringSlice("propagation-clusters", nil, `Member clusters the secrets are propagated to with --output=karmada or fleet; empty targets every cluster`)
+	argFleetWorkspace         = flags.String("fleet-workspace", "fleet-default", `Fleet workspace namespace the Bundles are written to with --output=fleet (fleet-default)`)
+	argESOSourceNamespace     = flags.String("eso-source-namespace", "", `Namespace of the source secrets with --output=external-secret (defaults to --status-namespace)`)
+	argAWSSecretName          = flags.String("aws-secret-name", "awsecr-cred", `Default AWS secret name`)
+	argAWSRegion              = flags.String("aws-region", "us-east-1", `Default AWS region`)
+	argAWSAccountRoles        = flags.StringToString("aws-account-roles", nil, `Role assumed to fetch the token of an AWS account, as account=role-arn; may be repeated`)
+	argECRConcurrency         = flags.Int("ecr-concurrency", 4, `How many ECR GetAuthorizationToken calls, one per region and account role, run at the same time`)
+	argAWSAccountIDs          = flags.StringSlice("aws-account-ids", nil, `AWS account IDs whose ECR registries are included, optionally as account:region; may be repeated and is combined with the awsaccount env var`)
+	argEndpointForm           = flags.String("registry-endpoint-form", endpointFormURL, `How registries are keyed in the docker config: url (as returned by the provider), host (bare hostname) or both; providers may override it in --config`)
+	argRefreshMinutes         = flags.Int("refresh-mins", 60, `Default time to wait before refreshing (60 minutes); providers may override it in --config`)
+	argResyncPeriod           = flags.Duration("resync-period", 0, `How often every namespace is synced from the cached credentials to repair drift, without fetching new tokens; 0 uses --refresh-mins`)
+	argConfigFile             = flags.String("config", "", `Optional YAML config file with per-provider settings`)
+	argStrictConfig           = flags.Bool("strict-config", false, `Refuse to start when a flag, environment variable or the config file has an invalid value, instead of falling back to its default`)
+	argConfigReloadPeriod     = flags.Duration("config-reload-period", 30*time.Second, `How often --config is checked for changes, which are applied without a restart; 0 disables reloading`)
+	argRefreshJitter          = flags.Float64("refresh-jitter", 0.1, `Maximum fraction of the refresh interval randomly added to each provider refresh, to spread token requests (0.1)`)
+	argPriorityWaveDelay      = flags.Duration("priority-wave-delay", 0, `Pause of a provider refresh between the namespaces of one registry-creds.k8s.io/priority and those of the next lower one (disabled)`)
+	argNamespaceJitter        = flags.Duration("namespace-jitter", 0, `Maximum random delay before processing each namespace during a provider refresh (disabled)`)
+	argKubeAPIQPS             = flags.Float32("kube-api-qps", 0, `Maximum sustained queries per second to the Kubernetes API; 0 uses the client-go default (5)`)
+	argKubeAPIBurst           = flags.Int("kube-api-burst", 0, `Maximum burst of queries to the Kubernetes API; 0 uses the client-go default (10)`)
+	argKubeAPIWriteQPS        = flags.Float32("kube-api-write-qps", 0, `Maximum sustained Kubernetes creates, updates and deletes per second, shared by all namespaces; a refresh queues its writes over time instead of bursting them. 0 disables the limit`)
+	argKubeAPIWriteBurst      = flags.Int("kube-api-write-burst", 10, `Maximum burst of Kubernetes writes above --kube-api-write-qps (10)`)
+	argKubeAPIRetries         = flags.Int("kube-api-throttle-retries", 5, `How often a Kubernetes write answered with 429 Too Many Requests is retried; meanwhile every write backs off for the Retry-After, or a doubling backoff (5)`)
+	argKubeAPIMaxBackoff      = flags.Duration("kube-api-max-backoff", time.Minute, `Maximum backoff of Kubernetes writes after consecutive 429 Too Many Requests responses without a Retry-After (1m)`)
+	argKubeAPIWriteRetries    = flags.Int("kube-api-write-retries", 3, `How often a Kubernetes write that failed with a transient error, such as a server error, a timeout or a broken connection, is retried before the namespace's sync fails; 0 disables retries (3)`)
+	argKubeAPIWriteBackoff    = flags.Duration("kube-api-write-backoff", time.Second, `Wait before the first retry of a failed Kubernetes write, doubling with every further retry (1s)`)
+	argKubeAPIWriteMaxBackoff = flags.Duration("kube-api-write-max-backoff", 30*time.Second, `Maximum wait between retries of a failed Kubernetes write (30s)`)
+	argAPIServerHost          = flags.String("apiserver-host", "", `Host name or IPv4/IPv6 address of the Kubernetes API server, replacing KUBERNETES_SERVICE_HOST or the kubeconfig's server when that address is not reachable`)
+	argAPIServerPort          = flags.Int("apiserver-port", 0, `Port of the Kubernetes API server, replacing KUBERNETES_SERVICE_PORT or the kubeconfig's port; 0 keeps it`)
+	argAPIServerSNI           = flags.String("apiserver-tls-server-name", "", `Server name sent with TLS SNI and expected in the API server certificate, e.g. kubernetes.default.svc when --apiserver-host is an address the certificate does not list`)
+	argKubeAPITimeout         = flags.Duration("kube-api-timeout", 30*time.Second, `Timeout of a single Kubernetes API request, excluding watches; 0 disables it (30s)`)
+	argSkipKubeSystem         = flags.Bool("skip-kube-system", true, `Deprecated: if false, kube-system is removed from --skip-system-namespaces`)
+	argCreateServiceAccounts  = flags.Bool("create-service-accounts", false, `If true, create missing ServiceAccounts of a namespace with the pull secrets attached instead of waiting for them or failing the sync; needs create on serviceaccounts`)
+	argPauseFile              = flags.String("pause-file", "", `While this file exists nothing is written to the cluster, e.g. during incident response or maintenance; tokens are still fetched and validated. Mount it from a ConfigMap to pause without a restart`)
+	argCanaryNamespaces       = flags.StringSlice("canary-namespaces", nil, `Namespaces that get new credentials first; the other namespaces only get them once the registries accept them and no canary pod fails to pull; may be repeated`)
+	argCanarySoak             = flags.Duration("canary-soak", 0, `How long the canary namespaces run on new credentials before their pods are checked for failed image pulls`)
+	argServiceAccountWait     = flags.Duration("service-account-wait", time.Minute, `How long after a namespace was created its missing ServiceAccounts are waited for instead of failing the sync; the namespace is synced again when they appear (1m)`)
+	argOpenShift              = flags.Bool("openshift", false, `If true, also patch the builder and deployer ServiceAccounts of every project and wait for OpenShift to create missing ServiceAccounts instead of failing the project`)
+	argSkipSystemNamespaces   = flags.StringSlice("skip-system-namespaces", defaultSystemNamespaces, `Namespaces that never get the pull secrets, as names or shell patterns such as openshift-*; may be repeated, an empty value skips none`)
+	argProviderProxy          = flags.String("provider-proxy", "", `Proxy URL used for provider API calls; defaults to the HTTPS_PROXY/HTTP_PROXY/NO_PROXY env vars`)
+	argProviderCABundle       = flags.String("provider-ca-bundle", "", `PEM file of additional CA certificates trusted for provider API calls, e.g. of a TLS-intercepting proxy`)
+	argSecretSplitSize        = flags.Int("secret-split-size", defaultSecretSplitSize, `Split a provider's .dockerconfigjson across several secrets (<name>, <name>-2, ...) when its data exceeds this many bytes; 0 disables splitting`)
+	argProviderTimeout        = flags.Duration("provider-timeout", 30*time.Second, `Timeout of a single provider API call; 0 disables it (30s)`)
+	argProviderFetchTimeout   = flags.Duration("provider-fetch-timeout", 0, `Timeout of a provider's whole token fetch, including its retries; 0 disables it`)
+	argAWSAssumeRole          = flags.String("aws_assume_role", "", `If specified AWS will assume this role and use it to retrieve tokens`)
+	argCircuitBreakerFailures = flags.Int("circuit-breaker-failures", 5, `Number of consecutive failed refreshes after which a provider is only retried every --circuit-breaker-interval; 0 disables the circuit breaker`)
+	argNodeCredRegistries     = flags.StringSlice("node-credential-registries", nil, `Registry hosts or shell patterns, e.g. *.dkr.ecr.*.amazonaws.com, that kubelet credential providers on the nodes already cover; see --node-credential-mode`)
+	argRegistryAllowlist      = flags.StringSlice("registry-allowlist", nil, `Registry hosts or shell patterns, e.g. *.dkr.ecr.eu-west-1.amazonaws.com, the providers' tokens are limited to; empty allows every registry`)
+	argRegistryDenylist       = flags.StringSlice("registry-denylist", nil, `Registry hosts or shell patterns whose tokens are left out of everything the controller writes, even if allowed by --registry-allowlist`)
+	argNodeCredMode           = flags.String("node-credential-mode", nodeCredentialAnnotate, `What to do about registries in --node-credential-registries: annotate lists them on each namespace, skip also leaves them out of the pull secrets (annotate)`)
+	argWatchPullFailures      = flags.Bool("watch-pull-failures", false, `Watch the pods of the managed namespaces and report the containers that cannot pull from a provider's registry for lack of credentials although the namespace has the pull secret, with a metric and a Warning Event on the pod`)
+	argWorkloadRollout        = flags.String("workload-rollout", workloadRolloutOff, `What to do about workloads whose pods failed to pull their images before a namespace first got the pull secrets: off, annotate marks them with registry-creds.k8s.io/credentials-available-at, restart also restarts them (off)`)
+	argVClusterSelector       = flags.String("vcluster-selector", "", `Label selector of the control plane pods of vclusters, e.g. app=vcluster; the pull secrets are also synced into every namespace of the vclusters found. Empty disables it`)
+	argVClusterInterval       = flags.Duration("vcluster-sync-interval", 5*time.Minute, `How often the vclusters are discovered and synced (5m)`)
+	argEventAggregationWindow = flags.Duration("event-aggregation-window", 10*time.Minute, `Identical Kubernetes Events are emitted once per window, and their repeats summarised in one more Event when it ends; 0 disables the aggregation (10m)`)
+	argCircuitBreakerInterval = flags.Duration("circuit-breaker-interval", 6*time.Hour, `How often a provider with an open circuit is retried (6h)`)
+	argStaleRetryInterval     = flags.Duration("stale-retry-interval", time.Minute, `How often a provider whose refresh failed is retried while its cached, unexpired tokens are served; 0 waits for the refresh interval (1m)`)
+	argTokenGenFxnRetryType   = flags.String("token-retry-type", defaultTokenGenRetryType, `The type of retry timer to use when generating a secret token; either simple or exponential (simple)`)
+	argTokenGenFxnRetries     = flags.Int("token-retries", defaultTokenGenRetries, `Default number of times to retry generating a secret token (3)`)
+	argTokenGenFxnRetryDelay  = flags.Int("token-retry-delay", defaultTokenGenRetryDelay, `Default number of seconds to wait before retrying secret token generation (5 seconds)`)
+	argTokenRetryInitial      = flags.Duration("token-retry-initial-interval", backoff.DefaultInitialInterval, `Initial delay of the exponential retry timer (500ms)`)
+	argTokenRetryMultiplier   = flags.Float64("token-retry-multiplier", backoff.DefaultMultiplier, `Factor by which the exponential retry delay grows after each try (1.5)`)
+	argTokenRetryMaxInterval  = flags.Duration("token-retry-max-interval", backoff.DefaultMaxInterval, `Upper bound of a single exponential retry delay (1m)`)
+	argTokenRetryMaxElapsed   = flags.Duration("token-retry-max-elapsed-time", backoff.DefaultMaxElapsedTime, `Give up retrying once the exponential retry timer has run this long (15m)`)
+	argPullSecretOrder        = flags.String("image-pull-secrets-order", secretsync.OrderKeep, `Where managed entries go in a ServiceAccount's imagePullSecrets; keep (existing position, new ones appended), first or last`)
+	argDedupePullSecrets      = flags.Bool("dedupe-image-pull-secrets", false, `If true, remove duplicate entries from a ServiceAccount's imagePullSecrets`)
+	argPrunePullSecrets       = flags.Bool("prune-image-pull-secrets", false, `If true, remove imagePullSecrets entries the controller added for providers that are no longer enabled`)
+	argRepairPullSecrets      = flags.Bool("repair-image-pull-secrets", true, `If true, remove imagePullSecrets entries the controller added whose secret was deleted and that no provider writes any more`)
+	argExcludeAnnotatedSAs    = flags.Bool("exclude-annotated-serviceaccounts", false, `If true, never change ServiceAccounts annotated registry-creds.k8s.io/skip: "true", e.g. ones managed strictly by GitOps`)
+	argAttachSASecrets        = flags.Bool("attach-serviceaccount-secrets", false, `If true, also list managed secrets under the ServiceAccount's secrets field`)
+	argStatusConfigMap        = flags.String("status-configmap", "registry-creds-status", `Name of the ConfigMap summarising the per-namespace sync state; empty disables it`)
+	argStatusNamespace        = flags.String("status-namespace", "", `Namespace of the status ConfigMap (defaults to $POD_NAMESPACE, then kube-system)`)
+	argPersistTokens          = flags.Bool("persist-tokens", true, `Keep the last fetched tokens of every provider in a <secret>-last-good Secret of the status namespace, so a restart during a provider outage can still seed new namespaces with them`)
+	argStatusShutdownReport   = flags.Bool("status-shutdown-report", false, `On shutdown, also write the state of every provider and the namespaces left behind by an interrupted rotation into the status ConfigMap, under shutdown.json`)
+	argStatusInterval         = flags.Duration("status-interval", time.Minute, `How often the status ConfigMap is written when the sync state changed (1m)`)
+	argLogLevel               = flags.String("log-level", log.InfoLevel.String(), `Minimum level of the log messages: panic, fatal, error, warn, info, debug or trace; debug also logs what every update of a secret or ServiceAccount changed (info)`)
+	argHealthProbeAddress     = flags.String("health-probe-address", ":8081", `Address to serve the /healthz and /readyz probes on; empty disables them`)
+	argWaitForInitialSync     = flags.Bool("wait-for-initial-sync", false, `Report ready on /readyz only once every namespace that is not excluded has been synced since startup`)
+	argProbePermissions       = flags.Bool("probe-permissions", true, `If true, check the controller's RBAC at startup and switch off what it is not allowed to do, e.g. run in secrets-only mode without update on serviceaccounts`)
+	argLeaderElect            = flags.Bool("leader-elect", false, `If true, only the replica holding the leader lease refreshes providers and writes the status ConfigMap; the lease lives in --status-namespace`)
+	argCloudEventsSink        = flags.String("cloudevents-sink", "", `URL a CloudEvent is POSTed to after every rotation, e.g. a Knative broker or Argo Events webhook; empty disables the events`)
+	argCloudEventsSource      = flags.String("cloudevents-source", "registry-creds", `Source attribute of the rotation CloudEvents`)
+	argAgentAddress           = flags.String("agent-address", "", `Serve the cached credentials to the node's kubelet in the credential provider protocol on this unix:///path socket or loopback host:port, see the credential-provider subcommand; empty disables it`)
+	argListenAddress          = flags.String("listen-address", ":8080", `Address to serve the /version, /metrics and /reconcile endpoints on; empty disables the HTTP server`)
+	argAPITokenFile           = flags.String("api-token-file", "", `File containing the bearer token required by the /reconcile endpoint; the endpoint is disabled without it`)
 )
 
-var (
-	awsAccountIDs []string
+// providerDefaults are the provider settings validateParams derives from the flags and the environment. Every
+// controller keeps its own copy rather than sharing package-level variables, so concurrent providers and tests cannot
+// race on them.
+type providerDefaults struct {
+	AccountIDs []string
+	// AccountRegions holds the region of every account that does not use --aws-region
+	AccountRegions map[string]string
+	// AccountRoles holds the role assumed for every account listed in --aws-account-roles
+	AccountRoles map[string]string
 
-	// RetryCfg represents the currently-configured number of retries + retry delay
-	RetryCfg RetryConfig
+	// Retry is the default number of retries + retry delay; providers may override it in --config
+	Retry RetryConfig
+}
 
-	// The retry backoff timers
-	simpleBackoff      *backoff.ConstantBackOff
-	exponentialBackoff *backoff.ExponentialBackOff
-)
+// newProviderDefaults returns the defaults of the flags: the account of the AWS credentials and simple retries
+func newProviderDefaults() providerDefaults {
+	return providerDefaults{
+		AccountIDs: []string{""},
+		Retry: RetryConfig{
+			Type:                defaultTokenGenRetryType,
+			NumberOfRetries:     defaultTokenGenRetries,
+			RetryDelayInSeconds: defaultTokenGenRetryDelay,
+		},
+	}
+}
 
 type dockerJSON struct {
 	Auths map[string]registryAuth `json:"auths,omitempty"`
 }
 
 type registryAuth struct {
-	Auth  string `json:"auth"`
-	Email string `json:"email"`
+	Auth     string `json:"auth"`
+	Email    string `json:"email"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
 }
 
 type controller struct {
-	k8sutil   *k8sutil.KubeUtilInterface
-	ecrClient ecrInterface
+	k8sutil *k8sutil.KubeUtilInterface
+
+	// reloadLock guards the config and the AWS clients, which a change of the config file replaces, see reloadConfig
+	reloadLock sync.RWMutex
+	ecrClient  ecrInterface
+	config     *Config
+
+	// ecrClients caches the clients of accounts outside the default region, created with newRegionalEcrClient
+	ecrClientsLock       sync.Mutex
+	ecrClients           map[string]ecrInterface
+	newRegionalEcrClient func(region, role string) ecrInterface
+	// newInstanceEcrClient creates the clients of the additional ECR providers of cfg, see ECRInstanceConfig
+	newInstanceEcrClient func(cfg *Config, name, region, role string) ecrInterface
+	// newECRClients builds the default and regional clients of a reloaded config, nil keeps the current clients
+	newECRClients func(cfg *Config) (ecrInterface, func(region, role string) ecrInterface, error)
+
+	// syncLock serializes namespace processing between the informer and the provider refresh timers
+	syncLock sync.Mutex
+	// pendingRollouts are the namespaces that got their first credentials but whose workloads were not rolled out yet,
+	// see --workload-rollout; guarded by syncLock
+	pendingRollouts map[string]bool
+
+	// secrets caches the last successfully generated secrets per provider, keyed by the provider's secret name
+	secretsLock sync.Mutex
+	secrets     map[string][]*v1.Secret
+	// tokens holds the tokens the cached secrets were generated from, keyed like secrets
+	tokens map[string][]AuthToken
+	// canarySecrets holds the secrets of a rotation the canary namespaces are verifying, keyed like secrets, see
+	// setCanarySecrets
+	canarySecrets map[string][]*v1.Secret
+
+	// rollouts holds when the running rollout of each provider's new secrets to the namespaces started, keyed by
+	// provider name and guarded by secretsLock
+	rollouts map[string]time.Time
+
+	// triggered is 1 while a refresh requested through /reconcile is running
+	triggered int32
+
+	status *statusTracker
+
+	// circuits holds the circuit breaker of every provider, see circuit
+	circuitsLock sync.Mutex
+	circuits     map[string]*circuitBreaker
+
+	// recorder records Events on the controller's Pod, nil disables them
+	recorder record.EventRecorder
+
+	// output replaces writing Secret objects when --output is not "secret"
+	output secretOutput
+
+	// fake replaces the ECR provider with --provider=fake
+	fake *providers.Fake
+	// tokenFiles replaces the ECR provider with --provider=file
+	tokenFiles *providers.File
+
+	// sinks receive the secrets of every successful refresh, e.g. --vault-addr
+	sinks []credentialSink
+
+	// events receives a CloudEvent per rotation with --cloudevents-sink, nil disables them
+	events *cloudEventSink
+
+	// verifyRegistry checks the tokens of a canary rotation against their registry, nil skips the check
+	verifyRegistry registryVerifier
+
+	// workloads patches the workloads of --workload-rollout, nil disables it
+	workloads client.Client
+
+	// newVClusterUtil connects to the API server of a vcluster, see --vcluster-selector
+	newVClusterUtil func(cfg *rest.Config) (*k8sutil.KubeUtilInterface, error)
+
+	// defaults are the provider settings of the flags and the environment, see validateParams
+	defaults providerDefaults
+
+	// stale marks the providers serving their cached tokens after a failed refresh, guarded by secretsLock
+	stale map[string]bool
+
+	// ecrFailedAccounts are the AWS accounts whose tokens the last fetch of an ECR provider could not get, keyed by
+	// provider name and guarded by secretsLock
+	ecrFailedAccounts map[string][]string
+
+	// caps are the optional features the controller's RBAC allows, see --probe-permissions
+	caps capabilities
+
+	// clampWarned holds the refresh interval a warning was last logged for per provider, see clampRefreshInterval
+	clampLock   sync.Mutex
+	clampWarned map[string]time.Duration
+
+	// initialSync holds /readyz back until every namespace was synced once, see --wait-for-initial-sync; nil disables it
+	initialSync *initialSync
+
+	// elected is closed once this replica leads, see --leader-elect; nil when no manager runs the controller
+	elected <-chan struct{}
+
+	// leaderCtx is the context of the leader's runnable, nil until it started; triggered refreshes run in it, so they
+	// stop with the leadership
+	leaderLock sync.Mutex
+	leaderCtx  context.Context
+
+	// refreshTimers holds the refresh timer of every provider by name, guarded by refreshTimersLock
+	refreshTimersLock sync.Mutex
+	refreshTimers     map[string]*providerTimer
+}
+
+func newController(util *k8sutil.KubeUtilInterface, ecrClient ecrInterface) *controller {
+	return &controller{
+		k8sutil:         util,
+		ecrClient:       ecrClient,
+		config:          &Config{},
+		ecrClients:      map[string]ecrInterface{},
+		secrets:         map[string][]*v1.Secret{},
+		tokens:          map[string][]AuthToken{},
+		canarySecrets:   map[string][]*v1.Secret{},
+		stale:           map[string]bool{},
+		rollouts:        map[string]time.Time{},
+		pendingRollouts: map[string]bool{},
+		defaults:        newProviderDefaults(),
+		status:          newStatusTracker(),
+		caps:            allCapabilities(),
+
+		ecrFailedAccounts: map[string][]string{},
+		refreshTimers:     map[string]*providerTimer{},
+		newVClusterUtil:   newVClusterUtil,
+	}
 }
 
 // RetryConfig represents the number of retries + the retry delay for retrying an operation if it should fail
@@ -117,319 +383,955 @@ type RetryConfig struct {
 	Type                string
 	NumberOfRetries     int
 	RetryDelayInSeconds int
-}
 
-type ecrInterface interface {
-	GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error)
+	// Exponential timer tuning; zero values keep the backoff library defaults
+	InitialInterval time.Duration
+	Multiplier      float64
+	MaxInterval     time.Duration
+	MaxElapsedTime  time.Duration
 }
 
-func newEcrClient() ecrInterface {
-	sess := session.Must(session.NewSession())
+type ecrInterface = providers.ECRClient
+
+// newAWSConfig returns the AWS config shared by all AWS clients, assuming the role of the options if set
+func newAWSConfig(sess *session.Session, opts awsClientOptions) *aws.Config {
 	awsConfig := aws.NewConfig().WithRegion(*argAWSRegion)
 
-	if *argAWSAssumeRole != "" {
-		creds := stscreds.NewCredentials(sess, *argAWSAssumeRole)
+	if opts.AssumeRole != "" {
+		creds := stscreds.NewCredentials(sess, opts.AssumeRole)
 		awsConfig.Credentials = creds
 	}
 
-	return ecr.New(sess, awsConfig)
+	return awsConfig
 }
 
-func (c *controller) getECRAuthorizationKey() ([]AuthToken, error) {
-	var tokens []AuthToken
+func newRegionalEcrClient(region string, opts awsClientOptions) (ecrInterface, error) {
+	sess, err := newAWSSession(opts)
+	if err != nil {
+		return nil, err
+	}
+	return ecr.New(sess, newAWSConfig(sess, opts).WithRegion(region)), nil
+}
+
+// unavailableEcrClient stands in for a client that could not be created, failing every request with the reason
+type unavailableEcrClient struct {
+	err error
+}
+
+func (u unavailableEcrClient) GetAuthorizationTokenWithContext(aws.Context, *ecr.GetAuthorizationTokenInput, ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+	return nil, u.err
+}
 
-	regIds := make([]*string, len(awsAccountIDs))
-	for i, awsAccountID := range awsAccountIDs {
-		regIds[i] = aws.String(awsAccountID)
+// lazyRegionalEcrClient creates a client on first use, when an error can only be reported by its requests
+func lazyRegionalEcrClient(region string, opts awsClientOptions) ecrInterface {
+	client, err := newRegionalEcrClient(region, opts)
+	if err != nil {
+		log.Errorf("Could not create the ECR client of region %s! [Err: %s]", region, err)
+		return unavailableEcrClient{err: err}
+	}
+	return client
+}
+
+// newECRClientOptions returns the options of the AWS clients of the ecr provider configured by cfg
+func newECRClientOptions(util *k8sutil.KubeUtilInterface, cfg *Config, name string, defaults providerDefaults) awsClientOptions {
+	opts := awsClientOptions{TLS: cfg.providerTLS(name), AssumeRole: cfg.providerAWSSettings(name, defaults).AssumeRole}
+	if ref := cfg.credentialsSecretRef(name); ref != nil {
+		log.Infof("Reading the AWS credentials from secret %s/%s", ref.namespace(), ref.Name)
+		opts.Credentials = newSecretAWSCredentials(util, ref)
 	}
+	return opts
+}
+
+// currentConfig returns the config file the controller last loaded
+func (c *controller) currentConfig() *Config {
+	c.reloadLock.RLock()
+	defer c.reloadLock.RUnlock()
+	return c.config
+}
 
-	params := &ecr.GetAuthorizationTokenInput{
-		RegistryIds: regIds,
+// ecrProvider returns the ECR provider of the configured accounts, sharing the controller's regional clients
+func (c *controller) ecrProvider() *providers.ECR {
+	c.reloadLock.RLock()
+	client, settings := c.ecrClient, c.config.awsSettings(c.defaults)
+	c.reloadLock.RUnlock()
+	return &providers.ECR{
+		Client:         client,
+		Region:         settings.Region,
+		AccountIDs:     settings.AccountIDs,
+		AccountRegions: settings.AccountRegions,
+		AccountRoles:   settings.AccountRoles,
+		ClientFor:      func(region string) ecrInterface { return c.ecrClientFor(region, "") },
+		ClientForRole:  c.ecrClientFor,
+		Concurrency:    *argECRConcurrency,
+		CallTimeout:    *argProviderTimeout,
 	}
+}
 
-	resp, err := c.ecrClient.GetAuthorizationToken(params)
+// newFileProvider returns the file provider configured by the --token-file* flags
+func newFileProvider() *providers.File {
+	return &providers.File{
+		Paths:  *argTokenFiles,
+		MaxAge: *argTokenFileMaxAge,
+	}
+}
 
+// newFakeProvider returns the fake provider configured by the --fake-* flags
+func newFakeProvider() *providers.Fake {
+	return &providers.Fake{
+		Registries: *argFakeRegistries,
+		Expiry:     *argFakeTokenExpiry,
+		FailEvery:  *argFakeFailEvery,
+		MinRefresh: *argFakeMinRefresh,
+	}
+}
+
+// newProviderController returns a controller with the providers of the flags and cfg and no output
+func newProviderController(util *k8sutil.KubeUtilInterface, cfg *Config, defaults providerDefaults) *controller {
+	c := newController(util, nil)
+	c.defaults = defaults
+	c.newECRClients = func(cfg *Config) (ecrInterface, func(region, role string) ecrInterface, error) {
+		opts := newECRClientOptions(util, cfg, providerECR, defaults)
+		client, err := newRegionalEcrClient(cfg.awsSettings(defaults).Region, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func(region, role string) ecrInterface {
+			if role == "" {
+				return lazyRegionalEcrClient(region, opts)
+			}
+			// an account role is assumed with the base credentials instead of the default assumed role
+			accountOpts := opts
+			accountOpts.AssumeRole = role
+			return lazyRegionalEcrClient(region, accountOpts)
+		}, nil
+	}
+	c.newInstanceEcrClient = func(cfg *Config, name, region, role string) ecrInterface {
+		opts := newECRClientOptions(util, cfg, name, defaults)
+		if role != "" {
+			opts.AssumeRole = role
+		}
+		return lazyRegionalEcrClient(region, opts)
+	}
+	var err error
+	c.ecrClient, c.newRegionalEcrClient, err = c.newECRClients(cfg)
 	if err != nil {
-		// Print the error, cast err to awserr.Error to get the Code and
-		// Message from an error.
-		log.Println(err.Error())
-		return []AuthToken{}, err
+		log.Fatalf("Could not create the ECR client! [Err: %s]", err)
+	}
+	c.config = cfg
+	warnInsecureTokenExchange(cfg)
+	if *argProvider == providerFake {
+		log.Infof("Using the fake provider for %s; no cloud credentials are used", strings.Join(*argFakeRegistries, ","))
+		c.fake = newFakeProvider()
 	}
+	if *argProvider == providerFile {
+		log.Infof("Distributing the tokens of %s; no cloud API is called", strings.Join(*argTokenFiles, ","))
+		c.tokenFiles = newFileProvider()
+	}
+	return c
+}
 
-	for _, auth := range resp.AuthorizationData {
-		tokens = append(tokens, AuthToken{
-			AccessToken: *auth.AuthorizationToken,
-			Endpoint:    *auth.ProxyEndpoint,
-		})
+// newWriteRetry returns the retries of failed Kubernetes writes configured by the --kube-api-write-* flags
+func newWriteRetry() *k8sutil.WriteRetry {
+	return &k8sutil.WriteRetry{
+		Retries:        *argKubeAPIWriteRetries,
+		InitialBackoff: *argKubeAPIWriteBackoff,
+		MaxBackoff:     *argKubeAPIWriteMaxBackoff,
+		OnRetry:        observeWriteRetry,
 	}
+}
 
-	return tokens, nil
+func (c *controller) getECRAuthorizationKey(ctx context.Context) ([]AuthToken, error) {
+	return c.ecrTokens(ctx, providerECR, *argAWSSecretName, c.ecrProvider())
 }
 
-func generateSecretObj(tokens []AuthToken, isJSONCfg bool, secretName string) (*v1.Secret, error) {
+// ecrTokens fetches the tokens of the ECR provider name, whose secret is secretName, keeping the previous tokens of
+// the accounts that failed
+func (c *controller) ecrTokens(ctx context.Context, name, secretName string, provider *providers.ECR) ([]AuthToken, error) {
+	tokens, err := provider.Tokens(ctx)
+	var partial *providers.PartialError
+	if errors.As(err, &partial) {
+		return c.keepFailedAccounts(name, secretName, tokens, partial), nil
+	}
+	c.recordFailedAccounts(name, nil)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return tokens, err
+}
+
+func generateSecretObj(tokens []AuthToken, secretGenerator SecretGenerator) (*v1.Secret, error) {
 	secret := &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: secretName,
+			Name: secretGenerator.SecretName,
 		},
 	}
-	if isJSONCfg {
-		auths := map[string]registryAuth{}
-		for _, token := range tokens {
-			auths[token.Endpoint] = registryAuth{
-				Auth:  token.AccessToken,
-				Email: "none",
-			}
+	setManagedMetadata(&secret.ObjectMeta)
+	auths := map[string]registryAuth{}
+	for _, token := range tokens {
+		auth, err := newRegistryAuth(secretGenerator.Name, token, secretGenerator.DockerConfig)
+		if err != nil {
+			return secret, err
 		}
+		for _, endpoint := range secretGenerator.DockerConfig.endpoints(token.Endpoint) {
+			auths[endpoint] = auth
+		}
+	}
+	if secretGenerator.IsJSONCfg {
 		configJSON, err := json.Marshal(dockerJSON{Auths: auths})
 		if err != nil {
 			return secret, err
 		}
-		secret.Data = map[string][]byte{".dockerconfigjson": configJSON}
-		secret.Type = "kubernetes.io/dockerconfigjson"
-	} else if len(tokens) == 1 {
-		secret.Data = map[string][]byte{
-			".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, tokens[0].Endpoint, tokens[0].AccessToken))}
-		secret.Type = "kubernetes.io/dockercfg"
+		secret.Data = map[string][]byte{v1.DockerConfigJsonKey: configJSON}
+		secret.Type = v1.SecretTypeDockerConfigJson
+	} else {
+		// the legacy format is the auths map of a docker config without the enclosing "auths" key
+		configJSON, err := json.Marshal(auths)
+		if err != nil {
+			return secret, err
+		}
+		secret.Data = map[string][]byte{v1.DockerConfigKey: configJSON}
+		secret.Type = v1.SecretTypeDockercfg
+	}
+	if expiry := providers.EarliestExpiry(tokens); !expiry.IsZero() {
+		secret.Annotations = mergeStringMaps(secret.Annotations, map[string]string{expiresAtAnnotation: expiry.UTC().Format(time.RFC3339)})
+	}
+	if err := secretGenerator.Secret.apply(secret, secretGenerator.Name, tokens, secretGenerator.DockerConfig); err != nil {
+		return secret, err
 	}
 	return secret, nil
 }
 
 // AuthToken represents an Access Token and an Endpoint for a registry service
-type AuthToken struct {
-	AccessToken string
-	Endpoint    string
-}
+type AuthToken = providers.AuthToken
 
 // SecretGenerator represents a token generation function for a registry service
 type SecretGenerator struct {
-	TokenGenFxn func() ([]AuthToken, error)
-	IsJSONCfg   bool
-	SecretName  string
+	Name string
+	// TokenGenFxn returns the provider's tokens, with ExpiresAt set when the provider knows it; fetchTokens normalizes
+	// their Endpoint and Registry
+	TokenGenFxn     func(ctx context.Context) ([]AuthToken, error)
+	IsJSONCfg       bool
+	SecretName      string
+	RefreshInterval time.Duration
+	RefreshJitter   float64
+	Retry           RetryConfig
+	DockerConfig    DockerConfigOptions
+	Secret          SecretOptions
+	// FetchTimeout bounds a whole fetchTokens call including its retries, 0 for none
+	FetchTimeout time.Duration
+	// Namespaces limits the namespaces the secret is distributed to, nil for every namespace
+	Namespaces *NamespaceSelector
+	// MinRefreshInterval is the shortest refresh interval the provider declares, see providers.MinRefresher; a
+	// shorter RefreshInterval is raised to it
+	MinRefreshInterval time.Duration
 }
 
 func getSecretGenerators(c *controller) []SecretGenerator {
 	secretGenerators := make([]SecretGenerator, 0)
 
-	secretGenerators = append(secretGenerators, SecretGenerator{
-		TokenGenFxn: c.getECRAuthorizationKey,
-		IsJSONCfg:   true,
-		SecretName:  *argAWSSecretName,
-	})
+	if c.fake != nil {
+		secretGenerators = append(secretGenerators, SecretGenerator{
+			Name:            providerFake,
+			TokenGenFxn:     c.fake.Tokens,
+			IsJSONCfg:       true,
+			SecretName:      *argFakeSecretName,
+			RefreshInterval: time.Duration(*argRefreshMinutes) * time.Minute,
+			RefreshJitter:   *argRefreshJitter,
+			Retry:           c.defaults.Retry,
+			FetchTimeout:    *argProviderFetchTimeout,
+		})
+	} else if c.tokenFiles != nil {
+		secretGenerators = append(secretGenerators, SecretGenerator{
+			Name:            providerFile,
+			TokenGenFxn:     c.tokenFiles.Tokens,
+			IsJSONCfg:       true,
+			SecretName:      *argTokenFileSecretName,
+			RefreshInterval: time.Duration(*argRefreshMinutes) * time.Minute,
+			RefreshJitter:   *argRefreshJitter,
+			Retry:           c.defaults.Retry,
+			FetchTimeout:    *argProviderFetchTimeout,
+		})
+	} else {
+		secretGenerators = append(secretGenerators, SecretGenerator{
+			Name:            providerECR,
+			TokenGenFxn:     c.getECRAuthorizationKey,
+			IsJSONCfg:       true,
+			SecretName:      *argAWSSecretName,
+			RefreshInterval: time.Duration(*argRefreshMinutes) * time.Minute,
+			RefreshJitter:   *argRefreshJitter,
+			Retry:           c.defaults.Retry,
+			FetchTimeout:    *argProviderFetchTimeout,
+		})
+	}
+
+	cfg := c.currentConfig()
+	if settings := cfg.tokenExchange(); settings != nil {
+		secretGenerators = append(secretGenerators, SecretGenerator{
+			Name:            providerTokenExchange,
+			TokenGenFxn:     c.tokenExchangeTokens,
+			IsJSONCfg:       true,
+			SecretName:      settings.secretName(),
+			RefreshInterval: time.Duration(*argRefreshMinutes) * time.Minute,
+			RefreshJitter:   *argRefreshJitter,
+			Retry:           c.defaults.Retry,
+			FetchTimeout:    *argProviderFetchTimeout,
+		})
+	}
+	for _, p := range cfg.ecrInstances() {
+		secretGenerators = append(secretGenerators, SecretGenerator{
+			Name:            p.Name,
+			TokenGenFxn:     c.ecrInstanceTokens(p.Name, p.ECR.SecretName),
+			IsJSONCfg:       true,
+			SecretName:      p.ECR.SecretName,
+			RefreshInterval: time.Duration(*argRefreshMinutes) * time.Minute,
+			RefreshJitter:   *argRefreshJitter,
+			Retry:           c.defaults.Retry,
+			FetchTimeout:    *argProviderFetchTimeout,
+		})
+	}
+	for i := range secretGenerators {
+		cfg.applyTo(&secretGenerators[i])
+		secretGenerators[i].MinRefreshInterval = c.minRefreshInterval(cfg, secretGenerators[i].Name)
+		c.clampRefreshInterval(&secretGenerators[i])
+	}
 
 	return secretGenerators
 }
 
-func (c *controller) processNamespace(namespace *v1.Namespace, secret *v1.Secret) error {
+func (c *controller) processNamespace(ctx context.Context, namespace *v1.Namespace, secret *v1.Secret) error {
 	logw := log.WithField("function", "processNamespace")
-	// Check if the secret exists for the namespace
-	logw.Debugf("checking for secret %s in namespace %s", secret.Name, namespace.GetName())
-	_, err := c.k8sutil.GetSecret(namespace.GetName(), secret.Name)
+	switch c.output.(type) {
+	case vaultOutput:
+		// the credentials only go to Vault, once per refresh
+		return nil
+	case agentOutput:
+		// the nodes fetch the credentials from the agent
+		return nil
+	}
+	if c.output != nil {
+		if err := c.output.write(ctx, namespace.GetName(), secret); err != nil {
+			return err
+		}
+		logw.Infof("Wrote secret %s for namespace %s to --output %s", secret.Name, namespace.GetName(), *argOutput)
+		if o, ok := c.output.(*propagationOutput); ok && !o.patchesServiceAccounts() {
+			return nil
+		}
+		if _, ok := c.output.(*kmsOutput); ok {
+			// the kubelet cannot pull with an encrypted secret
+			return nil
+		}
+		return c.patchServiceAccounts(ctx, namespace, secret)
+	}
 
+	secret, err := c.claimSecret(ctx, namespace.GetName(), secret)
+	if err != nil || secret == nil {
+		return err
+	}
+	previous := c.previousSecret(ctx, namespace.GetName(), secret.Name)
+	created, err := secretsync.EnsureSecret(ctx, c.k8sutil, namespace.GetName(), secret)
 	if err != nil {
-		logw.Debugf("Could not find secret %s in namespace %s; will try to create it", secret.Name, namespace.GetName())
-		// Secret not found, create
-		err := c.k8sutil.CreateSecret(namespace.GetName(), secret)
-		if err != nil {
-			return fmt.Errorf("could not create Secret: %v", err)
-		}
+		return err
+	}
+	if created {
 		logw.Infof("Created new secret %s in namespace %s", secret.Name, namespace.GetName())
 	} else {
-		// Existing secret needs updated
-		logw.Debugf("Found secret %s in namespace %s; will try to update it", secret.Name, namespace.GetName())
-		err := c.k8sutil.UpdateSecret(namespace.GetName(), secret)
-		if err != nil {
-			return fmt.Errorf("could not update Secret: %v", err)
-		}
 		logw.Infof("Updated secret %s in namespace %s", secret.Name, namespace.GetName())
+		if previous != nil {
+			logw.Debugf("Changes of secret %s in namespace %s: %s", secret.Name, namespace.GetName(), orNone(secretDiff(previous, secret)))
+		}
 	}
 
-	// Check if ServiceAccount exists
-	serviceAccount, err := c.k8sutil.GetServiceAccount(namespace.GetName(), "default")
-	if err != nil {
-		logw.Errorf("error getting service account default in namespace %s: %s", namespace.GetName(), err)
-		return fmt.Errorf("could not get ServiceAccounts: %v", err)
-	}
+	return c.patchServiceAccounts(ctx, namespace, secret)
+}
 
-	// Update existing one if image pull secrets already exists for aws ecr token
-	imagePullSecretFound := false
-	for i, imagePullSecret := range serviceAccount.ImagePullSecrets {
-		if imagePullSecret.Name == secret.Name {
-			serviceAccount.ImagePullSecrets[i] = v1.LocalObjectReference{Name: secret.Name}
-			imagePullSecretFound = true
-			break
+// patchServiceAccounts references the secret from every selected ServiceAccount, carrying on with the others if one fails
+func (c *controller) patchServiceAccounts(ctx context.Context, namespace *v1.Namespace, secret *v1.Secret) error {
+	logw := log.WithField("function", "patchServiceAccounts")
+	if !c.caps.updateServiceAccounts {
+		// secrets-only mode, logged at startup
+		return nil
+	}
+	annotated := namespace.Annotations[serviceAccountsAnnotation] != ""
+	var errs []error
+	for _, name := range serviceAccountNames(namespace) {
+		err := c.patchServiceAccount(ctx, namespace.GetName(), name, secret.Name)
+		switch {
+		case err == nil:
+		case k8sutil.IsNotFound(err) && annotated:
+			// a ServiceAccount named by the namespace owners may not have been created yet
+			logw.Warnf("Skipping service account %s in namespace %s selected by %s: %s", name, namespace.GetName(), serviceAccountsAnnotation, err)
+		case k8sutil.IsNotFound(err) && (*argOpenShift || newNamespace(namespace)):
+			// the ServiceAccounts of a namespace are created some time after it, on OpenShift even later, and the
+			// ServiceAccount watch syncs the namespace again once they exist
+			logw.Infof("Waiting for service account %s in namespace %s to be created: %s", name, namespace.GetName(), err)
+		case k8sutil.IsNotFound(err):
+			logw.Errorf("error getting service account %s in namespace %s: %s", name, namespace.GetName(), err)
+			return fmt.Errorf("could not get ServiceAccounts: %w", err)
+		default:
+			errs = append(errs, err)
 		}
 	}
+	return utilerrors.NewAggregate(errs)
+}
 
-	// Append to list of existing service accounts if there isn't one already
-	if !imagePullSecretFound {
-		serviceAccount.ImagePullSecrets = append(serviceAccount.ImagePullSecrets, v1.LocalObjectReference{Name: secret.Name})
+// patchServiceAccount adds secretName to the ServiceAccount's imagePullSecrets, honouring the ordering options
+func (c *controller) patchServiceAccount(ctx context.Context, namespace, name, secretName string) error {
+	logw := log.WithField("function", "patchServiceAccount")
+	logw.Infof("Updating ServiceAccount %s in namespace %s", name, namespace)
+	err := secretsync.AttachToServiceAccount(ctx, c.serviceAccountClient(), namespace, name, secretName, c.managedSecretNames(), currentPullSecretOptions())
+	if k8sutil.IsNotFound(err) && *argCreateServiceAccounts && c.caps.createServiceAccounts {
+		err = c.createServiceAccount(ctx, namespace, name, secretName)
 	}
-
-	logw.Infof("Updating ServiceAccount %s in namespace %s", serviceAccount.Name, namespace.GetName())
-	err = c.k8sutil.UpdateServiceAccount(namespace.GetName(), serviceAccount)
-	if err != nil {
-		logw.Errorf("error updating ServiceAccount %s in namespace %s: %s", serviceAccount.Name, namespace.GetName(), err)
-		return fmt.Errorf("could not update ServiceAccount: %v", err)
+	if errors.Is(err, secretsync.ErrSkipped) {
+		logw.Infof("Leaving ServiceAccount %s in namespace %s alone, it is annotated %s", name, namespace, secretsync.SkipAnnotation)
+		return nil
 	}
+	if err != nil && !k8sutil.IsNotFound(err) {
+		logw.Errorf("error updating ServiceAccount %s in namespace %s: %s", name, namespace, err)
+		return fmt.Errorf("could not update ServiceAccount: %w", err)
+	}
+	return err
+}
 
-	return nil
+// createServiceAccount creates a missing ServiceAccount with the secret already attached; when the ServiceAccount
+// controller created it in the meantime, the secret is attached to that one instead
+func (c *controller) createServiceAccount(ctx context.Context, namespace, name, secretName string) error {
+	sa := &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	setManagedMetadata(&sa.ObjectMeta)
+	secretsync.AttachPullSecret(sa, secretName, c.managedSecretNames(), currentPullSecretOptions())
+	err := c.k8sutil.CreateServiceAccount(ctx, namespace, sa)
+	if k8sutil.IsAlreadyExists(err) {
+		return secretsync.AttachToServiceAccount(ctx, c.serviceAccountClient(), namespace, name, secretName, c.managedSecretNames(), currentPullSecretOptions())
+	}
+	if err == nil {
+		log.Infof("Created ServiceAccount %s in namespace %s", name, namespace)
+	}
+	return err
 }
 
-func (c *controller) generateSecrets() []*v1.Secret {
-	var secrets []*v1.Secret
-	secretGenerators := getSecretGenerators(c)
-
-	maxTries := RetryCfg.NumberOfRetries + 1
-	for _, secretGenerator := range secretGenerators {
-		resetRetryTimer()
-
-		var newTokens []AuthToken
-		tries := 0
-		for {
-			tries++
-			log.Infof("Getting secret; try #%d of %d", tries, maxTries)
-			tokens, err := secretGenerator.TokenGenFxn()
-			if err != nil {
-				if tries < maxTries {
-					delayDuration := nextRetryDuration()
-					if delayDuration == backoff.Stop {
-						log.Errorf("Error getting secret for provider %s. Retry timer exceeded max tries/duration; will not try again until the next refresh cycle. [Err: %s]", secretGenerator.SecretName, err)
-						break
-					}
-					log.Errorf("Error getting secret for provider %s. Will try again after %f seconds. [Err: %s]", secretGenerator.SecretName, delayDuration.Seconds(), err)
-					<-time.After(delayDuration)
-					continue
+// fetchTokens calls the provider's token function, retrying according to the provider's retry configuration
+func fetchTokens(ctx context.Context, secretGenerator SecretGenerator) ([]AuthToken, error) {
+	if secretGenerator.FetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, secretGenerator.FetchTimeout)
+		defer cancel()
+	}
+	retryTimer := secretGenerator.Retry.newBackOff()
+
+	maxTries := secretGenerator.Retry.NumberOfRetries + 1
+	tries := 0
+	for {
+		tries++
+		log.Infof("Getting secret; try #%d of %d", tries, maxTries)
+		tokens, err := secretGenerator.TokenGenFxn(ctx)
+		if err != nil {
+			if tries < maxTries {
+				delayDuration := retryTimer.NextBackOff()
+				if delayDuration == backoff.Stop {
+					log.Errorf("Error getting secret for provider %s. Retry timer exceeded max tries/duration; will not try again until the next refresh cycle. [Err: %s]", secretGenerator.SecretName, err)
+					return nil, err
+				}
+				log.Errorf("Error getting secret for provider %s. Will try again after %f seconds. [Err: %s]", secretGenerator.SecretName, delayDuration.Seconds(), err)
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(delayDuration):
 				}
-				log.Errorf("Error getting secret for provider %s. Tried %d time(s); will not try again until the next refresh cycle. [Err: %s]", secretGenerator.SecretName, tries, err)
-				// os.Exit(1)
-				break
-			} else {
-				log.Infof("Successfully got secret for provider %s after trying %d time(s)", secretGenerator.SecretName, tries)
-				newTokens = tokens
-				break
+				continue
 			}
+			log.Errorf("Error getting secret for provider %s. Tried %d time(s); will not try again until the next refresh cycle. [Err: %s]", secretGenerator.SecretName, tries, err)
+			return nil, err
 		}
+		log.Infof("Successfully got secret for provider %s after trying %d time(s)", secretGenerator.SecretName, tries)
+		return filterRegistries(secretGenerator.Name, providers.Normalize(tokens)), nil
+	}
+}
 
-		newSecret, err := generateSecretObj(newTokens, secretGenerator.IsJSONCfg, secretGenerator.SecretName)
-		if err != nil {
-			log.Errorf("Error generating secret for provider %s. Skipping secret provider until the next refresh cycle! [Err: %s]", secretGenerator.SecretName, err)
-		} else {
-			secrets = append(secrets, newSecret)
+// pendingRotation holds the tokens and secrets of a successful fetch until they are committed, see commitRotation
+type pendingRotation struct {
+	secretGenerator SecretGenerator
+	tokens          []AuthToken
+	secrets         []*v1.Secret
+}
+
+// refreshSecret fetches new tokens for the provider and caches the resulting secrets if the fetch succeeded;
+// the provider's output is split over several secrets when it would exceed --secret-split-size
+func (c *controller) refreshSecret(ctx context.Context, secretGenerator SecretGenerator) ([]*v1.Secret, bool, error) {
+	secrets, pending, err := c.fetchSecret(ctx, secretGenerator)
+	if pending == nil {
+		return secrets, false, err
+	}
+	c.commitRotation(ctx, pending)
+	return secrets, true, nil
+}
+
+// fetchSecret fetches new tokens for the provider and returns the resulting secrets with the rotation that caches
+// them once committed. A failed fetch returns the restored or empty secrets and no rotation.
+func (c *controller) fetchSecret(ctx context.Context, secretGenerator SecretGenerator) ([]*v1.Secret, *pendingRotation, error) {
+	if !c.circuit(secretGenerator.Name).allow(time.Now(), *argCircuitBreakerInterval) {
+		log.Debugf("Circuit of provider %s is open; skipping the token fetch", secretGenerator.Name)
+		return nil, nil, nil
+	}
+	tokens, fetchErr := fetchTokens(ctx, secretGenerator)
+	if ctx.Err() == nil {
+		// a shutdown is not the provider's fault
+		c.recordProviderResult(secretGenerator.Name, fetchErr)
+	}
+
+	newSecret, err := generateSecretObj(distributedTokens(tokens), secretGenerator)
+	if err != nil {
+		return nil, nil, err
+	}
+	newSecrets, err := splitSecret(newSecret, *argSecretSplitSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fetchErr != nil {
+		if restored := c.restoreTokens(ctx, secretGenerator); restored != nil {
+			newSecrets = restored
 		}
+		c.recordStale(secretGenerator, fetchErr, time.Now())
+		return newSecrets, nil, nil
 	}
-	return secrets
+	c.recordStale(secretGenerator, nil, time.Now())
+	c.recordRotation(ctx, c.cachedSecrets(secretGenerator.SecretName), newSecrets)
+	return newSecrets, &pendingRotation{secretGenerator: secretGenerator, tokens: tokens, secrets: newSecrets}, nil
 }
 
-// SetupRetryTimer initializes and configures the Retry Timer
-func SetupRetryTimer() {
-	delayDuration := time.Duration(RetryCfg.RetryDelayInSeconds) * time.Second
-	switch RetryCfg.Type {
-	case retryTypeSimple:
-		simpleBackoff = backoff.NewConstantBackOff(delayDuration)
-	case retryTypeExponential:
-		exponentialBackoff = backoff.NewExponentialBackOff()
+// commitRotation makes the fetched secrets the provider's current ones: the reconciler, the agent and the expiry
+// scheduling use them from then on, and they are written to the rendered files, the sinks and the token store
+func (c *controller) commitRotation(ctx context.Context, pending *pendingRotation) {
+	secretGenerator := pending.secretGenerator
+	recordTokenExpiry(secretGenerator, pending.tokens, time.Now())
+	if err := c.writeRenderedFormats(ctx, secretGenerator, pending.tokens); err != nil {
+		log.Errorf("Error writing the rendered credentials of provider %s! [Err: %s]", secretGenerator.Name, err)
+	}
+	if err := c.writeSinks(ctx, secretGenerator, pending.secrets); err != nil {
+		log.Errorf("Error writing the credentials of provider %s! [Err: %s]", secretGenerator.Name, err)
+	}
+
+	c.secretsLock.Lock()
+	previousTokens := c.tokens[secretGenerator.SecretName]
+	for _, old := range c.secrets[secretGenerator.SecretName] {
+		secretSizeBytes.DeleteLabelValues(secretGenerator.Name, old.Name)
+	}
+	c.secrets[secretGenerator.SecretName] = pending.secrets
+	c.tokens[secretGenerator.SecretName] = pending.tokens
+	c.secretsLock.Unlock()
+	recordSecretSizes(secretGenerator.Name, pending.secrets)
+	if err := c.persistTokens(ctx, secretGenerator, previousTokens, pending.tokens); err != nil {
+		log.Errorf("Could not persist the credentials of provider %s! [Err: %s]", secretGenerator.Name, err)
 	}
 }
 
-func resetRetryTimer() {
-	switch RetryCfg.Type {
-	case retryTypeSimple:
-		simpleBackoff.Reset()
-	case retryTypeExponential:
-		exponentialBackoff.Reset()
+// cachedSecrets returns the secrets last generated for a provider, nil if there are none yet
+func (c *controller) cachedSecrets(secretName string) []*v1.Secret {
+	c.secretsLock.Lock()
+	defer c.secretsLock.Unlock()
+	return c.secrets[secretName]
+}
+
+// generateSecrets returns the current secrets of every provider, fetching tokens for providers that have none cached yet
+func (c *controller) generateSecrets(ctx context.Context) []*v1.Secret {
+	return c.generateProviderSecrets(ctx, getSecretGenerators(c))
+}
+
+// generateProviderSecrets fetches the uncached providers, and those whose cached tokens expired, concurrently, so a slow
+// provider does not delay the others, and returns the secrets in the order of the providers
+func (c *controller) generateProviderSecrets(ctx context.Context, secretGenerators []SecretGenerator) []*v1.Secret {
+	results := make([][]*v1.Secret, len(secretGenerators))
+
+	var wg sync.WaitGroup
+	for i, secretGenerator := range secretGenerators {
+		if cached := c.servableSecrets(secretGenerator.SecretName, time.Now()); cached != nil {
+			results[i] = cached
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, secretGenerator SecretGenerator) {
+			defer wg.Done()
+			newSecrets, _, err := c.refreshSecret(ctx, secretGenerator)
+			if err != nil {
+				log.Errorf("Error generating secret for provider %s. Skipping secret provider until the next refresh cycle! [Err: %s]", secretGenerator.SecretName, err)
+				return
+			}
+			results[i] = newSecrets
+		}(i, secretGenerator)
 	}
+	wg.Wait()
+
+	var secrets []*v1.Secret
+	for _, result := range results {
+		secrets = append(secrets, result...)
+	}
+	return secrets
 }
 
-func nextRetryDuration() time.Duration {
-	switch RetryCfg.Type {
-	case retryTypeSimple:
-		return simpleBackoff.NextBackOff()
+// newBackOff returns a fresh retry timer for cfg; every fetch gets its own so providers never share timer state
+func (cfg RetryConfig) newBackOff() backoff.BackOff {
+	switch cfg.Type {
 	case retryTypeExponential:
-		return exponentialBackoff.NextBackOff()
+		return newExponentialBackOff(cfg)
+	case retryTypeSimple:
+		return backoff.NewConstantBackOff(time.Duration(cfg.RetryDelayInSeconds) * time.Second)
 	default:
-		return time.Duration(defaultTokenGenRetryDelay) * time.Second
+		return backoff.NewConstantBackOff(time.Duration(defaultTokenGenRetryDelay) * time.Second)
+	}
+}
+
+// newExponentialBackOff returns the library defaults overridden by any non-zero values of cfg
+func newExponentialBackOff(cfg RetryConfig) *backoff.ExponentialBackOff {
+	b := backoff.NewExponentialBackOff()
+	if cfg.InitialInterval > 0 {
+		b.InitialInterval = cfg.InitialInterval
+	}
+	if cfg.Multiplier > 0 {
+		b.Multiplier = cfg.Multiplier
+	}
+	if cfg.MaxInterval > 0 {
+		b.MaxInterval = cfg.MaxInterval
 	}
+	if cfg.MaxElapsedTime > 0 {
+		b.MaxElapsedTime = cfg.MaxElapsedTime
+	}
+	b.Reset()
+	return b
 }
 
-func validateParams() {
+// validateParams applies the environment overrides and falls back to a default for every invalid setting; it returns
+// the resulting provider defaults and all problems it found, see reportConfigProblems
+func validateParams() (providerDefaults, configProblems) {
+	var problems configProblems
+	defaults := newProviderDefaults()
+
 	// Allow environment variables to overwrite args
-	awsAccountIDEnv := os.Getenv("awsaccount")
-	awsRegionEnv := os.Getenv("awsregion")
-	argAWSAssumeRoleEnv := os.Getenv("aws_assume_role")
+	bindEnv(flags, &problems)
+
+	level, err := log.ParseLevel(*argLogLevel)
+	if err != nil {
+		problems.flag("log-level", *argLogLevel, "unknown log level", "defaulting to info")
+		level = log.InfoLevel
+	}
+	log.SetLevel(level)
 
 	// initialize the retry configuration using command line values
-	RetryCfg = RetryConfig{
+	retry := RetryConfig{
 		Type:                *argTokenGenFxnRetryType,
 		NumberOfRetries:     *argTokenGenFxnRetries,
 		RetryDelayInSeconds: *argTokenGenFxnRetryDelay,
+		InitialInterval:     *argTokenRetryInitial,
+		Multiplier:          *argTokenRetryMultiplier,
+		MaxInterval:         *argTokenRetryMaxInterval,
+		MaxElapsedTime:      *argTokenRetryMaxElapsed,
 	}
 	// ensure command line values are valid
-	if RetryCfg.Type != retryTypeSimple && RetryCfg.Type != retryTypeExponential {
-		log.Errorf("Unknown Retry Timer type '%s'! Defaulting to %s", RetryCfg.Type, defaultTokenGenRetryType)
-		RetryCfg.Type = defaultTokenGenRetryType
-	}
-	if RetryCfg.NumberOfRetries < 0 {
-		log.Errorf("Cannot use a negative value for the number of retries! Defaulting to %d", defaultTokenGenRetries)
-		RetryCfg.NumberOfRetries = defaultTokenGenRetries
-	}
-	if RetryCfg.RetryDelayInSeconds < 0 {
-		log.Errorf("Cannot use a negative value for the retry delay in seconds! Defaulting to %d", defaultTokenGenRetryDelay)
-		RetryCfg.RetryDelayInSeconds = defaultTokenGenRetryDelay
-	}
-	// look for overrides in environment variables and use them if they exist and are valid
-	tokenType, ok := os.LookupEnv(tokenGenRetryTypeKey)
-	if ok && len(tokenType) > 0 {
-		if tokenType != retryTypeSimple && tokenType != retryTypeExponential {
-			log.Errorf("Unknown Retry Timer type '%s'! Defaulting to %s", tokenType, defaultTokenGenRetryType)
-			RetryCfg.Type = defaultTokenGenRetryType
-		} else {
-			RetryCfg.Type = tokenType
-		}
-	}
-	tokenRetries, ok := os.LookupEnv(tokenGenRetriesKey)
-	if ok && len(tokenRetries) > 0 {
-		tokenRetriesInt, err := strconv.Atoi(tokenRetries)
-		if err != nil {
-			log.Errorf("Unable to parse value of environment variable %s! [Err: %s]", tokenGenRetriesKey, err)
-		} else {
-			if tokenRetriesInt < 0 {
-				log.Errorf("Cannot use a negative value for environment variable %s! Defaulting to %d", tokenGenRetriesKey, defaultTokenGenRetries)
-				RetryCfg.NumberOfRetries = defaultTokenGenRetries
-			} else {
-				RetryCfg.NumberOfRetries = tokenRetriesInt
-			}
+	if retry.Type != retryTypeSimple && retry.Type != retryTypeExponential {
+		problems.flag("token-retry-type", retry.Type, "unknown retry timer type", "defaulting to "+defaultTokenGenRetryType)
+		retry.Type = defaultTokenGenRetryType
+	}
+	if retry.NumberOfRetries < 0 {
+		problems.flag("token-retries", retry.NumberOfRetries, "cannot be negative", "defaulting to "+strconv.Itoa(defaultTokenGenRetries))
+		retry.NumberOfRetries = defaultTokenGenRetries
+	}
+	if retry.RetryDelayInSeconds < 0 {
+		problems.flag("token-retry-delay", retry.RetryDelayInSeconds, "cannot be negative", "defaulting to "+strconv.Itoa(defaultTokenGenRetryDelay))
+		retry.RetryDelayInSeconds = defaultTokenGenRetryDelay
+	}
+	if retry.Multiplier != 0 && retry.Multiplier < 1 {
+		problems.flag("token-retry-multiplier", retry.Multiplier, "must be at least 1", "defaulting to "+fmt.Sprint(backoff.DefaultMultiplier))
+		retry.Multiplier = backoff.DefaultMultiplier
+	}
+	for _, interval := range []struct {
+		name string
+		d    *time.Duration
+	}{
+		{"token-retry-initial-interval", &retry.InitialInterval},
+		{"token-retry-max-interval", &retry.MaxInterval},
+		{"token-retry-max-elapsed-time", &retry.MaxElapsedTime},
+	} {
+		if *interval.d < 0 {
+			problems.flag(interval.name, *interval.d, "cannot be negative", "using the library default")
+			*interval.d = 0
 		}
 	}
-	tokenRetryDelay, ok := os.LookupEnv(tokenGenRetryDelayKey)
-	if ok && len(tokenRetryDelay) > 0 {
-		tokenRetryDelayInt, err := strconv.Atoi(tokenRetryDelay)
-		if err != nil {
-			log.Errorf("Unable to parse value of environment variable %s! [Err: %s]", tokenGenRetryDelayKey, err)
-		} else {
-			if tokenRetryDelayInt < 0 {
-				log.Errorf("Cannot use a negative value for environment variable %s! Defaulting to %d", tokenGenRetryDelayKey, defaultTokenGenRetryDelay)
-				RetryCfg.RetryDelayInSeconds = defaultTokenGenRetryDelay
-			} else {
-				RetryCfg.RetryDelayInSeconds = tokenRetryDelayInt
-			}
+	defaults.Retry = retry
+	if *argRefreshJitter < 0 {
+		problems.flag("refresh-jitter", *argRefreshJitter, "cannot be negative", "disabling jitter")
+		*argRefreshJitter = 0
+	}
+	if *argNamespaceJitter < 0 {
+		problems.flag("namespace-jitter", *argNamespaceJitter, "cannot be negative", "disabling jitter")
+		*argNamespaceJitter = 0
+	}
+	if *argPriorityWaveDelay < 0 {
+		problems.flag("priority-wave-delay", *argPriorityWaveDelay, "cannot be negative", "disabling the pause")
+		*argPriorityWaveDelay = 0
+	}
+	if *argPullSecretOrder != secretsync.OrderKeep && *argPullSecretOrder != secretsync.OrderFirst && *argPullSecretOrder != secretsync.OrderLast {
+		problems.flag("image-pull-secrets-order", *argPullSecretOrder, "unknown imagePullSecrets order", "defaulting to "+secretsync.OrderKeep)
+		*argPullSecretOrder = secretsync.OrderKeep
+	}
+	if *argProvider != providerECR && *argProvider != providerFake && *argProvider != providerFile {
+		problems.flag("provider", *argProvider, "unknown provider", "defaulting to "+providerECR)
+		*argProvider = providerECR
+	}
+	if *argProvider == providerFile && len(*argTokenFiles) == 0 {
+		problems.flag("token-files", "", "the file provider needs at least one token file", "")
+	}
+	if *argTokenFileMaxAge < 0 {
+		problems.flag("token-file-max-age", *argTokenFileMaxAge, "cannot be negative", "disabling the check")
+		*argTokenFileMaxAge = 0
+	}
+	if *argFakeTokenExpiry < 0 {
+		problems.flag("fake-token-expiry", *argFakeTokenExpiry, "cannot be negative", "never rotating fake tokens")
+		*argFakeTokenExpiry = 0
+	}
+	if *argFakeFailEvery < 0 {
+		problems.flag("fake-fail-every", *argFakeFailEvery, "cannot be negative", "never failing fake calls")
+		*argFakeFailEvery = 0
+	}
+	if *argFakeMinRefresh < 0 {
+		problems.flag("fake-min-refresh", *argFakeMinRefresh, "cannot be negative", "declaring no minimum")
+		*argFakeMinRefresh = 0
+	}
+	if *argUnmanagedSecrets != unmanagedOverwrite && *argUnmanagedSecrets != unmanagedAdopt && *argUnmanagedSecrets != unmanagedSkip {
+		problems.flag("unmanaged-secrets", *argUnmanagedSecrets, "must be overwrite, adopt or skip", "defaulting to "+unmanagedOverwrite)
+		*argUnmanagedSecrets = unmanagedOverwrite
+	}
+	if *argOwnership != ownershipController && *argOwnership != ownershipGitOps {
+		problems.flag("ownership", *argOwnership, "unknown ownership strategy", "defaulting to "+ownershipController)
+		*argOwnership = ownershipController
+	}
+	if *argOutput != outputSecret && *argOutput != outputSealedSecret && *argOutput != outputExternalSecret && *argOutput != outputMirror &&
+		*argOutput != outputKarmada && *argOutput != outputFleet && *argOutput != outputVault && *argOutput != outputAgent && *argOutput != outputKMSSecret &&
+		*argOutput != outputYAML {
+		problems.flag("output", *argOutput, "unknown output", "defaulting to "+outputSecret)
+		*argOutput = outputSecret
+	}
+	if *argAgentAddress != "" {
+		if err := validAgentAddress(*argAgentAddress); err != nil {
+			problems.flag("agent-address", *argAgentAddress, err.Error(), "disabling the agent")
+			*argAgentAddress = ""
 		}
 	}
-	// Set up the Retry Timer
-	SetupRetryTimer()
+	if *argAgentAddress != "" && *argLeaderElect {
+		// every node's agent must have tokens, but only the leader refreshes them
+		problems.flag("agent-address", *argAgentAddress, "cannot be combined with --leader-elect, under which only the leader fetches tokens and every other agent answers with a miss", "")
+	}
+	if *argOutput == outputAgent && *argAgentAddress == "" {
+		problems.flag("output", *argOutput, "needs --agent-address", "")
+	}
+	if *argOutput == outputYAML && *argOutputDir == "" {
+		problems.flag("output", *argOutput, "needs --output-dir", "")
+	}
+	if *argOutput == outputKMSSecret && *argKMSKeyID == "" {
+		problems.flag("output", *argOutput, "needs --kms-key-id", "")
+	}
+	if !validEndpointForm(*argEndpointForm) {
+		problems.flag("registry-endpoint-form", *argEndpointForm, "unknown registry endpoint form", "defaulting to "+endpointFormURL)
+		*argEndpointForm = endpointFormURL
+	}
+	if *argStatusInterval <= 0 {
+		problems.flag("status-interval", *argStatusInterval, "must be positive", "defaulting to 1m")
+		*argStatusInterval = time.Minute
+	}
+	if host := strings.TrimSuffix(strings.TrimPrefix(*argAPIServerHost, "["), "]"); strings.ContainsAny(host, "/[]") ||
+		(strings.Contains(host, ":") && net.ParseIP(host) == nil) {
+		problems.flag("apiserver-host", *argAPIServerHost, "expected a host name or IP address without scheme or port", "using the detected API server")
+		*argAPIServerHost = ""
+	}
+	if *argAPIServerPort < 0 || *argAPIServerPort > 65535 {
+		problems.flag("apiserver-port", *argAPIServerPort, "not a valid port", "using the detected API server port")
+		*argAPIServerPort = 0
+	}
+	if *argKubeAPIWriteQPS < 0 {
+		problems.flag("kube-api-write-qps", *argKubeAPIWriteQPS, "cannot be negative", "disabling the write limit")
+		*argKubeAPIWriteQPS = 0
+	}
+	if *argKubeAPIWriteBurst < 1 {
+		problems.flag("kube-api-write-burst", *argKubeAPIWriteBurst, "must be at least 1", "defaulting to 10")
+		*argKubeAPIWriteBurst = 10
+	}
+	if *argKubeAPIRetries < 0 {
+		problems.flag("kube-api-throttle-retries", *argKubeAPIRetries, "cannot be negative", "not retrying throttled writes")
+		*argKubeAPIRetries = 0
+	}
+	if *argKubeAPIMaxBackoff < time.Second {
+		problems.flag("kube-api-max-backoff", *argKubeAPIMaxBackoff, "must be at least 1s", "defaulting to 1m")
+		*argKubeAPIMaxBackoff = time.Minute
+	}
+	if *argKubeAPIWriteRetries < 0 {
+		problems.flag("kube-api-write-retries", *argKubeAPIWriteRetries, "cannot be negative", "not retrying failed writes")
+		*argKubeAPIWriteRetries = 0
+	}
+	if *argKubeAPIWriteBackoff <= 0 {
+		problems.flag("kube-api-write-backoff", *argKubeAPIWriteBackoff, "must be positive", "defaulting to 1s")
+		*argKubeAPIWriteBackoff = time.Second
+	}
+	if *argKubeAPIWriteMaxBackoff < *argKubeAPIWriteBackoff {
+		problems.flag("kube-api-write-max-backoff", *argKubeAPIWriteMaxBackoff, "cannot be less than --kube-api-write-backoff", "using --kube-api-write-backoff")
+		*argKubeAPIWriteMaxBackoff = *argKubeAPIWriteBackoff
+	}
+	if *argKubeAPIQPS < 0 || *argKubeAPIBurst < 0 {
+		problems.flag("kube-api-qps", fmt.Sprintf("%v (burst %d)", *argKubeAPIQPS, *argKubeAPIBurst), "cannot be negative", "using the client-go limits")
+		*argKubeAPIQPS = 0
+		*argKubeAPIBurst = 0
+	}
+	if *argSecretSplitSize < 0 || *argSecretSplitSize > maxSecretSize {
+		problems.flag("secret-split-size", *argSecretSplitSize, fmt.Sprintf("must be between 0 and %d bytes", maxSecretSize), "defaulting to "+strconv.Itoa(defaultSecretSplitSize))
+		*argSecretSplitSize = defaultSecretSplitSize
+	}
+	if *argCircuitBreakerFailures < 0 {
+		problems.flag("circuit-breaker-failures", *argCircuitBreakerFailures, "cannot be negative", "disabling the circuit breaker")
+		*argCircuitBreakerFailures = 0
+	}
+	if *argCircuitBreakerInterval <= 0 {
+		problems.flag("circuit-breaker-interval", *argCircuitBreakerInterval, "must be positive", "defaulting to 6h")
+		*argCircuitBreakerInterval = 6 * time.Hour
+	}
+	if *argStaleRetryInterval < 0 {
+		problems.flag("stale-retry-interval", *argStaleRetryInterval, "cannot be negative", "defaulting to 1m")
+		*argStaleRetryInterval = time.Minute
+	}
+	if *argEventAggregationWindow < 0 {
+		problems.flag("event-aggregation-window", *argEventAggregationWindow, "cannot be negative", "defaulting to 10m")
+		*argEventAggregationWindow = 10 * time.Minute
+	}
+	if *argProviderFetchTimeout < 0 {
+		problems.flag("provider-fetch-timeout", *argProviderFetchTimeout, "cannot be negative", "disabling the timeout")
+		*argProviderFetchTimeout = 0
+	}
+	if *argProviderTimeout < 0 {
+		problems.flag("provider-timeout", *argProviderTimeout, "cannot be negative", "disabling the timeout")
+		*argProviderTimeout = 0
+	}
+	if *argResyncPeriod < 0 {
+		problems.flag("resync-period", *argResyncPeriod, "cannot be negative", "using --refresh-mins")
+		*argResyncPeriod = 0
+	}
+	if *argCanarySoak < 0 {
+		problems.flag("canary-soak", *argCanarySoak, "cannot be negative", "defaulting to 0")
+		*argCanarySoak = 0
+	}
+	if *argConfigReloadPeriod < 0 {
+		problems.flag("config-reload-period", *argConfigReloadPeriod, "cannot be negative", "disabling reloading")
+		*argConfigReloadPeriod = 0
+	}
+	if *argWaitForInitialSync && *argHealthProbeAddress == "" {
+		problems.flag("wait-for-initial-sync", *argWaitForInitialSync, "needs --health-probe-address", "ignoring it")
+		*argWaitForInitialSync = false
+	}
+	if *argStatusShutdownReport && *argStatusConfigMap == "" {
+		problems.flag("status-shutdown-report", *argStatusShutdownReport, "needs --status-configmap", "ignoring it")
+		*argStatusShutdownReport = false
+	}
+	if *argServiceAccountWait < 0 {
+		problems.flag("service-account-wait", *argServiceAccountWait, "cannot be negative", "defaulting to 0")
+		*argServiceAccountWait = 0
+	}
+	if *argKubeAPITimeout < 0 {
+		problems.flag("kube-api-timeout", *argKubeAPITimeout, "cannot be negative", "disabling the timeout")
+		*argKubeAPITimeout = 0
+	}
 
-	if len(awsRegionEnv) > 0 {
-		argAWSRegion = &awsRegionEnv
+	selector, err := parseExcludedNamespaceSelector(*argExcludedNSSelector)
+	if err != nil {
+		problems.flag("excluded-namespace-selector", *argExcludedNSSelector, err.Error(), "excluding no namespaces by label")
+		selector = labels.Nothing()
 	}
+	excludedNamespaceSelector = selector
 
-	if len(awsAccountIDEnv) > 0 {
-		awsAccountIDs = strings.Split(awsAccountIDEnv, ",")
-	} else {
-		awsAccountIDs = []string{""}
+	patterns, errs := validSystemNamespaces(*argSkipSystemNamespaces)
+	for _, err := range errs {
+		problems.flag("skip-system-namespaces", "", err.Error(), "ignoring the pattern")
+	}
+	*argSkipSystemNamespaces = patterns
+	if !*argSkipKubeSystem {
+		*argSkipSystemNamespaces = removeString(*argSkipSystemNamespaces, "kube-system")
 	}
 
-	if len(argAWSAssumeRoleEnv) > 0 {
-		argAWSAssumeRole = &argAWSAssumeRoleEnv
+	registries, errs := validRegistryPatterns(*argNodeCredRegistries)
+	for _, err := range errs {
+		problems.flag("node-credential-registries", "", err.Error(), "ignoring the pattern")
+	}
+	*argNodeCredRegistries = registries
+	registries, errs = validRegistryPatterns(*argRegistryAllowlist)
+	for _, err := range errs {
+		problems.flag("registry-allowlist", "", err.Error(), "ignoring the pattern")
+	}
+	if len(registries) == 0 && len(*argRegistryAllowlist) > 0 {
+		// an allowlist of nothing but malformed patterns must not turn into allowing every registry
+		problems.flag("registry-allowlist", strings.Join(*argRegistryAllowlist, ","), "no valid pattern", "")
 	}
+	*argRegistryAllowlist = registries
+	registries, errs = validRegistryPatterns(*argRegistryDenylist)
+	for _, err := range errs {
+		problems.flag("registry-denylist", "", err.Error(), "ignoring the pattern")
+	}
+	*argRegistryDenylist = registries
+	if *argNodeCredMode != nodeCredentialAnnotate && *argNodeCredMode != nodeCredentialSkip {
+		problems.flag("node-credential-mode", *argNodeCredMode, "must be annotate or skip", "defaulting to "+nodeCredentialAnnotate)
+		*argNodeCredMode = nodeCredentialAnnotate
+	}
+	if *argVClusterSelector != "" {
+		if _, err := labels.Parse(*argVClusterSelector); err != nil {
+			problems.flag("vcluster-selector", *argVClusterSelector, err.Error(), "disabling the vcluster sync")
+			*argVClusterSelector = ""
+		}
+	}
+	if *argVClusterInterval < time.Minute {
+		problems.flag("vcluster-sync-interval", *argVClusterInterval, "must be at least 1m", "defaulting to 5m")
+		*argVClusterInterval = 5 * time.Minute
+	}
+	sanitizeSecretNameFlag(&problems, "aws-secret-name", argAWSSecretName, "awsecr-cred")
+	sanitizeSecretNameFlag(&problems, "fake-secret-name", argFakeSecretName, "fake-registry-creds")
+	sanitizeSecretNameFlag(&problems, "token-file-secret-name", argTokenFileSecretName, "file-registry-creds")
+	switch *argWorkloadRollout {
+	case workloadRolloutOff, workloadRolloutAnnotate, workloadRolloutRestart:
+	default:
+		problems.flag("workload-rollout", *argWorkloadRollout, "must be off, annotate or restart", "defaulting to "+workloadRolloutOff)
+		*argWorkloadRollout = workloadRolloutOff
+	}
+
+	// the entries are checked per source for the report, then combined
+	reported := map[string]bool{}
+	accountEntries := append([]string{}, *argAWSAccountIDs...)
+	_, _, errs = parseAWSAccounts(accountEntries)
+	for _, err := range errs {
+		problems.flag("aws-account-ids", "", err.Error(), "ignoring the account")
+		reported[err.Error()] = true
+	}
+	if envEntries := legacyAWSAccounts(); len(envEntries) > 0 {
+		_, _, errs = parseAWSAccounts(envEntries)
+		for _, err := range errs {
+			problems.env(legacyEnvAWSAccounts, "", err.Error(), "ignoring the account")
+			reported[err.Error()] = true
+		}
+		accountEntries = append(accountEntries, envEntries...)
+	}
+	ids, regions, errs := parseAWSAccounts(accountEntries)
+	for _, err := range errs {
+		// an account listed with different regions in the flag and the environment
+		if !reported[err.Error()] {
+			problems.env(legacyEnvAWSAccounts, "", err.Error(), "keeping the first region")
+		}
+	}
+	if len(ids) > 0 {
+		defaults.AccountIDs = ids
+		defaults.AccountRegions = regions
+	}
+
+	roles, errs := parseAWSAccountRoles(*argAWSAccountRoles)
+	for _, err := range errs {
+		problems.flag("aws-account-roles", "", err.Error(), "ignoring the role")
+	}
+	defaults.AccountRoles = roles
+	if *argECRConcurrency < 1 {
+		problems.flag("ecr-concurrency", *argECRConcurrency, "must be at least 1", "defaulting to 1")
+		*argECRConcurrency = 1
+	}
+	return defaults, problems
 }
 
 func stringSliceContains(stringSlice []string, searchString string) bool {
@@ -442,60 +1344,378 @@ func stringSliceContains(stringSlice []string, searchString string) bool {
 	return false
 }
 
-func handler(c *controller, ns *v1.Namespace) error {
+// namespaceResyncPeriod is how often every namespace is reconciled: --resync-period, else --refresh-mins
+func namespaceResyncPeriod() time.Duration {
+	if *argResyncPeriod > 0 {
+		return *argResyncPeriod
+	}
+	return time.Duration(*argRefreshMinutes) * time.Minute
+}
+
+// removeString returns the slice without any element equal to s
+func removeString(stringSlice []string, s string) []string {
+	result := make([]string, 0, len(stringSlice))
+	for _, v := range stringSlice {
+		if v != s {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func handler(ctx context.Context, c *controller, ns *v1.Namespace) (err error) {
 	namespace := ns.GetName()
-	if stringSliceContains(c.k8sutil.ExcludedNamespaces, namespace) {
+	if writesPaused() {
+		// the namespace is caught up by the refresh on resume
+		log.Debugf("---------- handler( namespace: %s paused)", namespace)
+		return nil
+	}
+	if c.namespaceExcluded(ns) {
 		log.Infof("---------- handler( namespace: %s excluded)", namespace)
+		if c.cleanupExcluded(ns) {
+			// the namespace may have been relabelled or added to the list since the secrets were distributed
+			return c.removeFromNamespace(ctx, ns)
+		}
+		return nil
+	}
+	if systemNamespace(namespace) {
+		log.Debugf("---------- handler( namespace: %s skipped, see --skip-system-namespaces)", namespace)
 		return nil
 	}
+	c.syncLock.Lock()
+	defer c.syncLock.Unlock()
+	defer func(start time.Time) { observeNamespaceSync(syncTriggerReconcile, start, err) }(time.Now())
+
 	log.Infof("---------- handler( namespace: %s started)", namespace)
 	log.Infof("generating credentials for namespace %s", namespace)
-	secrets := c.generateSecrets()
+	selected, unselected := c.selectProviders(ns)
+	if err := c.removeUnselected(ctx, ns, unselected); err != nil {
+		log.Errorf("Could not remove the secrets of providers that do not select namespace %s! [Err: %s]", namespace, err)
+		return err
+	}
+	if err := c.repairServiceAccounts(ctx, ns, c.providerSecretNames(selected)); err != nil {
+		log.Errorf("Could not repair the imagePullSecrets of the ServiceAccounts in namespace %s! [Err: %s]", namespace, err)
+		return err
+	}
+	secrets := c.namespaceSecrets(ctx, namespace, selected)
 	log.Infof("Got %d refreshed credentials for namespace %s", len(secrets), namespace)
+	if *argWorkloadRollout != workloadRolloutOff && c.firstCredentials(ctx, namespace, secrets) {
+		// kept until the rollout ran: if a write below fails, the retry finds the secrets and no longer counts as first
+		c.pendingRollouts[namespace] = true
+	}
 	for _, secret := range secrets {
-		if *argSkipKubeSystem && namespace == "kube-system" {
-			continue
-		}
 		log.Infof("Processing secret for namespace %s, secret %s", ns.Name, secret.Name)
 
-		if err := c.processNamespace(ns, secret); err != nil {
+		err := c.processNamespace(ctx, ns, secret)
+		c.status.record(ns.Name, secret, err)
+		if err != nil {
 			log.Errorf("error processing secret for namespace %s, secret %s: %s", ns.Name, secret.Name, err)
 			return err
 		}
 
 		log.Infof("Finished processing secret for namespace %s, secret %s", ns.Name, secret.Name)
 	}
+	c.markNodeCoveredRegistries(ctx, ns, selected)
+	if c.pendingRollouts[namespace] {
+		if err := c.rolloutWorkloads(ctx, namespace, selected); err != nil {
+			// the secrets are in place, the workloads can still be restarted by hand
+			log.Errorf("Could not %s the workloads that failed to pull their images in namespace %s! [Err: %s]", *argWorkloadRollout, namespace, err)
+		}
+		delete(c.pendingRollouts, namespace)
+	}
+	if c.initialSync != nil && c.servesAll(selected) {
+		c.initialSync.record(namespace)
+	}
 	log.Infof("Finished refreshing credentials for namespace %s", ns.GetName())
 	return nil
 }
 
+// subcommand returns the first positional argument after the program name, if any
+func subcommand() string {
+	// flags.Parse is handed os.Args, so the program name is the first positional argument
+	args := flags.Args()
+	if len(args) < 2 {
+		return ""
+	}
+	return args[1]
+}
+
 func main() {
-	log.Info("Starting up...")
 	err := flags.Parse(os.Args)
 	if err != nil {
 		log.Fatalf("Could not parse command line arguments! [Err: %s]", err)
 	}
 
-	validateParams()
+	cmd := subcommand()
+	switch cmd {
+	case "", "check", "rollback", "verify-provider":
+	case "print-config":
+		// the YAML goes to stdout, so the logs must not end up in it
+		log.SetOutput(os.Stderr)
+	case "version":
+		printVersion(os.Stdout)
+		return
+	case "decrypt":
+		// run as an initContainer of the workload, see --output=kms-secret
+		bindSubcommandEnv()
+		newClient := func(keyID string) kmsInterface {
+			client, err := newKMSClient(keyID, awsClientOptions{})
+			if err != nil {
+				log.Fatalf("Could not create the KMS client! [Err: %s]", err)
+			}
+			return client
+		}
+		if err := runDecrypt(context.Background(), newClient, *argDecryptFrom, *argDecryptTo); err != nil {
+			log.Fatalf("Could not decrypt the pull secret! [Err: %s]", err)
+		}
+		return
+	case "credential-provider":
+		// executed by the kubelet, which reads the response from stdout
+		log.SetOutput(os.Stderr)
+		bindSubcommandEnv()
+		if err := runCredentialProvider(os.Stdin, os.Stdout, *argAgentAddress); err != nil {
+			log.Fatalf("Could not get credentials from the agent! [Err: %s]", err)
+		}
+		return
+	default:
+		log.Fatalf("Unknown subcommand '%s'", cmd)
+	}
 
-	log.Info("Using AWS Account: ", strings.Join(awsAccountIDs, ","))
+	log.Info("Starting up...")
+	defaults, problems := validateParams()
+	cfg, err := loadConfig(*argConfigFile)
+	if err != nil {
+		problems.file(*argConfigFile, err)
+	}
+	reportConfigProblems(problems)
+	if cmd == "print-config" {
+		if err := printConfig(os.Stdout, flags, cfg, defaults); err != nil {
+			log.Fatalf("Could not print the configuration! [Err: %s]", err)
+		}
+		return
+	}
+	if cmd == "verify-provider" {
+		name := *argVerifyProviderName
+		if name == "" {
+			name = *argProvider
+		}
+		var verify registryVerifier
+		if *argVerifyRegistry {
+			client, err := newProviderHTTPClient(nil)
+			if err != nil {
+				log.Fatalf("Could not create the registry client! [Err: %s]", err)
+			}
+			verify = newRegistryVerifier(client)
+		}
+		c := newProviderController(newVerifyKubeUtil(), cfg, defaults)
+		if !printCheckReport(os.Stdout, runVerifyProvider(context.Background(), c, name, verify)) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	log.Infof("Version: %s (git SHA %s, built %s)", version, gitSHA, buildDate)
+
+	log.Info("Using AWS Account: ", strings.Join(defaults.AccountIDs, ","))
+	for id, region := range defaults.AccountRegions {
+		log.Infof("Using AWS Region %s for account %s", region, id)
+	}
+	for id, role := range defaults.AccountRoles {
+		log.Infof("Assuming role %s for account %s", role, id)
+	}
 	log.Info("Using AWS Region: ", *argAWSRegion)
 	log.Info("Using AWS Assume Role: ", *argAWSAssumeRole)
 	log.Info("Refresh Interval (minutes): ", *argRefreshMinutes)
-	log.Infof("Retry Timer: %s", RetryCfg.Type)
-	log.Info("Token Generation Retries: ", RetryCfg.NumberOfRetries)
-	log.Info("Token Generation Retry Delay (seconds): ", RetryCfg.RetryDelayInSeconds)
+	log.Info("Namespace Resync Period: ", namespaceResyncPeriod())
+	log.Infof("Retry Timer: %s", defaults.Retry.Type)
+	log.Info("Token Generation Retries: ", defaults.Retry.NumberOfRetries)
+	log.Info("Token Generation Retry Delay (seconds): ", defaults.Retry.RetryDelayInSeconds)
+	if defaults.Retry.Type == retryTypeExponential {
+		b := newExponentialBackOff(defaults.Retry)
+		log.Infof("Exponential Retry: initial %s, multiplier %v, max interval %s, max elapsed %s",
+			b.InitialInterval, b.Multiplier, b.MaxInterval, b.MaxElapsedTime)
+	}
 
 	excludedNamespaces := strings.Split(*argExcludedNamespaces, ",")
-	util, err := k8sutil.New(excludedNamespaces)
+	throttle := &k8sutil.Throttle{
+		Retries:    *argKubeAPIRetries,
+		MaxBackoff: *argKubeAPIMaxBackoff,
+		OnThrottle: observeThrottle,
+	}
+	// the controller's client and the manager's share one token bucket, so --kube-api-qps caps them together
+	rateLimiter := k8sutil.NewRateLimiter(k8sutil.ClientOptions{QPS: *argKubeAPIQPS, Burst: *argKubeAPIBurst, Throttle: throttle})
+	util, err := k8sutil.New(excludedNamespaces, k8sutil.ClientOptions{
+		QPS:           *argKubeAPIQPS,
+		Burst:         *argKubeAPIBurst,
+		RateLimiter:   rateLimiter,
+		Timeout:       *argKubeAPITimeout,
+		Throttle:      throttle,
+		WriteRetry:    newWriteRetry(),
+		UserAgent:     userAgent(),
+		APIServerHost: *argAPIServerHost,
+		APIServerPort: *argAPIServerPort,
+		TLSServerName: *argAPIServerSNI,
+	})
 	if err != nil {
 		log.Error("Could not create k8s client!!", err)
 	}
 
-	ecrClient := newEcrClient()
-	c := &controller{util, ecrClient}
+	if *argKubeAPIWriteQPS > 0 {
+		log.Infof("Limiting Kubernetes writes to %v per second (burst %d)", *argKubeAPIWriteQPS, *argKubeAPIWriteBurst)
+		util.WriteLimiter = flowcontrol.NewTokenBucketRateLimiter(*argKubeAPIWriteQPS, *argKubeAPIWriteBurst)
+	}
+
+	c := newProviderController(util, cfg, defaults)
+	if len(*argCanaryNamespaces) > 0 {
+		log.Infof("Rotating credentials in canary namespaces %s first", strings.Join(*argCanaryNamespaces, ","))
+		client, err := newProviderHTTPClient(nil)
+		if err != nil {
+			log.Fatalf("Could not create the registry client of the canary rotation! [Err: %s]", err)
+		}
+		c.verifyRegistry = newRegistryVerifier(client)
+	}
+	if *argCloudEventsSink != "" {
+		log.Infof("Sending rotation CloudEvents to %s", *argCloudEventsSink)
+		c.events = newCloudEventSink(*argCloudEventsSink, *argCloudEventsSource)
+	}
+	if *argOutput == outputMirror {
+		log.Infof("Mirroring the secrets from hub namespace %s", mirrorHubNamespace())
+		c.output = newMirrorOutput(util, mirrorHubNamespace())
+	}
+	if *argOutput == outputSealedSecret {
+		output, err := newSealedSecretOutput(*argSealedSecretsCert, *argOutputURL, *argOutputTokenFile)
+		if err != nil {
+			log.Fatalf("Could not set up the sealed-secret output! [Err: %s]", err)
+		}
+		c.output = output
+	}
+	if *argOutput == outputYAML {
+		output, err := newYAMLOutput(util, *argOutputDir, c.managedSecretNames)
+		if err != nil {
+			log.Fatalf("Could not set up the yaml output! [Err: %s]", err)
+		}
+		log.Infof("Writing the manifests to %s instead of applying them", *argOutputDir)
+		c.output = output
+	}
+	if *argVaultAddr != "" || *argOutput == outputVault {
+		sink, err := newVaultSink(*argVaultAddr, *argVaultKVMount, *argVaultPath, *argVaultTokenFile, *argVaultRole, *argVaultAuthMount)
+		if err != nil {
+			log.Fatalf("Could not set up the Vault output! [Err: %s]", err)
+		}
+		log.Infof("Writing the credentials to %s at %s", sink.name(), sink.addr)
+		c.sinks = append(c.sinks, sink)
+	}
+	if *argOutput == outputVault {
+		c.output = vaultOutput{}
+	}
+	if *argOutput == outputAgent {
+		c.output = agentOutput{}
+	}
+	if *argOutput == outputKMSSecret {
+		log.Infof("Envelope-encrypting the secrets with KMS key %s", *argKMSKeyID)
+		client, err := newKMSClient(*argKMSKeyID, newECRClientOptions(util, cfg, providerECR, defaults))
+		if err != nil {
+			log.Fatalf("Could not create the KMS client! [Err: %s]", err)
+		}
+		c.output = newKMSOutput(util, client, *argKMSKeyID)
+	}
+
+	if cmd == "rollback" {
+		log.Warnf("Rolling back to the previous secrets; pause the controller with --pause-file first, or its next refresh replaces them")
+		if err := c.rollback(context.Background()); err != nil {
+			log.Fatalf("Could not roll back! [Err: %s]", err)
+		}
+		return
+	}
+	if cmd == "check" {
+		baseSts, assumedSts, err := newStsClients(newECRClientOptions(util, cfg, providerECR, defaults))
+		if err != nil {
+			log.Fatalf("Could not create the STS clients! [Err: %s]", err)
+		}
+		if !printCheckReport(os.Stdout, runChecks(context.Background(), c, baseSts, assumedSts)) {
+			os.Exit(1)
+		}
+		return
+	}
 
-	util.WatchNamespaces(time.Duration(*argRefreshMinutes)*time.Minute, func(ns *v1.Namespace) error {
-		return handler(c, ns)
+	ctrl.SetLogger(newLogrusLogger())
+	restConfig, err := k8sutil.NewRestConfig(k8sutil.ClientOptions{
+		QPS:           *argKubeAPIQPS,
+		Burst:         *argKubeAPIBurst,
+		RateLimiter:   rateLimiter,
+		UserAgent:     userAgent(),
+		APIServerHost: *argAPIServerHost,
+		APIServerPort: *argAPIServerPort,
+		TLSServerName: *argAPIServerSNI,
 	})
+	if err != nil {
+		log.Fatalf("Could not create k8s client config! [Err: %s]", err)
+	}
+	resyncPeriod := namespaceResyncPeriod()
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
+		SyncPeriod: &resyncPeriod,
+		// metrics are served on --listen-address together with the controller's own
+		MetricsBindAddress:            "0",
+		HealthProbeBindAddress:        *argHealthProbeAddress,
+		LeaderElection:                *argLeaderElect,
+		LeaderElectionID:              leaderElectionID,
+		LeaderElectionNamespace:       statusNamespace(),
+		LeaderElectionReleaseOnCancel: true,
+	})
+	if err != nil {
+		log.Fatalf("Could not create controller manager! [Err: %s]", err)
+	}
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		log.Fatalf("Could not add health check! [Err: %s]", err)
+	}
+	if err := mgr.AddReadyzCheck("ping", healthz.Ping); err != nil {
+		log.Fatalf("Could not add readiness check! [Err: %s]", err)
+	}
+	c.elected = mgr.Elected()
+	if *argWaitForInitialSync {
+		c.initialSync = newInitialSync()
+		if err := mgr.AddReadyzCheck("initial-sync", c.initialSyncCheck(mgr.GetClient(), mgr.Elected())); err != nil {
+			log.Fatalf("Could not add readiness check! [Err: %s]", err)
+		}
+	}
+	// read namespaces, ServiceAccounts and secret metadata from the manager's shared informers instead of the API server
+	util.Cache = mgr.GetCache()
+	c.recorder = newEventAggregator(mgr.GetEventRecorderFor(leaderElectionID), *argEventAggregationWindow)
+	if *argWorkloadRollout != workloadRolloutOff {
+		c.workloads = mgr.GetClient()
+	}
+	if *argOutput == outputKarmada || *argOutput == outputFleet {
+		output, err := newPropagationOutput(util, mgr.GetClient(), *argOutput, *argPropagationClusters, *argFleetWorkspace)
+		if err != nil {
+			log.Fatalf("Could not set up the %s output! [Err: %s]", *argOutput, err)
+		}
+		c.output = output
+	}
+	if *argOutput == outputExternalSecret {
+		sourceNamespace := *argESOSourceNamespace
+		if sourceNamespace == "" {
+			sourceNamespace = statusNamespace()
+		}
+		output, err := newExternalSecretOutput(util, mgr.GetClient(), sourceNamespace, *argESOStore, time.Duration(*argRefreshMinutes)*time.Minute)
+		if err != nil {
+			log.Fatalf("Could not set up the external-secret output! [Err: %s]", err)
+		}
+		c.output = output
+	}
+	if *argProbePermissions {
+		c.applyCapabilities(probeCapabilities(context.Background(), util))
+	}
+	if *argOutput == outputYAML {
+		c.disableClusterWrites()
+	}
+	if err := c.setupReconciler(mgr); err != nil {
+		log.Fatalf("Could not set up the namespace reconciler! [Err: %s]", err)
+	}
+
+	startServer(*argListenAddress, c)
+	startAgent(*argAgentAddress, c)
+
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		log.Fatalf("Controller manager failed! [Err: %s]", err)
+	}
 }
@@ -2,21 +2,35 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/request"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	authorizationType "k8s.io/client-go/kubernetes/typed/authorization/v1"
 	coreType "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/doddle/registry-creds/k8sutil"
+	"github.com/doddle/registry-creds/pkg/providers"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -26,55 +40,148 @@ func init() {
 	logrus.SetOutput(io.Discard)
 }
 
-func enableShortRetries() {
-	RetryCfg = RetryConfig{
-		Type:                "simple",
-		NumberOfRetries:     2,
-		RetryDelayInSeconds: 1,
-	}
-	SetupRetryTimer()
+// shortRetries keeps the tests of failing providers fast
+var shortRetries = RetryConfig{
+	Type:                "simple",
+	NumberOfRetries:     2,
+	RetryDelayInSeconds: 1,
 }
 
 type fakeKubeClient struct {
 	secrets         map[string]*fakeSecrets
 	namespaces      *fakeNamespaces
 	serviceaccounts map[string]*fakeServiceAccounts
+
+	configmaps map[string]*fakeConfigMaps
+
+	// deniedPermissions are "verb resource" pairs refused by SelfSubjectAccessReviews
+	deniedPermissions []string
+
+	pods map[string]*fakePods
+}
+
+type fakePods struct {
+	coreType.PodInterface
+	store []v1.Pod
+}
+
+func (f *fakeKubeClient) Pods(namespace string) coreType.PodInterface {
+	if f.pods == nil {
+		f.pods = map[string]*fakePods{}
+	}
+	if _, ok := f.pods[namespace]; !ok {
+		f.pods[namespace] = &fakePods{}
+	}
+	return f.pods[namespace]
+}
+
+func (f *fakePods) List(ctx context.Context, opts metav1.ListOptions) (*v1.PodList, error) {
+	return &v1.PodList{Items: f.store}, nil
+}
+
+type fakeConfigMaps struct {
+	coreType.ConfigMapInterface
+	store map[string]*v1.ConfigMap
+}
+
+func (f *fakeKubeClient) ConfigMaps(namespace string) coreType.ConfigMapInterface {
+	if f.configmaps == nil {
+		f.configmaps = map[string]*fakeConfigMaps{}
+	}
+	if _, ok := f.configmaps[namespace]; !ok {
+		f.configmaps[namespace] = &fakeConfigMaps{store: map[string]*v1.ConfigMap{}}
+	}
+	return f.configmaps[namespace]
+}
+
+func (f *fakeConfigMaps) Get(ctx context.Context, name string, opts metav1.GetOptions) (*v1.ConfigMap, error) {
+	cm, ok := f.store[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("configmaps"), name)
+	}
+	return cm, nil
+}
+
+func (f *fakeConfigMaps) Create(ctx context.Context, cm *v1.ConfigMap, opts metav1.CreateOptions) (*v1.ConfigMap, error) {
+	if _, ok := f.store[cm.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(v1.Resource("configmaps"), cm.Name)
+	}
+	f.store[cm.Name] = cm
+	return cm, nil
+}
+
+func (f *fakeConfigMaps) Update(ctx context.Context, cm *v1.ConfigMap, opts metav1.UpdateOptions) (*v1.ConfigMap, error) {
+	if _, ok := f.store[cm.Name]; !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("configmaps"), cm.Name)
+	}
+	f.store[cm.Name] = cm
+	return cm, nil
 }
 
 func (f *fakeKubeClient) Secrets(namespace string) coreType.SecretInterface {
 	return f.secrets[namespace]
 }
 
-func (f *fakeKubeClient) Core() coreType.CoreV1Interface {
-	return nil
+func (f *fakeKubeClient) SelfSubjectAccessReviews() authorizationType.SelfSubjectAccessReviewInterface {
+	return &fakeSelfSubjectAccessReviews{denied: f.deniedPermissions}
+}
+
+type fakeSelfSubjectAccessReviews struct {
+	authorizationType.SelfSubjectAccessReviewInterface
+	denied []string
+}
+
+func (f *fakeSelfSubjectAccessReviews) Create(ctx context.Context, review *authorizationv1.SelfSubjectAccessReview, opts metav1.CreateOptions) (*authorizationv1.SelfSubjectAccessReview, error) {
+	attrs := review.Spec.ResourceAttributes
+	review.Status.Allowed = !stringSliceContains(f.denied, attrs.Verb+" "+attrs.Resource)
+	return review, nil
 }
 
 type fakeSecrets struct {
 	coreType.SecretInterface
-	store map[string]*v1.Secret
+	// mu guards store against providers writing concurrently
+	mu     sync.Mutex
+	store  map[string]*v1.Secret
+	getErr error
+	// createErrs are returned by the next creates, one each
+	createErrs []error
 }
 
 type fakeServiceAccounts struct {
 	coreType.ServiceAccountInterface
-	store map[string]*v1.ServiceAccount
+	store     map[string]*v1.ServiceAccount
+	conflicts int
 }
 
 func (f *fakeServiceAccounts) Update(ctx context.Context, serviceAccount *v1.ServiceAccount, opts metav1.UpdateOptions) (*v1.ServiceAccount, error) {
-	serviceAccount, ok := f.store[serviceAccount.Name]
+	if f.conflicts > 0 {
+		f.conflicts--
+		return nil, apierrors.NewConflict(v1.Resource("serviceaccounts"), serviceAccount.Name, errors.New("object has been modified"))
+	}
+
+	_, ok := f.store[serviceAccount.Name]
 
 	if !ok {
-		return nil, fmt.Errorf("service account '%v' not found", serviceAccount.Name)
+		return nil, apierrors.NewNotFound(v1.Resource("serviceaccounts"), serviceAccount.Name)
 	}
 
 	f.store[serviceAccount.Name] = serviceAccount
 	return serviceAccount, nil
 }
 
+func (f *fakeServiceAccounts) Create(ctx context.Context, serviceAccount *v1.ServiceAccount, opts metav1.CreateOptions) (*v1.ServiceAccount, error) {
+	if _, ok := f.store[serviceAccount.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(v1.Resource("serviceaccounts"), serviceAccount.Name)
+	}
+	f.store[serviceAccount.Name] = serviceAccount
+	return serviceAccount, nil
+}
+
 func (f *fakeServiceAccounts) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
 	_, ok := f.store[name]
 
 	if !ok {
-		return fmt.Errorf("service account '%v' not found", name)
+		return apierrors.NewNotFound(v1.Resource("serviceaccounts"), name)
 	}
 
 	delete(f.store, name)
@@ -85,12 +192,21 @@ func (f *fakeServiceAccounts) Get(ctx context.Context, name string, opts metav1.
 	serviceAccount, ok := f.store[name]
 
 	if !ok {
-		return nil, fmt.Errorf("failed to find service account '%v'", name)
+		return nil, apierrors.NewNotFound(v1.Resource("serviceaccounts"), name)
 	}
 
 	return serviceAccount, nil
 }
 
+// CreateToken issues a token naming the ServiceAccount and the requested audience
+func (f *fakeServiceAccounts) CreateToken(ctx context.Context, name string, request *authenticationv1.TokenRequest, opts metav1.CreateOptions) (*authenticationv1.TokenRequest, error) {
+	if _, ok := f.store[name]; !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("serviceaccounts"), name)
+	}
+	request.Status.Token = name + "@" + strings.Join(request.Spec.Audiences, ",")
+	return request, nil
+}
+
 type fakeNamespaces struct {
 	coreType.NamespaceInterface
 	store map[string]v1.Namespace
@@ -106,6 +222,34 @@ func (f *fakeNamespaces) List(ctx context.Context, opts metav1.ListOptions) (*v1
 	return &v1.NamespaceList{Items: namespaces}, nil
 }
 
+// Patch applies the annotations of a merge patch, the only kind of namespace patch the controller sends
+func (f *fakeNamespaces) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*v1.Namespace, error) {
+	ns, ok := f.store[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("namespaces"), name)
+	}
+	var patch struct {
+		Metadata struct {
+			Annotations map[string]*string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	if ns.Annotations == nil {
+		ns.Annotations = map[string]string{}
+	}
+	for key, value := range patch.Metadata.Annotations {
+		if value == nil {
+			delete(ns.Annotations, key)
+		} else {
+			ns.Annotations[key] = *value
+		}
+	}
+	f.store[name] = ns
+	return &ns, nil
+}
+
 func (f *fakeKubeClient) Namespaces() coreType.NamespaceInterface {
 	return f.namespaces
 }
@@ -115,10 +259,18 @@ func (f *fakeKubeClient) ServiceAccounts(namespace string) coreType.ServiceAccou
 }
 
 func (f *fakeSecrets) Create(ctx context.Context, secret *v1.Secret, opts metav1.CreateOptions) (*v1.Secret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.createErrs) > 0 {
+		err := f.createErrs[0]
+		f.createErrs = f.createErrs[1:]
+		return nil, err
+	}
 	_, ok := f.store[secret.Name]
 
 	if ok {
-		return nil, fmt.Errorf("secret %v already exists", secret.Name)
+		return nil, apierrors.NewAlreadyExists(v1.Resource("secrets"), secret.Name)
 	}
 
 	f.store[secret.Name] = secret
@@ -126,21 +278,45 @@ func (f *fakeSecrets) Create(ctx context.Context, secret *v1.Secret, opts metav1
 }
 
 func (f *fakeSecrets) Update(ctx context.Context, secret *v1.Secret, opts metav1.UpdateOptions) (*v1.Secret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	_, ok := f.store[secret.Name]
 
 	if !ok {
-		return nil, fmt.Errorf("secret %v not found", secret.Name)
+		return nil, apierrors.NewNotFound(v1.Resource("secrets"), secret.Name)
 	}
 
 	f.store[secret.Name] = secret
 	return secret, nil
 }
 
+func (f *fakeSecrets) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.store[name]
+
+	if !ok {
+		return apierrors.NewNotFound(v1.Resource("secrets"), name)
+	}
+
+	delete(f.store, name)
+	return nil
+}
+
 func (f *fakeSecrets) Get(ctx context.Context, name string, opts metav1.GetOptions) (*v1.Secret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.getErr != nil {
+		return nil, f.getErr
+	}
+
 	secret, ok := f.store[name]
 
 	if !ok {
-		return nil, fmt.Errorf("secret with name '%v' not found", name)
+		return nil, apierrors.NewNotFound(v1.Resource("secrets"), name)
 	}
 
 	return secret, nil
@@ -148,7 +324,7 @@ func (f *fakeSecrets) Get(ctx context.Context, name string, opts metav1.GetOptio
 
 type fakeEcrClient struct{}
 
-func (f *fakeEcrClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+func (f *fakeEcrClient) GetAuthorizationTokenWithContext(ctx aws.Context, input *ecr.GetAuthorizationTokenInput, opts ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
 	return &ecr.GetAuthorizationTokenOutput{
 		AuthorizationData: []*ecr.AuthorizationData{
 			{
@@ -161,7 +337,7 @@ func (f *fakeEcrClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenIn
 
 type fakeFailingEcrClient struct{}
 
-func (f *fakeFailingEcrClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+func (f *fakeFailingEcrClient) GetAuthorizationTokenWithContext(ctx aws.Context, input *ecr.GetAuthorizationTokenInput, opts ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
 	return nil, errors.New("fake error")
 }
 
@@ -244,7 +420,7 @@ func newFakeFailingEcrClient() *fakeFailingEcrClient {
 func process(t *testing.T, c *controller) {
 	namespaces, _ := c.k8sutil.Kclient.Namespaces().List(context.TODO(), metav1.ListOptions{})
 	for _, ns := range namespaces.Items {
-		err := handler(c, &ns)
+		err := handler(context.TODO(), c, &ns)
 		assert.Nil(t, err)
 	}
 }
@@ -252,22 +428,24 @@ func process(t *testing.T, c *controller) {
 func newFakeController() *controller {
 	util := newKubeUtil()
 	ecrClient := newFakeEcrClient()
-	c := controller{util, ecrClient}
-	return &c
+	c := newController(util, ecrClient)
+	c.defaults.Retry = shortRetries
+	return c
 }
 
 func newFakeFailingController() *controller {
 	util := newKubeUtil()
 	ecrClient := newFakeFailingEcrClient()
-	c := controller{util, ecrClient}
-	return &c
+	c := newController(util, ecrClient)
+	c.defaults.Retry = shortRetries
+	return c
 }
 
 func TestGetECRAuthorizationKey(t *testing.T) {
-	awsAccountIDs = []string{"12345678", "999999"}
 	c := newFakeController()
+	c.defaults.AccountIDs = []string{"12345678", "999999"}
 
-	tokens, err := c.getECRAuthorizationKey()
+	tokens, err := c.getECRAuthorizationKey(context.TODO())
 
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(tokens))
@@ -299,27 +477,26 @@ func assertAllSecretsPresent(t *testing.T, secrets []v1.LocalObjectReference) {
 func assertAllExpectedSecrets(t *testing.T, c *controller) {
 	// Test AWS
 	for _, ns := range []string{"namespace1", "namespace2"} {
-		secret, err := c.k8sutil.GetSecret(ns, *argAWSSecretName)
+		secret, err := c.k8sutil.GetSecret(context.TODO(), ns, *argAWSSecretName)
 		assert.Nil(t, err)
 		assert.Equal(t, *argAWSSecretName, secret.Name)
 		assertDockerJSONContains(t, "fakeEndpoint", "fakeToken", secret)
 		assert.Equal(t, v1.SecretType("kubernetes.io/dockerconfigjson"), secret.Type)
 	}
 
-	_, err := c.k8sutil.GetSecret("kube-system", *argAWSSecretName)
+	_, err := c.k8sutil.GetSecret(context.TODO(), "kube-system", *argAWSSecretName)
 	assert.NotNil(t, err)
 }
 
 func assertExpectedSecretNumber(t *testing.T, c *controller, n int) {
 	for _, ns := range []string{"namespace1", "namespace2"} {
-		serviceAccount, err := c.k8sutil.GetServiceAccount(ns, "default")
+		serviceAccount, err := c.k8sutil.GetServiceAccount(context.TODO(), ns, "default")
 		assert.Nil(t, err)
 		assert.Exactly(t, n, len(serviceAccount.ImagePullSecrets))
 	}
 }
 
 func TestProcessOnce(t *testing.T) {
-	awsAccountIDs = []string{""}
 	c := newFakeController()
 
 	process(t, c)
@@ -340,6 +517,45 @@ func TestProcessTwice(t *testing.T) {
 	assertExpectedSecretNumber(t, c, 1)
 }
 
+func TestProcessWithFakeProvider(t *testing.T) {
+	c := newFakeController()
+	c.fake = &providers.Fake{Registries: []string{"https://registry.example.com"}}
+
+	process(t, c)
+
+	password := providers.FakePassword("https://registry.example.com", time.Time{})
+	for _, ns := range []string{"namespace1", "namespace2"} {
+		secret, err := c.k8sutil.GetSecret(context.TODO(), ns, *argFakeSecretName)
+		assert.Nil(t, err)
+		assertDockerJSONContains(t, "https://registry.example.com", base64.StdEncoding.EncodeToString([]byte("fake:"+password)), secret)
+
+		_, err = c.k8sutil.GetSecret(context.TODO(), ns, *argAWSSecretName)
+		assert.NotNil(t, err)
+		serviceAccount, err := c.k8sutil.GetServiceAccount(context.TODO(), ns, "default")
+		assert.Nil(t, err)
+		assertSecretPresent(t, serviceAccount.ImagePullSecrets, *argFakeSecretName)
+	}
+}
+
+func TestProcessWithFileProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".dockerconfigjson")
+	auth := base64.StdEncoding.EncodeToString([]byte("robot:offline"))
+	assert.Nil(t, os.WriteFile(path, []byte(`{"auths": {"https://registry.example.com": {"auth": "`+auth+`"}}}`), 0o600))
+	c := newFakeController()
+	c.tokenFiles = &providers.File{Paths: []string{path}}
+
+	process(t, c)
+
+	for _, ns := range []string{"namespace1", "namespace2"} {
+		secret, err := c.k8sutil.GetSecret(context.TODO(), ns, *argTokenFileSecretName)
+		assert.Nil(t, err)
+		assertDockerJSONContains(t, "https://registry.example.com", auth, secret)
+
+		_, err = c.k8sutil.GetSecret(context.TODO(), ns, *argAWSSecretName)
+		assert.NotNil(t, err)
+	}
+}
+
 func TestProcessWithExistingSecrets(t *testing.T) {
 	c := newFakeController()
 
@@ -357,7 +573,7 @@ func TestProcessWithExistingSecrets(t *testing.T) {
 		for _, secret := range []*v1.Secret{
 			secretAWS,
 		} {
-			err := c.k8sutil.CreateSecret(ns, secret)
+			err := c.k8sutil.CreateSecret(context.TODO(), ns, secret)
 			assert.Nil(t, err)
 		}
 	}
@@ -372,22 +588,52 @@ func TestProcessWithExistingImagePullSecrets(t *testing.T) {
 	c := newFakeController()
 
 	for _, ns := range []string{"namespace1", "namespace2"} {
-		serviceAccount, err := c.k8sutil.GetServiceAccount(ns, "default")
+		serviceAccount, err := c.k8sutil.GetServiceAccount(context.TODO(), ns, "default")
 		assert.Nil(t, err)
 		serviceAccount.ImagePullSecrets = append(serviceAccount.ImagePullSecrets, v1.LocalObjectReference{Name: "someOtherSecret"})
-		_ = c.k8sutil.UpdateServiceAccount(ns, serviceAccount)
+		_ = c.k8sutil.UpdateServiceAccount(context.TODO(), ns, serviceAccount)
 	}
 
 	process(t, c)
 
 	for _, ns := range []string{"namespace1", "namespace2"} {
-		serviceAccount, err := c.k8sutil.GetServiceAccount(ns, "default")
+		serviceAccount, err := c.k8sutil.GetServiceAccount(context.TODO(), ns, "default")
 		assert.Nil(t, err)
 		assertAllSecretsPresent(t, serviceAccount.ImagePullSecrets)
 		assertSecretPresent(t, serviceAccount.ImagePullSecrets, "someOtherSecret")
 	}
 }
 
+func TestProcessNamespaceForbiddenSecretGet(t *testing.T) {
+	c := newFakeController()
+	secrets := c.k8sutil.Kclient.Secrets("namespace1").(*fakeSecrets)
+	secrets.getErr = apierrors.NewForbidden(v1.Resource("secrets"), *argAWSSecretName, errors.New("denied"))
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: *argAWSSecretName}}
+	err := c.processNamespace(context.TODO(), ns, secret)
+
+	assert.True(t, k8sutil.IsForbidden(err))
+	assert.Contains(t, err.Error(), "could not get secret "+*argAWSSecretName+" in namespace namespace1")
+	// a failed read must not be answered with a Create
+	assert.Empty(t, secrets.store)
+}
+
+func TestProcessNamespaceRetriesServiceAccountConflict(t *testing.T) {
+	c := newFakeController()
+	serviceAccounts := c.k8sutil.Kclient.ServiceAccounts("namespace1").(*fakeServiceAccounts)
+	serviceAccounts.conflicts = 2
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: *argAWSSecretName}}
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+
+	serviceAccount, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	assertSecretPresent(t, serviceAccount.ImagePullSecrets, *argAWSSecretName)
+	assert.Equal(t, 0, serviceAccounts.conflicts)
+}
+
 func TestDefaultAwsRegionFromArgs(t *testing.T) {
 	assert.Equal(t, "us-east-1", *argAWSRegion)
 }
@@ -403,9 +649,6 @@ func TestAwsRegionFromEnv(t *testing.T) {
 }
 
 func TestFailingGcrPassingEcrStillSucceeds(t *testing.T) {
-	enableShortRetries()
-
-	awsAccountIDs = []string{""}
 	c := newFakeFailingController()
 	c.ecrClient = newFakeEcrClient()
 
@@ -421,9 +664,6 @@ func TestControllerGenerateSecretsSimpleRetryOnError(t *testing.T) {
 		log.SetOutput(io.Discard)
 		logrus.SetOutput(io.Discard)
 	}()
-	enableShortRetries()
-
-	awsAccountIDs = []string{""}
 	c := newFakeFailingController()
 
 	process(t, c)
@@ -438,14 +678,80 @@ func TestControllerGenerateSecretsExponentialRetryOnError(t *testing.T) {
 		log.SetOutput(io.Discard)
 		logrus.SetOutput(io.Discard)
 	}()
-	RetryCfg = RetryConfig{
+	c := newFakeFailingController()
+	c.defaults.Retry = RetryConfig{
 		Type:                "exponential",
 		NumberOfRetries:     3,
 		RetryDelayInSeconds: 1,
 	}
-	SetupRetryTimer()
-	awsAccountIDs = []string{""}
-	c := newFakeFailingController()
 
 	process(t, c)
 }
+
+func TestVersionHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	versionHandler(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+
+	v := VersionInfo{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &v))
+	assert.Equal(t, version, v.Version)
+	assert.Equal(t, gitSHA, v.GitSHA)
+	assert.NotEmpty(t, v.GoVersion)
+}
+
+type fakeStsClient struct {
+	arn string
+	err error
+}
+
+func (f *fakeStsClient) GetCallerIdentityWithContext(ctx aws.Context, input *sts.GetCallerIdentityInput, opts ...request.Option) (*sts.GetCallerIdentityOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &sts.GetCallerIdentityOutput{Arn: aws.String(f.arn)}, nil
+}
+
+func TestRunChecks(t *testing.T) {
+	c := newFakeController()
+
+	results := runChecks(context.TODO(), c, &fakeStsClient{arn: "arn:aws:iam::12345678:user/test"}, nil)
+	assert.True(t, printCheckReport(io.Discard, results))
+
+	c.k8sutil.Kclient.(*fakeKubeClient).deniedPermissions = []string{"update serviceaccounts"}
+	results = runChecks(context.TODO(), c, &fakeStsClient{err: errors.New("no credentials")}, nil)
+	assert.False(t, printCheckReport(io.Discard, results))
+
+	var failed []string
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r.Name)
+		}
+	}
+	assert.Equal(t, []string{"AWS identity", "Kubernetes RBAC: update serviceaccounts"}, failed)
+}
+
+func TestGenerateProviderSecretsConcurrently(t *testing.T) {
+	c := newFakeController()
+	slow := func(ctx context.Context) ([]AuthToken, error) {
+		time.Sleep(200 * time.Millisecond)
+		return []AuthToken{{AccessToken: base64.StdEncoding.EncodeToString([]byte("AWS:token")), Endpoint: "https://registry.example.com"}}, nil
+	}
+	failing := func(ctx context.Context) ([]AuthToken, error) {
+		return nil, errors.New("denied")
+	}
+	generators := []SecretGenerator{
+		{Name: "slow-a", SecretName: "slow-a", TokenGenFxn: slow, IsJSONCfg: true},
+		{Name: "failing", SecretName: "failing", TokenGenFxn: failing, IsJSONCfg: true},
+		{Name: "slow-b", SecretName: "slow-b", TokenGenFxn: slow, IsJSONCfg: true},
+	}
+
+	start := time.Now()
+	secrets := c.generateProviderSecrets(context.TODO(), generators)
+	assert.Less(t, time.Since(start), 350*time.Millisecond, "the slow providers are fetched at the same time")
+	// a failed fetch yields an empty secret
+	if assert.Len(t, secrets, 3) {
+		assert.Equal(t, "slow-a", secrets[0].Name)
+		assert.Equal(t, "failing", secrets[1].Name)
+		assert.Equal(t, "slow-b", secrets[2].Name)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+)
+
+const metricsNamespace = "registry_creds"
+
+var (
+	// metricsRegistry is shared with controller-runtime, which already registers the Go, process, workqueue and client metrics
+	metricsRegistry = ctrlmetrics.Registry
+
+	secretSizeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_size_bytes",
+		Help:      "Size of the data of each generated secret, compared against the 1MiB Kubernetes secret limit.",
+	}, []string{"provider", "secret"})
+	secretParts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_parts",
+		Help:      "Number of secrets a provider's output is split across.",
+	}, []string{"provider"})
+
+	namespaceSyncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "namespace_sync_duration_seconds",
+		Help:      "Time taken to write the secrets and ServiceAccounts of a single namespace.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"trigger", "result"})
+	syncCycleDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_cycle_duration_seconds",
+		Help:      "Time taken by a provider refresh to fetch a token and push it to every managed namespace.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"provider"})
+	providerCircuitOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "provider_circuit_open",
+		Help:      "1 while a provider's circuit breaker is open after repeated refresh failures.",
+	}, []string{"provider"})
+	providerStale = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "provider_stale",
+		Help:      "1 while a provider's refresh fails and its cached, unexpired tokens are served to namespaces.",
+	}, []string{"provider"})
+	managedNamespaces = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "managed_namespaces",
+		Help:      "Number of namespaces that receive the pull secrets, as of the last provider refresh.",
+	})
+	cycleNamespaces = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cycle_namespaces",
+		Help:      "Namespaces seen by the last refresh of a provider, by state: managed, failed, or the reason they were skipped.",
+	}, []string{"provider", "state"})
+	tokenExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_expiry_timestamp_seconds",
+		Help:      "Unix time at which the earliest token of a provider's last successful fetch expires, for providers that report it.",
+	}, []string{"provider"})
+	canaryFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "canary_failures_total",
+		Help:      "Number of provider rotations stopped because they failed in the canary namespaces.",
+	}, []string{"provider"})
+	danglingPullSecrets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dangling_pull_secrets_total",
+		Help:      "Number of managed imagePullSecrets entries found pointing to a deleted secret, by whether the secret was recreated or the entry removed.",
+	}, []string{"action"})
+	eventsSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_suppressed_total",
+		Help:      "Number of Kubernetes Events not emitted because an identical Event was emitted in the current --event-aggregation-window or the Event rate limit was exhausted.",
+	}, []string{"reason"})
+	ecrAccountFailed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ecr_account_failed",
+		Help:      "1 for every AWS account whose ECR token the last fetch of an ECR provider could not get while the other accounts succeeded.",
+	}, []string{"provider", "account"})
+	agentRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_requests_total",
+		Help:      "Kubelet credential requests answered by the agent, by whether credentials for the image's registry were found.",
+	}, []string{"result"})
+	kubeAPIThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "kube_api_throttled_total",
+		Help:      "Number of Kubernetes API requests throttled, by source: server for 429 Too Many Requests responses, client for requests held back by the client-side rate limit.",
+	}, []string{"source"})
+	kubeAPIThrottledSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "kube_api_throttled_seconds_total",
+		Help:      "Time Kubernetes API requests were held back by throttling, by source; a server backoff pauses every write.",
+	}, []string{"source"})
+	kubeAPIWriteRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "kube_api_write_retries_total",
+		Help:      "Number of Kubernetes writes retried after a transient error, such as a server error, a timeout or a broken connection.",
+	})
+	pullFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pull_failures_total",
+		Help:      "Containers seen failing to pull from a provider's registry for lack of credentials although their namespace has the provider's pull secret, see --watch-pull-failures; the namespace is in the log and the Event.",
+	}, []string{"registry"})
+	unmanagedSecrets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unmanaged_secrets_total",
+		Help:      "Existing secrets of a managed name found without the managed-by label, by what --unmanaged-secrets did about them; the namespace is in the log and the Event.",
+	}, []string{"action"})
+	pausedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "paused",
+		Help:      "1 while writes are paused by --pause-file.",
+	})
+)
+
+const (
+	syncTriggerReconcile = "reconcile"
+	syncTriggerRefresh   = "refresh"
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		secretSizeBytes,
+		secretParts,
+		namespaceSyncDuration,
+		syncCycleDuration,
+		managedNamespaces,
+		cycleNamespaces,
+		providerCircuitOpen,
+		providerStale,
+		pausedGauge,
+		canaryFailures,
+		tokenExpiry,
+		danglingPullSecrets,
+		eventsSuppressed,
+		kubeAPIThrottled,
+		kubeAPIThrottledSeconds,
+		kubeAPIWriteRetries,
+		ecrAccountFailed,
+		agentRequests,
+		pullFailures,
+		unmanagedSecrets,
+	)
+}
+
+// observeNamespaceSync records the duration of a namespace sync started at start
+func observeNamespaceSync(trigger string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	namespaceSyncDuration.WithLabelValues(trigger, result).Observe(time.Since(start).Seconds())
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// recordTokenExpiry publishes and logs how long the provider's new tokens are valid, warning when they expire before
+// the provider's next scheduled refresh
+func recordTokenExpiry(secretGenerator SecretGenerator, tokens []AuthToken, now time.Time) {
+	expiry := providers.EarliestExpiry(tokens)
+	if expiry.IsZero() {
+		tokenExpiry.DeleteLabelValues(secretGenerator.Name)
+		return
+	}
+	tokenExpiry.WithLabelValues(secretGenerator.Name).Set(float64(expiry.Unix()))
+
+	remaining := expiry.Sub(now).Round(time.Second)
+	if remaining < secretGenerator.RefreshInterval {
+		log.Warnf("The tokens of provider %s expire in %s at %s, before the next refresh in %s", secretGenerator.Name, remaining, expiry.UTC().Format(time.RFC3339), secretGenerator.RefreshInterval)
+		return
+	}
+	log.Infof("The tokens of provider %s are valid for %s, until %s", secretGenerator.Name, remaining, expiry.UTC().Format(time.RFC3339))
+}
+
+// observeThrottle is the k8sutil.Throttle callback counting throttled Kubernetes API requests
+func observeThrottle(source string, delay time.Duration) {
+	kubeAPIThrottled.WithLabelValues(source).Inc()
+	kubeAPIThrottledSeconds.WithLabelValues(source).Add(delay.Seconds())
+}
+
+// observeWriteRetry is the k8sutil.WriteRetry callback counting retried Kubernetes writes
+func observeWriteRetry(error) {
+	kubeAPIWriteRetries.Inc()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+)
+
+const (
+	outputMirror = "mirror"
+
+	// mirrorOfAnnotation on a mirror names the hub secret it is copied from, as <namespace>/<name>
+	mirrorOfAnnotation = annotationPrefix + "mirror-of"
+	// mirrorVersionAnnotation on a mirror is the resourceVersion of the hub secret it was last copied from
+	mirrorVersionAnnotation = annotationPrefix + "mirror-version"
+)
+
+// mirrorOutput writes every provider secret once into a hub namespace and keeps copies of the hub secret in the consumer
+// namespaces. The mirrors are copied from the hub object, not from the provider's tokens, so a hub secret that is
+// updated in any way is reflected into every namespace.
+type mirrorOutput struct {
+	util         *k8sutil.KubeUtilInterface
+	hubNamespace string
+
+	// written holds the data last written to each hub secret, so it is only updated once per refresh
+	writtenLock sync.Mutex
+	written     map[string]map[string][]byte
+}
+
+// mirrorHubNamespace is where the hub secrets live: --mirror-hub-namespace, else the status namespace
+func mirrorHubNamespace() string {
+	if *argMirrorHubNamespace != "" {
+		return *argMirrorHubNamespace
+	}
+	return statusNamespace()
+}
+
+func newMirrorOutput(util *k8sutil.KubeUtilInterface, hubNamespace string) *mirrorOutput {
+	return &mirrorOutput{util: util, hubNamespace: hubNamespace, written: map[string]map[string][]byte{}}
+}
+
+func (o *mirrorOutput) write(ctx context.Context, namespace string, secret *v1.Secret) error {
+	if err := o.writeHub(ctx, secret); err != nil {
+		return err
+	}
+	hub, err := o.util.GetSecret(ctx, o.hubNamespace, secret.Name)
+	if k8sutil.IsNotFound(err) {
+		// the hub secret was deleted since it was last written
+		o.forget(secret.Name)
+		if err := o.writeHub(ctx, secret); err != nil {
+			return err
+		}
+		hub, err = o.util.GetSecret(ctx, o.hubNamespace, secret.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read hub Secret: %w", err)
+	}
+	if namespace == o.hubNamespace {
+		return nil
+	}
+
+	_, err = secretsync.EnsureSecret(ctx, o.util, namespace, o.mirrorOf(hub))
+	if err != nil {
+		return fmt.Errorf("could not write mirror of %s/%s: %w", o.hubNamespace, secret.Name, err)
+	}
+	return nil
+}
+
+// mirrorOf returns the mirror copy of a hub secret
+func (o *mirrorOutput) mirrorOf(hub *v1.Secret) *v1.Secret {
+	mirror := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: hub.Name,
+			Annotations: map[string]string{
+				mirrorOfAnnotation:      o.hubNamespace + "/" + hub.Name,
+				mirrorVersionAnnotation: hub.ResourceVersion,
+			},
+		},
+		Type: hub.Type,
+		Data: hub.Data,
+	}
+	setManagedMetadata(&mirror.ObjectMeta)
+	return mirror
+}
+
+// writeHub creates or updates the hub secret when the provider's data changed
+func (o *mirrorOutput) writeHub(ctx context.Context, secret *v1.Secret) error {
+	o.writtenLock.Lock()
+	defer o.writtenLock.Unlock()
+	if reflect.DeepEqual(o.written[secret.Name], secret.Data) {
+		return nil
+	}
+
+	hub := secret.DeepCopy()
+	hub.Namespace = o.hubNamespace
+	created, err := secretsync.EnsureSecret(ctx, o.util, o.hubNamespace, hub)
+	if err != nil {
+		return fmt.Errorf("could not write hub Secret: %w", err)
+	}
+	if created {
+		log.Infof("Created hub secret %s in namespace %s", secret.Name, o.hubNamespace)
+	} else {
+		log.Infof("Updated hub secret %s in namespace %s", secret.Name, o.hubNamespace)
+	}
+	o.written[secret.Name] = secret.Data
+	return nil
+}
+
+// forget makes the next writeHub write the hub secret even if the provider's data did not change
+func (o *mirrorOutput) forget(name string) {
+	o.writtenLock.Lock()
+	defer o.writtenLock.Unlock()
+	delete(o.written, name)
+}
+
+// hubSecretChanged only lets through updates of a managed secret in the hub namespace
+func (c *controller) hubSecretChanged(hubNamespace string) predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		DeleteFunc:  func(event.DeleteEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return e.ObjectNew.GetNamespace() == hubNamespace && stringSliceContains(c.managedSecretNames(), e.ObjectNew.GetName())
+		},
+	}
+}
+
+// allNamespaces maps a hub secret to a request for every namespace, so every mirror is brought up to date
+func allNamespaces(reader client.Reader) func(client.Object) []ctrl.Request {
+	return func(client.Object) []ctrl.Request {
+		namespaces := &v1.NamespaceList{}
+		if err := reader.List(context.Background(), namespaces); err != nil {
+			log.Errorf("Could not list namespaces to update the mirrors! [Err: %s]", err)
+			return nil
+		}
+		requests := make([]ctrl.Request, 0, len(namespaces.Items))
+		for _, ns := range namespaces.Items {
+			requests = append(requests, ctrl.Request{NamespacedName: types.NamespacedName{Name: ns.Name}})
+		}
+		return requests
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestMirrorOutput(t *testing.T) {
+	util := newKubeUtil()
+	output := newMirrorOutput(util, "namespace1")
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "awsecr-cred"},
+		Data:       map[string][]byte{v1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+		Type:       v1.SecretTypeDockerConfigJson,
+	}
+
+	assert.Nil(t, output.write(context.TODO(), "namespace2", secret))
+	hub, err := util.GetSecret(context.TODO(), "namespace1", "awsecr-cred")
+	assert.Nil(t, err)
+	assert.Equal(t, secret.Data, hub.Data)
+	mirror, err := util.GetSecret(context.TODO(), "namespace2", "awsecr-cred")
+	assert.Nil(t, err)
+	assert.Equal(t, secret.Data, mirror.Data)
+	assert.Equal(t, v1.SecretTypeDockerConfigJson, mirror.Type)
+	assert.Equal(t, "namespace1/awsecr-cred", mirror.Annotations[mirrorOfAnnotation])
+	assert.Equal(t, managedByValue, mirror.Labels[managedByLabel])
+
+	// the mirrors follow the hub, however it was changed
+	hub.Data = map[string][]byte{v1.DockerConfigJsonKey: []byte(`{"auths":{"edited":{}}}`)}
+	assert.Nil(t, util.UpdateSecret(context.TODO(), "namespace1", hub))
+	assert.Nil(t, output.write(context.TODO(), "namespace2", secret))
+	mirror, err = util.GetSecret(context.TODO(), "namespace2", "awsecr-cred")
+	assert.Nil(t, err)
+	assert.Equal(t, hub.Data, mirror.Data)
+
+	// a deleted hub secret is written again
+	assert.Nil(t, util.DeleteSecret(context.TODO(), "namespace1", "awsecr-cred"))
+	assert.Nil(t, output.write(context.TODO(), "namespace1", secret))
+	hub, err = util.GetSecret(context.TODO(), "namespace1", "awsecr-cred")
+	assert.Nil(t, err)
+	assert.Equal(t, secret.Data, hub.Data)
+}
+
+func TestRemoveFromNamespaceKeepsHubSecret(t *testing.T) {
+	c := newFakeController()
+	c.output = newMirrorOutput(c.k8sutil, "namespace1")
+	process(t, c)
+
+	for _, ns := range []string{"namespace1", "namespace2"} {
+		namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}}
+		assert.Nil(t, c.removeFromNamespace(context.TODO(), namespace))
+	}
+
+	_, err := c.k8sutil.GetSecret(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	_, err = c.k8sutil.GetSecret(context.TODO(), "namespace2", *argAWSSecretName)
+	assert.NotNil(t, err)
+}
+
+func TestHubSecretChanged(t *testing.T) {
+	c := newFakeController()
+	p := c.hubSecretChanged("namespace1")
+
+	hub := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: *argAWSSecretName, Namespace: "namespace1"}}
+	mirror := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: *argAWSSecretName, Namespace: "namespace2"}}
+	other := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "namespace1"}}
+
+	assert.True(t, p.Update(event.UpdateEvent{ObjectOld: hub, ObjectNew: hub}))
+	assert.False(t, p.Update(event.UpdateEvent{ObjectOld: mirror, ObjectNew: mirror}))
+	assert.False(t, p.Update(event.UpdateEvent{ObjectOld: other, ObjectNew: other}))
+	assert.False(t, p.Delete(event.DeleteEvent{Object: hub}))
+
+	reader := fake.NewClientBuilder().WithObjects(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace2"}},
+	).Build()
+	assert.Len(t, allNamespaces(reader)(hub), 2)
+}
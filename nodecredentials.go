@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// --node-credential-mode values
+const (
+	nodeCredentialAnnotate = "annotate"
+	nodeCredentialSkip     = "skip"
+)
+
+// nodeCoveredAnnotation on a namespace lists the registries of its pull secrets that the nodes' kubelet credential
+// providers already cover
+const nodeCoveredAnnotation = annotationPrefix + "node-covered-registries"
+
+// nodeCovered reports whether a kubelet credential provider covers the registry host, per --node-credential-registries
+func nodeCovered(host string) bool {
+	return matchesRegistry(*argNodeCredRegistries, host)
+}
+
+// validRegistryPatterns drops the malformed patterns and returns an error for each
+func validRegistryPatterns(patterns []string) ([]string, []error) {
+	valid := make([]string, 0, len(patterns))
+	var errs []error
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid registry pattern '%s': %v", pattern, err))
+			continue
+		}
+		valid = append(valid, pattern)
+	}
+	return valid, errs
+}
+
+// distributedTokens returns the tokens that go into the pull secrets: with --node-credential-mode=skip the registries
+// covered by the nodes are left out, since the kubelet already has credentials for them
+func distributedTokens(tokens []AuthToken) []AuthToken {
+	if *argNodeCredMode != nodeCredentialSkip || len(*argNodeCredRegistries) == 0 {
+		return tokens
+	}
+	result := make([]AuthToken, 0, len(tokens))
+	for _, token := range tokens {
+		if !nodeCovered(token.Host()) {
+			result = append(result, token)
+		}
+	}
+	return result
+}
+
+// nodeCoveredRegistries returns the sorted hosts of the providers' cached tokens that the nodes cover
+func (c *controller) nodeCoveredRegistries(secretGenerators []SecretGenerator) []string {
+	c.secretsLock.Lock()
+	defer c.secretsLock.Unlock()
+	seen := map[string]bool{}
+	var hosts []string
+	for _, secretGenerator := range secretGenerators {
+		for _, token := range c.tokens[secretGenerator.SecretName] {
+			host := token.Host()
+			if nodeCovered(host) && !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// markNodeCoveredRegistries keeps the namespace's registry-creds.k8s.io/node-covered-registries annotation in line
+// with the registries of its providers that the nodes cover; it only writes when the list changed
+func (c *controller) markNodeCoveredRegistries(ctx context.Context, ns *v1.Namespace, secretGenerators []SecretGenerator) {
+	if len(*argNodeCredRegistries) == 0 || !c.caps.annotateNamespaces {
+		return
+	}
+	value := strings.Join(c.nodeCoveredRegistries(secretGenerators), ",")
+	if ns.Annotations[nodeCoveredAnnotation] == value {
+		return
+	}
+	if err := c.k8sutil.AnnotateNamespace(ctx, ns.GetName(), nodeCoveredAnnotation, value); err != nil {
+		// informational only, so the sync does not fail over it
+		log.Warnf("Could not mark the registries covered by the nodes on namespace %s! [Err: %s]", ns.GetName(), err)
+		return
+	}
+	log.Infof("Registries covered by the nodes' credential providers in namespace %s: %s", ns.GetName(), value)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDistributedTokens(t *testing.T) {
+	defer func(registries []string, mode string) {
+		*argNodeCredRegistries = registries
+		*argNodeCredMode = mode
+	}(*argNodeCredRegistries, *argNodeCredMode)
+
+	tokens := []AuthToken{
+		{Endpoint: "https://123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+		{Endpoint: "https://registry.example.com"},
+	}
+	*argNodeCredRegistries = []string{"*.dkr.ecr.*.amazonaws.com"}
+	assert.True(t, nodeCovered("123456789012.DKR.ECR.eu-west-1.amazonaws.com"))
+	assert.False(t, nodeCovered("registry.example.com"))
+
+	// annotate only marks the registries
+	assert.Equal(t, tokens, distributedTokens(tokens))
+
+	*argNodeCredMode = nodeCredentialSkip
+	assert.Equal(t, tokens[1:], distributedTokens(tokens))
+}
+
+func TestValidateParamsNodeCredentials(t *testing.T) {
+	defer func(registries []string, mode string) {
+		*argNodeCredRegistries = registries
+		*argNodeCredMode = mode
+	}(*argNodeCredRegistries, *argNodeCredMode)
+
+	*argNodeCredRegistries = []string{"*.dkr.ecr.*.amazonaws.com", "registry-["}
+	*argNodeCredMode = "merge"
+	_, problems := validateParams()
+	assert.Equal(t, []string{"*.dkr.ecr.*.amazonaws.com"}, *argNodeCredRegistries)
+	assert.Equal(t, nodeCredentialAnnotate, *argNodeCredMode)
+	assert.Contains(t, problemStrings(problems), `flag --node-credential-mode="merge": must be annotate or skip; defaulting to annotate`)
+}
+
+func TestHandlerMarksNodeCoveredRegistries(t *testing.T) {
+	defer func(registries []string) { *argNodeCredRegistries = registries }(*argNodeCredRegistries)
+	*argNodeCredRegistries = []string{"fake*"}
+
+	c := newFakeController()
+	namespaces := c.k8sutil.Kclient.(*fakeKubeClient).namespaces
+	ns := namespaces.store["namespace1"]
+	assert.Nil(t, handler(context.TODO(), c, &ns))
+	assert.Equal(t, "fakeEndpoint", namespaces.store["namespace1"].Annotations[nodeCoveredAnnotation])
+
+	// the annotation is removed once no registry is covered any more
+	*argNodeCredRegistries = []string{"registry.example.com"}
+	ns = namespaces.store["namespace1"]
+	assert.Nil(t, handler(context.TODO(), c, &ns))
+	assert.NotContains(t, namespaces.store["namespace1"].Annotations, nodeCoveredAnnotation)
+
+	// without the permission nothing is written
+	c.caps.annotateNamespaces = false
+	*argNodeCredRegistries = []string{"fake*"}
+	assert.Nil(t, handler(context.TODO(), c, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}))
+	assert.NotContains(t, namespaces.store["namespace1"].Annotations, nodeCoveredAnnotation)
+}
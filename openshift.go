@@ -0,0 +1,12 @@
+package main
+
+const (
+	// builderServiceAccount pulls the base images of OpenShift builds
+	builderServiceAccount = "builder"
+	// deployerServiceAccount runs the deployer pods of OpenShift DeploymentConfigs
+	deployerServiceAccount = "deployer"
+)
+
+// openShiftServiceAccounts are patched next to "default" in every project with --openshift. OpenShift creates them
+// asynchronously after the project, and not at all when the Build and DeploymentConfig capabilities are disabled.
+var openShiftServiceAccounts = []string{builderServiceAccount, deployerServiceAccount}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Ownership strategies, see --ownership
+const (
+	// ownershipController only marks the objects as managed by registry-creds
+	ownershipController = "controller"
+	// ownershipGitOps also tells Argo CD and Flux to leave the objects alone
+	ownershipGitOps = "gitops"
+
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "registry-creds"
+)
+
+// gitOpsAnnotations stop Argo CD from reporting the objects as out of sync or pruning them, and Flux from pruning or
+// reverting them when they end up in a directory it reconciles
+var gitOpsAnnotations = map[string]string{
+	"argocd.argoproj.io/compare-options":    "IgnoreExtraneous",
+	"argocd.argoproj.io/sync-options":       "Prune=false",
+	"kustomize.toolkit.fluxcd.io/prune":     "disabled",
+	"kustomize.toolkit.fluxcd.io/reconcile": "disabled",
+}
+
+// managedLabels returns the labels of every object the controller writes; --managed-labels win over the defaults
+func managedLabels() map[string]string {
+	labels := map[string]string{managedByLabel: managedByValue}
+	for k, v := range *argManagedLabels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// managedAnnotations returns the annotations of every object the controller writes, nil if there are none
+func managedAnnotations() map[string]string {
+	var annotations map[string]string
+	if *argOwnership == ownershipGitOps {
+		annotations = map[string]string{}
+		for k, v := range gitOpsAnnotations {
+			annotations[k] = v
+		}
+	}
+	for k, v := range *argManagedAnnotations {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[k] = v
+	}
+	return annotations
+}
+
+// setManagedMetadata adds the managed labels and annotations to an object the controller writes
+func setManagedMetadata(meta *metav1.ObjectMeta) {
+	meta.Labels = mergeStringMaps(meta.Labels, managedLabels())
+	meta.Annotations = mergeStringMaps(meta.Annotations, managedAnnotations())
+}
+
+// mergeStringMaps returns base with the entries of extra added, allocating base if needed
+func mergeStringMaps(base, extra map[string]string) map[string]string {
+	if len(extra) == 0 {
+		return base
+	}
+	if base == nil {
+		base = make(map[string]string, len(extra))
+	}
+	for k, v := range extra {
+		base[k] = v
+	}
+	return base
+}
+
+// containsStringMap reports whether every entry of extra is in base
+func containsStringMap(base, extra map[string]string) bool {
+	for k, v := range extra {
+		if got, ok := base[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
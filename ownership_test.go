@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManagedMetadata(t *testing.T) {
+	defer func() {
+		*argOwnership = ownershipController
+		*argManagedLabels = nil
+		*argManagedAnnotations = nil
+	}()
+
+	assert.Equal(t, map[string]string{managedByLabel: managedByValue}, managedLabels())
+	assert.Nil(t, managedAnnotations())
+
+	*argOwnership = ownershipGitOps
+	*argManagedLabels = map[string]string{"team": "platform"}
+	*argManagedAnnotations = map[string]string{"argocd.argoproj.io/sync-options": "Prune=confirm", "note": "rotated"}
+	assert.Equal(t, map[string]string{managedByLabel: managedByValue, "team": "platform"}, managedLabels())
+	annotations := managedAnnotations()
+	assert.Equal(t, "IgnoreExtraneous", annotations["argocd.argoproj.io/compare-options"])
+	assert.Equal(t, "disabled", annotations["kustomize.toolkit.fluxcd.io/prune"])
+	assert.Equal(t, "Prune=confirm", annotations["argocd.argoproj.io/sync-options"])
+	assert.Equal(t, "rotated", annotations["note"])
+}
+
+func TestProcessWritesManagedMetadata(t *testing.T) {
+	*argOwnership = ownershipGitOps
+	defer func() { *argOwnership = ownershipController }()
+	c := newFakeController()
+
+	process(t, c)
+
+	secret, err := c.k8sutil.GetSecret(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, managedByValue, secret.Labels[managedByLabel])
+	assert.Equal(t, "IgnoreExtraneous", secret.Annotations["argocd.argoproj.io/compare-options"])
+	assert.Equal(t, "disabled", secret.Annotations["kustomize.toolkit.fluxcd.io/reconcile"])
+}
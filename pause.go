@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pausePollInterval is how often --pause-file is checked for a change
+const pausePollInterval = 10 * time.Second
+
+// writesPaused reports whether --pause-file exists. While paused the providers are still refreshed, so broken
+// credentials show up in the logs and metrics, but nothing is written to the cluster.
+func writesPaused() bool {
+	if *argPauseFile == "" {
+		return false
+	}
+	_, err := os.Stat(*argPauseFile)
+	return err == nil
+}
+
+// runPauseWatcher logs pausing and resuming, and refreshes every provider on resume so the namespaces catch up on the
+// writes skipped in the meantime
+func (c *controller) runPauseWatcher(ctx context.Context) {
+	if *argPauseFile == "" {
+		return
+	}
+	paused := false
+	ticker := time.NewTicker(pausePollInterval)
+	defer ticker.Stop()
+	for {
+		if now := writesPaused(); now != paused {
+			paused = now
+			c.pauseChanged(paused)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *controller) pauseChanged(paused bool) {
+	if paused {
+		pausedGauge.Set(1)
+		log.Warnf("Paused by %s; tokens are still fetched, but no secrets, ServiceAccounts or ConfigMaps are written until it is removed", *argPauseFile)
+		return
+	}
+	pausedGauge.Set(0)
+	log.Infof("Resumed, %s was removed; refreshing every provider", *argPauseFile)
+	c.triggerRefresh()
+}
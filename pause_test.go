@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func pauseWrites(t *testing.T) string {
+	file := filepath.Join(t.TempDir(), "paused")
+	assert.Nil(t, os.WriteFile(file, nil, 0o600))
+	*argPauseFile = file
+	t.Cleanup(func() { *argPauseFile = "" })
+	return file
+}
+
+func TestWritesPaused(t *testing.T) {
+	assert.False(t, writesPaused())
+
+	file := pauseWrites(t)
+	assert.True(t, writesPaused())
+
+	assert.Nil(t, os.Remove(file))
+	assert.False(t, writesPaused())
+}
+
+func TestPausedRefreshFetchesButDoesNotWrite(t *testing.T) {
+	c := newFakeController()
+	pauseWrites(t)
+
+	sg := getSecretGenerators(c)[0]
+	c.refreshProvider(context.TODO(), sg)
+	assert.NotEmpty(t, c.cachedSecrets(sg.SecretName))
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", sg.SecretName)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	exists, err = c.k8sutil.SecretExists(context.TODO(), "namespace1", sg.SecretName)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
+
+func TestPausedStatusIsWrittenAfterResume(t *testing.T) {
+	defer func(name string) { *argStatusConfigMap = name }(*argStatusConfigMap)
+	*argStatusConfigMap = "registry-creds-status"
+	c := newFakeController()
+	file := pauseWrites(t)
+
+	c.status.record("namespace1", &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret"}}, nil)
+	assert.Nil(t, c.writeStatus(context.TODO()))
+	_, err := c.k8sutil.GetConfigMap(context.TODO(), statusNamespace(), *argStatusConfigMap)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, os.Remove(file))
+	assert.Nil(t, c.writeStatus(context.TODO()))
+	_, err = c.k8sutil.GetConfigMap(context.TODO(), statusNamespace(), *argStatusConfigMap)
+	assert.Nil(t, err)
+}
+
+func TestPauseChangedSetsGauge(t *testing.T) {
+	c := newFakeController()
+	c.pauseChanged(true)
+	assert.Equal(t, float64(1), testutil.ToFloat64(pausedGauge))
+	pausedGauge.Set(0)
+}
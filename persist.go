@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+)
+
+const (
+	// lastGoodSuffix is appended to a provider's secret name for the secret in the status namespace holding its last fetched tokens
+	lastGoodSuffix = "-last-good"
+	// lastGoodTokensKey is the key of the JSON encoded tokens in a last-good secret
+	lastGoodTokensKey = "tokens"
+)
+
+// lastGoodSecretName is the name of the secret that keeps the last fetched tokens of the provider whose secret is called name
+func lastGoodSecretName(name string) string {
+	return name + lastGoodSuffix
+}
+
+// persistTokens saves the tokens of a successful fetch in the status namespace, unless they did not change since the
+// previous fetch, so a restarted controller can seed new namespaces while the provider is down, see restoreTokens
+func (c *controller) persistTokens(ctx context.Context, secretGenerator SecretGenerator, previous, tokens []AuthToken) error {
+	if !*argPersistTokens || writesPaused() || reflect.DeepEqual(previous, tokens) {
+		return nil
+	}
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        lastGoodSecretName(secretGenerator.SecretName),
+			Namespace:   statusNamespace(),
+			Annotations: map[string]string{rotatedAtAnnotation: time.Now().UTC().Format(time.RFC3339)},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{lastGoodTokensKey: data},
+	}
+	setManagedMetadata(&secret.ObjectMeta)
+	_, err = secretsync.EnsureSecret(ctx, c.k8sutil, statusNamespace(), secret)
+	return err
+}
+
+// persistedTokens returns the unexpired tokens persistTokens saved for a provider, nil if there are none
+func (c *controller) persistedTokens(ctx context.Context, secretGenerator SecretGenerator, now time.Time) ([]AuthToken, error) {
+	secret, err := c.k8sutil.GetSecret(ctx, statusNamespace(), lastGoodSecretName(secretGenerator.SecretName))
+	if k8sutil.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tokens []AuthToken
+	if err := json.Unmarshal(secret.Data[lastGoodTokensKey], &tokens); err != nil {
+		return nil, fmt.Errorf("could not decode secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+	var valid []AuthToken
+	for _, token := range tokens {
+		if token.ExpiresAt.IsZero() || token.ExpiresAt.After(now) {
+			valid = append(valid, token)
+		}
+	}
+	return valid, nil
+}
+
+// restoreTokens caches the persisted tokens of a provider whose fetch failed before any succeeded, typically after a
+// restart during a provider outage, and returns their secrets; nil if there are no unexpired persisted tokens
+func (c *controller) restoreTokens(ctx context.Context, secretGenerator SecretGenerator) []*v1.Secret {
+	if !*argPersistTokens || c.cachedSecrets(secretGenerator.SecretName) != nil {
+		return nil
+	}
+	tokens, err := c.persistedTokens(ctx, secretGenerator, time.Now())
+	if err != nil {
+		log.Errorf("Could not read the persisted credentials of provider %s! [Err: %s]", secretGenerator.Name, err)
+		return nil
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+	secret, err := generateSecretObj(distributedTokens(tokens), secretGenerator)
+	if err != nil {
+		log.Errorf("Could not generate the secret of the persisted credentials of provider %s! [Err: %s]", secretGenerator.Name, err)
+		return nil
+	}
+	secrets, err := splitSecret(secret, *argSecretSplitSize)
+	if err != nil {
+		log.Errorf("Could not generate the secret of the persisted credentials of provider %s! [Err: %s]", secretGenerator.Name, err)
+		return nil
+	}
+
+	c.secretsLock.Lock()
+	defer c.secretsLock.Unlock()
+	if c.secrets[secretGenerator.SecretName] != nil {
+		// a concurrent fetch succeeded meanwhile
+		return c.secrets[secretGenerator.SecretName]
+	}
+	log.Warnf("Seeding namespaces with the persisted credentials of provider %s until a fetch succeeds", secretGenerator.Name)
+	c.secrets[secretGenerator.SecretName] = secrets
+	c.tokens[secretGenerator.SecretName] = tokens
+	return secrets
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// persistTestGenerator returns a provider whose fetch returns a token expiring at expiry, or fails with *fetchErr
+func persistTestGenerator(expiry time.Time, fetchErr *error) SecretGenerator {
+	return SecretGenerator{
+		Name:       "persist-test",
+		SecretName: "persist-cred",
+		IsJSONCfg:  true,
+		Retry:      RetryConfig{Type: retryTypeSimple},
+		TokenGenFxn: func(context.Context) ([]AuthToken, error) {
+			if *fetchErr != nil {
+				return nil, *fetchErr
+			}
+			return []AuthToken{{AccessToken: "token", Endpoint: "https://registry.example.com", ExpiresAt: expiry}}, nil
+		},
+	}
+}
+
+func TestPersistedTokensSeedAfterRestart(t *testing.T) {
+	c := newFakeController()
+	var fetchErr error
+	sg := persistTestGenerator(time.Now().Add(time.Hour).Round(time.Second), &fetchErr)
+	defer providerStale.DeleteLabelValues(sg.Name)
+
+	fetched := c.generateProviderSecrets(context.TODO(), []SecretGenerator{sg})
+	assert.Len(t, fetched, 1)
+	persisted, err := c.k8sutil.GetSecret(context.TODO(), statusNamespace(), "persist-cred-last-good")
+	if assert.Nil(t, err) {
+		assert.Contains(t, string(persisted.Data[lastGoodTokensKey]), `"AccessToken":"token"`)
+		assert.Equal(t, managedByValue, persisted.Labels[managedByLabel])
+	}
+
+	// a restarted controller talking to the same cluster while the provider is down
+	restarted := newController(c.k8sutil, newFakeEcrClient())
+	fetchErr = errors.New("registry down")
+	seeded := restarted.generateProviderSecrets(context.TODO(), []SecretGenerator{sg})
+	if assert.Len(t, seeded, 1) {
+		assert.Equal(t, fetched[0].Data, seeded[0].Data)
+	}
+	assert.True(t, restarted.isStale(sg.Name))
+	assert.Equal(t, seeded, restarted.cachedSecrets(sg.SecretName))
+}
+
+func TestPersistedTokensExpired(t *testing.T) {
+	c := newFakeController()
+	var fetchErr error
+	sg := persistTestGenerator(time.Now().Add(-time.Minute), &fetchErr)
+	defer providerStale.DeleteLabelValues(sg.Name)
+
+	_, ok, err := c.refreshSecret(context.TODO(), sg)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	restarted := newController(c.k8sutil, newFakeEcrClient())
+	fetchErr = errors.New("registry down")
+	_, ok, err = restarted.refreshSecret(context.TODO(), sg)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, restarted.cachedSecrets(sg.SecretName))
+	assert.False(t, restarted.isStale(sg.Name))
+}
+
+func TestPersistTokensSkipsUnchanged(t *testing.T) {
+	c := newFakeController()
+	limiter := &countingLimiter{}
+	c.k8sutil.WriteLimiter = limiter
+	sg := SecretGenerator{SecretName: "persist-cred"}
+	tokens := []AuthToken{{AccessToken: "token", Endpoint: "https://registry.example.com"}}
+
+	assert.Nil(t, c.persistTokens(context.TODO(), sg, nil, tokens))
+	assert.Equal(t, 1, limiter.waits)
+	assert.Nil(t, c.persistTokens(context.TODO(), sg, tokens, tokens))
+	assert.Equal(t, 1, limiter.waits)
+
+	*argPersistTokens = false
+	defer func() { *argPersistTokens = true }()
+	assert.Nil(t, c.persistTokens(context.TODO(), sg, nil, []AuthToken{{AccessToken: "other"}}))
+	assert.Equal(t, 1, limiter.waits)
+}
@@ -0,0 +1,232 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// ECRName is the name of the ECR provider
+const ECRName = "ecr"
+
+// ECRMinRefreshInterval is the minimum refresh interval of the ECR provider: its tokens are valid for 12 hours, and
+// GetAuthorizationToken is rate limited per account and region, a limit shared with every node pulling from ECR
+const ECRMinRefreshInterval = 5 * time.Minute
+
+// ECRClient is the part of the ECR API the provider uses; *ecr.ECR implements it
+type ECRClient interface {
+	GetAuthorizationTokenWithContext(ctx aws.Context, input *ecr.GetAuthorizationTokenInput, opts ...request.Option) (*ecr.GetAuthorizationTokenOutput, error)
+}
+
+// ECR fetches the tokens of the ECR registries of one or more AWS accounts
+type ECR struct {
+	// Client requests the tokens of the accounts in Region
+	Client ECRClient
+	Region string
+	// AccountIDs are the registries to fetch tokens for; an empty ID stands for the default registry of the caller's account
+	AccountIDs []string
+	// AccountRegions holds the region of every account whose registry is not in Region
+	AccountRegions map[string]string
+	// AccountRoles holds the role assumed to request the token of an account, for accounts that do not grant the
+	// caller access to their registry
+	AccountRoles map[string]string
+	// ClientFor returns the client of another region; if nil, Client is used for every region
+	ClientFor func(region string) ECRClient
+	// ClientForRole returns the client of a region that assumes an account role; if nil, AccountRoles are ignored
+	ClientForRole func(region, role string) ECRClient
+	// CallTimeout bounds every API call; 0 disables it
+	CallTimeout time.Duration
+	// Concurrency is how many API calls run at the same time; 0 or 1 makes them one after the other
+	Concurrency int
+}
+
+var _ Provider = &ECR{}
+
+// Name implements Provider
+func (e *ECR) Name() string {
+	return ECRName
+}
+
+// MinRefreshInterval implements MinRefresher
+func (e *ECR) MinRefreshInterval() time.Duration {
+	return ECRMinRefreshInterval
+}
+
+// ecrCall is a single GetAuthorizationToken request: the accounts sharing a region and assumed role
+type ecrCall struct {
+	region   string
+	role     string
+	accounts []string
+}
+
+// PartialError is returned together with the tokens of the accounts that succeeded when the tokens of others could
+// not be fetched, e.g. because one account revoked the caller's access
+type PartialError struct {
+	// Failed holds the error of every failed account ID; "" is the default registry of the caller's account
+	Failed map[string]error
+}
+
+// Accounts returns the failed account IDs in order
+func (e *PartialError) Accounts() []string {
+	accounts := make([]string, 0, len(e.Failed))
+	for account := range e.Failed {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+	return accounts
+}
+
+func (e *PartialError) Error() string {
+	messages := make([]string, 0, len(e.Failed))
+	for _, account := range e.Accounts() {
+		messages = append(messages, e.Failed[account].Error())
+	}
+	return fmt.Sprintf("could not get the ECR tokens of %d account(s): %s", len(e.Failed), strings.Join(messages, "; "))
+}
+
+// Tokens requests one token per region and assumed role and returns a token per registry, in the order of
+// AccountIDs; registries reached through more than one account ID, e.g. the default registry and the account's own
+// ID, are returned once. If only some accounts fail, the tokens of the others are returned with a *PartialError.
+func (e *ECR) Tokens(ctx context.Context) ([]AuthToken, error) {
+	calls := e.calls()
+	results := make([][]AuthToken, len(calls))
+	errs := make([]map[string]error, len(calls))
+
+	concurrency := e.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range calls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			results[i], errs[i] = e.fetchCall(ctx, calls[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var tokens []AuthToken
+	failed := map[string]error{}
+	for i := range calls {
+		tokens = append(tokens, results[i]...)
+		for account, err := range errs[i] {
+			failed[account] = err
+		}
+	}
+	if len(failed) == 0 {
+		return DedupeTokens(Normalize(tokens)), nil
+	}
+	if len(tokens) == 0 {
+		// nothing to distribute; report the first failure like a single call would
+		for _, id := range e.AccountIDs {
+			if err, ok := failed[id]; ok {
+				return []AuthToken{}, err
+			}
+		}
+	}
+	return DedupeTokens(Normalize(tokens)), &PartialError{Failed: failed}
+}
+
+// fetchCall requests the tokens of a call's accounts at once. If that fails for more than one account, every account
+// is requested on its own, so an account that revoked access does not fail the others.
+func (e *ECR) fetchCall(ctx context.Context, call ecrCall) ([]AuthToken, map[string]error) {
+	tokens, err := e.fetch(ctx, call, call.accounts)
+	if err == nil {
+		return tokens, nil
+	}
+	if len(call.accounts) == 1 {
+		return nil, map[string]error{call.accounts[0]: err}
+	}
+	tokens = nil
+	failed := map[string]error{}
+	for _, account := range call.accounts {
+		accountTokens, err := e.fetch(ctx, call, []string{account})
+		if err != nil {
+			failed[account] = fmt.Errorf("account %s: %w", accountName(account), err)
+			continue
+		}
+		tokens = append(tokens, accountTokens...)
+	}
+	return tokens, failed
+}
+
+func accountName(account string) string {
+	if account == "" {
+		return "default"
+	}
+	return account
+}
+
+func (e *ECR) fetch(ctx context.Context, call ecrCall, accounts []string) ([]AuthToken, error) {
+	regIds := make([]*string, len(accounts))
+	for i, awsAccountID := range accounts {
+		regIds[i] = aws.String(awsAccountID)
+	}
+
+	callCtx, cancel := callContext(ctx, e.CallTimeout)
+	defer cancel()
+	resp, err := e.clientFor(call.region, call.role).GetAuthorizationTokenWithContext(callCtx, &ecr.GetAuthorizationTokenInput{
+		RegistryIds: regIds,
+	})
+	if err != nil {
+		if call.role != "" {
+			return nil, fmt.Errorf("could not get ECR authorization token in %s as %s: %w", call.region, call.role, err)
+		}
+		return nil, fmt.Errorf("could not get ECR authorization token in %s: %w", call.region, err)
+	}
+
+	var tokens []AuthToken
+	for _, auth := range resp.AuthorizationData {
+		tokens = append(tokens, AuthToken{
+			AccessToken: aws.StringValue(auth.AuthorizationToken),
+			Endpoint:    NormalizeEndpoint(aws.StringValue(auth.ProxyEndpoint)),
+			ExpiresAt:   aws.TimeValue(auth.ExpiresAt),
+		})
+	}
+	return tokens, nil
+}
+
+func (e *ECR) clientFor(region, role string) ECRClient {
+	if role != "" && e.ClientForRole != nil {
+		return e.ClientForRole(region, role)
+	}
+	if region == e.Region || e.ClientFor == nil {
+		return e.Client
+	}
+	return e.ClientFor(region)
+}
+
+// calls groups the account IDs by the region their token is requested from and the role assumed for it, in order of
+// first use
+func (e *ECR) calls() []ecrCall {
+	var calls []ecrCall
+	index := map[[2]string]int{}
+	for _, id := range e.AccountIDs {
+		region := e.AccountRegions[id]
+		if region == "" {
+			region = e.Region
+		}
+		role := ""
+		if e.ClientForRole != nil {
+			role = e.AccountRoles[id]
+		}
+		i, ok := index[[2]string{region, role}]
+		if !ok {
+			i = len(calls)
+			index[[2]string{region, role}] = i
+			calls = append(calls, ecrCall{region: region, role: role})
+		}
+		calls[i].accounts = append(calls[i].accounts, id)
+	}
+	return calls
+}
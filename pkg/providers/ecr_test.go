@@ -0,0 +1,151 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeECRClient returns one token per requested registry, tagged with its region
+type fakeECRClient struct {
+	region string
+	calls  int
+	err    error
+	// denied fails every request that includes one of these registries
+	denied map[string]bool
+}
+
+func (f *fakeECRClient) GetAuthorizationTokenWithContext(ctx aws.Context, input *ecr.GetAuthorizationTokenInput, opts ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	for _, id := range input.RegistryIds {
+		if f.denied[*id] {
+			return nil, fmt.Errorf("access denied to registry %s", *id)
+		}
+	}
+	out := &ecr.GetAuthorizationTokenOutput{}
+	for _, id := range input.RegistryIds {
+		out.AuthorizationData = append(out.AuthorizationData, &ecr.AuthorizationData{
+			AuthorizationToken: aws.String("token-" + f.region),
+			ProxyEndpoint:      aws.String(fmt.Sprintf("https://%s.dkr.ecr.%s.amazonaws.com/", *id, f.region)),
+		})
+	}
+	return out, nil
+}
+
+func TestECRTokens(t *testing.T) {
+	regional := &fakeECRClient{region: "eu-west-1"}
+	provider := &ECR{
+		Client:         &fakeECRClient{region: "us-east-1"},
+		Region:         "us-east-1",
+		AccountIDs:     []string{"123456789012", "210987654321", "333333333333", "123456789012"},
+		AccountRegions: map[string]string{"210987654321": "eu-west-1", "333333333333": "eu-west-1"},
+		ClientFor:      func(region string) ECRClient { return regional },
+	}
+
+	tokens, err := provider.Tokens(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, []AuthToken{
+		{AccessToken: "token-us-east-1", Endpoint: "https://123456789012.dkr.ecr.us-east-1.amazonaws.com", Registry: "123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+		{AccessToken: "token-eu-west-1", Endpoint: "https://210987654321.dkr.ecr.eu-west-1.amazonaws.com", Registry: "210987654321.dkr.ecr.eu-west-1.amazonaws.com"},
+		{AccessToken: "token-eu-west-1", Endpoint: "https://333333333333.dkr.ecr.eu-west-1.amazonaws.com", Registry: "333333333333.dkr.ecr.eu-west-1.amazonaws.com"},
+	}, tokens)
+	assert.Equal(t, 1, regional.calls, "one call per region")
+	assert.Equal(t, ECRName, provider.Name())
+}
+
+func TestECRTokensError(t *testing.T) {
+	provider := &ECR{Client: &fakeECRClient{err: errors.New("denied")}, Region: "us-east-1", AccountIDs: []string{""}}
+
+	_, err := provider.Tokens(context.TODO())
+	assert.EqualError(t, err, "could not get ECR authorization token in us-east-1: denied")
+}
+
+func TestECRTokensPartialFailure(t *testing.T) {
+	client := &fakeECRClient{region: "us-east-1", denied: map[string]bool{"222222222222": true}}
+	provider := &ECR{Client: client, Region: "us-east-1", AccountIDs: []string{"111111111111", "222222222222", "333333333333"}}
+
+	tokens, err := provider.Tokens(context.TODO())
+	var partial *PartialError
+	assert.True(t, errors.As(err, &partial))
+	assert.Equal(t, []string{"222222222222"}, partial.Accounts())
+	assert.EqualError(t, err, "could not get the ECR tokens of 1 account(s): account 222222222222: could not get ECR authorization token in us-east-1: access denied to registry 222222222222")
+	assert.Len(t, tokens, 2)
+	assert.Equal(t, "111111111111.dkr.ecr.us-east-1.amazonaws.com", tokens[0].Registry)
+	assert.Equal(t, "333333333333.dkr.ecr.us-east-1.amazonaws.com", tokens[1].Registry)
+	assert.Equal(t, 4, client.calls, "the batch, then one call per account")
+
+	// without any token the first failure is returned as before
+	client.denied = map[string]bool{"111111111111": true, "222222222222": true, "333333333333": true}
+	tokens, err = provider.Tokens(context.TODO())
+	assert.Empty(t, tokens)
+	assert.EqualError(t, err, "account 111111111111: could not get ECR authorization token in us-east-1: access denied to registry 111111111111")
+}
+
+// blockingECRClient counts the calls running at the same time
+type blockingECRClient struct {
+	fakeECRClient
+	lock    sync.Mutex
+	running int
+	max     int
+}
+
+func (f *blockingECRClient) GetAuthorizationTokenWithContext(ctx aws.Context, input *ecr.GetAuthorizationTokenInput, opts ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+	f.lock.Lock()
+	f.running++
+	if f.running > f.max {
+		f.max = f.running
+	}
+	f.lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.running--
+	return f.fakeECRClient.GetAuthorizationTokenWithContext(ctx, input, opts...)
+}
+
+func TestECRTokensPerRoleConcurrently(t *testing.T) {
+	client := &blockingECRClient{fakeECRClient: fakeECRClient{region: "us-east-1"}}
+	var roles []string
+	var lock sync.Mutex
+	provider := &ECR{
+		Client:     client,
+		Region:     "us-east-1",
+		AccountIDs: []string{"111111111111", "222222222222", "333333333333", "444444444444", "555555555555"},
+		AccountRoles: map[string]string{
+			"222222222222": "arn:aws:iam::222222222222:role/pull",
+			"333333333333": "arn:aws:iam::333333333333:role/pull",
+			"444444444444": "arn:aws:iam::444444444444:role/pull",
+			"555555555555": "arn:aws:iam::555555555555:role/pull",
+		},
+		ClientForRole: func(region, role string) ECRClient {
+			lock.Lock()
+			defer lock.Unlock()
+			roles = append(roles, role)
+			return client
+		},
+		Concurrency: 2,
+	}
+
+	tokens, err := provider.Tokens(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, roles, 4)
+	assert.Equal(t, 5, client.calls, "one call per role")
+	assert.Equal(t, 2, client.max, "at most Concurrency calls at a time")
+
+	// the tokens keep the order of AccountIDs
+	for i, token := range tokens {
+		assert.Equal(t, provider.AccountIDs[i]+".dkr.ecr.us-east-1.amazonaws.com", token.Registry)
+	}
+}
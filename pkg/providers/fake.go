@@ -0,0 +1,105 @@
+package providers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FakeName is the name of the fake provider
+const FakeName = "fake"
+
+// ErrInjectedFailure is returned by the fake provider for the calls it is configured to fail
+var ErrInjectedFailure = errors.New("injected fake provider failure")
+
+// Fake returns deterministic tokens without calling any API, for end-to-end tests and local demos without cloud credentials
+type Fake struct {
+	// Registries are the endpoints a token is returned for
+	Registries []string
+	// Username is the user name of every token, "fake" if empty
+	Username string
+	// Expiry is how long a password stays valid; the password changes at every multiple of Expiry. 0 never changes it
+	Expiry time.Duration
+	// FailEvery makes every n-th call of Tokens fail with ErrInjectedFailure; 0 never fails
+	FailEvery int
+	// MinRefresh is the minimum refresh interval the fake declares, like a rate-limited registry; 0 declares none
+	MinRefresh time.Duration
+	// Now returns the current time, time.Now if nil
+	Now func() time.Time
+
+	mu    sync.Mutex
+	calls int
+}
+
+var _ Provider = &Fake{}
+
+// Name implements Provider
+func (f *Fake) Name() string {
+	return FakeName
+}
+
+// MinRefreshInterval implements MinRefresher
+func (f *Fake) MinRefreshInterval() time.Duration {
+	return f.MinRefresh
+}
+
+// Tokens returns a token per registry whose password only depends on the registry and the current expiry window
+func (f *Fake) Tokens(ctx context.Context) ([]AuthToken, error) {
+	f.mu.Lock()
+	f.calls++
+	calls := f.calls
+	f.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return []AuthToken{}, err
+	}
+	if f.FailEvery > 0 && calls%f.FailEvery == 0 {
+		return []AuthToken{}, fmt.Errorf("call %d: %w", calls, ErrInjectedFailure)
+	}
+
+	username := f.Username
+	if username == "" {
+		username = FakeName
+	}
+	window := f.window()
+	var expiresAt time.Time
+	if f.Expiry > 0 {
+		expiresAt = window.Add(f.Expiry)
+	}
+
+	var tokens []AuthToken
+	for _, registry := range f.Registries {
+		endpoint := NormalizeEndpoint(registry)
+		password := FakePassword(endpoint, window)
+		tokens = append(tokens, AuthToken{
+			AccessToken: base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+			Endpoint:    endpoint,
+			ExpiresAt:   expiresAt,
+		})
+	}
+	return DedupeTokens(Normalize(tokens)), nil
+}
+
+// window returns the start of the current expiry window, the zero time if tokens never expire
+func (f *Fake) window() time.Time {
+	if f.Expiry <= 0 {
+		return time.Time{}
+	}
+	now := time.Now
+	if f.Now != nil {
+		now = f.Now
+	}
+	return now().UTC().Truncate(f.Expiry)
+}
+
+// FakePassword returns the password the fake provider hands out for endpoint in the expiry window starting at window,
+// so tests can predict the content of the generated secrets
+func FakePassword(endpoint string, window time.Time) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", endpoint, window.Unix())))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,53 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeTokens(t *testing.T) {
+	now := time.Date(2022, 9, 1, 10, 30, 0, 0, time.UTC)
+	fake := &Fake{
+		Registries: []string{"https://registry.example.com/", "https://mirror.example.com"},
+		Expiry:     time.Hour,
+		Now:        func() time.Time { return now },
+	}
+
+	tokens, err := fake.Tokens(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 2)
+	assert.Equal(t, "https://registry.example.com", tokens[0].Endpoint)
+	user, password, err := tokens[0].Credentials()
+	assert.Nil(t, err)
+	assert.Equal(t, "fake", user)
+	assert.Equal(t, FakePassword("https://registry.example.com", time.Date(2022, 9, 1, 10, 0, 0, 0, time.UTC)), password)
+	assert.NotEqual(t, tokens[0].AccessToken, tokens[1].AccessToken)
+	assert.Equal(t, time.Date(2022, 9, 1, 11, 0, 0, 0, time.UTC), tokens[0].ExpiresAt)
+
+	// the same window gives the same token, the next window a new one
+	now = now.Add(20 * time.Minute)
+	again, err := fake.Tokens(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, tokens, again)
+	now = now.Add(20 * time.Minute)
+	rotated, err := fake.Tokens(context.TODO())
+	assert.Nil(t, err)
+	assert.NotEqual(t, tokens[0].AccessToken, rotated[0].AccessToken)
+}
+
+func TestFakeTokensFailEvery(t *testing.T) {
+	fake := &Fake{Registries: []string{"https://registry.example.com"}, FailEvery: 3}
+
+	for call := 1; call <= 6; call++ {
+		_, err := fake.Tokens(context.TODO())
+		if call%3 == 0 {
+			assert.True(t, errors.Is(err, ErrInjectedFailure), "call %d", call)
+		} else {
+			assert.Nil(t, err, "call %d", call)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// FileName is the name of the token file provider
+const FileName = "file"
+
+// File reads the tokens from docker config files that something else keeps up to date, e.g. a sidecar or a mounted
+// Secret, so the controller only distributes them and never calls a cloud API itself
+type File struct {
+	// Paths are the files to read, each either a .dockerconfigjson ({"auths": {...}}) or a legacy .dockercfg; a
+	// registry listed in more than one file gets the token of the first
+	Paths []string
+	// MaxAge fails the fetch when a file was last written longer ago, so a stalled writer shows up as a failed
+	// refresh instead of silently distributing old tokens; 0 disables the check
+	MaxAge time.Duration
+	// Now returns the current time, time.Now if nil
+	Now func() time.Time
+}
+
+var _ Provider = &File{}
+
+// fileAuth is a registry entry of a docker config file
+type fileAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Name implements Provider
+func (f *File) Name() string {
+	return FileName
+}
+
+// Tokens reads every file again, so tokens rewritten in place are picked up by the next refresh
+func (f *File) Tokens(ctx context.Context) ([]AuthToken, error) {
+	if err := ctx.Err(); err != nil {
+		return []AuthToken{}, err
+	}
+	var tokens []AuthToken
+	for _, path := range f.Paths {
+		fileTokens, err := f.read(path)
+		if err != nil {
+			return []AuthToken{}, err
+		}
+		tokens = append(tokens, fileTokens...)
+	}
+	return DedupeTokens(Normalize(tokens)), nil
+}
+
+// read returns the tokens of one file in registry order
+func (f *File) read(path string) ([]AuthToken, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read token file: %w", err)
+	}
+	if f.MaxAge > 0 {
+		now := time.Now
+		if f.Now != nil {
+			now = f.Now
+		}
+		if age := now().Sub(info.ModTime()); age > f.MaxAge {
+			return nil, fmt.Errorf("token file %s was written %s ago, more than the maximum age of %s", path, age.Round(time.Second), f.MaxAge)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read token file: %w", err)
+	}
+	auths, err := parseDockerConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse token file %s: %w", path, err)
+	}
+	if len(auths) == 0 {
+		return nil, fmt.Errorf("token file %s lists no registries", path)
+	}
+
+	registries := make([]string, 0, len(auths))
+	for registry := range auths {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+	tokens := make([]AuthToken, 0, len(auths))
+	for _, registry := range registries {
+		auth := auths[registry]
+		token := AuthToken{AccessToken: auth.Auth, Endpoint: registry}
+		if auth.Auth == "" {
+			if auth.Username == "" && auth.Password == "" {
+				return nil, fmt.Errorf("token file %s has no credentials for %s", path, registry)
+			}
+			token.Username, token.Password = auth.Username, auth.Password
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// parseDockerConfig accepts the .dockerconfigjson form with its "auths" key as well as the legacy .dockercfg form,
+// which is the bare map of registries
+func parseDockerConfig(data []byte) (map[string]fileAuth, error) {
+	var config struct {
+		Auths map[string]fileAuth `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err == nil && config.Auths != nil {
+		return config.Auths, nil
+	}
+	var legacy map[string]fileAuth
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, err
+	}
+	return legacy, nil
+}
@@ -0,0 +1,75 @@
+package providers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTokenFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestFileTokens(t *testing.T) {
+	dockerConfigJSON := writeTokenFile(t, ".dockerconfigjson", `{"auths": {
+		"https://b.example.com/": {"auth": "dXNlcjpiLXBhc3N3b3Jk"},
+		"a.example.com": {"username": "robot", "password": "a-password"}
+	}}`)
+	dockerCfg := writeTokenFile(t, ".dockercfg", `{
+		"b.example.com": {"auth": "dXNlcjpvdGhlcg=="},
+		"c.example.com": {"auth": "dXNlcjpjLXBhc3N3b3Jk", "email": "none"}
+	}`)
+	file := &File{Paths: []string{dockerConfigJSON, dockerCfg}}
+
+	tokens, err := file.Tokens(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, []AuthToken{
+		{Endpoint: "a.example.com", Registry: "a.example.com", Username: "robot", Password: "a-password"},
+		{Endpoint: "https://b.example.com", Registry: "b.example.com", AccessToken: "dXNlcjpiLXBhc3N3b3Jk"},
+		{Endpoint: "c.example.com", Registry: "c.example.com", AccessToken: "dXNlcjpjLXBhc3N3b3Jk"},
+	}, tokens)
+
+	// the files are read again on every call
+	assert.Nil(t, os.WriteFile(dockerCfg, []byte(`{"c.example.com": {"auth": "dXNlcjpuZXc="}}`), 0o600))
+	tokens, err = file.Tokens(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, "dXNlcjpuZXc=", tokens[2].AccessToken)
+}
+
+func TestFileTokensErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"not JSON":       `auths:`,
+		"no registries":  `{"auths": {}}`,
+		"no credentials": `{"auths": {"a.example.com": {"email": "none"}}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			file := &File{Paths: []string{writeTokenFile(t, "config.json", content)}}
+			_, err := file.Tokens(context.TODO())
+			assert.NotNil(t, err)
+		})
+	}
+
+	_, err := (&File{Paths: []string{filepath.Join(t.TempDir(), "missing")}}).Tokens(context.TODO())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFileTokensMaxAge(t *testing.T) {
+	path := writeTokenFile(t, "config.json", `{"auths": {"a.example.com": {"auth": "dXNlcjpw"}}}`)
+	written := time.Date(2022, 9, 1, 10, 0, 0, 0, time.UTC)
+	assert.Nil(t, os.Chtimes(path, written, written))
+	now := written.Add(time.Hour)
+	file := &File{Paths: []string{path}, MaxAge: 2 * time.Hour, Now: func() time.Time { return now }}
+
+	_, err := file.Tokens(context.TODO())
+	assert.Nil(t, err)
+
+	now = written.Add(3 * time.Hour)
+	_, err = file.Tokens(context.TODO())
+	assert.EqualError(t, err, "token file "+path+" was written 3h0m0s ago, more than the maximum age of 2h0m0s")
+}
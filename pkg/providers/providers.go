@@ -0,0 +1,128 @@
+// Package providers fetches registry credentials from cloud providers. It holds no global state, so it can be used
+// outside of the registry-creds controller, e.g. by a CLI that writes a docker config.
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuthToken represents an Access Token and an Endpoint for a registry service
+type AuthToken struct {
+	// AccessToken is the base64 encoded user:password auth value; providers with separate credentials set Username and Password instead
+	AccessToken string
+	Endpoint    string
+	Username    string
+	Password    string
+	// Registry is the normalized registry host of Endpoint, without scheme or trailing slash, see Normalize
+	Registry string
+	// ExpiresAt is when the registry stops accepting the token, zero if unknown
+	ExpiresAt time.Time
+}
+
+// Provider returns the current credentials of every registry it covers
+type Provider interface {
+	// Name identifies the provider, e.g. "ecr"
+	Name() string
+	Tokens(ctx context.Context) ([]AuthToken, error)
+}
+
+// MinRefresher is implemented by providers whose token API should not be called more often than a minimum interval,
+// e.g. because of its rate limits; the controller refreshes them at most that often
+type MinRefresher interface {
+	MinRefreshInterval() time.Duration
+}
+
+// MinRefreshInterval returns the minimum refresh interval a provider declares, 0 if it declares none
+func MinRefreshInterval(p Provider) time.Duration {
+	if m, ok := p.(MinRefresher); ok {
+		return m.MinRefreshInterval()
+	}
+	return 0
+}
+
+// Host returns the registry host of the token, derived from Endpoint if the provider did not normalize it
+func (t AuthToken) Host() string {
+	if t.Registry != "" {
+		return t.Registry
+	}
+	return RegistryHost(t.Endpoint)
+}
+
+// Credentials returns the user name and password of the token, either given explicitly or decoded from the auth form
+func (t AuthToken) Credentials() (string, string, error) {
+	if t.Username != "" || t.Password != "" {
+		return t.Username, t.Password, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(t.AccessToken)
+	if err != nil {
+		return "", "", fmt.Errorf("token for %s is not base64 encoded user:password: %v", t.Endpoint, err)
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", fmt.Errorf("token for %s is not base64 encoded user:password", t.Endpoint)
+	}
+	return user, password, nil
+}
+
+// RegistryHost strips the scheme and any trailing slash from a registry endpoint
+func RegistryHost(endpoint string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(endpoint, "https://"), "http://")
+	return strings.TrimSuffix(host, "/")
+}
+
+// NormalizeEndpoint drops any trailing slash from a registry endpoint
+func NormalizeEndpoint(endpoint string) string {
+	return strings.TrimSuffix(endpoint, "/")
+}
+
+// Normalize fills in the derived fields every provider returns: Endpoint without trailing slash and Registry. The
+// controller normalizes the tokens of every provider, so consumers can rely on them.
+func Normalize(tokens []AuthToken) []AuthToken {
+	result := make([]AuthToken, 0, len(tokens))
+	for _, token := range tokens {
+		token.Endpoint = NormalizeEndpoint(token.Endpoint)
+		if token.Registry == "" {
+			token.Registry = RegistryHost(token.Endpoint)
+		}
+		result = append(result, token)
+	}
+	return result
+}
+
+// DedupeTokens drops tokens for a registry host that is already covered by an earlier token; hosts compare case-insensitively
+func DedupeTokens(tokens []AuthToken) []AuthToken {
+	seen := map[string]bool{}
+	result := make([]AuthToken, 0, len(tokens))
+	for _, token := range tokens {
+		host := strings.ToLower(token.Host())
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+		result = append(result, token)
+	}
+	return result
+}
+
+// EarliestExpiry returns the earliest known expiry of the tokens, zero if none is known
+func EarliestExpiry(tokens []AuthToken) time.Time {
+	var earliest time.Time
+	for _, token := range tokens {
+		if !token.ExpiresAt.IsZero() && (earliest.IsZero() || token.ExpiresAt.Before(earliest)) {
+			earliest = token.ExpiresAt
+		}
+	}
+	return earliest
+}
+
+// callContext bounds a single provider API call by timeout; 0 disables the timeout
+func callContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
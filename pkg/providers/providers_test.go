@@ -0,0 +1,72 @@
+package providers
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentials(t *testing.T) {
+	user, password, err := AuthToken{AccessToken: base64.StdEncoding.EncodeToString([]byte("AWS:secret"))}.Credentials()
+	assert.Nil(t, err)
+	assert.Equal(t, "AWS", user)
+	assert.Equal(t, "secret", password)
+
+	user, password, err = AuthToken{Username: "robot", Password: "pass"}.Credentials()
+	assert.Nil(t, err)
+	assert.Equal(t, "robot", user)
+	assert.Equal(t, "pass", password)
+
+	_, _, err = AuthToken{AccessToken: base64.StdEncoding.EncodeToString([]byte("no-colon"))}.Credentials()
+	assert.NotNil(t, err)
+}
+
+func TestRegistryHost(t *testing.T) {
+	assert.Equal(t, "registry.example.com", RegistryHost("https://registry.example.com/"))
+	assert.Equal(t, "registry.example.com:5000", RegistryHost("http://registry.example.com:5000"))
+}
+
+func TestNormalizeEndpoint(t *testing.T) {
+	assert.Equal(t, "https://123456789012.dkr.ecr.us-east-1.amazonaws.com", NormalizeEndpoint("https://123456789012.dkr.ecr.us-east-1.amazonaws.com/"))
+	assert.Equal(t, "registry.example.com", NormalizeEndpoint("registry.example.com"))
+}
+
+func TestDedupeTokens(t *testing.T) {
+	tokens := DedupeTokens([]AuthToken{
+		{AccessToken: "first", Endpoint: "https://registry.example.com"},
+		{AccessToken: "other", Endpoint: "https://other.example.com"},
+		{AccessToken: "second", Endpoint: "Registry.example.com"},
+	})
+
+	assert.Equal(t, []AuthToken{
+		{AccessToken: "first", Endpoint: "https://registry.example.com"},
+		{AccessToken: "other", Endpoint: "https://other.example.com"},
+	}, tokens)
+}
+
+func TestNormalize(t *testing.T) {
+	tokens := Normalize([]AuthToken{
+		{Endpoint: "https://registry.example.com/"},
+		{Endpoint: "other.example.com", Registry: "mirror.example.com"},
+	})
+	assert.Equal(t, []AuthToken{
+		{Endpoint: "https://registry.example.com", Registry: "registry.example.com"},
+		{Endpoint: "other.example.com", Registry: "mirror.example.com"},
+	}, tokens)
+	assert.Equal(t, "registry.example.com", AuthToken{Endpoint: "https://registry.example.com/"}.Host())
+}
+
+func TestEarliestExpiry(t *testing.T) {
+	early := time.Date(2022, 9, 1, 10, 0, 0, 0, time.UTC)
+	tokens := []AuthToken{{ExpiresAt: early.Add(time.Hour)}, {}, {ExpiresAt: early}}
+	assert.Equal(t, early, EarliestExpiry(tokens))
+	assert.True(t, EarliestExpiry([]AuthToken{{}}).IsZero())
+}
+
+func TestMinRefreshInterval(t *testing.T) {
+	assert.Equal(t, ECRMinRefreshInterval, MinRefreshInterval(&ECR{}))
+	assert.Equal(t, time.Hour, MinRefreshInterval(&Fake{MinRefresh: time.Hour}))
+	assert.Zero(t, MinRefreshInterval(&File{}))
+}
@@ -0,0 +1,121 @@
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// TokenExchangeName is the name of the token exchange provider
+const TokenExchangeName = "token-exchange"
+
+// maxTokenExchangeResponse bounds the size of a token service response
+const maxTokenExchangeResponse = 1 << 20
+
+// TokenExchange trades a Kubernetes ServiceAccount token for registry credentials at a registry's token service, for
+// registries that trust the cluster's tokens, so no credentials have to be stored. The ServiceAccount token is POSTed
+// as a bearer token; the service answers with JSON holding the credentials:
+//
+//	{"username": "robot", "password": "...", "expires_in": 3600}
+//
+// "token" or "access_token" may be given instead of "password".
+type TokenExchange struct {
+	// URL of the token service
+	URL string
+	// Registry is the endpoint the credentials are valid for
+	Registry string
+	// Username is used when the response has none
+	Username string
+	// SubjectToken returns the ServiceAccount token, requested for the audience the token service expects
+	SubjectToken func(ctx context.Context) (string, error)
+	// Client makes the calls to the token service, http.DefaultClient if nil
+	Client *http.Client
+	// Timeout bounds the call to the token service; 0 disables the timeout
+	Timeout time.Duration
+	// Now returns the current time, time.Now if nil
+	Now func() time.Time
+}
+
+var _ Provider = &TokenExchange{}
+
+type tokenExchangeResponse struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Name implements Provider
+func (t *TokenExchange) Name() string {
+	return TokenExchangeName
+}
+
+// Tokens requests a ServiceAccount token and exchanges it for the registry's credentials
+func (t *TokenExchange) Tokens(ctx context.Context) ([]AuthToken, error) {
+	subject, err := t.SubjectToken(ctx)
+	if err != nil {
+		return []AuthToken{}, fmt.Errorf("could not get the ServiceAccount token: %w", err)
+	}
+
+	ctx, cancel := callContext(ctx, t.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, nil)
+	if err != nil {
+		return []AuthToken{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+subject)
+	req.Header.Set("Accept", "application/json")
+
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return []AuthToken{}, fmt.Errorf("token exchange with %s failed: %w", t.URL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenExchangeResponse))
+	if err != nil {
+		return []AuthToken{}, fmt.Errorf("could not read the response of %s: %w", t.URL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return []AuthToken{}, fmt.Errorf("token exchange with %s failed: %s", t.URL, resp.Status)
+	}
+
+	var result tokenExchangeResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return []AuthToken{}, fmt.Errorf("invalid response from %s: %v", t.URL, err)
+	}
+	username := result.Username
+	if username == "" {
+		username = t.Username
+	}
+	password := result.Password
+	for _, alt := range []string{result.Token, result.AccessToken} {
+		if password == "" {
+			password = alt
+		}
+	}
+	if username == "" || password == "" {
+		return []AuthToken{}, fmt.Errorf("response from %s has no username and password", t.URL)
+	}
+
+	token := AuthToken{
+		AccessToken: base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+		Endpoint:    t.Registry,
+	}
+	if result.ExpiresIn > 0 {
+		now := time.Now
+		if t.Now != nil {
+			now = t.Now
+		}
+		token.ExpiresAt = now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	}
+	return Normalize([]AuthToken{token}), nil
+}
@@ -0,0 +1,68 @@
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenExchange(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"token": "secret", "expires_in": 600}`))
+	}))
+	defer server.Close()
+
+	now := time.Date(2022, 9, 1, 10, 0, 0, 0, time.UTC)
+	exchange := &TokenExchange{
+		URL:          server.URL,
+		Registry:     "https://registry.example.com/",
+		Username:     "robot",
+		SubjectToken: func(context.Context) (string, error) { return "sa-token", nil },
+		Now:          func() time.Time { return now },
+	}
+	tokens, err := exchange.Tokens(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer sa-token", authorization)
+	assert.Equal(t, []AuthToken{{
+		AccessToken: base64.StdEncoding.EncodeToString([]byte("robot:secret")),
+		Endpoint:    "https://registry.example.com",
+		Registry:    "registry.example.com",
+		ExpiresAt:   now.Add(10 * time.Minute),
+	}}, tokens)
+}
+
+func TestTokenExchangeErrors(t *testing.T) {
+	status := http.StatusOK
+	body := `{"password": "secret"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	exchange := &TokenExchange{
+		URL:          server.URL,
+		Registry:     "registry.example.com",
+		SubjectToken: func(context.Context) (string, error) { return "sa-token", nil },
+	}
+
+	// neither the response nor the provider has a username
+	_, err := exchange.Tokens(context.TODO())
+	assert.ErrorContains(t, err, "no username and password")
+
+	status = http.StatusForbidden
+	_, err = exchange.Tokens(context.TODO())
+	assert.ErrorContains(t, err, "403 Forbidden")
+
+	exchange.SubjectToken = func(context.Context) (string, error) { return "", errors.New("forbidden") }
+	_, err = exchange.Tokens(context.TODO())
+	assert.ErrorContains(t, err, "ServiceAccount token")
+}
@@ -0,0 +1,45 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// SecretClient reads and writes Secrets
+type SecretClient interface {
+	SecretExists(ctx context.Context, namespace, name string) (bool, error)
+	CreateSecret(ctx context.Context, namespace string, secret *v1.Secret) error
+	UpdateSecret(ctx context.Context, namespace string, secret *v1.Secret) error
+}
+
+// EnsureSecret creates the secret in namespace or updates it if it exists, and reports whether it was created.
+// Only a NotFound means the secret is missing: RBAC or network errors are returned instead of being answered with a Create.
+func EnsureSecret(ctx context.Context, client SecretClient, namespace string, secret *v1.Secret) (bool, error) {
+	exists, err := client.SecretExists(ctx, namespace, secret.Name)
+	if err != nil {
+		return false, fmt.Errorf("could not check Secret: %w", err)
+	}
+
+	if exists {
+		if err := client.UpdateSecret(ctx, namespace, secret); err != nil {
+			return false, fmt.Errorf("could not update Secret: %w", err)
+		}
+		return false, nil
+	}
+
+	err = client.CreateSecret(ctx, namespace, secret)
+	if apierrors.IsAlreadyExists(err) {
+		// the secret was created after the existence check, e.g. read from a stale cache
+		if err := client.UpdateSecret(ctx, namespace, secret); err != nil {
+			return false, fmt.Errorf("could not update Secret: %w", err)
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not create Secret: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,77 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeSecrets is an in-memory SecretClient; stale makes SecretExists miss existing secrets like an outdated cache
+type fakeSecrets struct {
+	store     map[string]*v1.Secret
+	stale     bool
+	existsErr error
+}
+
+func (f *fakeSecrets) SecretExists(ctx context.Context, namespace, name string) (bool, error) {
+	if f.existsErr != nil {
+		return false, f.existsErr
+	}
+	_, ok := f.store[name]
+	return ok && !f.stale, nil
+}
+
+func (f *fakeSecrets) CreateSecret(ctx context.Context, namespace string, secret *v1.Secret) error {
+	if _, ok := f.store[secret.Name]; ok {
+		return apierrors.NewAlreadyExists(v1.Resource("secrets"), secret.Name)
+	}
+	f.store[secret.Name] = secret
+	return nil
+}
+
+func (f *fakeSecrets) UpdateSecret(ctx context.Context, namespace string, secret *v1.Secret) error {
+	if _, ok := f.store[secret.Name]; !ok {
+		return apierrors.NewNotFound(v1.Resource("secrets"), secret.Name)
+	}
+	f.store[secret.Name] = secret
+	return nil
+}
+
+func newSecret(value string) *v1.Secret {
+	return &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "creds"}, Data: map[string][]byte{"key": []byte(value)}}
+}
+
+func TestEnsureSecret(t *testing.T) {
+	client := &fakeSecrets{store: map[string]*v1.Secret{}}
+
+	created, err := EnsureSecret(context.TODO(), client, "ns", newSecret("a"))
+	assert.Nil(t, err)
+	assert.True(t, created)
+
+	created, err = EnsureSecret(context.TODO(), client, "ns", newSecret("b"))
+	assert.Nil(t, err)
+	assert.False(t, created)
+	assert.Equal(t, "b", string(client.store["creds"].Data["key"]))
+}
+
+func TestEnsureSecretStaleCache(t *testing.T) {
+	client := &fakeSecrets{store: map[string]*v1.Secret{"creds": newSecret("a")}, stale: true}
+
+	created, err := EnsureSecret(context.TODO(), client, "ns", newSecret("b"))
+	assert.Nil(t, err)
+	assert.False(t, created)
+	assert.Equal(t, "b", string(client.store["creds"].Data["key"]))
+}
+
+func TestEnsureSecretCheckFails(t *testing.T) {
+	client := &fakeSecrets{store: map[string]*v1.Secret{}, existsErr: apierrors.NewForbidden(v1.Resource("secrets"), "creds", errors.New("denied"))}
+
+	_, err := EnsureSecret(context.TODO(), client, "ns", newSecret("a"))
+	assert.True(t, apierrors.IsForbidden(err))
+	assert.Empty(t, client.store)
+}
@@ -0,0 +1,281 @@
+// Package sync writes pull secrets into namespaces and references them from ServiceAccounts. The functions work on
+// small client interfaces, so they can be unit tested without an API server.
+package sync
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// AnnotationPrefix is the prefix of every annotation registry-creds reads or writes
+	AnnotationPrefix = "registry-creds.k8s.io/"
+
+	// ManagedPullSecretsAnnotation records which imagePullSecrets entries the controller added to a ServiceAccount
+	ManagedPullSecretsAnnotation = AnnotationPrefix + "managed-image-pull-secrets"
+
+	// SkipAnnotation set to "true" on a ServiceAccount asks the controller never to change it, see
+	// PullSecretOptions.SkipAnnotated
+	SkipAnnotation = AnnotationPrefix + "skip"
+
+	// Ordering of managed imagePullSecrets entries
+	OrderKeep  = "keep"
+	OrderFirst = "first"
+	OrderLast  = "last"
+)
+
+// PullSecretOptions controls how managed entries are placed in a ServiceAccount's imagePullSecrets
+type PullSecretOptions struct {
+	Order  string
+	Dedupe bool
+	// Prune removes entries previously added by the controller for providers that are no longer enabled
+	Prune bool
+	// AttachSecrets also lists managed secrets under the ServiceAccount's secrets field
+	AttachSecrets bool
+	// SkipAnnotated leaves ServiceAccounts annotated with SkipAnnotation alone
+	SkipAnnotated bool
+}
+
+// ErrSkipped is returned when a ServiceAccount is not changed because of its SkipAnnotation
+var ErrSkipped = errors.New("ServiceAccount is annotated " + SkipAnnotation + ": \"true\"")
+
+// Skipped reports whether the ServiceAccount is annotated with SkipAnnotation
+func Skipped(sa *v1.ServiceAccount) bool {
+	return sa.Annotations[SkipAnnotation] == "true"
+}
+
+// ServiceAccountClient reads and writes ServiceAccounts
+type ServiceAccountClient interface {
+	GetServiceAccount(ctx context.Context, namespace, name string) (*v1.ServiceAccount, error)
+	UpdateServiceAccount(ctx context.Context, namespace string, sa *v1.ServiceAccount) error
+}
+
+// AttachToServiceAccount adds secretName to the ServiceAccount's imagePullSecrets and writes it back, re-reading the
+// ServiceAccount when the update conflicts with another writer; a missing ServiceAccount returns a NotFound error and
+// a skipped one ErrSkipped
+func AttachToServiceAccount(ctx context.Context, client ServiceAccountClient, namespace, name, secretName string, managed []string, opts PullSecretOptions) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		serviceAccount, err := client.GetServiceAccount(ctx, namespace, name)
+		if err != nil {
+			return err
+		}
+		if opts.SkipAnnotated && Skipped(serviceAccount) {
+			return ErrSkipped
+		}
+		AttachPullSecret(serviceAccount, secretName, managed, opts)
+		return client.UpdateServiceAccount(ctx, namespace, serviceAccount)
+	})
+}
+
+// DetachFromServiceAccount removes the managed entries the controller added to the ServiceAccount and reports whether
+// it had to be updated; a missing or skipped ServiceAccount has nothing to detach
+func DetachFromServiceAccount(ctx context.Context, client ServiceAccountClient, namespace, name string, managed []string, opts PullSecretOptions) (bool, error) {
+	updated := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		serviceAccount, err := client.GetServiceAccount(ctx, namespace, name)
+		if err != nil {
+			return err
+		}
+		if opts.SkipAnnotated && Skipped(serviceAccount) {
+			return nil
+		}
+		if !DetachPullSecrets(serviceAccount, managed) {
+			return nil
+		}
+		updated = true
+		return client.UpdateServiceAccount(ctx, namespace, serviceAccount)
+	})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return updated, err
+}
+
+// HasPullSecret reports whether the ServiceAccount's imagePullSecrets reference name
+func HasPullSecret(sa *v1.ServiceAccount, name string) bool {
+	for _, ref := range sa.ImagePullSecrets {
+		if ref.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// DanglingPullSecrets returns the entries the controller added to the ServiceAccount's imagePullSecrets whose secret
+// does not exist in the namespace
+func DanglingPullSecrets(ctx context.Context, client SecretClient, namespace string, sa *v1.ServiceAccount) ([]string, error) {
+	var dangling []string
+	for _, name := range SplitList(sa.Annotations[ManagedPullSecretsAnnotation]) {
+		if !HasPullSecret(sa, name) {
+			continue
+		}
+		exists, err := client.SecretExists(ctx, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			dangling = append(dangling, name)
+		}
+	}
+	return dangling, nil
+}
+
+// AttachPullSecret makes sure secretName is referenced by the ServiceAccount's imagePullSecrets and records it as managed
+func AttachPullSecret(sa *v1.ServiceAccount, secretName string, managed []string, opts PullSecretOptions) {
+	previouslyManaged := SplitList(sa.Annotations[ManagedPullSecretsAnnotation])
+
+	var refs []v1.LocalObjectReference
+	seen := map[string]bool{}
+	for _, ref := range sa.ImagePullSecrets {
+		if opts.Dedupe && seen[ref.Name] {
+			continue
+		}
+		if opts.Prune && contains(previouslyManaged, ref.Name) && !contains(managed, ref.Name) {
+			continue
+		}
+		seen[ref.Name] = true
+		refs = append(refs, ref)
+	}
+	if !seen[secretName] {
+		refs = append(refs, v1.LocalObjectReference{Name: secretName})
+	}
+
+	switch opts.Order {
+	case OrderFirst, OrderLast:
+		refs = orderManaged(refs, managed, opts.Order == OrderFirst)
+	}
+	sa.ImagePullSecrets = refs
+
+	if opts.AttachSecrets || opts.Prune {
+		sa.Secrets = updateSecretReferences(sa.Secrets, secretName, previouslyManaged, managed, opts)
+	}
+
+	var nowManaged []string
+	for _, name := range previouslyManaged {
+		if seen[name] {
+			nowManaged = append(nowManaged, name)
+		}
+	}
+	if !contains(nowManaged, secretName) {
+		nowManaged = append(nowManaged, secretName)
+	}
+	sort.Strings(nowManaged)
+	if sa.Annotations == nil {
+		sa.Annotations = map[string]string{}
+	}
+	sa.Annotations[ManagedPullSecretsAnnotation] = strings.Join(nowManaged, ",")
+}
+
+// DetachPullSecrets removes the managed entries the controller added to the ServiceAccount, leaving entries added by
+// others alone; it returns false if the ServiceAccount did not change
+func DetachPullSecrets(sa *v1.ServiceAccount, managed []string) bool {
+	previouslyManaged := SplitList(sa.Annotations[ManagedPullSecretsAnnotation])
+	owned := func(name string) bool {
+		return contains(previouslyManaged, name) && contains(managed, name)
+	}
+
+	changed := false
+	var refs []v1.LocalObjectReference
+	for _, ref := range sa.ImagePullSecrets {
+		if owned(ref.Name) {
+			changed = true
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	var secretRefs []v1.ObjectReference
+	for _, ref := range sa.Secrets {
+		if owned(ref.Name) {
+			changed = true
+			continue
+		}
+		secretRefs = append(secretRefs, ref)
+	}
+
+	var stillManaged []string
+	for _, name := range previouslyManaged {
+		if !contains(managed, name) {
+			stillManaged = append(stillManaged, name)
+		}
+	}
+	if len(stillManaged) != len(previouslyManaged) {
+		changed = true
+		if len(stillManaged) == 0 {
+			delete(sa.Annotations, ManagedPullSecretsAnnotation)
+		} else {
+			sa.Annotations[ManagedPullSecretsAnnotation] = strings.Join(stillManaged, ",")
+		}
+	}
+	sa.ImagePullSecrets = refs
+	sa.Secrets = secretRefs
+	return changed
+}
+
+// updateSecretReferences applies the same attach/prune rules as imagePullSecrets to the ServiceAccount's secrets field
+func updateSecretReferences(refs []v1.ObjectReference, secretName string, previouslyManaged, managed []string, opts PullSecretOptions) []v1.ObjectReference {
+	var result []v1.ObjectReference
+	found := false
+	for _, ref := range refs {
+		if opts.Prune && contains(previouslyManaged, ref.Name) && !contains(managed, ref.Name) {
+			continue
+		}
+		if ref.Name == secretName {
+			if found && opts.Dedupe {
+				continue
+			}
+			found = true
+		}
+		result = append(result, ref)
+	}
+	if opts.AttachSecrets && !found {
+		result = append(result, v1.ObjectReference{Name: secretName})
+	}
+	return result
+}
+
+// orderManaged moves the managed entries to the front or back of refs, in provider order, keeping everything else stable
+func orderManaged(refs []v1.LocalObjectReference, managed []string, first bool) []v1.LocalObjectReference {
+	var own, others []v1.LocalObjectReference
+	for _, ref := range refs {
+		if !contains(managed, ref.Name) {
+			others = append(others, ref)
+		}
+	}
+	for _, name := range managed {
+		for _, ref := range refs {
+			if ref.Name == name {
+				own = append(own, ref)
+			}
+		}
+	}
+	if first {
+		return append(own, others...)
+	}
+	return append(others, own...)
+}
+
+// SplitList splits a comma separated annotation value, dropping empty items
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func contains(items []string, item string) bool {
+	for _, v := range items {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
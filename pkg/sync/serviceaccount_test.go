@@ -0,0 +1,197 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func pullSecretNames(sa *v1.ServiceAccount) []string {
+	var names []string
+	for _, ref := range sa.ImagePullSecrets {
+		names = append(names, ref.Name)
+	}
+	return names
+}
+
+func newServiceAccountWithPullSecrets(annotations map[string]string, names ...string) *v1.ServiceAccount {
+	sa := &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: annotations}}
+	for _, name := range names {
+		sa.ImagePullSecrets = append(sa.ImagePullSecrets, v1.LocalObjectReference{Name: name})
+	}
+	return sa
+}
+
+func TestAttachPullSecretKeepsPosition(t *testing.T) {
+	sa := newServiceAccountWithPullSecrets(nil, "a", "ecr", "b")
+	AttachPullSecret(sa, "ecr", []string{"ecr"}, PullSecretOptions{Order: OrderKeep})
+
+	assert.Equal(t, []string{"a", "ecr", "b"}, pullSecretNames(sa))
+	assert.Equal(t, "ecr", sa.Annotations[ManagedPullSecretsAnnotation])
+}
+
+func TestAttachPullSecretOrdering(t *testing.T) {
+	sa := newServiceAccountWithPullSecrets(nil, "a", "ecr", "b")
+	AttachPullSecret(sa, "ecr", []string{"ecr"}, PullSecretOptions{Order: OrderFirst})
+	assert.Equal(t, []string{"ecr", "a", "b"}, pullSecretNames(sa))
+
+	AttachPullSecret(sa, "ecr", []string{"ecr"}, PullSecretOptions{Order: OrderLast})
+	assert.Equal(t, []string{"a", "b", "ecr"}, pullSecretNames(sa))
+}
+
+func TestAttachPullSecretDedupe(t *testing.T) {
+	sa := newServiceAccountWithPullSecrets(nil, "a", "ecr", "a", "ecr")
+	AttachPullSecret(sa, "ecr", []string{"ecr"}, PullSecretOptions{Order: OrderKeep})
+	assert.Equal(t, []string{"a", "ecr", "a", "ecr"}, pullSecretNames(sa))
+
+	AttachPullSecret(sa, "ecr", []string{"ecr"}, PullSecretOptions{Order: OrderKeep, Dedupe: true})
+	assert.Equal(t, []string{"a", "ecr"}, pullSecretNames(sa))
+}
+
+func TestAttachPullSecretPrune(t *testing.T) {
+	annotations := map[string]string{ManagedPullSecretsAnnotation: "ecr,old-provider"}
+	sa := newServiceAccountWithPullSecrets(annotations, "old-provider", "user-secret", "ecr")
+
+	AttachPullSecret(sa, "ecr", []string{"ecr"}, PullSecretOptions{Order: OrderKeep})
+	assert.Equal(t, []string{"old-provider", "user-secret", "ecr"}, pullSecretNames(sa))
+
+	AttachPullSecret(sa, "ecr", []string{"ecr"}, PullSecretOptions{Order: OrderKeep, Prune: true})
+	assert.Equal(t, []string{"user-secret", "ecr"}, pullSecretNames(sa))
+	assert.Equal(t, "ecr", sa.Annotations[ManagedPullSecretsAnnotation])
+}
+
+func secretReferenceNames(sa *v1.ServiceAccount) []string {
+	var names []string
+	for _, ref := range sa.Secrets {
+		names = append(names, ref.Name)
+	}
+	return names
+}
+
+func TestAttachPullSecretToSecretsField(t *testing.T) {
+	sa := newServiceAccountWithPullSecrets(nil)
+	sa.Secrets = []v1.ObjectReference{{Name: "default-token-abcde"}}
+
+	AttachPullSecret(sa, "ecr", []string{"ecr"}, PullSecretOptions{Order: OrderKeep})
+	assert.Equal(t, []string{"default-token-abcde"}, secretReferenceNames(sa))
+
+	opts := PullSecretOptions{Order: OrderKeep, AttachSecrets: true}
+	AttachPullSecret(sa, "ecr", []string{"ecr"}, opts)
+	AttachPullSecret(sa, "ecr", []string{"ecr"}, opts)
+	assert.Equal(t, []string{"default-token-abcde", "ecr"}, secretReferenceNames(sa))
+
+	opts.Prune = true
+	AttachPullSecret(sa, "ecr2", []string{"ecr2"}, opts)
+	assert.Equal(t, []string{"default-token-abcde", "ecr2"}, secretReferenceNames(sa))
+	assert.Equal(t, []string{"ecr2"}, pullSecretNames(sa))
+}
+
+// fakeServiceAccounts is an in-memory ServiceAccountClient that fails the first conflicts updates
+type fakeServiceAccounts struct {
+	store     map[string]*v1.ServiceAccount
+	conflicts int
+	updates   int
+}
+
+func (f *fakeServiceAccounts) GetServiceAccount(ctx context.Context, namespace, name string) (*v1.ServiceAccount, error) {
+	sa, ok := f.store[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("serviceaccounts"), name)
+	}
+	return sa.DeepCopy(), nil
+}
+
+func (f *fakeServiceAccounts) UpdateServiceAccount(ctx context.Context, namespace string, sa *v1.ServiceAccount) error {
+	if f.conflicts > 0 {
+		f.conflicts--
+		return apierrors.NewConflict(v1.Resource("serviceaccounts"), sa.Name, errors.New("object has been modified"))
+	}
+	f.updates++
+	f.store[sa.Name] = sa
+	return nil
+}
+
+func TestAttachToServiceAccount(t *testing.T) {
+	client := &fakeServiceAccounts{store: map[string]*v1.ServiceAccount{"default": newServiceAccountWithPullSecrets(nil, "other")}, conflicts: 2}
+
+	assert.Nil(t, AttachToServiceAccount(context.TODO(), client, "ns", "default", "ecr", []string{"ecr"}, PullSecretOptions{Order: OrderKeep}))
+	assert.Equal(t, []string{"other", "ecr"}, pullSecretNames(client.store["default"]))
+	assert.True(t, HasPullSecret(client.store["default"], "ecr"))
+
+	err := AttachToServiceAccount(context.TODO(), client, "ns", "missing", "ecr", []string{"ecr"}, PullSecretOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestDetachFromServiceAccount(t *testing.T) {
+	sa := newServiceAccountWithPullSecrets(nil, "other")
+	AttachPullSecret(sa, "ecr", []string{"ecr"}, PullSecretOptions{Order: OrderKeep, AttachSecrets: true})
+	client := &fakeServiceAccounts{store: map[string]*v1.ServiceAccount{"default": sa}}
+
+	updated, err := DetachFromServiceAccount(context.TODO(), client, "ns", "default", []string{"ecr"}, PullSecretOptions{})
+	assert.Nil(t, err)
+	assert.True(t, updated)
+	assert.Equal(t, []string{"other"}, pullSecretNames(client.store["default"]))
+	assert.Empty(t, client.store["default"].Secrets)
+	assert.NotContains(t, client.store["default"].Annotations, ManagedPullSecretsAnnotation)
+
+	// nothing left to detach, and a missing ServiceAccount is not an error
+	updated, err = DetachFromServiceAccount(context.TODO(), client, "ns", "default", []string{"ecr"}, PullSecretOptions{})
+	assert.Nil(t, err)
+	assert.False(t, updated)
+	updated, err = DetachFromServiceAccount(context.TODO(), client, "ns", "missing", []string{"ecr"}, PullSecretOptions{})
+	assert.Nil(t, err)
+	assert.False(t, updated)
+}
+
+func TestSkippedServiceAccount(t *testing.T) {
+	sa := newServiceAccountWithPullSecrets(nil, "other")
+	AttachPullSecret(sa, "ecr", []string{"ecr"}, PullSecretOptions{})
+	sa.Annotations[SkipAnnotation] = "true"
+	client := &fakeServiceAccounts{store: map[string]*v1.ServiceAccount{"default": sa}}
+	opts := PullSecretOptions{SkipAnnotated: true}
+
+	err := AttachToServiceAccount(context.TODO(), client, "ns", "default", "gcr", []string{"ecr", "gcr"}, opts)
+	assert.ErrorIs(t, err, ErrSkipped)
+	updated, err := DetachFromServiceAccount(context.TODO(), client, "ns", "default", []string{"ecr"}, opts)
+	assert.Nil(t, err)
+	assert.False(t, updated)
+	assert.Equal(t, []string{"other", "ecr"}, pullSecretNames(client.store["default"]))
+	assert.Zero(t, client.updates)
+
+	// without SkipAnnotated the annotation is ignored
+	assert.Nil(t, AttachToServiceAccount(context.TODO(), client, "ns", "default", "gcr", []string{"ecr", "gcr"}, PullSecretOptions{}))
+	assert.Equal(t, []string{"other", "ecr", "gcr"}, pullSecretNames(client.store["default"]))
+}
+
+func TestDetachPullSecretsKeepsUnmanagedEntries(t *testing.T) {
+	// an entry with the same name that the controller did not add is left alone
+	sa := newServiceAccountWithPullSecrets(nil, "ecr")
+	assert.False(t, DetachPullSecrets(sa, []string{"ecr"}))
+	assert.Equal(t, []string{"ecr"}, pullSecretNames(sa))
+}
+
+func TestDanglingPullSecrets(t *testing.T) {
+	sa := newServiceAccountWithPullSecrets(nil, "other")
+	AttachPullSecret(sa, "ecr", []string{"ecr", "ecr-2"}, PullSecretOptions{})
+	AttachPullSecret(sa, "ecr-2", []string{"ecr", "ecr-2"}, PullSecretOptions{})
+	secrets := &fakeSecrets{store: map[string]*v1.Secret{"ecr": newSecret("a")}}
+
+	// only managed entries are reported, never the ones added by users
+	dangling, err := DanglingPullSecrets(context.TODO(), secrets, "ns", sa)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ecr-2"}, dangling)
+
+	secrets.existsErr = errors.New("forbidden")
+	_, err = DanglingPullSecrets(context.TODO(), secrets, "ns", sa)
+	assert.NotNil(t, err)
+}
+
+func TestSplitList(t *testing.T) {
+	assert.Equal(t, []string{"a", "b"}, SplitList(" a,, b ,"))
+	assert.Empty(t, SplitList(""))
+}
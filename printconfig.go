@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+)
+
+// resolvedConfig is the output of print-config: the value of every flag after the environment and the fallbacks for
+// invalid values were applied, where each value came from, and the per-provider settings once the file is merged in
+type resolvedConfig struct {
+	// Flags are keyed by flag name, so they can be copied into the values or args of a deployment
+	Flags map[string]interface{} `json:"flags"`
+	// Sources say whether a flag was set on the command line (flag) or by an environment variable (env NAME);
+	// flags left at their default are not listed
+	Sources   map[string]string    `json:"sources,omitempty"`
+	Providers []resolvedProvider   `json:"providers"`
+	AWS       *resolvedAWSSettings `json:"aws,omitempty"`
+	// File is the --config file as loaded
+	File *Config `json:"file,omitempty"`
+}
+
+type resolvedProvider struct {
+	Name            string             `json:"name"`
+	SecretName      string             `json:"secretName"`
+	RefreshInterval string             `json:"refreshInterval"`
+	RefreshJitter   float64            `json:"refreshJitter"`
+	FetchTimeout    string             `json:"fetchTimeout"`
+	Retry           resolvedRetry      `json:"retry"`
+	Namespaces      *NamespaceSelector `json:"namespaces,omitempty"`
+	// MinRefreshInterval is the minimum the provider declares, which refreshInterval was raised to if shorter
+	MinRefreshInterval string `json:"minRefreshInterval,omitempty"`
+	// AWS are the settings of an additional ECR provider; those of the ecr provider are the top-level AWS
+	AWS *resolvedAWSSettings `json:"aws,omitempty"`
+}
+
+type resolvedRetry struct {
+	Type            string  `json:"type"`
+	Retries         int     `json:"retries"`
+	Delay           string  `json:"delay"`
+	InitialInterval string  `json:"initialInterval,omitempty"`
+	Multiplier      float64 `json:"multiplier,omitempty"`
+	MaxInterval     string  `json:"maxInterval,omitempty"`
+	MaxElapsedTime  string  `json:"maxElapsedTime,omitempty"`
+}
+
+type resolvedAWSSettings struct {
+	Region         string            `json:"region"`
+	AssumeRole     string            `json:"assumeRole"`
+	AccountIDs     []string          `json:"accountIDs"`
+	AccountRegions map[string]string `json:"accountRegions,omitempty"`
+	AccountRoles   map[string]string `json:"accountRoles,omitempty"`
+}
+
+// printConfig writes the resolved configuration, with the provider defaults of validateParams, as YAML; the passwords
+// of URLs are redacted
+func printConfig(w io.Writer, fs *flag.FlagSet, cfg *Config, defaults providerDefaults) error {
+	resolved := resolvedConfig{Flags: map[string]interface{}{}, Sources: map[string]string{}}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Deprecated != "" {
+			// folded into their replacement by validateParams
+			return
+		}
+		resolved.Flags[f.Name] = flagValue(fs, f)
+		if env := envBindings[f.Name]; env != "" {
+			resolved.Sources[f.Name] = sourceEnv + " " + env
+		} else if f.Changed {
+			resolved.Sources[f.Name] = sourceFlag
+		}
+	})
+
+	c := &controller{config: cfg, defaults: defaults}
+	if *argProvider == providerFake {
+		c.fake = &providers.Fake{}
+	}
+	if *argProvider == providerFile {
+		c.tokenFiles = &providers.File{}
+	}
+	for _, sg := range getSecretGenerators(c) {
+		resolved.Providers = append(resolved.Providers, resolvedProvider{
+			Name:            sg.Name,
+			SecretName:      sg.SecretName,
+			RefreshInterval: sg.RefreshInterval.String(),
+			RefreshJitter:   sg.RefreshJitter,
+			FetchTimeout:    sg.FetchTimeout.String(),
+			Retry: resolvedRetry{
+				Type:            sg.Retry.Type,
+				Retries:         sg.Retry.NumberOfRetries,
+				Delay:           fmt.Sprintf("%ds", sg.Retry.RetryDelayInSeconds),
+				InitialInterval: durationString(sg.Retry.InitialInterval),
+				Multiplier:      sg.Retry.Multiplier,
+				MaxInterval:     durationString(sg.Retry.MaxInterval),
+				MaxElapsedTime:  durationString(sg.Retry.MaxElapsedTime),
+			},
+			Namespaces:         sg.Namespaces,
+			MinRefreshInterval: durationString(sg.MinRefreshInterval),
+		})
+		if sg.Name == providerECR {
+			resolved.AWS = newResolvedAWSSettings(cfg.awsSettings(defaults))
+		} else if p := cfg.provider(sg.Name); p != nil && p.ECR != nil {
+			resolved.Providers[len(resolved.Providers)-1].AWS = newResolvedAWSSettings(cfg.providerAWSSettings(sg.Name, defaults))
+		}
+	}
+
+	if *argConfigFile != "" {
+		file := *cfg
+		file.Providers = make([]ProviderConfig, len(cfg.Providers))
+		copy(file.Providers, cfg.Providers)
+		for i, p := range file.Providers {
+			if p.TokenExchange != nil {
+				exchange := *p.TokenExchange
+				exchange.URL = redactURL(exchange.URL)
+				file.Providers[i].TokenExchange = &exchange
+			}
+		}
+		resolved.File = &file
+	}
+
+	out, err := yaml.Marshal(resolved)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// flagValue returns the flag's value typed like in YAML; lists and maps stay lists and maps
+func flagValue(fs *flag.FlagSet, f *flag.Flag) interface{} {
+	var value interface{}
+	var err error
+	switch f.Value.Type() {
+	case "bool":
+		value, err = fs.GetBool(f.Name)
+	case "int":
+		value, err = fs.GetInt(f.Name)
+	case "float32":
+		value, err = fs.GetFloat32(f.Name)
+	case "float64":
+		value, err = fs.GetFloat64(f.Name)
+	case "stringSlice":
+		var items []string
+		items, err = fs.GetStringSlice(f.Name)
+		for i := range items {
+			items[i] = redactURL(items[i])
+		}
+		value = items
+	case "stringToString":
+		value, err = fs.GetStringToString(f.Name)
+	default:
+		value = redactURL(f.Value.String())
+	}
+	if err != nil {
+		return f.Value.String()
+	}
+	return value
+}
+
+// redactURL replaces the password of a URL with "xxxxx"; anything else is returned unchanged
+func redactURL(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	return u.Redacted()
+}
+
+// durationString formats an optional duration, empty for 0
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func newResolvedAWSSettings(settings awsSettings) *resolvedAWSSettings {
+	return &resolvedAWSSettings{
+		Region:         settings.Region,
+		AssumeRole:     settings.AssumeRole,
+		AccountIDs:     settings.AccountIDs,
+		AccountRegions: settings.AccountRegions,
+		AccountRoles:   settings.AccountRoles,
+	}
+}
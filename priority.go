@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// namespacePriorityAnnotation orders the namespaces of a provider refresh: the higher the integer, the earlier the
+// namespace gets the new credentials; namespaces without it have priority 0
+const namespacePriorityAnnotation = annotationPrefix + "priority"
+
+// priorityWave is the namespaces of one priority, written together during a refresh
+type priorityWave struct {
+	priority   int
+	namespaces []*v1.Namespace
+}
+
+// namespacePriority returns the namespace's priority, 0 when it has none or an invalid one
+func namespacePriority(ns *v1.Namespace) int {
+	value, ok := ns.Annotations[namespacePriorityAnnotation]
+	if !ok {
+		return 0
+	}
+	priority, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		log.Warnf("Ignoring the %s annotation '%s' of namespace %s; it must be an integer", namespacePriorityAnnotation, value, ns.Name)
+		return 0
+	}
+	return priority
+}
+
+// priorityWaves groups the namespaces by priority, highest first, keeping their order within a priority
+func priorityWaves(namespaces []*v1.Namespace) []priorityWave {
+	priorities := make(map[*v1.Namespace]int, len(namespaces))
+	for _, ns := range namespaces {
+		priorities[ns] = namespacePriority(ns)
+	}
+	sorted := append([]*v1.Namespace(nil), namespaces...)
+	sort.SliceStable(sorted, func(i, j int) bool { return priorities[sorted[i]] > priorities[sorted[j]] })
+
+	var waves []priorityWave
+	for _, ns := range sorted {
+		if len(waves) == 0 || waves[len(waves)-1].priority != priorities[ns] {
+			waves = append(waves, priorityWave{priority: priorities[ns]})
+		}
+		waves[len(waves)-1].namespaces = append(waves[len(waves)-1].namespaces, ns)
+	}
+	return waves
+}
+
+// syncByPriority writes the secrets into the namespaces one priority after the other, pausing --priority-wave-delay
+// between two priorities, and returns the namespaces that were updated and that failed
+func (c *controller) syncByPriority(ctx context.Context, secretGenerator SecretGenerator, targets []*v1.Namespace, secrets []*v1.Secret) ([]string, []string) {
+	updated, failed := []string{}, []string{}
+	for i, wave := range priorityWaves(targets) {
+		if i > 0 && *argPriorityWaveDelay > 0 {
+			log.Infof("Waiting %s before writing the credentials of provider %s to the %d namespaces of priority %d",
+				*argPriorityWaveDelay, secretGenerator.Name, len(wave.namespaces), wave.priority)
+			select {
+			case <-ctx.Done():
+				return updated, failed
+			case <-time.After(*argPriorityWaveDelay):
+			}
+		}
+		waveUpdated, waveFailed := c.syncTargets(ctx, wave.namespaces, secrets)
+		updated, failed = append(updated, waveUpdated...), append(failed, waveFailed...)
+	}
+	return updated, failed
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func prioritizedNamespace(name, priority string) *v1.Namespace {
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if priority != "" {
+		ns.Annotations = map[string]string{namespacePriorityAnnotation: priority}
+	}
+	return ns
+}
+
+func TestPriorityWaves(t *testing.T) {
+	namespaces := []*v1.Namespace{
+		prioritizedNamespace("sandbox", "-10"),
+		prioritizedNamespace("team-a", ""),
+		prioritizedNamespace("prod-a", "100"),
+		prioritizedNamespace("team-b", "high"),
+		prioritizedNamespace("prod-b", " 100"),
+	}
+
+	var got [][]string
+	var priorities []int
+	for _, wave := range priorityWaves(namespaces) {
+		var names []string
+		for _, ns := range wave.namespaces {
+			names = append(names, ns.Name)
+		}
+		got = append(got, names)
+		priorities = append(priorities, wave.priority)
+	}
+	assert.Equal(t, [][]string{{"prod-a", "prod-b"}, {"team-a", "team-b"}, {"sandbox"}}, got)
+	assert.Equal(t, []int{100, 0, -10}, priorities)
+	assert.Empty(t, priorityWaves(nil))
+}
+
+func TestSyncByPriority(t *testing.T) {
+	defer func(delay time.Duration) { *argPriorityWaveDelay = delay }(*argPriorityWaveDelay)
+	*argPriorityWaveDelay = 50 * time.Millisecond
+
+	c := newFakeController()
+	sg := getSecretGenerators(c)[0]
+	secrets, _, err := c.refreshSecret(context.TODO(), sg)
+	assert.Nil(t, err)
+	targets := []*v1.Namespace{prioritizedNamespace("namespace1", ""), prioritizedNamespace("namespace2", "10")}
+
+	start := time.Now()
+	updated, failed := c.syncByPriority(context.TODO(), sg, targets, secrets)
+	assert.Equal(t, []string{"namespace2", "namespace1"}, updated)
+	assert.Empty(t, failed)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// a shutdown stops before the next priority
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	updated, _ = c.syncByPriority(ctx, sg, targets, secrets)
+	assert.Equal(t, []string{"namespace2"}, updated)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+)
+
+const (
+	outputKarmada = "karmada"
+	outputFleet   = "fleet"
+
+	// maxBundleName keeps the Fleet Bundle names within a DNS label
+	maxBundleName = 63
+)
+
+var (
+	propagationPolicyGVK = schema.GroupVersionKind{Group: "policy.karmada.io", Version: "v1alpha1", Kind: "PropagationPolicy"}
+	fleetBundleGVK       = schema.GroupVersionKind{Group: "fleet.cattle.io", Version: "v1alpha1", Kind: "Bundle"}
+)
+
+// propagationOutput leaves the distribution of the secrets to the member clusters to a federation layer. With Karmada
+// the controller runs against the Karmada API server, writes the secrets there and lets a PropagationPolicy per secret
+// push them to the member clusters. With Fleet every secret is wrapped in a Bundle in the Fleet workspace namespace,
+// which Fleet deploys to the namespace of the same name on the targeted clusters.
+type propagationOutput struct {
+	util      *k8sutil.KubeUtilInterface
+	client    client.Client
+	mode      string
+	clusters  []string
+	workspace string
+}
+
+func newPropagationOutput(util *k8sutil.KubeUtilInterface, c client.Client, mode string, clusters []string, workspace string) (*propagationOutput, error) {
+	if mode == outputFleet && workspace == "" {
+		return nil, fmt.Errorf("--fleet-workspace is required with --output=%s", outputFleet)
+	}
+	return &propagationOutput{util: util, client: c, mode: mode, clusters: clusters, workspace: workspace}, nil
+}
+
+func (o *propagationOutput) write(ctx context.Context, namespace string, secret *v1.Secret) error {
+	if o.mode == outputFleet {
+		return o.writeBundle(ctx, namespace, secret)
+	}
+	if _, err := secretsync.EnsureSecret(ctx, o.util, namespace, secret); err != nil {
+		return err
+	}
+	return applyManagedObject(ctx, o.util, o.client, propagationPolicyGVK, namespace, secret.Name, o.propagationPolicySpec(secret))
+}
+
+// patchesServiceAccounts reports whether the ServiceAccounts of the controller's cluster get the secrets. Karmada
+// propagates the ServiceAccounts of its API server like any other resource; a Fleet Bundle only reaches the members.
+func (o *propagationOutput) patchesServiceAccounts() bool {
+	return o.mode != outputFleet
+}
+
+// propagationPolicySpec selects the secret and places it on --propagation-clusters, or on every member cluster
+func (o *propagationOutput) propagationPolicySpec(secret *v1.Secret) map[string]interface{} {
+	placement := map[string]interface{}{}
+	if len(o.clusters) > 0 {
+		placement["clusterAffinity"] = map[string]interface{}{"clusterNames": stringsToInterfaces(o.clusters)}
+	}
+	return map[string]interface{}{
+		"resourceSelectors": []interface{}{
+			map[string]interface{}{"apiVersion": "v1", "kind": "Secret", "name": secret.Name},
+		},
+		"placement": placement,
+	}
+}
+
+// bundleName returns the name of the Bundle of a secret in namespace, hashed when it would be too long
+func bundleName(namespace, secretName string) string {
+	name := fmt.Sprintf("registry-creds-%s-%s", namespace, secretName)
+	if len(name) <= maxBundleName {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return strings.TrimRight(name[:maxBundleName-9], "-.") + "-" + hex.EncodeToString(sum[:])[:8]
+}
+
+// writeBundle creates or updates the Fleet Bundle that deploys secret into namespace on the targeted clusters
+func (o *propagationOutput) writeBundle(ctx context.Context, namespace string, secret *v1.Secret) error {
+	manifest := secret.DeepCopy()
+	manifest.TypeMeta.APIVersion = "v1"
+	manifest.TypeMeta.Kind = "Secret"
+	manifest.Namespace = namespace
+	manifest.ResourceVersion = ""
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	var targets []interface{}
+	for _, cluster := range o.clusters {
+		targets = append(targets, map[string]interface{}{"clusterName": cluster})
+	}
+	if len(targets) == 0 {
+		// an empty selector matches every cluster of the workspace
+		targets = []interface{}{map[string]interface{}{"clusterSelector": map[string]interface{}{}}}
+	}
+	spec := map[string]interface{}{
+		"defaultNamespace": namespace,
+		"resources": []interface{}{
+			map[string]interface{}{"name": secret.Name + ".json", "content": string(content)},
+		},
+		"targets": targets,
+	}
+	return applyManagedObject(ctx, o.util, o.client, fleetBundleGVK, o.workspace, bundleName(namespace, secret.Name), spec)
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	result := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		result = append(result, value)
+	}
+	return result
+}
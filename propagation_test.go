@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+)
+
+func propagatedSecret() *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "awsecr-cred"},
+		Data:       map[string][]byte{v1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+		Type:       v1.SecretTypeDockerConfigJson,
+	}
+}
+
+func TestKarmadaOutput(t *testing.T) {
+	util := newKubeUtil()
+	cl := fake.NewClientBuilder().Build()
+	output, err := newPropagationOutput(util, cl, outputKarmada, []string{"member1", "member2"}, "")
+	assert.Nil(t, err)
+
+	assert.Nil(t, output.write(context.TODO(), "namespace2", propagatedSecret()))
+	secret, err := util.GetSecret(context.TODO(), "namespace2", "awsecr-cred")
+	assert.Nil(t, err)
+	assert.Equal(t, propagatedSecret().Data, secret.Data)
+
+	policy := &unstructured.Unstructured{}
+	policy.SetGroupVersionKind(propagationPolicyGVK)
+	assert.Nil(t, cl.Get(context.TODO(), types.NamespacedName{Namespace: "namespace2", Name: "awsecr-cred"}, policy))
+	clusters, _, _ := unstructured.NestedStringSlice(policy.Object, "spec", "placement", "clusterAffinity", "clusterNames")
+	assert.Equal(t, []string{"member1", "member2"}, clusters)
+	selectors, _, _ := unstructured.NestedSlice(policy.Object, "spec", "resourceSelectors")
+	assert.Equal(t, []interface{}{map[string]interface{}{"apiVersion": "v1", "kind": "Secret", "name": "awsecr-cred"}}, selectors)
+	assert.Equal(t, managedLabels(), policy.GetLabels())
+
+	// writing again leaves the policy alone
+	version := policy.GetResourceVersion()
+	assert.Nil(t, output.write(context.TODO(), "namespace2", propagatedSecret()))
+	assert.Nil(t, cl.Get(context.TODO(), types.NamespacedName{Namespace: "namespace2", Name: "awsecr-cred"}, policy))
+	assert.Equal(t, version, policy.GetResourceVersion())
+}
+
+func TestFleetOutput(t *testing.T) {
+	c := newFakeController()
+	cl := fake.NewClientBuilder().Build()
+	output, err := newPropagationOutput(c.k8sutil, cl, outputFleet, nil, "fleet-default")
+	assert.Nil(t, err)
+	c.output = output
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, propagatedSecret()))
+
+	bundle := &unstructured.Unstructured{}
+	bundle.SetGroupVersionKind(fleetBundleGVK)
+	assert.Nil(t, cl.Get(context.TODO(), types.NamespacedName{Namespace: "fleet-default", Name: "registry-creds-namespace1-awsecr-cred"}, bundle))
+	defaultNamespace, _, _ := unstructured.NestedString(bundle.Object, "spec", "defaultNamespace")
+	assert.Equal(t, "namespace1", defaultNamespace)
+	targets, _, _ := unstructured.NestedSlice(bundle.Object, "spec", "targets")
+	assert.Equal(t, []interface{}{map[string]interface{}{"clusterSelector": map[string]interface{}{}}}, targets)
+
+	resources, _, _ := unstructured.NestedSlice(bundle.Object, "spec", "resources")
+	assert.Len(t, resources, 1)
+	manifest := &v1.Secret{}
+	assert.Nil(t, json.Unmarshal([]byte(resources[0].(map[string]interface{})["content"].(string)), manifest))
+	assert.Equal(t, "Secret", manifest.Kind)
+	assert.Equal(t, "namespace1", manifest.Namespace)
+	assert.Equal(t, propagatedSecret().Data, manifest.Data)
+
+	// the secret only exists on the member clusters, so neither it nor the ServiceAccount entry is written here
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", "awsecr-cred")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	sa, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	assert.False(t, secretsync.HasPullSecret(sa, "awsecr-cred"))
+	assert.False(t, c.writesSecrets())
+
+	_, err = newPropagationOutput(c.k8sutil, cl, outputFleet, nil, "")
+	assert.NotNil(t, err)
+}
+
+// restartingClient fails the first creates with a server error, like an API server that restarts
+type restartingClient struct {
+	client.Client
+	failures int
+}
+
+func (r *restartingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if r.failures > 0 {
+		r.failures--
+		return apierrors.NewInternalError(errors.New("restarting"))
+	}
+	return r.Client.Create(ctx, obj, opts...)
+}
+
+func TestFleetOutputRetriesWrites(t *testing.T) {
+	c := newFakeController()
+	c.k8sutil.WriteRetry = &k8sutil.WriteRetry{Retries: 3, InitialBackoff: time.Millisecond}
+	cl := &restartingClient{Client: fake.NewClientBuilder().Build(), failures: 2}
+	output, err := newPropagationOutput(c.k8sutil, cl, outputFleet, nil, "fleet-default")
+	assert.Nil(t, err)
+
+	// the Bundles go through the write path of the other writes
+	assert.Nil(t, output.write(context.TODO(), "namespace1", propagatedSecret()))
+	assert.Equal(t, 0, cl.failures)
+	bundle := &unstructured.Unstructured{}
+	bundle.SetGroupVersionKind(fleetBundleGVK)
+	assert.Nil(t, cl.Get(context.TODO(), types.NamespacedName{Namespace: "fleet-default", Name: "registry-creds-namespace1-awsecr-cred"}, bundle))
+}
+
+func TestBundleName(t *testing.T) {
+	assert.Equal(t, "registry-creds-team-a-awsecr-cred", bundleName("team-a", "awsecr-cred"))
+
+	long := bundleName(strings.Repeat("n", 60), "awsecr-cred")
+	assert.Len(t, long, maxBundleName)
+	assert.NotEqual(t, long, bundleName(strings.Repeat("n", 60), "gcr-secret"))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// newProviderHTTPClient returns the HTTP client used to call provider APIs, honouring --provider-proxy and --provider-ca-bundle
+// and presenting the provider's client certificate if one is configured
+func newProviderHTTPClient(clientTLS *ProviderTLS) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	// without an explicit proxy the HTTPS_PROXY, HTTP_PROXY and NO_PROXY env vars apply
+	transport.Proxy = http.ProxyFromEnvironment
+	if *argProviderProxy != "" {
+		proxyURL, err := url.Parse(*argProviderProxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid provider proxy URL '%s'", *argProviderProxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if *argProviderCABundle != "" {
+		pool, err := loadCABundle(*argProviderCABundle)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	if clientTLS != nil {
+		// fail early on a broken key pair, then reload it on every handshake so a rotated secret is picked up
+		if _, err := tls.LoadX509KeyPair(clientTLS.CertFile, clientTLS.KeyFile); err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(clientTLS.CertFile, clientTLS.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not load client certificate: %v", err)
+			}
+			return &cert, nil
+		}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// loadCABundle returns the system roots extended with the PEM certificates in path
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA bundle: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// providerContext derives the context of a single provider API call, bounded by --provider-timeout
+func providerContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *argProviderTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, *argProviderTimeout)
+}
+
+// awsClientOptions configure the sessions of the AWS clients
+type awsClientOptions struct {
+	// TLS is the client certificate presented to the AWS APIs, nil for none
+	TLS *ProviderTLS
+	// Credentials replace the SDK's default credential chain when set, e.g. from a credentialsSecretRef; an assumed
+	// role is assumed with them
+	Credentials *credentials.Credentials
+	// AssumeRole is the ARN of the role the clients assume, "" for none
+	AssumeRole string
+}
+
+// newAWSSession returns a session whose clients use the provider HTTP client and identify the controller in their User-Agent
+func newAWSSession(opts awsClientOptions) (*session.Session, error) {
+	client, err := newProviderHTTPClient(opts.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("could not configure the provider HTTP client: %v", err)
+	}
+	config := aws.NewConfig().WithHTTPClient(client)
+	if opts.Credentials != nil {
+		config = config.WithCredentials(opts.Credentials)
+	}
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		Config: *config,
+	}))
+	// appended to the SDK's own User-Agent, so CloudTrail shows e.g. "aws-sdk-go/1.44.0 (go1.19; linux; amd64) registry-creds/v1.2.3"
+	sess.Handlers.Build.PushBack(request.MakeAddToUserAgentHandler(userAgentProduct, version))
+	return sess, nil
+}
+
+// checkProviderTLS loads the client certificate of every provider of cfg, so a config whose certificate cannot be
+// used is rejected before it replaces the current one
+func checkProviderTLS(cfg *Config) error {
+	for _, p := range cfg.Providers {
+		if p.TLS == nil {
+			continue
+		}
+		if _, err := newProviderHTTPClient(p.TLS); err != nil {
+			return fmt.Errorf("provider '%s': %v", p.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderHTTPClientCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.Nil(t, os.WriteFile(bundle, certPEM, 0600))
+
+	*argProviderCABundle = ""
+	client, err := newProviderHTTPClient(nil)
+	assert.Nil(t, err)
+	_, err = client.Get(server.URL)
+	assert.NotNil(t, err)
+
+	*argProviderCABundle = bundle
+	defer func() { *argProviderCABundle = "" }()
+	client, err = newProviderHTTPClient(nil)
+	assert.Nil(t, err)
+	resp, err := client.Get(server.URL)
+	assert.Nil(t, err)
+	resp.Body.Close()
+}
+
+func TestProviderHTTPClientInvalidCABundle(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	assert.Nil(t, os.WriteFile(bundle, []byte("not a certificate"), 0600))
+
+	*argProviderCABundle = bundle
+	defer func() { *argProviderCABundle = "" }()
+	_, err := newProviderHTTPClient(nil)
+	assert.NotNil(t, err)
+}
+
+func TestProviderHTTPClientProxy(t *testing.T) {
+	*argProviderProxy = "http://proxy.example.com:3128"
+	defer func() { *argProviderProxy = "" }()
+
+	client, err := newProviderHTTPClient(nil)
+	assert.Nil(t, err)
+	req, _ := http.NewRequest("GET", "https://api.ecr.us-east-1.amazonaws.com", nil)
+	proxyURL, err := client.Transport.(*http.Transport).Proxy(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "proxy.example.com:3128", proxyURL.Host)
+
+	*argProviderProxy = "://bad"
+	_, err = newProviderHTTPClient(nil)
+	assert.NotNil(t, err)
+}
+
+// writeClientCert writes a self-signed client certificate and key to dir
+func writeClientCert(t *testing.T, dir string) *ProviderTLS {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "registry-creds"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	clientTLS := &ProviderTLS{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	assert.Nil(t, os.WriteFile(clientTLS.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, os.WriteFile(clientTLS.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return clientTLS
+}
+
+func TestProviderHTTPClientCertificate(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.pem")
+	assert.Nil(t, os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+	*argProviderCABundle = bundle
+	defer func() { *argProviderCABundle = "" }()
+
+	client, err := newProviderHTTPClient(writeClientCert(t, dir))
+	assert.Nil(t, err)
+	resp, err := client.Get(server.URL)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "registry-creds", string(body))
+
+	_, err = newProviderHTTPClient(&ProviderTLS{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: filepath.Join(dir, "missing.key")})
+	assert.NotNil(t, err)
+}
+
+func TestAWSSessionUserAgent(t *testing.T) {
+	var agent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agent = r.Header.Get("User-Agent")
+		_, _ = io.WriteString(w, "{}")
+	}))
+	defer server.Close()
+
+	sess, err := newAWSSession(awsClientOptions{Credentials: credentials.NewStaticCredentials("id", "secret", "")})
+	assert.Nil(t, err)
+	client := ecr.New(sess, aws.NewConfig().WithRegion("us-east-1").WithEndpoint(server.URL))
+	_, err = client.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
+	assert.Nil(t, err)
+
+	assert.Contains(t, agent, "aws-sdk-go/")
+	assert.True(t, strings.HasSuffix(agent, " registry-creds/"+version), agent)
+	assert.Equal(t, "registry-creds/"+version, userAgent())
+}
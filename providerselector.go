@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// NamespaceSelector limits the namespaces a provider's secret is distributed to; a namespace must match both fields
+type NamespaceSelector struct {
+	// Names are namespace names or shell patterns such as team-a-*; empty matches every name
+	Names []string `json:"names,omitempty"`
+	// LabelSelector is a label selector such as team=a; empty matches every namespace
+	LabelSelector string `json:"labelSelector,omitempty"`
+}
+
+func (s *NamespaceSelector) validate() error {
+	for _, pattern := range s.Names {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid namespace pattern '%s': %v", pattern, err)
+		}
+	}
+	if _, err := labels.Parse(s.LabelSelector); err != nil {
+		return fmt.Errorf("invalid labelSelector '%s': %v", s.LabelSelector, err)
+	}
+	return nil
+}
+
+// matches reports whether the namespace is selected; a nil selector selects every namespace
+func (s *NamespaceSelector) matches(ns *v1.Namespace) bool {
+	if s == nil {
+		return true
+	}
+	if len(s.Names) > 0 && !matchesAny(s.Names, ns.GetName()) {
+		return false
+	}
+	if s.LabelSelector != "" {
+		// validated when the config is loaded
+		selector, err := labels.Parse(s.LabelSelector)
+		if err != nil || !selector.Matches(labels.Set(ns.GetLabels())) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeSecretsAnnotation lists secret names, or shell patterns, a namespace refuses while still getting the others
+const excludeSecretsAnnotation = annotationPrefix + "exclude-secrets"
+
+// secretRefused reports whether the namespace's excludeSecretsAnnotation lists the secret
+func secretRefused(ns *v1.Namespace, secretName string) bool {
+	value := ns.GetAnnotations()[excludeSecretsAnnotation]
+	if value == "" {
+		return false
+	}
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return matchesAny(patterns, secretName)
+}
+
+// selects reports whether the provider's secret belongs in the namespace
+func (s SecretGenerator) selects(ns *v1.Namespace) bool {
+	return s.Namespaces.matches(ns) && !secretRefused(ns, s.SecretName)
+}
+
+// selectProviders splits the providers into those whose secret belongs in the namespace and those whose does not
+func (c *controller) selectProviders(ns *v1.Namespace) ([]SecretGenerator, []SecretGenerator) {
+	var selected, unselected []SecretGenerator
+	for _, secretGenerator := range getSecretGenerators(c) {
+		if secretGenerator.selects(ns) {
+			selected = append(selected, secretGenerator)
+		} else {
+			unselected = append(unselected, secretGenerator)
+		}
+	}
+	return selected, unselected
+}
+
+// removeUnselected deletes the secrets of the providers that do not select the namespace, e.g. after the namespace
+// was relabelled, refused the secret or the provider's selector changed
+func (c *controller) removeUnselected(ctx context.Context, ns *v1.Namespace, unselected []SecretGenerator) error {
+	if len(unselected) == 0 {
+		return nil
+	}
+	return c.removeSecrets(ctx, ns, c.providerSecretNames(unselected))
+}
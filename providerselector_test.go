@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+)
+
+func TestNamespaceSelectorMatches(t *testing.T) {
+	teamA := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a-web", Labels: map[string]string{"team": "a"}}}
+	teamB := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b-web", Labels: map[string]string{"team": "b"}}}
+
+	var all *NamespaceSelector
+	assert.True(t, all.matches(teamA))
+
+	byName := &NamespaceSelector{Names: []string{"team-a-*"}}
+	assert.True(t, byName.matches(teamA))
+	assert.False(t, byName.matches(teamB))
+
+	byLabel := &NamespaceSelector{LabelSelector: "team=b"}
+	assert.False(t, byLabel.matches(teamA))
+	assert.True(t, byLabel.matches(teamB))
+
+	both := &NamespaceSelector{Names: []string{"team-*"}, LabelSelector: "team=a"}
+	assert.True(t, both.matches(teamA))
+	assert.False(t, both.matches(teamB))
+}
+
+func TestLoadConfigNamespaces(t *testing.T) {
+	_, err := loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    namespaces:
+      labelSelector: "team in (a"
+`))
+	assert.NotNil(t, err)
+
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    namespaces:
+      names: ["team-["]
+`))
+	assert.NotNil(t, err)
+}
+
+func TestHandlerDistributesToSelectedNamespaces(t *testing.T) {
+	c := newFakeController()
+	namespace1 := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	namespace2 := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace2"}}
+	assert.Nil(t, handler(context.TODO(), c, namespace2))
+
+	c.config = &Config{Providers: []ProviderConfig{{Name: providerECR, Namespaces: &NamespaceSelector{Names: []string{"namespace1"}}}}}
+	assert.Nil(t, handler(context.TODO(), c, namespace1))
+	assert.Nil(t, handler(context.TODO(), c, namespace2))
+
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	// the secret distributed before the selector was set is removed again
+	exists, err = c.k8sutil.SecretExists(context.TODO(), "namespace2", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	sa, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace2", "default")
+	assert.Nil(t, err)
+	assert.False(t, secretsync.HasPullSecret(sa, *argAWSSecretName))
+}
+
+func TestRefreshProviderSkipsUnselectedNamespaces(t *testing.T) {
+	c := newFakeController()
+	c.config = &Config{Providers: []ProviderConfig{{Name: providerECR, Namespaces: &NamespaceSelector{Names: []string{"namespace2"}}}}}
+
+	c.refreshProvider(context.TODO(), getSecretGenerators(c)[0])
+
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	exists, err = c.k8sutil.SecretExists(context.TODO(), "namespace2", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
+
+func TestSecretRefused(t *testing.T) {
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	assert.False(t, secretRefused(ns, "awsecr-cred"))
+
+	ns.Annotations = map[string]string{excludeSecretsAnnotation: "gcr-secret, awsecr-*"}
+	assert.True(t, secretRefused(ns, "awsecr-cred"))
+	assert.True(t, secretRefused(ns, "gcr-secret"))
+	assert.False(t, secretRefused(ns, "acr-secret"))
+}
+
+func TestHandlerRemovesRefusedSecrets(t *testing.T) {
+	c := newFakeController()
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	assert.Nil(t, handler(context.TODO(), c, ns))
+
+	ns.Annotations = map[string]string{excludeSecretsAnnotation: *argAWSSecretName}
+	assert.Nil(t, handler(context.TODO(), c, ns))
+
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	sa, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	assert.False(t, secretsync.HasPullSecret(sa, *argAWSSecretName))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// reasonPullFailing is the Event recorded on a pod that cannot pull from a managed registry although its namespace has
+// the pull secret
+const reasonPullFailing = "PullFailingWithCredentials"
+
+// pullFailure is a container waiting for an image from a registry that rejected the pull for lack of credentials
+type pullFailure struct {
+	container string
+	image     string
+	host      string
+}
+
+// podPullFailures returns the containers of the pod that cannot pull an image from one of hosts because of its credentials
+func podPullFailures(pod *v1.Pod, hosts []string) []pullFailure {
+	var failures []pullFailure
+	statuses := append(append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		waiting := status.State.Waiting
+		if waiting == nil || !imagePullWaiting(waiting.Reason) {
+			continue
+		}
+		host := imageHost(status.Image)
+		if !registryListed(hosts, host) || !authFailure(waiting.Message) {
+			continue
+		}
+		failures = append(failures, pullFailure{container: status.Name, image: status.Image, host: host})
+	}
+	return failures
+}
+
+func imagePullWaiting(reason string) bool {
+	return reason == "ErrImagePull" || reason == "ImagePullBackOff"
+}
+
+// pullFailureWatcher reports the pods of managed namespaces that keep failing to pull from the providers' registries
+// although the namespace has the provider's pull secret, i.e. where distributing the secret did not help
+type pullFailureWatcher struct {
+	client client.Reader
+	c      *controller
+
+	// reported holds the image every container of a pod was reported for, so a pod flapping between ErrImagePull and
+	// ImagePullBackOff is reported once
+	reportedLock sync.Mutex
+	reported     map[types.NamespacedName]map[string]string
+}
+
+func newPullFailureWatcher(reader client.Reader, c *controller) *pullFailureWatcher {
+	return &pullFailureWatcher{client: reader, c: c, reported: map[types.NamespacedName]map[string]string{}}
+}
+
+// Reconcile checks a single pod; nothing is requeued, the kubelet's next pull attempt updates the pod again
+func (w *pullFailureWatcher) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	pod := &v1.Pod{}
+	if err := w.client.Get(ctx, req.NamespacedName, pod); err != nil {
+		w.forget(req.NamespacedName, nil)
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	ns := &v1.Namespace{}
+	if err := w.client.Get(ctx, types.NamespacedName{Name: req.Namespace}, ns); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if w.c.namespaceExcluded(ns) || systemNamespace(ns.Name) {
+		w.forget(req.NamespacedName, nil)
+		return ctrl.Result{}, nil
+	}
+
+	// the registry hosts of the providers that select the namespace, with the names of their secrets
+	selected, _ := w.c.selectProviders(ns)
+	providers := map[string][]SecretGenerator{}
+	var hosts []string
+	w.c.secretsLock.Lock()
+	for _, secretGenerator := range selected {
+		for _, token := range w.c.tokens[secretGenerator.SecretName] {
+			hosts = append(hosts, token.Host())
+			providers[token.Host()] = append(providers[token.Host()], secretGenerator)
+		}
+	}
+	w.c.secretsLock.Unlock()
+
+	failures := podPullFailures(pod, hosts)
+	w.forget(req.NamespacedName, failures)
+	for _, failure := range failures {
+		if w.wasReported(req.NamespacedName, failure) {
+			continue
+		}
+		secret, err := w.syncedSecret(ctx, ns.Name, providers[failure.host])
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if secret == "" {
+			// not distributed yet, see --workload-rollout
+			log.Debugf("Pod %s in namespace %s cannot pull %s before the pull secret was synced", pod.Name, ns.Name, failure.image)
+			continue
+		}
+		w.report(pod, failure, secret)
+	}
+	return ctrl.Result{}, nil
+}
+
+// syncedSecret returns the first secret of the providers that exists in the namespace, "" if none does
+func (w *pullFailureWatcher) syncedSecret(ctx context.Context, namespace string, secretGenerators []SecretGenerator) (string, error) {
+	for _, name := range w.c.providerSecretNames(secretGenerators) {
+		exists, err := w.c.k8sutil.SecretExists(ctx, namespace, name)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// report counts, logs and records an Event for a container failing to pull although the namespace has secret
+func (w *pullFailureWatcher) report(pod *v1.Pod, failure pullFailure, secret string) {
+	w.reportedLock.Lock()
+	name := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	if w.reported[name] == nil {
+		w.reported[name] = map[string]string{}
+	}
+	w.reported[name][failure.container] = failure.image
+	w.reportedLock.Unlock()
+
+	// the usual cause is a pod that does not reference the secret, e.g. one admitted with another ServiceAccount
+	reference := "does not reference it in imagePullSecrets"
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		if ref.Name == secret {
+			reference = "references it, so the registry rejected the credentials"
+		}
+	}
+	pullFailures.WithLabelValues(failure.host).Inc()
+	log.Warnf("Container %s of pod %s in namespace %s cannot pull %s although the namespace has the pull secret %s; the pod %s",
+		failure.container, pod.Name, pod.Namespace, failure.image, secret, reference)
+	if w.c.recorder != nil {
+		w.c.recorder.Eventf(pod, v1.EventTypeWarning, reasonPullFailing, "Cannot pull %s although the namespace has the pull secret %s of registry-creds; the pod %s",
+			failure.image, secret, reference)
+	}
+}
+
+func (w *pullFailureWatcher) wasReported(name types.NamespacedName, failure pullFailure) bool {
+	w.reportedLock.Lock()
+	defer w.reportedLock.Unlock()
+	return w.reported[name][failure.container] == failure.image
+}
+
+// forget drops the reported containers of the pod that no longer fail, all of them if failures is empty
+func (w *pullFailureWatcher) forget(name types.NamespacedName, failures []pullFailure) {
+	w.reportedLock.Lock()
+	defer w.reportedLock.Unlock()
+	if len(failures) == 0 {
+		delete(w.reported, name)
+		return
+	}
+	failing := map[string]bool{}
+	for _, failure := range failures {
+		failing[failure.container] = true
+	}
+	for container := range w.reported[name] {
+		if !failing[container] {
+			delete(w.reported[name], container)
+		}
+	}
+}
+
+// pullWaiting only lets through pods with a container waiting for an image pull, and deletions so their reports are
+// forgotten
+func pullWaiting() predicate.Predicate {
+	waiting := func(obj client.Object) bool {
+		pod, ok := obj.(*v1.Pod)
+		if !ok {
+			return false
+		}
+		statuses := append(append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if status.State.Waiting != nil && imagePullWaiting(status.State.Waiting.Reason) {
+				return true
+			}
+		}
+		return false
+	}
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return waiting(e.Object) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return waiting(e.ObjectNew) || waiting(e.ObjectOld) },
+		DeleteFunc:  func(event.DeleteEvent) bool { return true },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+	}
+}
+
+// setupPullFailureWatcher registers the pod watch of --watch-pull-failures with the manager
+func (c *controller) setupPullFailureWatcher(mgr manager.Manager) error {
+	log.Infof("Reporting pods that fail to pull from the providers' registries although their namespace has the pull secrets")
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("pullfailure").
+		For(&v1.Pod{}, builder.WithPredicates(pullWaiting())).
+		Complete(newPullFailureWatcher(mgr.GetClient(), c))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestPullFailureWatcher(t *testing.T) {
+	c := newFakeController()
+	c.fake = &providers.Fake{Registries: []string{"https://registry.example.com"}, Expiry: time.Hour}
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	pod := failingPod("web", nil)
+	pod.Status.ContainerStatuses[0].Name = "app"
+	other := failingPod("other", nil)
+	other.Status.ContainerStatuses[0].Image = "docker.io/library/nginx"
+	w := newPullFailureWatcher(fake.NewClientBuilder().WithObjects(ns, &pod, &other).Build(), c)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "namespace1", Name: "web"}}
+	failures := testutil.ToFloat64(pullFailures.WithLabelValues("registry.example.com"))
+
+	// before the secret reached the namespace the failure is expected, see --workload-rollout
+	_, err := w.Reconcile(context.TODO(), req)
+	require.Nil(t, err)
+	assert.Empty(t, recorder.Events)
+
+	require.Nil(t, handler(context.TODO(), c, ns))
+	_, err = w.Reconcile(context.TODO(), req)
+	require.Nil(t, err)
+	require.Len(t, recorder.Events, 1)
+	assert.Equal(t, "Warning PullFailingWithCredentials Cannot pull registry.example.com/app:1 although the namespace has the pull secret "+
+		c.managedSecretNames()[0]+" of registry-creds; the pod does not reference it in imagePullSecrets", <-recorder.Events)
+	assert.Equal(t, failures+1, testutil.ToFloat64(pullFailures.WithLabelValues("registry.example.com")))
+
+	// the kubelet's next attempts are not reported again
+	_, err = w.Reconcile(context.TODO(), req)
+	require.Nil(t, err)
+	assert.Empty(t, recorder.Events)
+
+	// registries the controller does not manage are none of its business
+	_, err = w.Reconcile(context.TODO(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "namespace1", Name: "other"}})
+	require.Nil(t, err)
+	assert.Empty(t, recorder.Events)
+
+	// a pod that pulled its image is forgotten, and reported again should it fail once more
+	running := pod.DeepCopy()
+	running.Status.ContainerStatuses[0].State = v1.ContainerState{Running: &v1.ContainerStateRunning{}}
+	require.Nil(t, w.client.(client.Client).Update(context.TODO(), running))
+	_, err = w.Reconcile(context.TODO(), req)
+	require.Nil(t, err)
+	assert.Empty(t, w.reported)
+}
+
+func TestPullWaiting(t *testing.T) {
+	pod := failingPod("web", nil)
+	running := v1.Pod{Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}}}}}
+	assert.True(t, pullWaiting().Create(event.CreateEvent{Object: &pod}))
+	assert.False(t, pullWaiting().Create(event.CreateEvent{Object: &running}))
+	// a pod that just pulled its image clears its report
+	assert.True(t, pullWaiting().Update(event.UpdateEvent{ObjectOld: &pod, ObjectNew: &running}))
+	assert.False(t, pullWaiting().Update(event.UpdateEvent{ObjectOld: &running, ObjectNew: &running}))
+}
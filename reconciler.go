@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	crhandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// namespaceReconciler pushes the pull secrets into a namespace whenever the namespace, one of its managed secrets
+// or one of its ServiceAccounts changes
+type namespaceReconciler struct {
+	client client.Reader
+	c      *controller
+}
+
+// Reconcile syncs a single namespace; returning an error requeues it with backoff
+func (r *namespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ns := &v1.Namespace{}
+	if err := r.client.Get(ctx, types.NamespacedName{Name: req.Name}, ns); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !ns.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+	return ctrl.Result{}, handler(ctx, r.c, ns)
+}
+
+// namespaceOf maps any namespaced object to a request for its namespace
+func namespaceOf(obj client.Object) []ctrl.Request {
+	return []ctrl.Request{{NamespacedName: types.NamespacedName{Name: obj.GetNamespace()}}}
+}
+
+// managedSecretDeleted only lets through the deletion of a secret the controller distributes
+func (c *controller) managedSecretDeleted() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		UpdateFunc:  func(event.UpdateEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return stringSliceContains(c.managedSecretNames(), e.Object.GetName())
+		},
+	}
+}
+
+// serviceAccountDrifted lets through new ServiceAccounts and ServiceAccounts that lost a managed imagePullSecrets entry;
+// the controller's own updates add the entries, so they do not trigger another sync
+func (c *controller) serviceAccountDrifted() predicate.Predicate {
+	return predicate.Funcs{
+		DeleteFunc:  func(event.DeleteEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			sa, ok := e.ObjectNew.(*v1.ServiceAccount)
+			if !ok {
+				return false
+			}
+			for _, name := range c.managedSecretNames() {
+				if !secretsync.HasPullSecret(sa, name) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// setupReconciler registers the namespace reconciler and the provider refresh with the manager
+func (c *controller) setupReconciler(mgr manager.Manager) error {
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named("namespace").
+		For(&v1.Namespace{}).
+		Watches(&source.Kind{Type: &v1.Secret{}}, crhandler.EnqueueRequestsFromMapFunc(namespaceOf),
+			builder.OnlyMetadata, builder.WithPredicates(c.managedSecretDeleted())).
+		Watches(&source.Kind{Type: &v1.ServiceAccount{}}, crhandler.EnqueueRequestsFromMapFunc(namespaceOf),
+			builder.WithPredicates(c.serviceAccountDrifted()))
+	if mirror, ok := c.output.(*mirrorOutput); ok {
+		// a changed hub secret is copied into every namespace
+		b = b.Watches(&source.Kind{Type: &v1.Secret{}}, crhandler.EnqueueRequestsFromMapFunc(allNamespaces(mgr.GetClient())),
+			builder.OnlyMetadata, builder.WithPredicates(c.hubSecretChanged(mirror.hubNamespace)))
+	}
+	err := b.Complete(&namespaceReconciler{client: mgr.GetClient(), c: c})
+	if err != nil {
+		return err
+	}
+	if *argWatchPullFailures {
+		if err := c.setupPullFailureWatcher(mgr); err != nil {
+			return err
+		}
+	}
+
+	// the refresh timers and the status writer only run on the elected leader
+	return mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		c.setLeaderContext(ctx)
+		c.startProviderRefresh(ctx)
+		go c.runStatusWriter(ctx)
+		go c.runPauseWatcher(ctx)
+		go c.runConfigReloader(ctx)
+		go c.runVClusterSync(ctx)
+		<-ctx.Done()
+		c.reportShutdown(time.Now())
+		return nil
+	}))
+}
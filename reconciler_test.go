@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func newFakeReconciler(c *controller, objs ...*v1.Namespace) *namespaceReconciler {
+	builder := fake.NewClientBuilder()
+	for _, ns := range objs {
+		builder = builder.WithObjects(ns)
+	}
+	return &namespaceReconciler{client: builder.Build(), c: c}
+}
+
+func TestReconcileNamespace(t *testing.T) {
+	c := newFakeController()
+	r := newFakeReconciler(c, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}})
+
+	_, err := r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "namespace1"}})
+	assert.Nil(t, err)
+
+	_, err = c.k8sutil.GetSecret(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	serviceAccount, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	assertSecretPresent(t, serviceAccount.ImagePullSecrets, *argAWSSecretName)
+
+	// namespaces deleted in the meantime are ignored
+	_, err = r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "gone"}})
+	assert.Nil(t, err)
+}
+
+func TestManagedSecretDeletedPredicate(t *testing.T) {
+	c := newFakeController()
+	p := c.managedSecretDeleted()
+
+	managed := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: *argAWSSecretName, Namespace: "namespace1"}}
+	other := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "namespace1"}}
+
+	assert.True(t, p.Delete(event.DeleteEvent{Object: managed}))
+	assert.False(t, p.Delete(event.DeleteEvent{Object: other}))
+	assert.False(t, p.Update(event.UpdateEvent{ObjectOld: managed, ObjectNew: managed}))
+	assert.False(t, p.Create(event.CreateEvent{Object: managed}))
+}
+
+func TestServiceAccountDriftedPredicate(t *testing.T) {
+	c := newFakeController()
+	p := c.serviceAccountDrifted()
+
+	attached := &v1.ServiceAccount{
+		ObjectMeta:       metav1.ObjectMeta{Name: "default", Namespace: "namespace1"},
+		ImagePullSecrets: []v1.LocalObjectReference{{Name: *argAWSSecretName}},
+	}
+	detached := &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "namespace1"}}
+
+	assert.False(t, p.Update(event.UpdateEvent{ObjectOld: detached, ObjectNew: attached}))
+	assert.True(t, p.Update(event.UpdateEvent{ObjectOld: attached, ObjectNew: detached}))
+	assert.True(t, p.Create(event.CreateEvent{Object: detached}))
+	assert.False(t, p.Delete(event.DeleteEvent{Object: attached}))
+	assert.Equal(t, []ctrl.Request{{NamespacedName: types.NamespacedName{Name: "namespace1"}}}, namespaceOf(attached))
+}
+
+func TestReadsFromCache(t *testing.T) {
+	c := newFakeController()
+	c.k8sutil.Cache = fake.NewClientBuilder().WithObjects(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "cached"}},
+		&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "cached"}},
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: *argAWSSecretName, Namespace: "cached"}},
+	).Build()
+
+	namespaces, err := c.k8sutil.GetNamespaces(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, namespaces.Items, 1)
+	assert.Equal(t, "cached", namespaces.Items[0].Name)
+
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "cached", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	exists, err = c.k8sutil.SecretExists(context.TODO(), "cached", "missing")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	// changes to a ServiceAccount read from the cache do not leak into the cache
+	sa, err := c.k8sutil.GetServiceAccount(context.TODO(), "cached", "default")
+	assert.Nil(t, err)
+	sa.ImagePullSecrets = append(sa.ImagePullSecrets, v1.LocalObjectReference{Name: "changed"})
+	sa, err = c.k8sutil.GetServiceAccount(context.TODO(), "cached", "default")
+	assert.Nil(t, err)
+	assert.Empty(t, sa.ImagePullSecrets)
+}
+
+func TestNamespaceResyncPeriod(t *testing.T) {
+	defer func(d time.Duration) { *argResyncPeriod = d }(*argResyncPeriod)
+
+	assert.Equal(t, time.Duration(*argRefreshMinutes)*time.Minute, namespaceResyncPeriod())
+	*argResyncPeriod = 5 * time.Minute
+	assert.Equal(t, 5*time.Minute, namespaceResyncPeriod())
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+)
+
+const (
+	// expiryRefreshMargin is how long before the earliest token expiry a provider is refreshed at the latest
+	expiryRefreshMargin = 10 * time.Minute
+	// minExpiryRefresh keeps a provider whose tokens are about to expire, or already expired, from refreshing in a loop
+	minExpiryRefresh = time.Minute
+)
+
+// providerTimer is the refresh timer of one provider, see startProviderRefresh
+type providerTimer struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// startProviderRefresh starts an independent refresh timer for every provider that has none running, and stops the
+// timers of the providers the config no longer has; it runs when the replica starts leading and after every reload
+func (c *controller) startProviderRefresh(ctx context.Context) {
+	c.refreshTimersLock.Lock()
+	defer c.refreshTimersLock.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+
+	configured := map[string]bool{}
+	for _, secretGenerator := range getSecretGenerators(c) {
+		configured[secretGenerator.Name] = true
+		if timer, ok := c.refreshTimers[secretGenerator.Name]; ok && timer.ctx.Err() == nil {
+			continue
+		}
+		log.Infof("Refreshing provider %s every %s (jitter %.0f%%)", secretGenerator.Name, secretGenerator.RefreshInterval, secretGenerator.RefreshJitter*100)
+		timerCtx, cancel := context.WithCancel(ctx)
+		c.refreshTimers[secretGenerator.Name] = &providerTimer{ctx: timerCtx, cancel: cancel}
+		go c.runProviderRefresh(timerCtx, secretGenerator)
+	}
+	for name, timer := range c.refreshTimers {
+		if !configured[name] {
+			log.Infof("Stopped refreshing provider %s, it is no longer configured", name)
+			timer.cancel()
+			delete(c.refreshTimers, name)
+		}
+	}
+}
+
+func (c *controller) runProviderRefresh(ctx context.Context, secretGenerator SecretGenerator) {
+	for {
+		current, ok := c.currentGenerator(secretGenerator.Name)
+		if !ok {
+			// removed by a reload, which stops the timer
+			return
+		}
+		secretGenerator = current
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.nextRefresh(secretGenerator, time.Now())):
+		}
+		c.refreshProvider(ctx, secretGenerator)
+	}
+}
+
+// currentGenerator returns the provider's generator with the settings of the last loaded config file, false if the
+// config no longer has the provider
+func (c *controller) currentGenerator(name string) (SecretGenerator, bool) {
+	for _, sg := range getSecretGenerators(c) {
+		if sg.Name == name {
+			return sg, true
+		}
+	}
+	return SecretGenerator{}, false
+}
+
+// nextRefresh returns how long to wait for the provider's next refresh: its jittered refresh interval, or
+// --stale-retry-interval after a failed refresh but no less than the provider's minimum refresh interval, shortened
+// so the tokens are replaced expiryRefreshMargin before the earliest of them expires
+func (c *controller) nextRefresh(secretGenerator SecretGenerator, now time.Time) time.Duration {
+	next := jitter(secretGenerator.RefreshInterval, secretGenerator.RefreshJitter)
+	if retry := *argStaleRetryInterval; retry > 0 && c.isStale(secretGenerator.Name) {
+		if retry < secretGenerator.MinRefreshInterval {
+			retry = secretGenerator.MinRefreshInterval
+		}
+		if retry < next {
+			log.Infof("Retrying provider %s in %s while its cached credentials are served", secretGenerator.Name, retry)
+			next = retry
+		}
+	}
+
+	c.secretsLock.Lock()
+	expiry := providers.EarliestExpiry(c.tokens[secretGenerator.SecretName])
+	c.secretsLock.Unlock()
+	if expiry.IsZero() {
+		return next
+	}
+	untilExpiry := expiry.Sub(now) - expiryRefreshMargin
+	if untilExpiry < minExpiryRefresh {
+		untilExpiry = minExpiryRefresh
+	}
+	if untilExpiry < next {
+		log.Infof("Refreshing provider %s in %s, before its tokens expire at %s", secretGenerator.Name, untilExpiry.Round(time.Second), expiry.UTC().Format(time.RFC3339))
+		return untilExpiry
+	}
+	return next
+}
+
+// minRefreshInterval returns the minimum refresh interval the provider name declares, see providers.MinRefresher
+func (c *controller) minRefreshInterval(cfg *Config, name string) time.Duration {
+	switch name {
+	case providerECR:
+		return providers.ECRMinRefreshInterval
+	case providerFake:
+		if c.fake != nil {
+			return providers.MinRefreshInterval(c.fake)
+		}
+	case providerFile:
+		if c.tokenFiles != nil {
+			return providers.MinRefreshInterval(c.tokenFiles)
+		}
+	}
+	if p := cfg.provider(name); p != nil && p.ECR != nil {
+		return providers.ECRMinRefreshInterval
+	}
+	return 0
+}
+
+// clampRefreshInterval raises a refresh interval shorter than the minimum the provider declares to that minimum. The
+// warning is logged once per provider and configured interval, as the generators are built again on every use.
+func (c *controller) clampRefreshInterval(secretGenerator *SecretGenerator) {
+	if secretGenerator.RefreshInterval >= secretGenerator.MinRefreshInterval {
+		return
+	}
+	c.clampLock.Lock()
+	if c.clampWarned == nil {
+		c.clampWarned = map[string]time.Duration{}
+	}
+	if c.clampWarned[secretGenerator.Name] != secretGenerator.RefreshInterval {
+		c.clampWarned[secretGenerator.Name] = secretGenerator.RefreshInterval
+		log.Warnf("The refresh interval %s of provider %s is shorter than the minimum of %s the provider allows; refreshing every %s",
+			secretGenerator.RefreshInterval, secretGenerator.Name, secretGenerator.MinRefreshInterval, secretGenerator.MinRefreshInterval)
+	}
+	c.clampLock.Unlock()
+	secretGenerator.RefreshInterval = secretGenerator.MinRefreshInterval
+}
+
+// jitter returns a duration between d and d + factor*d; a factor of 0 disables jitter
+func jitter(d time.Duration, factor float64) time.Duration {
+	if factor <= 0 {
+		return d
+	}
+	return wait.Jitter(d, factor)
+}
+
+// namespaceDelay returns a random delay below --namespace-jitter to spread writes across namespaces
+func namespaceDelay() time.Duration {
+	if *argNamespaceJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(*argNamespaceJitter)))
+}
+
+// refreshProvider fetches a new token for a single provider and pushes the secret to every managed namespace
+func (c *controller) refreshProvider(ctx context.Context, secretGenerator SecretGenerator) {
+	start := time.Now()
+	previous := c.cachedSecrets(secretGenerator.SecretName)
+	secrets, pending, err := c.fetchSecret(ctx, secretGenerator)
+	if err != nil {
+		log.Errorf("Error generating secret for provider %s. Skipping secret provider until the next refresh cycle! [Err: %s]", secretGenerator.Name, err)
+		return
+	}
+	if pending == nil {
+		// keep the previously distributed secrets rather than replacing them with an empty one
+		return
+	}
+	// with canaries, the rotation is only committed once they verified it; until then every other namespace, including
+	// those the reconciler syncs meanwhile, gets the previous secrets
+	canaryRotation := len(*argCanaryNamespaces) > 0
+	if !canaryRotation {
+		c.commitRotation(ctx, pending)
+	}
+	if writesPaused() {
+		log.Warnf("Fetched new credentials of provider %s, but writes are paused by %s", secretGenerator.Name, *argPauseFile)
+		return
+	}
+
+	c.startRollout(secretGenerator.Name, start)
+	defer c.finishRollout(secretGenerator.Name)
+	listed := time.Now()
+	namespaces, err := c.k8sutil.GetNamespaces(ctx)
+	if err != nil {
+		log.Errorf("Could not list namespaces to refresh provider %s! [Err: %s]", secretGenerator.Name, err)
+		return
+	}
+	if output, ok := c.output.(*yamlOutput); ok {
+		output.prune(namespaces.Items, listed)
+	}
+
+	var targets []*v1.Namespace
+	counts := map[string]int{}
+	defer reportCycleNamespaces(secretGenerator, counts)
+	for i := range namespaces.Items {
+		ns := &namespaces.Items[i]
+		if reason := c.skipReason(ns); reason != "" {
+			counts[reason]++
+			continue
+		}
+		if !secretGenerator.selects(ns) {
+			counts[cycleNotSelected]++
+			continue
+		}
+		targets = append(targets, ns)
+	}
+	counts[cycleManaged] = len(targets)
+	warnSlowDrain(secretGenerator, len(targets)*len(secrets))
+
+	canaries, rest := splitCanaries(targets)
+	if len(canaries) > 0 {
+		c.setCanarySecrets(secretGenerator.SecretName, secrets)
+	}
+	updated, failed := c.syncTargets(ctx, canaries, secrets)
+	counts[cycleFailed] = len(failed)
+	if len(canaries) > 0 {
+		err := c.verifyCanaries(ctx, secretGenerator, pending.tokens, canaries, failed)
+		c.setCanarySecrets(secretGenerator.SecretName, nil)
+		if err != nil {
+			log.Errorf("Canary rotation of provider %s failed; not rolling out to the other %d namespaces! [Err: %s]", secretGenerator.Name, len(rest), err)
+			canaryFailures.WithLabelValues(secretGenerator.Name).Inc()
+			c.abortRotation(ctx, secretGenerator, canaries, previous)
+			return
+		}
+		log.Infof("Canary rotation of provider %s succeeded; rolling out to the other %d namespaces", secretGenerator.Name, len(rest))
+	}
+	if canaryRotation {
+		// verified, or none of the canary namespaces gets the provider's secrets
+		c.commitRotation(ctx, pending)
+	}
+	restUpdated, restFailed := c.syncByPriority(ctx, secretGenerator, rest, secrets)
+	updated, failed = append(updated, restUpdated...), append(failed, restFailed...)
+	counts[cycleFailed] = len(failed)
+	managedNamespaces.Set(float64(len(targets)))
+	syncCycleDuration.WithLabelValues(secretGenerator.Name).Observe(time.Since(start).Seconds())
+
+	secretNames := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		secretNames = append(secretNames, secret.Name)
+	}
+	c.emitRotation(ctx, c.newRotationEvent(secretGenerator, secretNames, updated, failed))
+	log.Infof("Finished refreshing provider %s", secretGenerator.Name)
+}
+
+// syncTargets writes the secrets into each namespace and returns the namespaces that were updated and that failed
+func (c *controller) syncTargets(ctx context.Context, targets []*v1.Namespace, secrets []*v1.Secret) ([]string, []string) {
+	updated, failed := []string{}, []string{}
+	for _, ns := range targets {
+		if delay := namespaceDelay(); delay > 0 {
+			select {
+			case <-ctx.Done():
+				return updated, failed
+			case <-time.After(delay):
+			}
+		}
+		nsStart := time.Now()
+		var errs []error
+		for _, secret := range secrets {
+			errs = append(errs, c.syncNamespace(ctx, ns, secret))
+		}
+		err := utilerrors.NewAggregate(errs)
+		observeNamespaceSync(syncTriggerRefresh, nsStart, err)
+		if err != nil {
+			failed = append(failed, ns.Name)
+		} else {
+			updated = append(updated, ns.Name)
+		}
+	}
+	return updated, failed
+}
+
+// writeDrainTime returns how long the write limit takes to admit the given number of writes, 0 without a limit
+func writeDrainTime(writes int) time.Duration {
+	if *argKubeAPIWriteQPS <= 0 {
+		return 0
+	}
+	return time.Duration(float64(writes) / float64(*argKubeAPIWriteQPS) * float64(time.Second))
+}
+
+// warnSlowDrain logs when the write limit cannot push a refresh to every namespace within the provider's refresh
+// interval; the secrets of the last namespaces would then be older than the interval
+func warnSlowDrain(secretGenerator SecretGenerator, writes int) {
+	drain := writeDrainTime(writes)
+	if drain > secretGenerator.RefreshInterval {
+		log.Warnf("Refreshing provider %s needs at least %d writes, which take %s at --kube-api-write-qps=%v, longer than its %s refresh interval",
+			secretGenerator.Name, writes, drain.Round(time.Second), *argKubeAPIWriteQPS, secretGenerator.RefreshInterval)
+	}
+}
+
+func (c *controller) syncNamespace(ctx context.Context, ns *v1.Namespace, secret *v1.Secret) error {
+	c.syncLock.Lock()
+	defer c.syncLock.Unlock()
+
+	err := c.processNamespace(ctx, ns, secret)
+	c.status.record(ns.Name, secret, err)
+	if err != nil {
+		log.Errorf("error processing secret for namespace %s, secret %s: %s", ns.Name, secret.Name, err)
+	}
+	return err
+}
+
+// skipNamespace reports whether a refresh leaves the namespace alone, decided before any secret is generated for it
+func (c *controller) skipNamespace(ns *v1.Namespace) bool {
+	return c.skipReason(ns) != ""
+}
+
+// the namespace states of a refresh cycle besides the skip reasons
+const (
+	cycleManaged     = "managed"
+	cycleFailed      = "failed"
+	cycleNotSelected = "not_selected"
+)
+
+// cycleStates are all states reported per refresh cycle with their wording, in the order of the summary line
+var cycleStates = []struct{ state, summary string }{
+	{cycleManaged, "managed"},
+	{cycleFailed, "failed"},
+	{skipExcludedName, "excluded by name"},
+	{skipExcludedLabel, "excluded by label"},
+	{skipNotOptedIn, "not opted in"},
+	{skipSystem, "system"},
+	{skipTerminating, "terminating"},
+	{cycleNotSelected, "not selected"},
+}
+
+// reportCycleNamespaces logs how many namespaces a refresh of the provider managed, failed and skipped and why, and
+// exports the counts; states without namespaces are reset to 0
+func reportCycleNamespaces(secretGenerator SecretGenerator, counts map[string]int) {
+	parts := make([]string, 0, len(cycleStates))
+	for _, s := range cycleStates {
+		cycleNamespaces.WithLabelValues(secretGenerator.Name, s.state).Set(float64(counts[s.state]))
+		parts = append(parts, fmt.Sprintf("%d %s", counts[s.state], s.summary))
+	}
+	log.Infof("Namespaces of provider %s: %s", secretGenerator.Name, strings.Join(parts, ", "))
+}
+
+var (
+	errNotLeading     = errors.New("not leading, only the leader refreshes the providers")
+	errRefreshRunning = errors.New("a triggered refresh is already in progress")
+)
+
+// setLeaderContext records the context of the leader's runnable for the refreshes triggered while it runs
+func (c *controller) setLeaderContext(ctx context.Context) {
+	c.leaderLock.Lock()
+	defer c.leaderLock.Unlock()
+	c.leaderCtx = ctx
+}
+
+// leaderContext returns the context of the leader's runnable, nil if this replica does not lead (yet or any more)
+func (c *controller) leaderContext() context.Context {
+	c.leaderLock.Lock()
+	defer c.leaderLock.Unlock()
+	if c.leaderCtx == nil || c.leaderCtx.Err() != nil {
+		return nil
+	}
+	return c.leaderCtx
+}
+
+// triggerRefresh refreshes every provider concurrently in the background, within the leader's context. It returns
+// errNotLeading before the leader's runnable started or after it stopped, and errRefreshRunning if a triggered
+// refresh is still running.
+func (c *controller) triggerRefresh() error {
+	ctx := c.leaderContext()
+	if ctx == nil {
+		return errNotLeading
+	}
+	if !atomic.CompareAndSwapInt32(&c.triggered, 0, 1) {
+		return errRefreshRunning
+	}
+	go func() {
+		defer atomic.StoreInt32(&c.triggered, 0)
+		var wg sync.WaitGroup
+		for _, secretGenerator := range getSecretGenerators(c) {
+			wg.Add(1)
+			go func(secretGenerator SecretGenerator) {
+				defer wg.Done()
+				c.refreshProvider(ctx, secretGenerator)
+			}(secretGenerator)
+		}
+		wg.Wait()
+	}()
+	return nil
+}
+
+func (c *controller) refreshRunning() bool {
+	return atomic.LoadInt32(&c.triggered) == 1
+}
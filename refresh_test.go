@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	"github.com/doddle/registry-creds/pkg/providers"
+)
+
+func TestJitter(t *testing.T) {
+	assert.Equal(t, time.Hour, jitter(time.Hour, 0))
+
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Hour, 0.1)
+		assert.GreaterOrEqual(t, d, time.Hour)
+		assert.LessOrEqual(t, d, 66*time.Minute)
+	}
+}
+
+func TestNamespaceDelay(t *testing.T) {
+	defer func(d time.Duration) { *argNamespaceJitter = d }(*argNamespaceJitter)
+
+	*argNamespaceJitter = 0
+	assert.Equal(t, time.Duration(0), namespaceDelay())
+
+	*argNamespaceJitter = time.Second
+	for i := 0; i < 100; i++ {
+		assert.Less(t, namespaceDelay(), time.Second)
+	}
+}
+
+func TestSyncTargetsStopsWaitingWhenCancelled(t *testing.T) {
+	defer func(d time.Duration) { *argNamespaceJitter = d }(*argNamespaceJitter)
+	*argNamespaceJitter = time.Hour
+	c := newFakeController()
+	secrets := c.generateSecrets(context.TODO())
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+
+	start := time.Now()
+	updated, failed := c.syncTargets(ctx, []*v1.Namespace{{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}}, secrets)
+	assert.Less(t, time.Since(start), time.Minute)
+	assert.Empty(t, updated)
+	assert.Empty(t, failed)
+}
+
+func TestRefreshProviderDistributesToAllNamespaces(t *testing.T) {
+	c := newFakeController()
+
+	c.refreshProvider(context.TODO(), getSecretGenerators(c)[0])
+
+	assertAllExpectedSecrets(t, c)
+	assertExpectedSecretNumber(t, c, 1)
+}
+
+func TestRefreshProviderRecordsSyncMetrics(t *testing.T) {
+	c := newFakeController()
+	sg := getSecretGenerators(c)[0]
+
+	c.refreshProvider(context.TODO(), sg)
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(managedNamespaces))
+	assert.Equal(t, 1, testutil.CollectAndCount(syncCycleDuration, "registry_creds_sync_cycle_duration_seconds"))
+	assert.GreaterOrEqual(t, testutil.CollectAndCount(namespaceSyncDuration), 1)
+}
+
+func TestRefreshProviderCountsNamespaces(t *testing.T) {
+	c := newFakeController()
+	sg := getSecretGenerators(c)[0]
+	c.k8sutil.ExcludedNamespaces = []string{"namespace1"}
+	now := metav1.Now()
+	c.k8sutil.Kclient.(*fakeKubeClient).namespaces.store["leaving"] = v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "leaving", DeletionTimestamp: &now}}
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(io.Discard)
+
+	c.refreshProvider(context.TODO(), sg)
+
+	for state, count := range map[string]float64{cycleManaged: 1, cycleFailed: 0, skipExcludedName: 1, skipSystem: 1, skipTerminating: 1, cycleNotSelected: 0} {
+		assert.Equal(t, count, testutil.ToFloat64(cycleNamespaces.WithLabelValues(sg.Name, state)), state)
+	}
+	assert.Contains(t, out.String(), "Namespaces of provider "+sg.Name+": 1 managed, 0 failed, 1 excluded by name, 0 excluded by label, 0 not opted in, 1 system, 1 terminating, 0 not selected")
+}
+
+// countingLimiter admits every write and counts them, or rejects them all with err
+type countingLimiter struct {
+	waits int
+	err   error
+}
+
+func (l *countingLimiter) TryAccept() bool { return true }
+func (l *countingLimiter) Accept()         {}
+func (l *countingLimiter) Stop()           {}
+func (l *countingLimiter) QPS() float32    { return 1 }
+func (l *countingLimiter) Wait(ctx context.Context) error {
+	l.waits++
+	return l.err
+}
+
+func TestRefreshProviderWaitsForWriteLimiter(t *testing.T) {
+	c := newFakeController()
+	limiter := &countingLimiter{}
+	c.k8sutil.WriteLimiter = limiter
+
+	c.refreshProvider(context.TODO(), getSecretGenerators(c)[0])
+
+	// a secret and a ServiceAccount update in each of the two namespaces, and the persisted tokens
+	assert.Equal(t, 5, limiter.waits)
+	assertAllExpectedSecrets(t, c)
+
+	limiter.err = context.DeadlineExceeded
+	err := c.k8sutil.DeleteSecret(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = c.k8sutil.GetSecret(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+}
+
+func TestThrottledWritesBackOffAndRetry(t *testing.T) {
+	c := newFakeController()
+	var delays []time.Duration
+	c.k8sutil.Throttle = &k8sutil.Throttle{Retries: 1, OnThrottle: func(source string, delay time.Duration) {
+		assert.Equal(t, k8sutil.ThrottledByServer, source)
+		delays = append(delays, delay)
+	}}
+	secrets := c.k8sutil.Kclient.(*fakeKubeClient).secrets["namespace1"]
+	secrets.createErrs = []error{apierrors.NewTooManyRequests("slow down", 1)}
+
+	start := time.Now()
+	assert.Nil(t, c.k8sutil.CreateSecret(context.TODO(), "namespace1", &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "retried"}}))
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.Equal(t, []time.Duration{time.Second}, delays)
+	assert.Contains(t, secrets.store, "retried")
+
+	// once the retries are used up the 429 is returned
+	c.k8sutil.Throttle.Retries = 0
+	secrets.createErrs = []error{apierrors.NewTooManyRequests("slow down", 0)}
+	err := c.k8sutil.CreateSecret(context.TODO(), "namespace1", &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "throttled"}})
+	assert.True(t, apierrors.IsTooManyRequests(err))
+	assert.NotContains(t, secrets.store, "throttled")
+
+	// every other write waits for the backoff
+	start = time.Now()
+	assert.Nil(t, c.k8sutil.DeleteSecret(context.TODO(), "namespace1", "retried"))
+	assert.Greater(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestTransientWriteFailuresAreRetried(t *testing.T) {
+	c := newFakeController()
+	retries := 0
+	c.k8sutil.WriteRetry = &k8sutil.WriteRetry{Retries: 2, InitialBackoff: time.Millisecond, OnRetry: func(error) { retries++ }}
+	secrets := c.k8sutil.Kclient.(*fakeKubeClient).secrets["namespace1"]
+
+	secrets.createErrs = []error{apierrors.NewServiceUnavailable("restarting"), apierrors.NewInternalError(errors.New("etcdserver: leader changed"))}
+	assert.Nil(t, c.k8sutil.CreateSecret(context.TODO(), "namespace1", &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "retried"}}))
+	assert.Equal(t, 2, retries)
+	assert.Contains(t, secrets.store, "retried")
+
+	// errors a retry cannot fix are returned at once
+	secrets.createErrs = []error{apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "denied", errors.New("RBAC"))}
+	err := c.k8sutil.CreateSecret(context.TODO(), "namespace1", &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "denied"}})
+	assert.True(t, apierrors.IsForbidden(err))
+	assert.Equal(t, 2, retries)
+}
+
+func TestObserveThrottle(t *testing.T) {
+	defer kubeAPIThrottled.DeleteLabelValues(k8sutil.ThrottledByClient)
+	defer kubeAPIThrottledSeconds.DeleteLabelValues(k8sutil.ThrottledByClient)
+
+	observeThrottle(k8sutil.ThrottledByClient, 1500*time.Millisecond)
+	assert.Equal(t, float64(1), testutil.ToFloat64(kubeAPIThrottled.WithLabelValues(k8sutil.ThrottledByClient)))
+	assert.Equal(t, 1.5, testutil.ToFloat64(kubeAPIThrottledSeconds.WithLabelValues(k8sutil.ThrottledByClient)))
+}
+
+func TestWriteDrainTime(t *testing.T) {
+	defer func() { *argKubeAPIWriteQPS = 0 }()
+	assert.Equal(t, time.Duration(0), writeDrainTime(5000))
+
+	*argKubeAPIWriteQPS = 20
+	assert.Equal(t, 250*time.Second, writeDrainTime(5000))
+}
+
+func TestRecordTokenExpiry(t *testing.T) {
+	now := time.Date(2022, 9, 1, 10, 30, 0, 0, time.UTC)
+	sg := SecretGenerator{Name: "test-expiry", RefreshInterval: time.Hour}
+	defer tokenExpiry.DeleteLabelValues(sg.Name)
+
+	recordTokenExpiry(sg, []AuthToken{{ExpiresAt: now.Add(12 * time.Hour)}, {ExpiresAt: now.Add(6 * time.Hour)}}, now)
+	assert.Equal(t, float64(now.Add(6*time.Hour).Unix()), testutil.ToFloat64(tokenExpiry.WithLabelValues(sg.Name)))
+
+	// a provider that does not report an expiry has no series
+	recordTokenExpiry(sg, []AuthToken{{}}, now)
+	assert.False(t, tokenExpiry.DeleteLabelValues(sg.Name))
+}
+
+func TestNextRefreshBeforeExpiry(t *testing.T) {
+	now := time.Date(2022, 9, 1, 10, 30, 0, 0, time.UTC)
+	c := newFakeController()
+	sg := SecretGenerator{Name: "test", SecretName: "test", RefreshInterval: 6 * time.Hour}
+	assert.Equal(t, 6*time.Hour, c.nextRefresh(sg, now))
+
+	c.tokens[sg.SecretName] = []AuthToken{{ExpiresAt: now.Add(12 * time.Hour)}}
+	assert.Equal(t, 6*time.Hour, c.nextRefresh(sg, now))
+
+	c.tokens[sg.SecretName] = []AuthToken{{ExpiresAt: now.Add(time.Hour)}}
+	assert.Equal(t, time.Hour-expiryRefreshMargin, c.nextRefresh(sg, now))
+
+	c.tokens[sg.SecretName] = []AuthToken{{ExpiresAt: now.Add(-time.Hour)}}
+	assert.Equal(t, minExpiryRefresh, c.nextRefresh(sg, now))
+}
+
+func TestRefreshIntervalClampedToProviderMinimum(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(io.Discard)
+	defer func(minutes int) { *argRefreshMinutes = minutes }(*argRefreshMinutes)
+	*argRefreshMinutes = 1
+	c := newFakeController()
+	c.fake = &providers.Fake{MinRefresh: 10 * time.Minute}
+
+	sg := getSecretGenerators(c)[0]
+	assert.Equal(t, 10*time.Minute, sg.RefreshInterval)
+	assert.Equal(t, 10*time.Minute, sg.MinRefreshInterval)
+	getSecretGenerators(c)
+	assert.Equal(t, 1, strings.Count(out.String(), "The refresh interval 1m0s of provider fake is shorter than the minimum of 10m0s"))
+
+	// a config file interval is clamped alike, and warned about once more
+	c.config = &Config{Providers: []ProviderConfig{{Name: providerFake, RefreshInterval: &metav1.Duration{Duration: 5 * time.Minute}}}}
+	assert.Equal(t, 10*time.Minute, getSecretGenerators(c)[0].RefreshInterval)
+	assert.Contains(t, out.String(), "The refresh interval 5m0s of provider fake")
+
+	// longer intervals and the ECR provider's default are kept
+	*argRefreshMinutes = 60
+	c = newFakeController()
+	sg = getSecretGenerators(c)[0]
+	assert.Equal(t, time.Hour, sg.RefreshInterval)
+	assert.Equal(t, providers.ECRMinRefreshInterval, sg.MinRefreshInterval)
+}
+
+func TestStaleRetryHonorsMinRefreshInterval(t *testing.T) {
+	c := newFakeController()
+	sg := SecretGenerator{Name: "rate-limited", SecretName: "rate-limited", RefreshInterval: time.Hour, MinRefreshInterval: 5 * time.Minute}
+	c.stale[sg.Name] = true
+	assert.Equal(t, 5*time.Minute, c.nextRefresh(sg, time.Now()))
+
+	sg.MinRefreshInterval = 0
+	assert.Equal(t, *argStaleRetryInterval, c.nextRefresh(sg, time.Now()))
+}
+
+func TestGenerateSecretObjExpiresAt(t *testing.T) {
+	expiry := time.Date(2022, 9, 1, 22, 30, 0, 0, time.UTC)
+	sg := SecretGenerator{Name: providerECR, SecretName: "awsecr-cred", IsJSONCfg: true}
+	secret, err := generateSecretObj([]AuthToken{{AccessToken: "token", Endpoint: "https://registry.example.com", ExpiresAt: expiry}}, sg)
+	assert.Nil(t, err)
+	assert.Equal(t, "2022-09-01T22:30:00Z", secret.Annotations[expiresAtAnnotation])
+}
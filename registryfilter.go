@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// matchesRegistry reports whether the registry host matches one of the host patterns, ignoring case
+func matchesRegistry(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// registryAllowed reports whether a provider's registry host passes --registry-allowlist and --registry-denylist; a
+// host on both lists is denied
+func registryAllowed(host string) bool {
+	if len(*argRegistryAllowlist) > 0 && !matchesRegistry(*argRegistryAllowlist, host) {
+		return false
+	}
+	return !matchesRegistry(*argRegistryDenylist, host)
+}
+
+// filterRegistries drops the tokens of the registries the allow and deny lists filter out, before anything is
+// generated from them
+func filterRegistries(provider string, tokens []AuthToken) []AuthToken {
+	if len(*argRegistryAllowlist) == 0 && len(*argRegistryDenylist) == 0 {
+		return tokens
+	}
+	result := make([]AuthToken, 0, len(tokens))
+	for _, token := range tokens {
+		if registryAllowed(token.Host()) {
+			result = append(result, token)
+			continue
+		}
+		log.Debugf("Leaving registry %s of provider %s out, it is filtered by --registry-allowlist or --registry-denylist", token.Host(), provider)
+	}
+	if len(tokens) > 0 && len(result) == 0 {
+		log.Warnf("Every registry of provider %s is filtered by --registry-allowlist or --registry-denylist; its secret holds no credentials", provider)
+	}
+	return result
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterRegistries(t *testing.T) {
+	defer func(allow, deny []string) { *argRegistryAllowlist, *argRegistryDenylist = allow, deny }(*argRegistryAllowlist, *argRegistryDenylist)
+
+	tokens := []AuthToken{
+		{Endpoint: "https://123456789012.dkr.ecr.eu-west-1.amazonaws.com"},
+		{Endpoint: "https://210987654321.dkr.ecr.us-east-1.amazonaws.com"},
+		{Endpoint: "https://registry.example.com"},
+	}
+	assert.Equal(t, tokens, filterRegistries(providerECR, tokens))
+
+	*argRegistryAllowlist = []string{"*.DKR.ECR.*.amazonaws.com"}
+	assert.Equal(t, tokens[:2], filterRegistries(providerECR, tokens))
+
+	// the denylist wins over the allowlist
+	*argRegistryDenylist = []string{"210987654321.*"}
+	assert.Equal(t, tokens[:1], filterRegistries(providerECR, tokens))
+
+	*argRegistryAllowlist = nil
+	assert.Equal(t, []AuthToken{tokens[0], tokens[2]}, filterRegistries(providerECR, tokens))
+}
+
+func TestFetchTokensFiltersRegistries(t *testing.T) {
+	defer func(deny []string) { *argRegistryDenylist = deny }(*argRegistryDenylist)
+	*argRegistryDenylist = []string{"fakeendpoint"}
+
+	c := newFakeController()
+	tokens, err := fetchTokens(context.TODO(), getSecretGenerators(c)[0])
+	assert.Nil(t, err)
+	assert.Empty(t, tokens)
+}
+
+func TestValidateParamsRegistryFilters(t *testing.T) {
+	defer func(allow, deny []string) { *argRegistryAllowlist, *argRegistryDenylist = allow, deny }(*argRegistryAllowlist, *argRegistryDenylist)
+
+	*argRegistryAllowlist = []string{"*.example.com", "registry-["}
+	*argRegistryDenylist = []string{"["}
+	_, problems := validateParams()
+	assert.Equal(t, []string{"*.example.com"}, *argRegistryAllowlist)
+	assert.Empty(t, *argRegistryDenylist)
+	assert.False(t, problems.fatal())
+
+	*argRegistryAllowlist = []string{"registry-["}
+	_, problems = validateParams()
+	assert.Contains(t, problemStrings(problems), `flag --registry-allowlist="registry-[": no valid pattern`)
+	assert.True(t, problems.fatal())
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// awsSettings are the region, assumed role and accounts the ecr provider uses, see Config.awsSettings
+type awsSettings struct {
+	Region         string
+	AssumeRole     string
+	AccountIDs     []string
+	AccountRegions map[string]string
+	AccountRoles   map[string]string
+}
+
+// runConfigReloader checks --config every --config-reload-period and applies its changes; a ConfigMap mount is
+// updated in place by the kubelet, so editing the ConfigMap reconfigures the controller without a restart
+func (c *controller) runConfigReloader(ctx context.Context) {
+	if *argConfigFile == "" || *argConfigReloadPeriod <= 0 {
+		return
+	}
+	// compared with the config the controller runs with, so an edit made before it became leader is applied too
+	last := c.currentConfig().checksum
+	ticker := time.NewTicker(*argConfigReloadPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		sum, err := configChecksum(*argConfigFile)
+		if err != nil || sum == last {
+			continue
+		}
+		if c.reloadConfig() == nil {
+			last = c.currentConfig().checksum
+		}
+	}
+}
+
+func configChecksum(path string) ([sha256.Size]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+// reloadConfig loads --config again, rebuilds the AWS clients from it and refreshes every provider. An invalid file,
+// or one whose clients cannot be created, keeps the previous configuration.
+func (c *controller) reloadConfig() error {
+	cfg, err := loadConfig(*argConfigFile)
+	if err == nil {
+		err = checkProviderTLS(cfg)
+	}
+	var ecrClient ecrInterface
+	var regionalEcrClient func(region, role string) ecrInterface
+	if err == nil && c.newECRClients != nil {
+		ecrClient, regionalEcrClient, err = c.newECRClients(cfg)
+	}
+	if err != nil {
+		log.Errorf("Could not reload config file %s, keeping the previous configuration! [Err: %s]", *argConfigFile, err)
+		return err
+	}
+
+	c.reloadLock.Lock()
+	previous := c.config.awsSettings(c.defaults)
+	c.config = cfg
+	if c.newECRClients != nil {
+		c.ecrClient, c.newRegionalEcrClient = ecrClient, regionalEcrClient
+		c.ecrClientsLock.Lock()
+		c.ecrClients = map[string]ecrInterface{}
+		c.ecrClientsLock.Unlock()
+	}
+	c.reloadLock.Unlock()
+
+	warnInsecureTokenExchange(cfg)
+	if current := cfg.awsSettings(c.defaults); !reflect.DeepEqual(previous, current) {
+		log.Infof("AWS settings changed: region %s, assume role '%s', accounts %s", current.Region, current.AssumeRole, strings.Join(current.AccountIDs, ","))
+	}
+	if ctx := c.leaderContext(); ctx != nil {
+		// providers added or removed by the file get or lose their timer
+		c.startProviderRefresh(ctx)
+	}
+	switch c.triggerRefresh() {
+	case nil:
+		log.Infof("Reloaded config file %s; refreshing every provider", *argConfigFile)
+	case errRefreshRunning:
+		log.Infof("Reloaded config file %s; a refresh is already running, the next one uses the new configuration", *argConfigFile)
+	default:
+		log.Infof("Reloaded config file %s; the providers are refreshed with it once this replica leads", *argConfigFile)
+	}
+	return nil
+}
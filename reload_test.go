@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadConfigRebuildsECRClients(t *testing.T) {
+	defer func(path string) { *argConfigFile = path }(*argConfigFile)
+	*argConfigFile = writeConfig(t, `
+providers:
+  - name: ecr
+    aws:
+      region: eu-west-1
+      assumeRole: arn:aws:iam::210987654321:role/registry-creds
+      accountIDs: ["210987654321"]
+`)
+	c := newController(newKubeUtil(), &regionEcrClient{region: *argAWSRegion})
+	built := 0
+	c.newECRClients = func(cfg *Config) (ecrInterface, func(region, role string) ecrInterface, error) {
+		built++
+		return &regionEcrClient{region: cfg.awsSettings(c.defaults).Region}, func(region, role string) ecrInterface {
+			return &regionEcrClient{region: region}
+		}, nil
+	}
+
+	assert.Nil(t, c.reloadConfig())
+	assert.Eventually(t, func() bool { return !c.refreshRunning() }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, built)
+	assert.Equal(t, "arn:aws:iam::210987654321:role/registry-creds", c.currentConfig().awsSettings(c.defaults).AssumeRole)
+
+	tokens, err := c.getECRAuthorizationKey(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 1)
+	assert.Equal(t, "https://210987654321.dkr.ecr.eu-west-1.amazonaws.com", tokens[0].Endpoint)
+}
+
+func TestReloadConfigKeepsPreviousOnError(t *testing.T) {
+	defer func(path string) { *argConfigFile = path }(*argConfigFile)
+	*argConfigFile = writeConfig(t, `
+providers:
+  - name: ecr
+    aws:
+      region: eu-west-1
+`)
+	c := newFakeController()
+	assert.Nil(t, c.reloadConfig())
+	assert.Eventually(t, func() bool { return !c.refreshRunning() }, time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, os.WriteFile(*argConfigFile, []byte("providers: [{name: gitlab}]"), 0o600))
+	assert.NotNil(t, c.reloadConfig())
+	assert.Equal(t, "eu-west-1", c.currentConfig().awsSettings(c.defaults).Region)
+}
+
+func TestReloadConfigKeepsPreviousOnBadCertificate(t *testing.T) {
+	defer func(path string) { *argConfigFile = path }(*argConfigFile)
+	*argConfigFile = writeConfig(t, `
+providers:
+  - name: ecr
+    aws:
+      region: eu-west-1
+`)
+	c := newFakeController()
+	assert.Nil(t, c.reloadConfig())
+	assert.Eventually(t, func() bool { return !c.refreshRunning() }, time.Second, 10*time.Millisecond)
+
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(*argConfigFile, []byte(`
+providers:
+  - name: ecr
+    aws:
+      region: us-east-1
+    tls:
+      certFile: `+filepath.Join(dir, "missing.crt")+`
+      keyFile: `+filepath.Join(dir, "missing.key")+`
+`), 0o600))
+	_, err := loadConfig(*argConfigFile)
+	assert.Nil(t, err)
+	assert.NotNil(t, c.reloadConfig())
+	assert.Equal(t, "eu-west-1", c.currentConfig().awsSettings(c.defaults).Region)
+}
+
+func TestConfigReloaderAppliesEditsMadeBeforeItStarted(t *testing.T) {
+	defer func(path string, period time.Duration) {
+		*argConfigFile, *argConfigReloadPeriod = path, period
+	}(*argConfigFile, *argConfigReloadPeriod)
+	*argConfigFile = writeConfig(t, `
+providers:
+  - name: ecr
+    aws:
+      region: eu-west-1
+`)
+	*argConfigReloadPeriod = 10 * time.Millisecond
+	c := newFakeController()
+	cfg, err := loadConfig(*argConfigFile)
+	assert.Nil(t, err)
+	c.config = cfg
+
+	// edited while the replica was waiting for the leadership
+	assert.Nil(t, os.WriteFile(*argConfigFile, []byte("providers: [{name: ecr, aws: {region: us-east-1}}]"), 0o600))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.runConfigReloader(ctx)
+	assert.Eventually(t, func() bool {
+		return c.currentConfig().awsSettings(c.defaults).Region == "us-east-1"
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	assert.Eventually(t, func() bool { return !c.refreshRunning() }, time.Second, 10*time.Millisecond)
+}
+
+func TestAWSSettingsDefaultToFlags(t *testing.T) {
+	settings := (&Config{}).awsSettings(newProviderDefaults())
+	assert.Equal(t, *argAWSRegion, settings.Region)
+	assert.Equal(t, *argAWSAssumeRole, settings.AssumeRole)
+	assert.Equal(t, []string{""}, settings.AccountIDs)
+}
+
+func TestReloadConfigStartsAndStopsProviderTimers(t *testing.T) {
+	defer func(path string) { *argConfigFile = path }(*argConfigFile)
+	*argConfigFile = writeConfig(t, "providers: [{name: ecr}]")
+	c := newFakeController()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.setLeaderContext(ctx)
+	timer := func(name string) *providerTimer {
+		c.refreshTimersLock.Lock()
+		defer c.refreshTimersLock.Unlock()
+		return c.refreshTimers[name]
+	}
+
+	c.startProviderRefresh(ctx)
+	ecr := timer(providerECR)
+	assert.NotNil(t, ecr)
+	assert.Nil(t, timer("ecr-prod"))
+
+	// a provider added by the file gets its own timer, the others keep theirs
+	assert.Nil(t, os.WriteFile(*argConfigFile, []byte(ecrInstancesConfig), 0o600))
+	assert.Nil(t, c.reloadConfig())
+	assert.Eventually(t, func() bool { return !c.refreshRunning() }, time.Second, 10*time.Millisecond)
+	prod := timer("ecr-prod")
+	assert.NotNil(t, prod)
+	assert.NotNil(t, timer("ecr-dev"))
+	assert.Same(t, ecr, timer(providerECR))
+
+	// one removed from it loses its timer
+	assert.Nil(t, os.WriteFile(*argConfigFile, []byte("providers: [{name: ecr}]"), 0o600))
+	assert.Nil(t, c.reloadConfig())
+	assert.Eventually(t, func() bool { return !c.refreshRunning() }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, timer("ecr-prod"))
+	assert.Nil(t, timer("ecr-dev"))
+	assert.NotNil(t, prod.ctx.Err())
+	assert.Nil(t, ecr.ctx.Err())
+}
+
+func TestRunProviderRefreshStopsForRemovedProvider(t *testing.T) {
+	c := newFakeController()
+	done := make(chan struct{})
+	go func() {
+		c.runProviderRefresh(context.Background(), SecretGenerator{Name: "ecr-removed"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the refresh timer of a provider the config no longer has kept running")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+)
+
+const (
+	// formats a provider's tokens can additionally be rendered in
+	formatContainerdHosts = "containerd-hosts"
+	formatContainerdCRI   = "containerd-cri"
+	formatContainersAuth  = "containers-auth"
+	formatWindows         = "windows-containerd"
+
+	renderKindSecret    = "Secret"
+	renderKindConfigMap = "ConfigMap"
+
+	// containerdCRIKey holds the registry.configs auth sections of the containerd CRI plugin
+	containerdCRIKey = "registry-auth.toml"
+	// containersAuthKey holds the containers-auth.json file read by CRI-O, podman and skopeo
+	containersAuthKey = "auth.json"
+	// windowsKubeletKey holds the docker config the kubelet of a Windows node reads from its root directory
+	windowsKubeletKey = "config.json"
+	// windowsPathsKey maps every other key of the windows-containerd format to the file it belongs in on the node
+	windowsPathsKey = "paths.json"
+
+	// the default locations on Windows nodes; NTFS ignores the case of the paths
+	windowsKubeletConfig = `C:\var\lib\kubelet\config.json`
+	windowsCertsDir      = `C:\Program Files\containerd\certs.d`
+)
+
+// RendererConfig writes a provider's tokens in a non-docker format into a single ConfigMap or Secret, e.g. for a
+// DaemonSet that copies them onto the nodes
+type RendererConfig struct {
+	// Format is containerd-hosts (a hosts.toml per registry), containerd-cri (registry auth for the containerd CRI
+	// plugin config), containers-auth (containers-auth.json) or windows-containerd (the hosts.toml files and the
+	// kubelet's config.json of Windows nodes)
+	Format string `json:"format"`
+	// Kind of the object written, Secret (default) or ConfigMap
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+func (r RendererConfig) validate() error {
+	if r.Format != formatContainerdHosts && r.Format != formatContainerdCRI && r.Format != formatContainersAuth && r.Format != formatWindows {
+		return fmt.Errorf("unknown format %q, must be %s, %s, %s or %s", r.Format, formatContainerdHosts, formatContainerdCRI, formatContainersAuth, formatWindows)
+	}
+	if r.Kind != "" && r.Kind != renderKindSecret && r.Kind != renderKindConfigMap {
+		return fmt.Errorf("unknown kind %q, must be %s or %s", r.Kind, renderKindSecret, renderKindConfigMap)
+	}
+	if r.Namespace == "" || r.Name == "" {
+		return fmt.Errorf("renderer %s needs a namespace and a name", r.Format)
+	}
+	if errs := validation.IsDNS1123Subdomain(r.Name); len(errs) > 0 {
+		return fmt.Errorf("invalid name '%s' of renderer %s: %s", r.Name, r.Format, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// invalidKeyChars are the characters not allowed in ConfigMap and Secret keys
+var invalidKeyChars = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+
+// hostsKey returns the key of a registry's hosts.toml; the file belongs in /etc/containerd/certs.d/<host>/hosts.toml
+func hostsKey(host string) string {
+	return invalidKeyChars.ReplaceAllString(host, "_") + ".hosts.toml"
+}
+
+// windowsHostDir returns the directory below certs.d that containerd looks up a registry's hosts.toml in on Windows,
+// where a port is written as host_port_ since a path may not contain a colon
+func windowsHostDir(host string) string {
+	host = strings.ToLower(host)
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		return host[:i] + "_" + host[i+1:] + "_"
+	}
+	return host
+}
+
+// renderedRegistry is a single registry with its decoded credentials
+type renderedRegistry struct {
+	Endpoint string
+	Host     string
+	// Auth is base64(username:password)
+	Auth string
+}
+
+// renderedRegistries returns the registries of the tokens, sorted by host so the rendered files are stable
+func renderedRegistries(provider string, tokens []AuthToken, dockerConfig DockerConfigOptions) ([]renderedRegistry, error) {
+	var registries []renderedRegistry
+	for _, token := range tokens {
+		auth, err := newRegistryAuth(provider, token, dockerConfig)
+		if err != nil {
+			return nil, err
+		}
+		host := token.Host()
+		endpoint := token.Endpoint
+		if endpoint == host {
+			endpoint = "https://" + host
+		}
+		registries = append(registries, renderedRegistry{Endpoint: endpoint, Host: host, Auth: auth.Auth})
+	}
+	sort.Slice(registries, func(i, j int) bool { return registries[i].Host < registries[j].Host })
+	return registries, nil
+}
+
+// renderFormat returns the data keys of the tokens in the given format
+func renderFormat(format, provider string, tokens []AuthToken, dockerConfig DockerConfigOptions) (map[string]string, error) {
+	registries, err := renderedRegistries(provider, tokens, dockerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]string{}
+	switch format {
+	case formatContainerdHosts:
+		for _, r := range registries {
+			data[hostsKey(r.Host)] = containerdHostsTOML(r)
+		}
+	case formatContainerdCRI:
+		var buf bytes.Buffer
+		for i, r := range registries {
+			if i > 0 {
+				buf.WriteString("\n")
+			}
+			fmt.Fprintf(&buf, "[plugins.\"io.containerd.grpc.v1.cri\".registry.configs.%q.auth]\n", r.Host)
+			fmt.Fprintf(&buf, "  auth = %q\n", r.Auth)
+		}
+		data[containerdCRIKey] = buf.String()
+	case formatContainersAuth:
+		content, err := dockerConfigAuths(registries)
+		if err != nil {
+			return nil, err
+		}
+		data[containersAuthKey] = content
+	case formatWindows:
+		paths := map[string]string{windowsKubeletKey: windowsKubeletConfig}
+		for _, r := range registries {
+			data[hostsKey(r.Host)] = containerdHostsTOML(r)
+			paths[hostsKey(r.Host)] = windowsCertsDir + `\` + windowsHostDir(r.Host) + `\hosts.toml`
+		}
+		content, err := dockerConfigAuths(registries)
+		if err != nil {
+			return nil, err
+		}
+		data[windowsKubeletKey] = content
+		content, err = jsonIndent(paths)
+		if err != nil {
+			return nil, err
+		}
+		data[windowsPathsKey] = content
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return data, nil
+}
+
+// containerdHostsTOML returns the hosts.toml of a registry, sending the credentials as an Authorization header
+func containerdHostsTOML(r renderedRegistry) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "server = %q\n\n", r.Endpoint)
+	fmt.Fprintf(&buf, "[host.%q]\n", r.Endpoint)
+	fmt.Fprintf(&buf, "  capabilities = [\"pull\", \"resolve\"]\n")
+	fmt.Fprintf(&buf, "  [host.%q.header]\n", r.Endpoint)
+	fmt.Fprintf(&buf, "    Authorization = [%q]\n", "Basic "+r.Auth)
+	return buf.String()
+}
+
+// dockerConfigAuths returns the auths file of the registries, the format of containers-auth.json and the kubelet's
+// config.json alike
+func dockerConfigAuths(registries []renderedRegistry) (string, error) {
+	auths := map[string]map[string]string{}
+	for _, r := range registries {
+		auths[r.Host] = map[string]string{"auth": r.Auth}
+	}
+	return jsonIndent(map[string]interface{}{"auths": auths})
+}
+
+func jsonIndent(v interface{}) (string, error) {
+	content, err := json.MarshalIndent(v, "", "  ")
+	return string(content), err
+}
+
+// writeRenderedFormats writes the provider's freshly fetched tokens into every configured renderer's object
+func (c *controller) writeRenderedFormats(ctx context.Context, secretGenerator SecretGenerator, tokens []AuthToken) error {
+	var errs []error
+	for _, r := range c.currentConfig().renderers(secretGenerator.Name) {
+		data, err := renderFormat(r.Format, secretGenerator.Name, tokens, secretGenerator.DockerConfig)
+		if err == nil && !writesPaused() {
+			err = c.writeRendered(ctx, r, data)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not write %s %s/%s in format %s: %w", r.kind(), r.Namespace, r.Name, r.Format, err))
+			continue
+		}
+		log.Infof("Wrote %s credentials of provider %s to %s %s/%s", r.Format, secretGenerator.Name, r.kind(), r.Namespace, r.Name)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (r RendererConfig) kind() string {
+	if r.Kind == "" {
+		return renderKindSecret
+	}
+	return r.Kind
+}
+
+// writeRendered replaces the data of the renderer's object, creating it if needed
+func (c *controller) writeRendered(ctx context.Context, r RendererConfig, data map[string]string) error {
+	meta := metav1.ObjectMeta{Name: r.Name, Namespace: r.Namespace}
+	setManagedMetadata(&meta)
+	if output, ok := c.output.(*yamlOutput); ok {
+		return output.writeRendered(r, meta, data)
+	}
+	if r.kind() == renderKindSecret {
+		secret := &v1.Secret{ObjectMeta: meta, Type: v1.SecretTypeOpaque, Data: map[string][]byte{}}
+		for key, value := range data {
+			secret.Data[key] = []byte(value)
+		}
+		_, err := secretsync.EnsureSecret(ctx, c.k8sutil, r.Namespace, secret)
+		return err
+	}
+
+	cm := &v1.ConfigMap{ObjectMeta: meta, Data: data}
+	_, err := c.k8sutil.GetConfigMap(ctx, r.Namespace, r.Name)
+	switch {
+	case k8sutil.IsNotFound(err):
+		err = c.k8sutil.CreateConfigMap(ctx, r.Namespace, cm)
+	case err == nil:
+		err = c.k8sutil.UpdateConfigMap(ctx, r.Namespace, cm)
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderFormats(t *testing.T) {
+	tokens := []AuthToken{
+		tokenFor("https://b.example.com:5000", "AWS", "secret"),
+		tokenFor("a.example.com", "AWS", "other"),
+	}
+	authB := base64.StdEncoding.EncodeToString([]byte("AWS:secret"))
+	authA := base64.StdEncoding.EncodeToString([]byte("AWS:other"))
+
+	data, err := renderFormat(formatContainerdHosts, providerECR, tokens, DockerConfigOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, `server = "https://b.example.com:5000"
+
+[host."https://b.example.com:5000"]
+  capabilities = ["pull", "resolve"]
+  [host."https://b.example.com:5000".header]
+    Authorization = ["Basic `+authB+`"]
+`, data["b.example.com_5000.hosts.toml"])
+	assert.Contains(t, data["a.example.com.hosts.toml"], `server = "https://a.example.com"`)
+
+	data, err = renderFormat(formatContainerdCRI, providerECR, tokens, DockerConfigOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, `[plugins."io.containerd.grpc.v1.cri".registry.configs."a.example.com".auth]
+  auth = "`+authA+`"
+
+[plugins."io.containerd.grpc.v1.cri".registry.configs."b.example.com:5000".auth]
+  auth = "`+authB+`"
+`, data[containerdCRIKey])
+
+	data, err = renderFormat(formatContainersAuth, providerECR, tokens, DockerConfigOptions{Username: "robot"})
+	assert.Nil(t, err)
+	auths := struct {
+		Auths map[string]struct{ Auth string } `json:"auths"`
+	}{}
+	assert.Nil(t, json.Unmarshal([]byte(data[containersAuthKey]), &auths))
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("robot:secret")), auths.Auths["b.example.com:5000"].Auth)
+
+	_, err = renderFormat("nope", providerECR, tokens, DockerConfigOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestRenderWindowsFormat(t *testing.T) {
+	tokens := []AuthToken{
+		tokenFor("https://B.example.com:5000", "AWS", "secret"),
+		tokenFor("a.example.com", "AWS", "other"),
+	}
+
+	data, err := renderFormat(formatWindows, providerECR, tokens, DockerConfigOptions{})
+	assert.Nil(t, err)
+	assert.Contains(t, data["a.example.com.hosts.toml"], `server = "https://a.example.com"`)
+	auths := struct {
+		Auths map[string]struct{ Auth string } `json:"auths"`
+	}{}
+	assert.Nil(t, json.Unmarshal([]byte(data[windowsKubeletKey]), &auths))
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("AWS:other")), auths.Auths["a.example.com"].Auth)
+
+	paths := map[string]string{}
+	assert.Nil(t, json.Unmarshal([]byte(data[windowsPathsKey]), &paths))
+	assert.Equal(t, map[string]string{
+		"config.json":                   `C:\var\lib\kubelet\config.json`,
+		"a.example.com.hosts.toml":      `C:\Program Files\containerd\certs.d\a.example.com\hosts.toml`,
+		"B.example.com_5000.hosts.toml": `C:\Program Files\containerd\certs.d\b.example.com_5000_\hosts.toml`,
+	}, paths)
+	for key := range paths {
+		assert.Contains(t, data, key)
+	}
+}
+
+func TestRendererConfigValidate(t *testing.T) {
+	assert.Nil(t, RendererConfig{Format: formatContainerdHosts, Namespace: "kube-system", Name: "hosts"}.validate())
+	assert.Nil(t, RendererConfig{Format: formatContainersAuth, Kind: renderKindConfigMap, Namespace: "kube-system", Name: "auth"}.validate())
+	assert.Nil(t, RendererConfig{Format: formatWindows, Namespace: "kube-system", Name: "windows-node-creds"}.validate())
+	assert.NotNil(t, RendererConfig{Format: "docker", Namespace: "kube-system", Name: "hosts"}.validate())
+	assert.NotNil(t, RendererConfig{Format: formatContainerdHosts, Kind: "Pod", Namespace: "kube-system", Name: "hosts"}.validate())
+	assert.NotNil(t, RendererConfig{Format: formatContainerdHosts, Name: "hosts"}.validate())
+}
+
+func TestRefreshWritesRenderedFormats(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `
+providers:
+  - name: fake
+    renderers:
+      - format: containerd-hosts
+        namespace: kube-system
+        name: registry-hosts
+      - format: containerd-cri
+        kind: ConfigMap
+        namespace: kube-system
+        name: registry-auth
+`))
+	assert.Nil(t, err)
+	c := newFakeController()
+	c.config = cfg
+	c.fake = newFakeProvider()
+
+	_, ok, err := c.refreshSecret(context.TODO(), getSecretGenerators(c)[0])
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	secret, err := c.k8sutil.GetSecret(context.TODO(), "kube-system", "registry-hosts")
+	assert.Nil(t, err)
+	assert.Contains(t, string(secret.Data["registry.example.com.hosts.toml"]), `server = "https://registry.example.com"`)
+	cm, err := c.k8sutil.GetConfigMap(context.TODO(), "kube-system", "registry-auth")
+	assert.Nil(t, err)
+	assert.Contains(t, cm.Data[containerdCRIKey], `configs."registry.example.com".auth`)
+}
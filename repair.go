@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+)
+
+// writesSecrets reports whether a sync writes the Secret objects into the namespace itself; with the sealed-secret,
+// external-secret and fleet outputs another controller writes them some time after the sync
+func (c *controller) writesSecrets() bool {
+	switch output := c.output.(type) {
+	case nil, *mirrorOutput, *kmsOutput:
+		return true
+	case *propagationOutput:
+		return output.mode == outputKarmada
+	}
+	return false
+}
+
+// repairServiceAccounts looks for managed imagePullSecrets entries in the namespace's ServiceAccounts whose secret was
+// deleted. A secret in expected is written again by the sync that follows, so its entry stays; every other entry is
+// removed, so the ServiceAccounts do not keep referencing secrets that no longer exist.
+func (c *controller) repairServiceAccounts(ctx context.Context, ns *v1.Namespace, expected []string) error {
+	if !*argRepairPullSecrets || !c.caps.updateServiceAccounts {
+		return nil
+	}
+	writesSecrets := c.writesSecrets()
+
+	var errs []error
+	for _, name := range serviceAccountNames(ns) {
+		sa, err := c.k8sutil.GetServiceAccount(ctx, ns.GetName(), name)
+		if k8sutil.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not get ServiceAccount %s: %w", name, err))
+			continue
+		}
+		if *argExcludeAnnotatedSAs && secretsync.Skipped(sa) {
+			continue
+		}
+		dangling, err := secretsync.DanglingPullSecrets(ctx, c.k8sutil, ns.GetName(), sa)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		var stale []string
+		for _, secret := range dangling {
+			if !stringSliceContains(expected, secret) {
+				stale = append(stale, secret)
+			} else if writesSecrets {
+				log.Infof("ServiceAccount %s in namespace %s references the deleted secret %s; recreating it", name, ns.GetName(), secret)
+				danglingPullSecrets.WithLabelValues("recreated").Inc()
+			}
+		}
+		if len(stale) == 0 {
+			continue
+		}
+		if _, err := secretsync.DetachFromServiceAccount(ctx, c.serviceAccountClient(), ns.GetName(), name, stale, currentPullSecretOptions()); err != nil {
+			errs = append(errs, fmt.Errorf("could not detach deleted secrets from ServiceAccount %s: %w", name, err))
+			continue
+		}
+		log.Infof("Removed the deleted secrets %s from ServiceAccount %s in namespace %s", strings.Join(stale, ", "), name, ns.GetName())
+		danglingPullSecrets.WithLabelValues("removed").Add(float64(len(stale)))
+	}
+	return utilerrors.NewAggregate(errs)
+}
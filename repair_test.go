@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHandlerRepairsDanglingPullSecrets(t *testing.T) {
+	c := newFakeController()
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	assert.Nil(t, handler(context.TODO(), c, ns))
+
+	// a split part that is no longer written, a user's secret and a deleted provider secret
+	sa, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	secretsync.AttachPullSecret(sa, *argAWSSecretName+"-2", []string{*argAWSSecretName + "-2"}, secretsync.PullSecretOptions{})
+	sa.ImagePullSecrets = append(sa.ImagePullSecrets, v1.LocalObjectReference{Name: "someOtherSecret"})
+	assert.Nil(t, c.k8sutil.UpdateServiceAccount(context.TODO(), "namespace1", sa))
+	assert.Nil(t, c.k8sutil.DeleteSecret(context.TODO(), "namespace1", *argAWSSecretName))
+
+	assert.Nil(t, handler(context.TODO(), c, ns))
+
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	sa, err = c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	assert.True(t, secretsync.HasPullSecret(sa, *argAWSSecretName))
+	assert.True(t, secretsync.HasPullSecret(sa, "someOtherSecret"))
+	assert.False(t, secretsync.HasPullSecret(sa, *argAWSSecretName+"-2"))
+	assert.NotContains(t, sa.Annotations[secretsync.ManagedPullSecretsAnnotation], *argAWSSecretName+"-2")
+
+	// disabled, stale entries are kept
+	*argRepairPullSecrets = false
+	defer func() { *argRepairPullSecrets = true }()
+	secretsync.AttachPullSecret(sa, *argAWSSecretName+"-2", []string{*argAWSSecretName + "-2"}, secretsync.PullSecretOptions{})
+	assert.Nil(t, c.k8sutil.UpdateServiceAccount(context.TODO(), "namespace1", sa))
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	sa, err = c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	assert.True(t, secretsync.HasPullSecret(sa, *argAWSSecretName+"-2"))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/cenkalti/backoff"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewExponentialBackOffDefaults(t *testing.T) {
+	b := newExponentialBackOff(RetryConfig{})
+
+	assert.Equal(t, backoff.DefaultInitialInterval, b.InitialInterval)
+	assert.Equal(t, backoff.DefaultMultiplier, b.Multiplier)
+	assert.Equal(t, backoff.DefaultMaxInterval, b.MaxInterval)
+	assert.Equal(t, backoff.DefaultMaxElapsedTime, b.MaxElapsedTime)
+}
+
+func TestNewExponentialBackOffOverrides(t *testing.T) {
+	b := newExponentialBackOff(RetryConfig{
+		InitialInterval: 2 * time.Second,
+		Multiplier:      3,
+		MaxInterval:     10 * time.Second,
+		MaxElapsedTime:  time.Minute,
+	})
+
+	assert.Equal(t, 2*time.Second, b.InitialInterval)
+	assert.Equal(t, 3.0, b.Multiplier)
+	assert.Equal(t, 10*time.Second, b.MaxInterval)
+	assert.Equal(t, time.Minute, b.MaxElapsedTime)
+
+	// the first delay is randomized around the configured initial interval
+	b.RandomizationFactor = 0
+	b.Reset()
+	assert.Equal(t, 2*time.Second, b.NextBackOff())
+	assert.Equal(t, 6*time.Second, b.NextBackOff())
+	assert.Equal(t, 10*time.Second, b.NextBackOff())
+}
+
+// hangingEcrClient blocks until the call's context is done
+type hangingEcrClient struct{}
+
+func (f *hangingEcrClient) GetAuthorizationTokenWithContext(ctx aws.Context, input *ecr.GetAuthorizationTokenInput, opts ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestProviderCallTimeout(t *testing.T) {
+	*argProviderTimeout = 50 * time.Millisecond
+	defer func() { *argProviderTimeout = 30 * time.Second }()
+
+	c := newController(newKubeUtil(), &hangingEcrClient{})
+	_, err := c.getECRAuthorizationKey(context.TODO())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestFetchTokensStopsRetryingWhenCancelled(t *testing.T) {
+	c := newFakeFailingController()
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+
+	start := time.Now()
+	_, err := fetchTokens(ctx, getSecretGenerators(c)[0])
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestFetchTokensFetchTimeout(t *testing.T) {
+	c := newController(newKubeUtil(), &hangingEcrClient{})
+	sg := getSecretGenerators(c)[0]
+	sg.Retry = RetryConfig{Type: retryTypeSimple, NumberOfRetries: 3, RetryDelayInSeconds: 1}
+	sg.FetchTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := fetchTokens(context.TODO(), sg)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second, "the retries are cut short by the fetch timeout")
+}
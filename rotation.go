@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+)
+
+const (
+	// rotatedAtAnnotation on a distributed secret is when its data was fetched
+	rotatedAtAnnotation = annotationPrefix + "rotated-at"
+	// previousHashAnnotation is the fingerprint of the data the secret replaced, see secretHash
+	previousHashAnnotation = annotationPrefix + "previous-hash"
+	// previousRotatedAtAnnotation is when the data the secret replaced was fetched
+	previousRotatedAtAnnotation = annotationPrefix + "previous-rotated-at"
+	// expiresAtAnnotation is when the earliest token in the secret expires, if the provider reports it
+	expiresAtAnnotation = annotationPrefix + "expires-at"
+	// rolledBackAtAnnotation is set on the secrets restored by the rollback subcommand
+	rolledBackAtAnnotation = annotationPrefix + "rolled-back-at"
+
+	// historySuffix is appended to a secret's name for the secret in the status namespace holding its previous data
+	historySuffix = "-previous"
+)
+
+// historySecretName is the name of the secret that keeps the previous data of the secret called name
+func historySecretName(name string) string {
+	return name + historySuffix
+}
+
+// rotationAnnotations returns the rotation history annotations of a secret
+func rotationAnnotations(secret *v1.Secret) map[string]string {
+	annotations := map[string]string{}
+	for _, key := range []string{rotatedAtAnnotation, previousHashAnnotation, previousRotatedAtAnnotation, expiresAtAnnotation} {
+		if value, ok := secret.Annotations[key]; ok {
+			annotations[key] = value
+		}
+	}
+	return annotations
+}
+
+// recordRotation annotates freshly generated secrets with their rotation history and keeps the data they replace in
+// a history secret in the status namespace. The history only holds a hash of the previous data on the distributed
+// secrets; the data itself never leaves the status namespace.
+func (c *controller) recordRotation(ctx context.Context, previous, current []*v1.Secret) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	byName := make(map[string]*v1.Secret, len(previous))
+	for _, secret := range previous {
+		byName[secret.Name] = secret
+	}
+
+	for _, secret := range current {
+		old := byName[secret.Name]
+		if old != nil && secretHash(old) == secretHash(secret) {
+			// the provider returned the same credentials, nothing rotated
+			secret.Annotations = mergeStringMaps(secret.Annotations, rotationAnnotations(old))
+			continue
+		}
+
+		annotations := map[string]string{rotatedAtAnnotation: now}
+		if old != nil {
+			annotations[previousHashAnnotation] = secretHash(old)
+			if at := old.Annotations[rotatedAtAnnotation]; at != "" {
+				annotations[previousRotatedAtAnnotation] = at
+			}
+			if err := c.writeHistory(ctx, old); err != nil {
+				log.Errorf("Could not keep the previous data of secret %s! [Err: %s]", old.Name, err)
+			}
+		}
+		secret.Annotations = mergeStringMaps(secret.Annotations, annotations)
+	}
+}
+
+// writeHistory saves a replaced secret as its history secret in the status namespace
+func (c *controller) writeHistory(ctx context.Context, old *v1.Secret) error {
+	if writesPaused() {
+		return nil
+	}
+	history := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        historySecretName(old.Name),
+			Namespace:   statusNamespace(),
+			Annotations: rotationAnnotations(old),
+		},
+		Type: old.Type,
+		Data: old.Data,
+	}
+	setManagedMetadata(&history.ObjectMeta)
+	_, err := secretsync.EnsureSecret(ctx, c.k8sutil, statusNamespace(), history)
+	return err
+}
+
+// historySecrets returns the restorable secrets of a provider, one per part of a split secret
+func (c *controller) historySecrets(ctx context.Context, secretGenerator SecretGenerator) ([]*v1.Secret, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	var restored []*v1.Secret
+	for i := 0; ; i++ {
+		name := partName(secretGenerator.SecretName, i)
+		history, err := c.k8sutil.GetSecret(ctx, statusNamespace(), historySecretName(name))
+		if k8sutil.IsNotFound(err) {
+			return restored, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Annotations: map[string]string{rolledBackAtAnnotation: now},
+			},
+			Type: history.Type,
+			Data: history.Data,
+		}
+		if at := history.Annotations[rotatedAtAnnotation]; at != "" {
+			secret.Annotations[rotatedAtAnnotation] = at
+		}
+		setManagedMetadata(&secret.ObjectMeta)
+		restored = append(restored, secret)
+	}
+}
+
+// rollback writes the previous data of every provider's secrets back into every managed namespace
+func (c *controller) rollback(ctx context.Context) error {
+	var secrets []*v1.Secret
+	for _, secretGenerator := range getSecretGenerators(c) {
+		restored, err := c.historySecrets(ctx, secretGenerator)
+		if err != nil {
+			return fmt.Errorf("could not read the previous secrets of provider %s: %w", secretGenerator.Name, err)
+		}
+		if len(restored) == 0 {
+			log.Warnf("No previous secrets of provider %s in namespace %s; nothing to roll back", secretGenerator.Name, statusNamespace())
+			continue
+		}
+		secrets = append(secrets, restored...)
+	}
+	if len(secrets) == 0 {
+		return fmt.Errorf("no previous secrets found in namespace %s", statusNamespace())
+	}
+
+	namespaces, err := c.k8sutil.GetNamespaces(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i := range namespaces.Items {
+		ns := &namespaces.Items[i]
+		if c.skipNamespace(ns) {
+			continue
+		}
+		for _, secret := range secrets {
+			if err := c.processNamespace(ctx, ns, secret); err != nil {
+				errs = append(errs, fmt.Errorf("namespace %s: %w", ns.Name, err))
+				continue
+			}
+			log.Infof("Rolled back secret %s in namespace %s", secret.Name, ns.Name)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func rotationTestSecret(data string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry-creds"},
+		Data:       map[string][]byte{".dockerconfigjson": []byte(data)},
+	}
+}
+
+func TestRecordRotation(t *testing.T) {
+	c := newFakeController()
+	c.k8sutil.Kclient.(*fakeKubeClient).secrets[statusNamespace()] = &fakeSecrets{store: map[string]*v1.Secret{}}
+
+	first := rotationTestSecret("first")
+	c.recordRotation(context.TODO(), nil, []*v1.Secret{first})
+	assert.NotEmpty(t, first.Annotations[rotatedAtAnnotation])
+	assert.NotContains(t, first.Annotations, previousHashAnnotation)
+
+	// the same credentials keep their history
+	same := rotationTestSecret("first")
+	c.recordRotation(context.TODO(), []*v1.Secret{first}, []*v1.Secret{same})
+	assert.Equal(t, first.Annotations, same.Annotations)
+
+	second := rotationTestSecret("second")
+	c.recordRotation(context.TODO(), []*v1.Secret{first}, []*v1.Secret{second})
+	assert.Equal(t, secretHash(first), second.Annotations[previousHashAnnotation])
+	assert.Equal(t, first.Annotations[rotatedAtAnnotation], second.Annotations[previousRotatedAtAnnotation])
+
+	history, err := c.k8sutil.GetSecret(context.TODO(), statusNamespace(), "registry-creds-previous")
+	assert.Nil(t, err)
+	assert.Equal(t, first.Data, history.Data)
+	assert.Equal(t, first.Annotations[rotatedAtAnnotation], history.Annotations[rotatedAtAnnotation])
+}
+
+func TestRollback(t *testing.T) {
+	now := time.Date(2022, 9, 1, 10, 30, 0, 0, time.UTC)
+	c := newFakeController()
+	c.fake = &providers.Fake{Registries: []string{"https://registry.example.com"}, Expiry: time.Hour, Now: func() time.Time { return now }}
+	c.k8sutil.Kclient.(*fakeKubeClient).secrets[statusNamespace()] = &fakeSecrets{store: map[string]*v1.Secret{}}
+	defer syncCycleDuration.DeleteLabelValues(providerFake)
+	sg := getSecretGenerators(c)[0]
+
+	assert.NotNil(t, c.rollback(context.TODO()))
+
+	c.refreshProvider(context.TODO(), sg)
+	previous, err := c.k8sutil.GetSecret(context.TODO(), "namespace1", sg.SecretName)
+	assert.Nil(t, err)
+	previousData := previous.Data
+	now = now.Add(time.Hour)
+	c.refreshProvider(context.TODO(), sg)
+	current, err := c.k8sutil.GetSecret(context.TODO(), "namespace1", sg.SecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, secretHash(previous), current.Annotations[previousHashAnnotation])
+
+	assert.Nil(t, c.rollback(context.TODO()))
+	for _, ns := range []string{"namespace1", "namespace2"} {
+		restored, err := c.k8sutil.GetSecret(context.TODO(), ns, sg.SecretName)
+		assert.Nil(t, err)
+		assert.Equal(t, previousData, restored.Data, ns)
+		assert.NotEmpty(t, restored.Annotations[rolledBackAtAnnotation], ns)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Output modes
+const (
+	outputSecret       = "secret"
+	outputSealedSecret = "sealed-secret"
+
+	// sealedSecretTimeout bounds a PUT to the --output-url target; the writes hold the sync lock, so a hung target
+	// must not stall every namespace
+	sealedSecretTimeout = 30 * time.Second
+)
+
+// secretOutput publishes a namespace's pull secret somewhere other than the Kubernetes API
+type secretOutput interface {
+	write(ctx context.Context, namespace string, secret *v1.Secret) error
+}
+
+// sealedSecret is a Bitnami SealedSecret manifest
+type sealedSecret struct {
+	APIVersion string           `json:"apiVersion"`
+	Kind       string           `json:"kind"`
+	Metadata   sealedObjectMeta `json:"metadata"`
+	Spec       sealedSecretSpec `json:"spec"`
+}
+
+type sealedObjectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type sealedSecretSpec struct {
+	EncryptedData map[string]string    `json:"encryptedData"`
+	Template      sealedSecretTemplate `json:"template"`
+}
+
+type sealedSecretTemplate struct {
+	Metadata sealedObjectMeta `json:"metadata"`
+	Type     v1.SecretType    `json:"type,omitempty"`
+}
+
+// sealedSecretOutput seals the pull secrets with the public key of the sealed-secrets controller and PUTs the
+// manifests to an HTTP target, e.g. a git server's file API, as <url>/<namespace>/<secret>.yaml
+type sealedSecretOutput struct {
+	publicKey *rsa.PublicKey
+	url       string
+	token     string
+	client    *http.Client
+}
+
+func newSealedSecretOutput(certFile, url, tokenFile string) (*sealedSecretOutput, error) {
+	if url == "" {
+		return nil, fmt.Errorf("--output-url is required with --output=%s", outputSealedSecret)
+	}
+	publicKey, err := loadSealingKey(certFile)
+	if err != nil {
+		return nil, err
+	}
+	token, err := readAPIToken(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read output token file: %v", err)
+	}
+	return &sealedSecretOutput{publicKey: publicKey, url: strings.TrimSuffix(url, "/"), token: token, client: &http.Client{Timeout: sealedSecretTimeout}}, nil
+}
+
+// loadSealingKey reads the RSA public key from the sealed-secrets controller's certificate, as printed by kubeseal --fetch-cert
+func loadSealingKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read sealed-secrets certificate: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM certificate found in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse sealed-secrets certificate: %v", err)
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("sealed-secrets certificate %s does not hold an RSA key", path)
+	}
+	return publicKey, nil
+}
+
+// hybridEncrypt encrypts plaintext the way the sealed-secrets controller expects: a random AES-256-GCM session key,
+// itself encrypted with RSA-OAEP, is prepended to the ciphertext
+func hybridEncrypt(rnd io.Reader, publicKey *rsa.PublicKey, plaintext, label []byte) ([]byte, error) {
+	sessionKey := make([]byte, 32)
+	if _, err := io.ReadFull(rnd, sessionKey); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	rsaCiphertext, err := rsa.EncryptOAEP(sha256.New(), rnd, publicKey, sessionKey, label)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, 2, 2+len(rsaCiphertext)+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint16(ciphertext, uint16(len(rsaCiphertext)))
+	ciphertext = append(ciphertext, rsaCiphertext...)
+	// the session key is never reused, so a zero nonce is safe
+	zeroNonce := make([]byte, aead.NonceSize())
+	return aead.Seal(ciphertext, zeroNonce, plaintext, nil), nil
+}
+
+// sealSecret returns the SealedSecret of secret in namespace, using the default strict scope: it can only be unsealed
+// under the same name and namespace
+func sealSecret(rnd io.Reader, publicKey *rsa.PublicKey, namespace string, secret *v1.Secret) (*sealedSecret, error) {
+	label := []byte(namespace + "/" + secret.Name)
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	encrypted := make(map[string]string, len(keys))
+	for _, key := range keys {
+		ciphertext, err := hybridEncrypt(rnd, publicKey, secret.Data[key], label)
+		if err != nil {
+			return nil, fmt.Errorf("could not seal key %s of secret %s: %v", key, secret.Name, err)
+		}
+		encrypted[key] = base64.StdEncoding.EncodeToString(ciphertext)
+	}
+
+	meta := sealedObjectMeta{Name: secret.Name, Namespace: namespace}
+	return &sealedSecret{
+		APIVersion: "bitnami.com/v1alpha1",
+		Kind:       "SealedSecret",
+		Metadata:   meta,
+		Spec: sealedSecretSpec{
+			EncryptedData: encrypted,
+			// the unsealed Secret carries the pull secret's labels and annotations
+			Template: sealedSecretTemplate{
+				Metadata: sealedObjectMeta{Name: meta.Name, Namespace: meta.Namespace, Labels: secret.Labels, Annotations: secret.Annotations},
+				Type:     secret.Type,
+			},
+		},
+	}, nil
+}
+
+func (o *sealedSecretOutput) write(ctx context.Context, namespace string, secret *v1.Secret) error {
+	sealed, err := sealSecret(rand.Reader, o.publicKey, namespace, secret)
+	if err != nil {
+		return err
+	}
+	manifest, err := yaml.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/%s/%s.yaml", o.url, namespace, secret.Name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/yaml")
+	if o.token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.token)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not write SealedSecret %s/%s: %v", namespace, secret.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("could not write SealedSecret %s/%s: %s returned %s", namespace, secret.Name, url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// hybridDecrypt mirrors the sealed-secrets controller's decryption
+func hybridDecrypt(t *testing.T, key *rsa.PrivateKey, ciphertext, label []byte) []byte {
+	rsaLen := int(binary.BigEndian.Uint16(ciphertext))
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, ciphertext[2:2+rsaLen], label)
+	assert.Nil(t, err)
+	block, err := aes.NewCipher(sessionKey)
+	assert.Nil(t, err)
+	aead, err := cipher.NewGCM(block)
+	assert.Nil(t, err)
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext[2+rsaLen:], nil)
+	assert.Nil(t, err)
+	return plaintext
+}
+
+func writeSealingCert(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sealed-secret"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	assert.Nil(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	return key, path
+}
+
+func TestSealSecret(t *testing.T) {
+	key, certFile := writeSealingCert(t)
+	publicKey, err := loadSealingKey(certFile)
+	assert.Nil(t, err)
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "awsecr-cred"},
+		Data:       map[string][]byte{v1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+		Type:       v1.SecretTypeDockerConfigJson,
+	}
+	sealed, err := sealSecret(rand.Reader, publicKey, "team-a", secret)
+	assert.Nil(t, err)
+	assert.Equal(t, "SealedSecret", sealed.Kind)
+	assert.Equal(t, "team-a", sealed.Spec.Template.Metadata.Namespace)
+	assert.Equal(t, v1.SecretTypeDockerConfigJson, sealed.Spec.Template.Type)
+
+	ciphertext, err := base64.StdEncoding.DecodeString(sealed.Spec.EncryptedData[v1.DockerConfigJsonKey])
+	assert.Nil(t, err)
+	assert.Equal(t, `{"auths":{}}`, string(hybridDecrypt(t, key, ciphertext, []byte("team-a/awsecr-cred"))))
+}
+
+func TestSealedSecretOutputWrite(t *testing.T) {
+	_, certFile := writeSealingCert(t)
+	var path, auth string
+	var manifest sealedSecret
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, auth = r.URL.Path, r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		assert.Nil(t, yaml.Unmarshal(body, &manifest))
+	}))
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600))
+
+	output, err := newSealedSecretOutput(certFile, server.URL+"/manifests/", tokenFile)
+	assert.Nil(t, err)
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "awsecr-cred"}, Data: map[string][]byte{"a": []byte("b")}}
+	assert.Nil(t, output.write(context.TODO(), "team-a", secret))
+
+	assert.Equal(t, "/manifests/team-a/awsecr-cred.yaml", path)
+	assert.Equal(t, "Bearer s3cret", auth)
+	assert.Equal(t, "awsecr-cred", manifest.Metadata.Name)
+	assert.Contains(t, manifest.Spec.EncryptedData, "a")
+
+	// a target that does not answer fails the write instead of holding up the sync
+	hung := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-hung }))
+	defer slow.Close()
+	defer close(hung)
+	output, err = newSealedSecretOutput(certFile, slow.URL, "")
+	assert.Nil(t, err)
+	output.client.Timeout = 100 * time.Millisecond
+	assert.NotNil(t, output.write(context.TODO(), "team-a", secret))
+
+	_, err = newSealedSecretOutput(certFile, "", "")
+	assert.NotNil(t, err)
+}
+
+type recordingOutput struct {
+	written []string
+}
+
+func (o *recordingOutput) write(ctx context.Context, namespace string, secret *v1.Secret) error {
+	o.written = append(o.written, namespace+"/"+secret.Name)
+	return nil
+}
+
+func TestProcessNamespaceWithOutput(t *testing.T) {
+	c := newFakeController()
+	output := &recordingOutput{}
+	c.output = output
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: *argAWSSecretName}}
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+
+	assert.Equal(t, []string{"namespace1/" + *argAWSSecretName}, output.written)
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.False(t, exists, "no Secret is written through the Kubernetes API")
+	sa, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	assert.True(t, secretsync.HasPullSecret(sa, *argAWSSecretName))
+}
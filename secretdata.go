@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"text/template"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// SecretOptions customise the secret object written for a provider beyond its docker config
+type SecretOptions struct {
+	// Type overrides the secret type, e.g. Opaque for tools that do not accept kubernetes.io/dockerconfigjson
+	Type string `json:"type,omitempty"`
+	// ExtraData holds additional keys, each a Go template rendered with .Provider, .Registries and .Registry (the first
+	// registry), e.g. a registry key with "{{ .Registry.Host }}" or an .npmrc rendered from the same token
+	ExtraData map[string]string `json:"extraData,omitempty"`
+}
+
+// registryTemplateData describes a single registry to the extra data templates
+type registryTemplateData struct {
+	Endpoint string
+	Host     string
+	Username string
+	Password string
+	// Auth is base64(Username:Password), as in the docker config
+	Auth string
+}
+
+// secretTemplateData is what the extra data templates are rendered with
+type secretTemplateData struct {
+	Provider   string
+	Registry   registryTemplateData
+	Registries []registryTemplateData
+}
+
+var secretTemplateFuncs = template.FuncMap{
+	"b64enc": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+}
+
+// validate parses every extra data template and renders it once so unknown fields are reported at startup
+func (o SecretOptions) validate() error {
+	for key := range o.ExtraData {
+		if key == v1.DockerConfigJsonKey || key == v1.DockerConfigKey {
+			return fmt.Errorf("extraData cannot replace the %s key", key)
+		}
+	}
+	_, err := o.renderExtraData(providerECR, []AuthToken{{
+		AccessToken: base64.StdEncoding.EncodeToString([]byte("user:password")),
+		Endpoint:    "https://registry.example.com",
+	}}, DockerConfigOptions{})
+	return err
+}
+
+// renderExtraData returns the rendered extra data keys for the tokens; the user name honours the docker config's Username
+func (o SecretOptions) renderExtraData(provider string, tokens []AuthToken, dockerConfig DockerConfigOptions) (map[string][]byte, error) {
+	if len(o.ExtraData) == 0 {
+		return nil, nil
+	}
+
+	data := secretTemplateData{Provider: provider}
+	for _, token := range tokens {
+		user, password, err := token.Credentials()
+		if err != nil {
+			return nil, err
+		}
+		if dockerConfig.Username != "" {
+			user = dockerConfig.Username
+		}
+		data.Registries = append(data.Registries, registryTemplateData{
+			Endpoint: token.Endpoint,
+			Host:     token.Host(),
+			Username: user,
+			Password: password,
+			Auth:     base64.StdEncoding.EncodeToString([]byte(user + ":" + password)),
+		})
+	}
+	if len(data.Registries) > 0 {
+		data.Registry = data.Registries[0]
+	}
+
+	// render in key order so the first error is reported consistently
+	keys := make([]string, 0, len(o.ExtraData))
+	for key := range o.ExtraData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rendered := map[string][]byte{}
+	for _, key := range keys {
+		tmpl, err := template.New(key).Funcs(secretTemplateFuncs).Option("missingkey=error").Parse(o.ExtraData[key])
+		if err != nil {
+			return nil, fmt.Errorf("invalid extraData template %s: %v", key, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("could not render extraData template %s: %v", key, err)
+		}
+		rendered[key] = buf.Bytes()
+	}
+	return rendered, nil
+}
+
+// apply adds the extra data keys and the type override to a generated secret
+func (o SecretOptions) apply(secret *v1.Secret, provider string, tokens []AuthToken, dockerConfig DockerConfigOptions) error {
+	extra, err := o.renderExtraData(provider, tokens, dockerConfig)
+	if err != nil {
+		return err
+	}
+	if len(extra) > 0 && secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	for key, value := range extra {
+		secret.Data[key] = value
+	}
+	if o.Type != "" {
+		secret.Type = v1.SecretType(o.Type)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+func tokenFor(endpoint, user, password string) AuthToken {
+	return AuthToken{AccessToken: base64.StdEncoding.EncodeToString([]byte(user + ":" + password)), Endpoint: endpoint}
+}
+
+func TestGenerateSecretObjExtraData(t *testing.T) {
+	sg := SecretGenerator{
+		Name:       providerECR,
+		SecretName: "creds",
+		IsJSONCfg:  true,
+		Secret: SecretOptions{
+			Type: "Opaque",
+			ExtraData: map[string]string{
+				"registry": "{{ .Registry.Host }}",
+				".npmrc":   "{{ range .Registries }}//{{ .Host }}/:_auth={{ .Auth }}\n{{ end }}",
+				"token":    "{{ .Registry.Password | b64enc }}",
+			},
+		},
+		DockerConfig: DockerConfigOptions{Username: "robot"},
+	}
+	tokens := []AuthToken{
+		tokenFor("https://a.example.com", "AWS", "secret"),
+		tokenFor("https://b.example.com", "AWS", "other"),
+	}
+
+	secret, err := generateSecretObj(tokens, sg)
+	assert.Nil(t, err)
+	assert.Equal(t, v1.SecretTypeOpaque, secret.Type)
+	assert.Contains(t, secret.Data, v1.DockerConfigJsonKey)
+	assert.Equal(t, "a.example.com", string(secret.Data["registry"]))
+	robotAuth := base64.StdEncoding.EncodeToString([]byte("robot:secret"))
+	assert.Contains(t, string(secret.Data[".npmrc"]), "//a.example.com/:_auth="+robotAuth+"\n")
+	assert.Contains(t, string(secret.Data[".npmrc"]), "//b.example.com/:_auth=")
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("secret")), string(secret.Data["token"]))
+}
+
+func TestSecretOptionsValidate(t *testing.T) {
+	assert.Nil(t, SecretOptions{ExtraData: map[string]string{"registry": "{{ .Registry.Endpoint }}"}}.validate())
+	assert.NotNil(t, SecretOptions{ExtraData: map[string]string{"registry": "{{ .Nope }}"}}.validate())
+	assert.NotNil(t, SecretOptions{ExtraData: map[string]string{"registry": "{{ .Registry"}}.validate())
+	assert.NotNil(t, SecretOptions{ExtraData: map[string]string{v1.DockerConfigJsonKey: "{}"}}.validate())
+}
+
+func TestLoadConfigSecretOptions(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    secret:
+      type: Opaque
+      extraData:
+        registry: "{{ .Registry.Host }}"
+`))
+	assert.Nil(t, err)
+
+	c := newFakeController()
+	c.config = cfg
+	sg := getSecretGenerators(c)[0]
+	assert.Equal(t, "Opaque", sg.Secret.Type)
+	assert.Equal(t, "{{ .Registry.Host }}", sg.Secret.ExtraData["registry"])
+}
+
+func TestSplitSecretKeepsExtraDataInFirstPart(t *testing.T) {
+	secret, err := generateSecretObj(manyTokens(20), SecretGenerator{IsJSONCfg: true, SecretName: "awsecr-cred"})
+	assert.Nil(t, err)
+	limit := secretSize(secret) / 3
+	secret.Data["registry"] = []byte("000000000000.dkr.ecr.us-east-1.amazonaws.com")
+
+	parts, err := splitSecret(secret, limit)
+	assert.Nil(t, err)
+	assert.Equal(t, secret.Data["registry"], parts[0].Data["registry"])
+	for _, part := range parts {
+		assert.LessOrEqual(t, secretSize(part), limit)
+	}
+	assert.NotContains(t, parts[1].Data, "registry")
+}
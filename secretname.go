@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// maxSecretNameLength leaves room for the "-N" suffix of split secrets within the 253 characters of a DNS-1123 subdomain
+const maxSecretNameLength = validation.DNS1123SubdomainMaxLength - 3
+
+var invalidSecretNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// secretNameProblem returns why name cannot be the name of a provider's secret, "" if it can
+func secretNameProblem(name string) string {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return strings.Join(errs, "; ")
+	}
+	if len(name) > maxSecretNameLength {
+		return fmt.Sprintf("must be no more than %d characters, leaving room for the suffix of split secrets", maxSecretNameLength)
+	}
+	return ""
+}
+
+// validateSecretName rejects a secret name from the config file, suggesting a valid one
+func validateSecretName(name string) error {
+	problem := secretNameProblem(name)
+	if problem == "" {
+		return nil
+	}
+	if sanitized := sanitizeSecretName(name); sanitized != "" {
+		return fmt.Errorf("invalid secret name '%s': %s; e.g. '%s' would be valid", name, problem, sanitized)
+	}
+	return fmt.Errorf("invalid secret name '%s': %s", name, problem)
+}
+
+// sanitizeSecretName turns name into a valid secret name: lower case, other characters replaced by '-', trimmed to
+// start and end with an alphanumeric character and to maxSecretNameLength. It returns "" if nothing is left.
+func sanitizeSecretName(name string) string {
+	name = invalidSecretNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	if len(name) > maxSecretNameLength {
+		name = name[:maxSecretNameLength]
+	}
+	return strings.Trim(name, "-.")
+}
+
+// secretNamesCollide reports whether two providers' secrets would overwrite each other, including the parts of split
+// secrets, e.g. awsecr-cred-2 is the second part of awsecr-cred
+func secretNamesCollide(a, b string) bool {
+	return a == b || splitPartOf(a, b) || splitPartOf(b, a)
+}
+
+func splitPartOf(name, secretName string) bool {
+	suffix := strings.TrimPrefix(name, secretName+"-")
+	if suffix == name || suffix == "" {
+		return false
+	}
+	return strings.Trim(suffix, "0123456789") == ""
+}
+
+// providerSecret is the secret a provider distributes into every namespace it selects
+type providerSecret struct {
+	provider string
+	name     string
+}
+
+// providerSecrets returns the secrets of the --provider and of the providers of cfg, in the order of getSecretGenerators
+func providerSecrets(cfg *Config) []providerSecret {
+	secrets := []providerSecret{{provider: *argProvider, name: baseSecretName()}}
+	if settings := cfg.tokenExchange(); settings != nil {
+		secrets = append(secrets, providerSecret{provider: providerTokenExchange, name: settings.secretName()})
+	}
+	for _, p := range cfg.Providers {
+		if p.ECR != nil {
+			secrets = append(secrets, providerSecret{provider: p.Name, name: p.ECR.SecretName})
+		}
+	}
+	return secrets
+}
+
+// validateSecretNames rejects a config in which one provider's secret, or an object of a renderer, would overwrite
+// another's: the providers would otherwise take turns writing the same secret in every namespace. Each clash is
+// reported once, by the later provider.
+func validateSecretNames(cfg *Config) []error {
+	var errs []error
+	secrets := providerSecrets(cfg)
+	for i, secret := range secrets {
+		for _, other := range secrets[:i] {
+			if secretNamesCollide(secret.name, other.name) {
+				errs = append(errs, fmt.Errorf("secretName '%s' of provider '%s' collides with the secret '%s' of provider '%s'", secret.name, secret.provider, other.name, other.provider))
+			}
+		}
+	}
+
+	rendered := map[string]string{}
+	for _, p := range cfg.Providers {
+		for _, r := range p.Renderers {
+			if r.kind() == renderKindSecret {
+				for _, secret := range secrets {
+					if secretNamesCollide(r.Name, secret.name) {
+						errs = append(errs, fmt.Errorf("renderer %s of provider '%s' would overwrite the secret '%s' of provider '%s' in namespace '%s'", r.Format, p.Name, secret.name, secret.provider, r.Namespace))
+					}
+				}
+			}
+			key := r.kind() + " " + r.Namespace + "/" + r.Name
+			if other, ok := rendered[key]; ok {
+				errs = append(errs, fmt.Errorf("renderer %s of provider '%s' writes the %s also written by a renderer of provider '%s'", r.Format, p.Name, key, other))
+				continue
+			}
+			rendered[key] = p.Name
+		}
+	}
+	return errs
+}
+
+// baseSecretName returns the secret name of the --provider
+func baseSecretName() string {
+	if *argProvider == providerFake {
+		return *argFakeSecretName
+	}
+	if *argProvider == providerFile {
+		return *argTokenFileSecretName
+	}
+	return *argAWSSecretName
+}
+
+// sanitizeSecretNameFlag replaces an invalid secret name flag with its sanitized form, or the default if nothing is
+// left of it, and reports the problem
+func sanitizeSecretNameFlag(problems *configProblems, flagName string, value *string, defaultName string) {
+	problem := secretNameProblem(*value)
+	if problem == "" {
+		return
+	}
+	sanitized := sanitizeSecretName(*value)
+	if sanitized == "" {
+		sanitized = defaultName
+	}
+	problems.flag(flagName, *value, problem, "using "+sanitized)
+	*value = sanitized
+}
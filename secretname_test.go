@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeSecretName(t *testing.T) {
+	assert.Equal(t, "awsecr-cred", sanitizeSecretName("awsecr-cred"))
+	assert.Equal(t, "my-ecr-creds", sanitizeSecretName("My_ECR creds"))
+	assert.Equal(t, "team.ecr", sanitizeSecretName("-team.ecr-"))
+	assert.Equal(t, "", sanitizeSecretName("__"))
+	assert.Len(t, sanitizeSecretName(strings.Repeat("a", 300)), maxSecretNameLength)
+
+	for _, name := range []string{"My_ECR creds", "-team.ecr-", strings.Repeat("a", 300)} {
+		assert.Empty(t, secretNameProblem(sanitizeSecretName(name)), name)
+	}
+}
+
+func TestValidateSecretName(t *testing.T) {
+	assert.Nil(t, validateSecretName("awsecr-cred"))
+	assert.ErrorContains(t, validateSecretName("ECR_cred"), "e.g. 'ecr-cred' would be valid")
+	assert.ErrorContains(t, validateSecretName(strings.Repeat("a", 252)), "leaving room for the suffix of split secrets")
+}
+
+func TestSecretNamesCollide(t *testing.T) {
+	assert.True(t, secretNamesCollide("awsecr-cred", "awsecr-cred"))
+	assert.True(t, secretNamesCollide("awsecr-cred", "awsecr-cred-2"))
+	assert.True(t, secretNamesCollide("awsecr-cred-12", "awsecr-cred"))
+	assert.False(t, secretNamesCollide("awsecr-cred", "awsecr-cred-b"))
+	assert.False(t, secretNamesCollide("awsecr-cred", "awsecr-cred-"))
+	assert.False(t, secretNamesCollide("awsecr-cred", "token-exchange-cred"))
+}
+
+func TestValidateParamsSanitizesSecretNames(t *testing.T) {
+	defer func(name string) { *argAWSSecretName = name }(*argAWSSecretName)
+	*argAWSSecretName = "ECR_Creds"
+	_, problems := validateParams()
+	assert.Contains(t, problemStrings(problems), `flag --aws-secret-name="ECR_Creds": a lowercase RFC 1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*'); using ecr-creds`)
+	assert.Equal(t, "ecr-creds", *argAWSSecretName)
+
+	*argAWSSecretName = "__"
+	validateParams()
+	assert.Equal(t, "awsecr-cred", *argAWSSecretName)
+}
+
+func TestLoadConfigRejectsInvalidSecretNames(t *testing.T) {
+	_, err := loadConfig(writeConfig(t, `
+providers:
+  - name: token-exchange
+    tokenExchange:
+      url: https://token.example.com
+      registry: registry.example.com
+      audience: registry.example.com
+      serviceAccount: registry-creds
+      secretName: Token_Cred
+    renderers:
+      - format: containerd-hosts
+        namespace: kube-system
+        name: Hosts_TOML
+`))
+	assert.ErrorContains(t, err, "invalid secret name 'Token_Cred'")
+	assert.ErrorContains(t, err, "e.g. 'token-cred' would be valid")
+	assert.ErrorContains(t, err, "invalid name 'Hosts_TOML'")
+
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: token-exchange
+    tokenExchange:
+      url: https://token.example.com
+      registry: registry.example.com
+      audience: registry.example.com
+      serviceAccount: registry-creds
+      secretName: awsecr-cred-2
+`))
+	assert.ErrorContains(t, err, "secretName 'awsecr-cred-2' of provider 'token-exchange' collides with the secret 'awsecr-cred' of provider 'ecr'")
+}
+
+func TestLoadConfigRejectsCollidingSecrets(t *testing.T) {
+	_, err := loadConfig(writeConfig(t, `
+providers:
+  - name: token-exchange
+    tokenExchange:
+      url: https://token.example.com
+      registry: registry.example.com
+      audience: registry.example.com
+      serviceAccount: registry-creds
+      secretName: shared-cred
+  - name: ecr-prod
+    ecr:
+      secretName: shared-cred
+    renderers:
+      - format: containerd-hosts
+        namespace: kube-system
+        name: awsecr-cred
+      - format: containers-auth
+        namespace: kube-system
+        name: auth
+  - name: ecr
+    renderers:
+      - format: containerd-cri
+        namespace: kube-system
+        name: auth
+`))
+	assert.ErrorContains(t, err, "secretName 'shared-cred' of provider 'ecr-prod' collides with the secret 'shared-cred' of provider 'token-exchange'")
+	assert.ErrorContains(t, err, "renderer containerd-hosts of provider 'ecr-prod' would overwrite the secret 'awsecr-cred' of provider 'ecr' in namespace 'kube-system'")
+	assert.ErrorContains(t, err, "renderer containerd-cri of provider 'ecr' writes the Secret kube-system/auth also written by a renderer of provider 'ecr-prod'")
+
+	// a ConfigMap may share the name of a secret
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    renderers:
+      - format: containerd-hosts
+        kind: ConfigMap
+        namespace: kube-system
+        name: awsecr-cred
+`))
+	assert.Nil(t, err)
+}
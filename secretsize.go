@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// maxSecretSize is the size limit the API server enforces on a secret's data
+	maxSecretSize = 1 << 20
+	// secretSizeWarnRatio is the fraction of maxSecretSize above which a secret is logged as approaching the limit
+	secretSizeWarnRatio = 0.8
+	// defaultSecretSplitSize leaves headroom below maxSecretSize for the rest of the secret object
+	defaultSecretSplitSize = 900 * 1024
+)
+
+// secretSize returns the number of bytes of the secret's data, keys included
+func secretSize(secret *v1.Secret) int {
+	size := 0
+	for k, v := range secret.Data {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// partName returns the name of the i-th (0-based) part of a split secret; the first part keeps the provider's secret name
+func partName(secretName string, i int) string {
+	if i == 0 {
+		return secretName
+	}
+	return fmt.Sprintf("%s-%d", secretName, i+1)
+}
+
+// splitSecret spreads the registries of a .dockerconfigjson secret over as many secrets as needed to keep each below limit;
+// other secret types, and any secret within the limit, are returned as is. A limit of 0 disables splitting.
+func splitSecret(secret *v1.Secret, limit int) ([]*v1.Secret, error) {
+	if limit <= 0 || secret.Type != v1.SecretTypeDockerConfigJson || secretSize(secret) <= limit {
+		return []*v1.Secret{secret}, nil
+	}
+
+	cfg := dockerJSON{}
+	if err := json.Unmarshal(secret.Data[v1.DockerConfigJsonKey], &cfg); err != nil {
+		return nil, err
+	}
+	endpoints := make([]string, 0, len(cfg.Auths))
+	for endpoint := range cfg.Auths {
+		endpoints = append(endpoints, endpoint)
+	}
+	// sorting by host keeps the url and bare host forms of a registry next to each other, normally in the same part
+	sort.Slice(endpoints, func(i, j int) bool {
+		hi, hj := providers.RegistryHost(endpoints[i]), providers.RegistryHost(endpoints[j])
+		if hi != hj {
+			return hi < hj
+		}
+		return endpoints[i] < endpoints[j]
+	})
+
+	// any extra data keys stay in the first part
+	extra := map[string][]byte{}
+	for key, value := range secret.Data {
+		if key != v1.DockerConfigJsonKey {
+			extra[key] = value
+		}
+	}
+
+	// pack the registries greedily in endpoint order so the parts stay stable between refreshes
+	overhead := len(v1.DockerConfigJsonKey) + len(`{"auths":{}}`)
+	var parts []map[string]registryAuth
+	size := 0
+	for _, endpoint := range endpoints {
+		entry, err := json.Marshal(map[string]registryAuth{endpoint: cfg.Auths[endpoint]})
+		if err != nil {
+			return nil, err
+		}
+		entrySize := len(entry) - 1 // drop the braces, add a separating comma
+		if len(parts) == 0 || size+entrySize > limit {
+			size = overhead
+			if len(parts) == 0 {
+				size += secretSize(&v1.Secret{Data: extra})
+			}
+			parts = append(parts, map[string]registryAuth{})
+		}
+		parts[len(parts)-1][endpoint] = cfg.Auths[endpoint]
+		size += entrySize
+	}
+
+	secrets := make([]*v1.Secret, 0, len(parts))
+	for i, auths := range parts {
+		configJSON, err := json.Marshal(dockerJSON{Auths: auths})
+		if err != nil {
+			return nil, err
+		}
+		part := secret.DeepCopy()
+		part.Name = partName(secret.Name, i)
+		part.Data = map[string][]byte{v1.DockerConfigJsonKey: configJSON}
+		if i == 0 {
+			for key, value := range extra {
+				part.Data[key] = value
+			}
+		}
+		secrets = append(secrets, part)
+	}
+	return secrets, nil
+}
+
+// recordSecretSizes exports the size of every part and warns about parts approaching the secret size limit
+func recordSecretSizes(provider string, secrets []*v1.Secret) {
+	secretParts.WithLabelValues(provider).Set(float64(len(secrets)))
+	for _, secret := range secrets {
+		size := secretSize(secret)
+		secretSizeBytes.WithLabelValues(provider, secret.Name).Set(float64(size))
+		switch {
+		case size > maxSecretSize:
+			log.Errorf("Secret %s of provider %s is %d bytes, above the %d bytes secret limit; it will be rejected. Lower --secret-split-size", secret.Name, provider, size, maxSecretSize)
+		case float64(size) > secretSizeWarnRatio*maxSecretSize:
+			log.Warnf("Secret %s of provider %s is %d bytes, approaching the %d bytes secret limit", secret.Name, provider, size, maxSecretSize)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+// manyRegistriesEcrClient returns a token for each of count registries
+type manyRegistriesEcrClient struct {
+	count int
+}
+
+func (f *manyRegistriesEcrClient) GetAuthorizationTokenWithContext(ctx aws.Context, input *ecr.GetAuthorizationTokenInput, opts ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+	out := &ecr.GetAuthorizationTokenOutput{}
+	for i := 0; i < f.count; i++ {
+		out.AuthorizationData = append(out.AuthorizationData, &ecr.AuthorizationData{
+			AuthorizationToken: aws.String(strings.Repeat("t", 100)),
+			ProxyEndpoint:      aws.String(fmt.Sprintf("https://%012d.dkr.ecr.us-east-1.amazonaws.com", i)),
+		})
+	}
+	return out, nil
+}
+
+func manyTokens(count int) []AuthToken {
+	var tokens []AuthToken
+	for i := 0; i < count; i++ {
+		tokens = append(tokens, AuthToken{AccessToken: strings.Repeat("t", 100), Endpoint: fmt.Sprintf("https://%012d.dkr.ecr.us-east-1.amazonaws.com", i)})
+	}
+	return tokens
+}
+
+func TestSplitSecretWithinLimit(t *testing.T) {
+	secret, err := generateSecretObj(manyTokens(3), SecretGenerator{IsJSONCfg: true, SecretName: "awsecr-cred"})
+	assert.Nil(t, err)
+
+	parts, err := splitSecret(secret, defaultSecretSplitSize)
+	assert.Nil(t, err)
+	assert.Equal(t, []*v1.Secret{secret}, parts)
+
+	parts, err = splitSecret(secret, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []*v1.Secret{secret}, parts)
+}
+
+func TestSplitSecret(t *testing.T) {
+	secret, err := generateSecretObj(manyTokens(20), SecretGenerator{IsJSONCfg: true, SecretName: "awsecr-cred"})
+	assert.Nil(t, err)
+	limit := secretSize(secret) / 3
+
+	parts, err := splitSecret(secret, limit)
+	assert.Nil(t, err)
+	assert.True(t, len(parts) >= 3)
+
+	endpoints := map[string]bool{}
+	for i, part := range parts {
+		assert.Equal(t, partName("awsecr-cred", i), part.Name)
+		assert.Equal(t, v1.SecretTypeDockerConfigJson, part.Type)
+		assert.LessOrEqual(t, secretSize(part), limit)
+
+		cfg := dockerJSON{}
+		assert.Nil(t, json.Unmarshal(part.Data[v1.DockerConfigJsonKey], &cfg))
+		for endpoint := range cfg.Auths {
+			assert.False(t, endpoints[endpoint])
+			endpoints[endpoint] = true
+		}
+	}
+	assert.Len(t, endpoints, 20)
+	assert.Equal(t, "awsecr-cred-2", parts[1].Name)
+}
+
+func TestSplitSecretIsAttachedToServiceAccount(t *testing.T) {
+	*argSecretSplitSize = 2000
+	defer func() { *argSecretSplitSize = defaultSecretSplitSize }()
+
+	c := newController(newKubeUtil(), &manyRegistriesEcrClient{count: 30})
+	process(t, c)
+
+	parts := c.cachedSecrets(*argAWSSecretName)
+	assert.True(t, len(parts) > 1)
+	serviceAccount, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	for _, part := range parts {
+		_, err := c.k8sutil.GetSecret(context.TODO(), "namespace1", part.Name)
+		assert.Nil(t, err)
+		assertSecretPresent(t, serviceAccount.ImagePullSecrets, part.Name)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newServeMux returns the handlers served on --listen-address
+func newServeMux(c *controller, apiToken string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", versionHandler)
+	mux.Handle("/metrics", metricsHandler())
+	mux.Handle("/reconcile", requireToken(apiToken, http.HandlerFunc(c.reconcileHandler)))
+	mux.Handle(apiPrefix, requireToken(apiToken, http.HandlerFunc(c.apiHandler)))
+	return mux
+}
+
+// startServer serves the operational endpoints in the background; an empty address disables it
+func startServer(addr string, c *controller) {
+	if addr == "" {
+		return
+	}
+	apiToken, err := readAPIToken(*argAPITokenFile)
+	if err != nil {
+		log.Fatalf("Could not read API token file! [Err: %s]", err)
+	}
+	go func() {
+		log.Infof("Serving operational endpoints on %s", addr)
+		if err := http.ListenAndServe(addr, newServeMux(c, apiToken)); err != nil {
+			log.Fatalf("HTTP server failed! [Err: %s]", err)
+		}
+	}()
+}
+
+// leading reports whether this replica holds the leadership, or runs without leader election
+func (c *controller) leading() bool {
+	if c.elected == nil {
+		return true
+	}
+	select {
+	case <-c.elected:
+		return true
+	default:
+		return false
+	}
+}
+
+func readAPIToken(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// requireToken only lets requests through that carry "Authorization: Bearer <token>"; an empty token disables the endpoint
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "endpoint disabled, set --api-token-file to enable it", http.StatusForbidden)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reconcileHandler triggers an immediate refresh of every provider
+func (c *controller) reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// only the leader writes; a standby replica would race it for every secret and ServiceAccount
+	if !c.leading() {
+		http.Error(w, "not the leader, send the request to the leading replica", http.StatusServiceUnavailable)
+		return
+	}
+	switch err := c.triggerRefresh(); err {
+	case nil:
+	case errRefreshRunning:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	log.Infof("Immediate refresh of all providers requested by %s", r.RemoteAddr)
+	w.WriteHeader(http.StatusAccepted)
+}
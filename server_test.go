@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func serve(mux *http.ServeMux, method, path, token string) int {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestReconcileEndpointRequiresToken(t *testing.T) {
+	c := newFakeController()
+
+	assert.Equal(t, http.StatusForbidden, serve(newServeMux(c, ""), http.MethodPost, "/reconcile", "anything"))
+
+	mux := newServeMux(c, "s3cret")
+	assert.Equal(t, http.StatusUnauthorized, serve(mux, http.MethodPost, "/reconcile", ""))
+	assert.Equal(t, http.StatusUnauthorized, serve(mux, http.MethodPost, "/reconcile", "wrong"))
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(mux, http.MethodGet, "/reconcile", "s3cret"))
+}
+
+func TestReconcileEndpointNeedsLeadership(t *testing.T) {
+	c := newFakeController()
+	elected := make(chan struct{})
+	c.elected = elected
+	mux := newServeMux(c, "s3cret")
+
+	assert.Equal(t, http.StatusServiceUnavailable, serve(mux, http.MethodPost, "/reconcile", "s3cret"))
+	assert.False(t, c.refreshRunning())
+
+	// elected, but the leader's runnable has not started yet
+	close(elected)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(mux, http.MethodPost, "/reconcile", "s3cret"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.setLeaderContext(ctx)
+	assert.Equal(t, http.StatusAccepted, serve(mux, http.MethodPost, "/reconcile", "s3cret"))
+	assert.Eventually(t, func() bool { return !c.refreshRunning() }, 5*time.Second, 10*time.Millisecond)
+
+	// the leadership was lost or the controller is shutting down
+	cancel()
+	assert.Equal(t, http.StatusServiceUnavailable, serve(mux, http.MethodPost, "/reconcile", "s3cret"))
+	assert.False(t, c.refreshRunning())
+}
+
+func TestReconcileEndpointRefreshesProviders(t *testing.T) {
+	c := newFakeController()
+	c.setLeaderContext(context.Background())
+	mux := newServeMux(c, "s3cret")
+
+	assert.Equal(t, http.StatusAccepted, serve(mux, http.MethodPost, "/reconcile", "s3cret"))
+
+	assert.Eventually(t, func() bool {
+		return c.cachedSecrets(*argAWSSecretName) != nil && !c.refreshRunning()
+	}, 5*time.Second, 10*time.Millisecond)
+	assertAllExpectedSecrets(t, c)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	recordSecretSizes("ecr", []*v1.Secret{{ObjectMeta: metav1.ObjectMeta{Name: "awsecr-cred"}, Data: map[string][]byte{"a": []byte("1")}}})
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	newServeMux(newFakeController(), "").ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `registry_creds_secret_size_bytes{provider="ecr",secret="awsecr-cred"} 2`)
+	assert.Contains(t, rec.Body.String(), `registry_creds_secret_parts{provider="ecr"} 1`)
+}
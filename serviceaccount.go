@@ -0,0 +1,66 @@
+package main
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+)
+
+const (
+	annotationPrefix = secretsync.AnnotationPrefix
+
+	// serviceAccountsAnnotation on a namespace lists the ServiceAccounts that get the pull secrets, "default" if unset
+	serviceAccountsAnnotation = annotationPrefix + "service-accounts"
+	defaultServiceAccount     = "default"
+)
+
+func currentPullSecretOptions() secretsync.PullSecretOptions {
+	return secretsync.PullSecretOptions{
+		Order:  *argPullSecretOrder,
+		Dedupe: *argDedupePullSecrets,
+		Prune:  *argPrunePullSecrets,
+
+		AttachSecrets: *argAttachSASecrets,
+		SkipAnnotated: *argExcludeAnnotatedSAs,
+	}
+}
+
+// serviceAccountNames returns the ServiceAccounts of the namespace that should reference the pull secrets
+func serviceAccountNames(ns *v1.Namespace) []string {
+	names := secretsync.SplitList(ns.Annotations[serviceAccountsAnnotation])
+	if len(names) == 0 {
+		names = []string{defaultServiceAccount}
+		if *argOpenShift {
+			names = append(names, openShiftServiceAccounts...)
+		}
+	}
+	return names
+}
+
+// managedSecretNames returns the secret names of all enabled providers, in provider order, including every part of a split secret
+func (c *controller) managedSecretNames() []string {
+	return c.providerSecretNames(getSecretGenerators(c))
+}
+
+// providerSecretNames returns the names of the secrets of the given providers
+func (c *controller) providerSecretNames(secretGenerators []SecretGenerator) []string {
+	var names []string
+	for _, secretGenerator := range secretGenerators {
+		cached := c.cachedSecrets(secretGenerator.SecretName)
+		if len(cached) == 0 {
+			names = append(names, secretGenerator.SecretName)
+		}
+		for _, secret := range cached {
+			names = append(names, secret.Name)
+		}
+	}
+	return names
+}
+
+// newNamespace reports whether the namespace was created less than --service-account-wait ago, so the ServiceAccount
+// controller may not have created its ServiceAccounts yet
+func newNamespace(ns *v1.Namespace) bool {
+	return time.Since(ns.CreationTimestamp.Time) < *argServiceAccountWait
+}
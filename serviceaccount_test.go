@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	secretsync "github.com/doddle/registry-creds/pkg/sync"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func pullSecretNames(sa *v1.ServiceAccount) []string {
+	var names []string
+	for _, ref := range sa.ImagePullSecrets {
+		names = append(names, ref.Name)
+	}
+	return names
+}
+
+func TestServiceAccountNames(t *testing.T) {
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	assert.Equal(t, []string{"default"}, serviceAccountNames(ns))
+
+	ns.Annotations = map[string]string{serviceAccountsAnnotation: "default, ci-runner,"}
+	assert.Equal(t, []string{"default", "ci-runner"}, serviceAccountNames(ns))
+}
+
+func TestProcessNamespaceAnnotatedServiceAccounts(t *testing.T) {
+	c := newFakeController()
+	c.k8sutil.Kclient.(*fakeKubeClient).serviceaccounts["namespace1"].store["ci-runner"] = &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "ci-runner"}}
+	secret := c.generateSecrets(context.TODO())[0]
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "namespace1",
+		Annotations: map[string]string{serviceAccountsAnnotation: "ci-runner"},
+	}}
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+
+	ciRunner, _ := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "ci-runner")
+	assert.Equal(t, []string{secret.Name}, pullSecretNames(ciRunner))
+	defaultSA, _ := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Empty(t, pullSecretNames(defaultSA))
+
+	// a missing ServiceAccount is skipped without failing the namespace
+	ns.Annotations[serviceAccountsAnnotation] = "missing,default"
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	defaultSA, _ = c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Equal(t, []string{secret.Name}, pullSecretNames(defaultSA))
+}
+
+func TestProcessNamespaceSkipsAnnotatedServiceAccounts(t *testing.T) {
+	defer func() { *argExcludeAnnotatedSAs = false }()
+	*argExcludeAnnotatedSAs = true
+	c := newFakeController()
+	c.k8sutil.Kclient.(*fakeKubeClient).serviceaccounts["namespace1"].store["gitops"] = &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Name:        "gitops",
+		Annotations: map[string]string{secretsync.SkipAnnotation: "true"},
+	}}
+	secret := c.generateSecrets(context.TODO())[0]
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "namespace1",
+		Annotations: map[string]string{serviceAccountsAnnotation: "gitops,default"},
+	}}
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+
+	gitops, _ := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "gitops")
+	assert.Empty(t, pullSecretNames(gitops))
+	defaultSA, _ := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Equal(t, []string{secret.Name}, pullSecretNames(defaultSA))
+}
+
+func TestProcessNamespaceOpenShift(t *testing.T) {
+	defer func() { *argOpenShift = false }()
+	*argOpenShift = true
+	c := newFakeController()
+	secret := c.generateSecrets(context.TODO())[0]
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	assert.Equal(t, []string{"default", "builder", "deployer"}, serviceAccountNames(ns))
+
+	// the builder and deployer ServiceAccounts of a new project do not exist yet
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	defaultSA, _ := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Equal(t, []string{secret.Name}, pullSecretNames(defaultSA))
+
+	serviceAccounts := c.k8sutil.Kclient.(*fakeKubeClient).serviceaccounts["namespace1"].store
+	serviceAccounts["builder"] = &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "builder"}}
+	serviceAccounts["deployer"] = &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "deployer"}}
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	for _, name := range openShiftServiceAccounts {
+		sa, _ := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", name)
+		assert.Equal(t, []string{secret.Name}, pullSecretNames(sa), name)
+	}
+}
+
+func TestProcessNamespaceWaitsForServiceAccountOfNewNamespace(t *testing.T) {
+	c := newFakeController()
+	secret := c.generateSecrets(context.TODO())[0]
+	delete(c.k8sutil.Kclient.(*fakeKubeClient).serviceaccounts["namespace1"].store, "default")
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1", CreationTimestamp: metav1.Now()}}
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", secret.Name)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	// an older namespace without its ServiceAccount fails and is retried
+	ns.CreationTimestamp = metav1.NewTime(time.Now().Add(-2 * *argServiceAccountWait))
+	assert.NotNil(t, c.processNamespace(context.TODO(), ns, secret))
+}
+
+func TestProcessNamespaceCreatesMissingServiceAccounts(t *testing.T) {
+	defer func() { *argCreateServiceAccounts = false }()
+	*argCreateServiceAccounts = true
+	c := newFakeController()
+	secret := c.generateSecrets(context.TODO())[0]
+	delete(c.k8sutil.Kclient.(*fakeKubeClient).serviceaccounts["namespace1"].store, "default")
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "namespace1",
+		Annotations: map[string]string{serviceAccountsAnnotation: "default,ci-runner"},
+	}}
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	for _, name := range []string{"default", "ci-runner"} {
+		sa, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", name)
+		assert.Nil(t, err, name)
+		assert.Equal(t, []string{secret.Name}, pullSecretNames(sa), name)
+		assert.Equal(t, managedByValue, sa.Labels[managedByLabel], name)
+	}
+
+	// without create on serviceaccounts the flag is ignored
+	caps := allCapabilities()
+	caps.createServiceAccounts = false
+	c.applyCapabilities(caps)
+	ns.Annotations[serviceAccountsAnnotation] = "builder"
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	_, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "builder")
+	assert.True(t, k8sutil.IsNotFound(err))
+}
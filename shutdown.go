@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/doddle/registry-creds/k8sutil"
+)
+
+const (
+	// shutdownReportKey is the key of the shutdown report in the status ConfigMap; namespace names cannot contain a
+	// dot, so it never clashes with a namespace's key
+	shutdownReportKey = "shutdown.json"
+	// shutdownReportTimeout bounds writing the report, which happens after the manager was told to stop
+	shutdownReportTimeout = 10 * time.Second
+)
+
+// shutdownReport is the state the controller stopped in, telling whether a restart interrupted a rotation
+type shutdownReport struct {
+	Time      time.Time          `json:"time"`
+	Providers []shutdownProvider `json:"providers"`
+}
+
+type shutdownProvider struct {
+	Name string `json:"name"`
+	// LastRefresh is when the provider's tokens were last fetched successfully
+	LastRefresh *time.Time `json:"lastRefresh,omitempty"`
+	// RolloutStarted is set if the rollout of new secrets to the namespaces was still running
+	RolloutStarted *time.Time `json:"rolloutStarted,omitempty"`
+	// OutOfDate lists the namespaces last written an earlier version of the provider's secrets
+	OutOfDate []string `json:"outOfDateNamespaces,omitempty"`
+}
+
+// startRollout and finishRollout bracket the writing of a provider's new secrets into the namespaces
+func (c *controller) startRollout(provider string, now time.Time) {
+	c.secretsLock.Lock()
+	defer c.secretsLock.Unlock()
+	c.rollouts[provider] = now
+}
+
+func (c *controller) finishRollout(provider string) {
+	c.secretsLock.Lock()
+	defer c.secretsLock.Unlock()
+	delete(c.rollouts, provider)
+}
+
+// outOfDateNamespaces returns the sorted namespaces whose last written version of one of the secrets differs from it;
+// namespaces that never got the secrets are not the provider's, or are not known yet
+func outOfDateNamespaces(secrets []*v1.Secret, statuses map[string]namespaceStatus) []string {
+	var namespaces []string
+	for ns, st := range statuses {
+		for _, secret := range secrets {
+			if hash, ok := st.SecretHashes[secret.Name]; ok && hash != secretHash(secret) {
+				namespaces = append(namespaces, ns)
+				break
+			}
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// shutdownReport collects the state of every provider
+func (c *controller) shutdownReport(now time.Time) shutdownReport {
+	report := shutdownReport{Time: now.UTC(), Providers: []shutdownProvider{}}
+	statuses := c.status.snapshot()
+	for _, sg := range getSecretGenerators(c) {
+		provider := shutdownProvider{
+			Name:        sg.Name,
+			LastRefresh: timePtr(c.circuit(sg.Name).state().lastSuccess),
+		}
+		c.secretsLock.Lock()
+		secrets := c.secrets[sg.SecretName]
+		if started, ok := c.rollouts[sg.Name]; ok {
+			provider.RolloutStarted = timePtr(started)
+		}
+		c.secretsLock.Unlock()
+		provider.OutOfDate = outOfDateNamespaces(secrets, statuses)
+		report.Providers = append(report.Providers, provider)
+	}
+	return report
+}
+
+// reportShutdown logs the shutdown report and, with --status-shutdown-report, writes it into the status ConfigMap
+func (c *controller) reportShutdown(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownReportTimeout)
+	defer cancel()
+	// deleted namespaces are neither out of date nor worth reporting
+	if err := c.pruneStatus(ctx); err != nil {
+		log.Warnf("Could not list namespaces, the shutdown report may list deleted ones! [Err: %s]", err)
+	}
+	report := c.shutdownReport(now)
+	interrupted := false
+	for _, p := range report.Providers {
+		fields := log.Fields{"provider": p.Name, "outOfDateNamespaces": len(p.OutOfDate)}
+		if p.LastRefresh != nil {
+			fields["lastRefresh"] = p.LastRefresh.Format(time.RFC3339)
+		}
+		if p.RolloutStarted != nil {
+			interrupted = true
+			fields["rolloutStarted"] = p.RolloutStarted.Format(time.RFC3339)
+		}
+		entry := log.WithFields(fields)
+		switch {
+		case len(p.OutOfDate) > 0:
+			entry.Warnf("Shutting down with %d namespaces behind the current secrets of provider %s: %s", len(p.OutOfDate), p.Name, strings.Join(p.OutOfDate, ", "))
+		case p.RolloutStarted != nil:
+			entry.Warnf("Shutting down while the secrets of provider %s are rolled out", p.Name)
+		default:
+			entry.Infof("Shutting down with every known namespace of provider %s up to date", p.Name)
+		}
+	}
+	if interrupted {
+		log.Warnf("Shutting down in the middle of a rotation; the next leader syncs every namespace when it starts")
+	}
+
+	if !*argStatusShutdownReport || *argStatusConfigMap == "" || writesPaused() {
+		return
+	}
+	if err := c.writeShutdownReport(ctx, report); err != nil {
+		log.Errorf("Could not write the shutdown report to ConfigMap %s! [Err: %s]", *argStatusConfigMap, err)
+	}
+}
+
+// writeShutdownReport adds the report to the status ConfigMap, together with the latest sync state
+func (c *controller) writeShutdownReport(ctx context.Context, report shutdownReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	namespace := statusNamespace()
+	cm, err := c.status.buildStatusConfigMap(*argStatusConfigMap, namespace)
+	if err != nil {
+		return err
+	}
+	cm.Data[shutdownReportKey] = string(data)
+
+	_, err = c.k8sutil.GetConfigMap(ctx, namespace, cm.Name)
+	switch {
+	case k8sutil.IsNotFound(err):
+		return c.k8sutil.CreateConfigMap(ctx, namespace, cm)
+	case err != nil:
+		return err
+	}
+	return c.k8sutil.UpdateConfigMap(ctx, namespace, cm)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestOutOfDateNamespaces(t *testing.T) {
+	current := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "awsecr-cred"}, Data: map[string][]byte{"a": []byte("2")}}
+	previous := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "awsecr-cred"}, Data: map[string][]byte{"a": []byte("1")}}
+	statuses := map[string]namespaceStatus{
+		"up-to-date": {SecretHashes: map[string]string{"awsecr-cred": secretHash(current)}},
+		"behind-b":   {SecretHashes: map[string]string{"awsecr-cred": secretHash(previous)}},
+		"behind-a":   {SecretHashes: map[string]string{"awsecr-cred": secretHash(previous)}},
+		"other":      {SecretHashes: map[string]string{"gcr-secret": "0123456789abcdef"}},
+	}
+
+	assert.Equal(t, []string{"behind-a", "behind-b"}, outOfDateNamespaces([]*v1.Secret{current}, statuses))
+	assert.Empty(t, outOfDateNamespaces(nil, statuses))
+}
+
+func TestShutdownReport(t *testing.T) {
+	c := newFakeController()
+	process(t, c)
+
+	report := c.shutdownReport(time.Now())
+	assert.NotEmpty(t, report.Providers)
+	for _, p := range report.Providers {
+		assert.Nil(t, p.RolloutStarted)
+		assert.Empty(t, p.OutOfDate)
+	}
+
+	provider := report.Providers[0].Name
+	started := time.Date(2022, 9, 1, 10, 0, 0, 0, time.UTC)
+	c.startRollout(provider, started)
+	report = c.shutdownReport(time.Now())
+	assert.Equal(t, started, *report.Providers[0].RolloutStarted)
+
+	c.finishRollout(provider)
+	report = c.shutdownReport(time.Now())
+	assert.Nil(t, report.Providers[0].RolloutStarted)
+}
+
+func TestWriteShutdownReport(t *testing.T) {
+	c := newFakeController()
+	process(t, c)
+
+	report := c.shutdownReport(time.Now())
+	assert.Nil(t, c.writeShutdownReport(context.TODO(), report))
+	cm, err := c.k8sutil.GetConfigMap(context.TODO(), statusNamespace(), *argStatusConfigMap)
+	assert.Nil(t, err)
+	assert.Contains(t, cm.Data, "namespace1")
+
+	written := shutdownReport{}
+	assert.Nil(t, json.Unmarshal([]byte(cm.Data[shutdownReportKey]), &written))
+	assert.Len(t, written.Providers, len(report.Providers))
+
+	// the next status update keeps the report
+	process(t, c)
+	assert.Nil(t, c.writeStatus(context.TODO()))
+	cm, err = c.k8sutil.GetConfigMap(context.TODO(), statusNamespace(), *argStatusConfigMap)
+	assert.Nil(t, err)
+	assert.Contains(t, cm.Data, shutdownReportKey)
+}
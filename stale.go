@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+)
+
+// tokensExpired reports whether every cached token has expired at now; tokens without an expiry never do
+func tokensExpired(tokens []providers.AuthToken, now time.Time) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	for _, token := range tokens {
+		if token.ExpiresAt.IsZero() || token.ExpiresAt.After(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// servableSecrets returns the secrets last generated for a provider, or nil if there are none or their tokens expired,
+// so a new namespace gets a fresh fetch instead of credentials the registry no longer accepts
+func (c *controller) servableSecrets(secretName string, now time.Time) []*v1.Secret {
+	c.secretsLock.Lock()
+	defer c.secretsLock.Unlock()
+	if tokensExpired(c.tokens[secretName], now) {
+		return nil
+	}
+	return c.secrets[secretName]
+}
+
+// recordStale records whether the provider serves its cached tokens after a failed refresh: only while they have not
+// expired, which keeps the provider retried every --stale-retry-interval instead of its refresh interval
+func (c *controller) recordStale(secretGenerator SecretGenerator, fetchErr error, now time.Time) {
+	c.secretsLock.Lock()
+	stale := fetchErr != nil && len(c.secrets[secretGenerator.SecretName]) > 0 && !tokensExpired(c.tokens[secretGenerator.SecretName], now)
+	expiry := providers.EarliestExpiry(c.tokens[secretGenerator.SecretName])
+	was := c.stale[secretGenerator.Name]
+	c.stale[secretGenerator.Name] = stale
+	c.secretsLock.Unlock()
+
+	switch {
+	case stale && !was:
+		if expiry.IsZero() {
+			log.Warnf("Serving the cached credentials of provider %s while its refresh fails", secretGenerator.Name)
+		} else {
+			log.Warnf("Serving the cached credentials of provider %s, valid until %s, while its refresh fails", secretGenerator.Name, expiry.UTC().Format(time.RFC3339))
+		}
+	case !stale && was && fetchErr != nil:
+		log.Errorf("The cached credentials of provider %s expired before a refresh succeeded", secretGenerator.Name)
+	case !stale && was:
+		log.Infof("Provider %s refreshed; no longer serving its cached credentials", secretGenerator.Name)
+	}
+	if stale {
+		providerStale.WithLabelValues(secretGenerator.Name).Set(1)
+	} else {
+		providerStale.WithLabelValues(secretGenerator.Name).Set(0)
+	}
+}
+
+// isStale reports whether the provider serves its cached tokens after a failed refresh
+func (c *controller) isStale(provider string) bool {
+	c.secretsLock.Lock()
+	defer c.secretsLock.Unlock()
+	return c.stale[provider]
+}
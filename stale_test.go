@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestStaleTokensServedUntilExpiry(t *testing.T) {
+	c := newFakeController()
+	expiry := time.Now().Add(time.Hour)
+	var fetchErr error
+	sg := SecretGenerator{
+		Name:            "stale-test",
+		SecretName:      "stale-cred",
+		IsJSONCfg:       true,
+		RefreshInterval: 6 * time.Hour,
+		Retry:           RetryConfig{Type: retryTypeSimple},
+		TokenGenFxn: func(context.Context) ([]AuthToken, error) {
+			if fetchErr != nil {
+				return nil, fetchErr
+			}
+			return []AuthToken{{AccessToken: "token", Endpoint: "https://registry.example.com", ExpiresAt: expiry}}, nil
+		},
+	}
+	defer providerStale.DeleteLabelValues(sg.Name)
+
+	_, ok, err := c.refreshSecret(context.TODO(), sg)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.False(t, c.isStale(sg.Name))
+	cached := c.cachedSecrets(sg.SecretName)
+
+	fetchErr = errors.New("registry down")
+	_, ok, err = c.refreshSecret(context.TODO(), sg)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.True(t, c.isStale(sg.Name))
+	assert.Equal(t, float64(1), testutil.ToFloat64(providerStale.WithLabelValues(sg.Name)))
+	assert.Equal(t, *argStaleRetryInterval, c.nextRefresh(sg, time.Now()))
+
+	// new namespaces still get the cached secret
+	assert.Equal(t, cached, c.generateProviderSecrets(context.TODO(), []SecretGenerator{sg}))
+	assert.Equal(t, cached, c.servableSecrets(sg.SecretName, time.Now()))
+	assert.Nil(t, c.servableSecrets(sg.SecretName, expiry.Add(time.Second)))
+
+	fetchErr = nil
+	_, ok, err = c.refreshSecret(context.TODO(), sg)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.False(t, c.isStale(sg.Name))
+	assert.Equal(t, float64(0), testutil.ToFloat64(providerStale.WithLabelValues(sg.Name)))
+}
+
+func TestExpiredTokensAreNotStale(t *testing.T) {
+	c := newFakeController()
+	sg := SecretGenerator{Name: "stale-test", SecretName: "stale-cred"}
+	defer providerStale.DeleteLabelValues(sg.Name)
+
+	c.secrets[sg.SecretName] = []*v1.Secret{{}}
+	c.tokens[sg.SecretName] = []AuthToken{{ExpiresAt: time.Now().Add(-time.Minute)}}
+	c.recordStale(sg, errors.New("registry down"), time.Now())
+	assert.False(t, c.isStale(sg.Name))
+
+	// nothing cached yet
+	c.recordStale(SecretGenerator{Name: "other", SecretName: "other"}, errors.New("registry down"), time.Now())
+	assert.False(t, c.isStale("other"))
+	providerStale.DeleteLabelValues("other")
+}
+
+func TestTokensExpired(t *testing.T) {
+	now := time.Date(2022, 9, 1, 10, 30, 0, 0, time.UTC)
+	assert.False(t, tokensExpired(nil, now))
+	assert.False(t, tokensExpired([]AuthToken{{}}, now))
+	assert.False(t, tokensExpired([]AuthToken{{ExpiresAt: now.Add(-time.Hour)}, {ExpiresAt: now.Add(time.Hour)}}, now))
+	assert.True(t, tokensExpired([]AuthToken{{ExpiresAt: now.Add(-time.Hour)}, {ExpiresAt: now}}, now))
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// namespaceStatus is the sync state of a single namespace, stored as JSON in the status ConfigMap
+type namespaceStatus struct {
+	LastSuccess         *time.Time        `json:"lastSuccess,omitempty"`
+	LastError           string            `json:"lastError,omitempty"`
+	LastErrorTime       *time.Time        `json:"lastErrorTime,omitempty"`
+	ConsecutiveFailures int               `json:"consecutiveFailures"`
+	SecretHashes        map[string]string `json:"secretHashes,omitempty"`
+}
+
+// statusTracker keeps the per-namespace sync state in memory until it is written to the status ConfigMap
+type statusTracker struct {
+	sync.Mutex
+	namespaces map[string]*namespaceStatus
+	dirty      bool
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{namespaces: map[string]*namespaceStatus{}}
+}
+
+func (s *statusTracker) get(namespace string) *namespaceStatus {
+	st, ok := s.namespaces[namespace]
+	if !ok {
+		st = &namespaceStatus{SecretHashes: map[string]string{}}
+		s.namespaces[namespace] = st
+	}
+	return st
+}
+
+// record updates the namespace's state with the outcome of syncing secret into it
+func (s *statusTracker) record(namespace string, secret *v1.Secret, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now().UTC()
+	st := s.get(namespace)
+	if err != nil {
+		st.LastError = err.Error()
+		st.LastErrorTime = &now
+		st.ConsecutiveFailures++
+	} else {
+		st.LastSuccess = &now
+		st.ConsecutiveFailures = 0
+		st.SecretHashes[secret.Name] = secretHash(secret)
+	}
+	s.dirty = true
+}
+
+// prune forgets the namespaces that are not in existing, so deleted namespaces leave the status ConfigMap
+func (s *statusTracker) prune(existing map[string]bool) int {
+	s.Lock()
+	defer s.Unlock()
+
+	removed := 0
+	for name := range s.namespaces {
+		if !existing[name] {
+			delete(s.namespaces, name)
+			removed++
+		}
+	}
+	if removed > 0 {
+		s.dirty = true
+	}
+	return removed
+}
+
+// snapshot returns a copy of the tracked state, keyed by namespace
+func (s *statusTracker) snapshot() map[string]namespaceStatus {
+	s.Lock()
+	defer s.Unlock()
+
+	result := make(map[string]namespaceStatus, len(s.namespaces))
+	for name, st := range s.namespaces {
+		cp := *st
+		cp.SecretHashes = map[string]string{}
+		for k, v := range st.SecretHashes {
+			cp.SecretHashes[k] = v
+		}
+		result[name] = cp
+	}
+	return result
+}
+
+// secretHash returns a short, stable fingerprint of the secret's data that does not reveal its content
+func secretHash(secret *v1.Secret) string {
+	keys := make([]string, 0, len(secret.Data))
+	for k := range secret.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write(secret.Data[k])
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// statusNamespace is where the status ConfigMap lives: --status-namespace, else the pod's own namespace, else kube-system
+func statusNamespace() string {
+	if *argStatusNamespace != "" {
+		return *argStatusNamespace
+	}
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	return "kube-system"
+}
+
+// buildStatusConfigMap renders the tracked state into the status ConfigMap
+func (s *statusTracker) buildStatusConfigMap(name, namespace string) (*v1.ConfigMap, error) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Data: map[string]string{},
+	}
+	setManagedMetadata(&cm.ObjectMeta)
+	for ns, st := range s.snapshot() {
+		data, err := json.Marshal(st)
+		if err != nil {
+			return nil, err
+		}
+		cm.Data[ns] = string(data)
+	}
+	return cm, nil
+}
+
+// pruneStatus drops the state of namespaces that no longer exist
+func (c *controller) pruneStatus(ctx context.Context) error {
+	namespaces, err := c.k8sutil.GetNamespaces(ctx)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(namespaces.Items))
+	for _, ns := range namespaces.Items {
+		existing[ns.Name] = true
+	}
+	if removed := c.status.prune(existing); removed > 0 {
+		log.Debugf("Removed %d deleted namespaces from the sync status", removed)
+	}
+	return nil
+}
+
+// writeStatus creates or updates the status ConfigMap if anything changed since the last write
+func (c *controller) writeStatus(ctx context.Context) error {
+	if writesPaused() {
+		return nil
+	}
+	if err := c.pruneStatus(ctx); err != nil {
+		log.Warnf("Could not list namespaces, keeping deleted ones in the sync status! [Err: %s]", err)
+	}
+	c.status.Lock()
+	dirty := c.status.dirty
+	c.status.dirty = false
+	c.status.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	namespace := statusNamespace()
+	cm, err := c.status.buildStatusConfigMap(*argStatusConfigMap, namespace)
+	if err != nil {
+		return err
+	}
+
+	existing, err := c.k8sutil.GetConfigMap(ctx, namespace, cm.Name)
+	switch {
+	case k8sutil.IsNotFound(err):
+		err = c.k8sutil.CreateConfigMap(ctx, namespace, cm)
+	case err == nil:
+		// the last shutdown report stays until the next shutdown replaces it
+		if report, ok := existing.Data[shutdownReportKey]; ok {
+			cm.Data[shutdownReportKey] = report
+		}
+		err = c.k8sutil.UpdateConfigMap(ctx, namespace, cm)
+	}
+	if err != nil {
+		c.status.Lock()
+		c.status.dirty = true
+		c.status.Unlock()
+	}
+	return err
+}
+
+// runStatusWriter periodically persists the sync state; an empty --status-configmap disables it
+func (c *controller) runStatusWriter(ctx context.Context) {
+	if *argStatusConfigMap == "" {
+		return
+	}
+	log.Infof("Writing sync status to ConfigMap %s/%s every %s", statusNamespace(), *argStatusConfigMap, *argStatusInterval)
+	ticker := time.NewTicker(*argStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.writeStatus(ctx); err != nil {
+				log.Errorf("Could not write status ConfigMap %s! [Err: %s]", *argStatusConfigMap, err)
+			}
+		}
+	}
+}
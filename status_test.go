@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSecretHashIsStable(t *testing.T) {
+	a := &v1.Secret{Data: map[string][]byte{"a": []byte("1"), "b": []byte("2")}}
+	b := &v1.Secret{Data: map[string][]byte{"b": []byte("2"), "a": []byte("1")}}
+	c := &v1.Secret{Data: map[string][]byte{"a": []byte("1"), "b": []byte("3")}}
+
+	assert.Equal(t, secretHash(a), secretHash(b))
+	assert.NotEqual(t, secretHash(a), secretHash(c))
+	assert.Len(t, secretHash(a), 16)
+}
+
+func TestStatusTrackerRecord(t *testing.T) {
+	s := newStatusTracker()
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "awsecr-cred"}, Data: map[string][]byte{"a": []byte("1")}}
+
+	s.record("namespace1", secret, errors.New("boom"))
+	s.record("namespace1", secret, errors.New("boom"))
+	st := s.snapshot()["namespace1"]
+	assert.Equal(t, 2, st.ConsecutiveFailures)
+	assert.Equal(t, "boom", st.LastError)
+	assert.Nil(t, st.LastSuccess)
+
+	s.record("namespace1", secret, nil)
+	st = s.snapshot()["namespace1"]
+	assert.Equal(t, 0, st.ConsecutiveFailures)
+	assert.NotNil(t, st.LastSuccess)
+	assert.Equal(t, secretHash(secret), st.SecretHashes["awsecr-cred"])
+}
+
+func TestWriteStatus(t *testing.T) {
+	c := newFakeController()
+	process(t, c)
+
+	assert.Nil(t, c.writeStatus(context.TODO()))
+	cm, err := c.k8sutil.GetConfigMap(context.TODO(), statusNamespace(), *argStatusConfigMap)
+	assert.Nil(t, err)
+	assert.Contains(t, cm.Data, "namespace1")
+	assert.Contains(t, cm.Data, "namespace2")
+
+	st := namespaceStatus{}
+	assert.Nil(t, json.Unmarshal([]byte(cm.Data["namespace1"]), &st))
+	assert.NotNil(t, st.LastSuccess)
+	assert.Contains(t, st.SecretHashes, *argAWSSecretName)
+
+	// a second sync updates the existing ConfigMap
+	process(t, c)
+	assert.Nil(t, c.writeStatus(context.TODO()))
+}
+
+func TestWriteStatusDropsDeletedNamespaces(t *testing.T) {
+	c := newFakeController()
+	process(t, c)
+	c.status.record("deleted", &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: *argAWSSecretName}}, nil)
+
+	assert.Nil(t, c.writeStatus(context.TODO()))
+	cm, err := c.k8sutil.GetConfigMap(context.TODO(), statusNamespace(), *argStatusConfigMap)
+	assert.Nil(t, err)
+	assert.Contains(t, cm.Data, "namespace1")
+	assert.NotContains(t, cm.Data, "deleted")
+	assert.NotContains(t, c.status.snapshot(), "deleted")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+)
+
+const (
+	providerTokenExchange = providers.TokenExchangeName
+
+	defaultTokenExchangeSecretName = "token-exchange-cred"
+	// minTokenExpiration is the shortest validity the TokenRequest API issues
+	minTokenExpiration = 10 * time.Minute
+)
+
+// TokenExchangeConfig configures the token-exchange provider, which trades a projected ServiceAccount token for the
+// credentials of a registry
+type TokenExchangeConfig struct {
+	// URL of the registry's token service
+	URL string `json:"url"`
+	// Registry is the endpoint the credentials are written for
+	Registry string `json:"registry"`
+	// Audience of the requested ServiceAccount token, as expected by the token service
+	Audience string `json:"audience"`
+	// ServiceAccount whose token is requested, in Namespace, which defaults to the status namespace
+	ServiceAccount string `json:"serviceAccount"`
+	Namespace      string `json:"namespace,omitempty"`
+	// TokenExpiration is how long the ServiceAccount token is valid, at least and by default 10m
+	TokenExpiration *metav1.Duration `json:"tokenExpiration,omitempty"`
+	// Username is used when the token service returns none
+	Username string `json:"username,omitempty"`
+	// SecretName of the distributed secret, "token-exchange-cred" by default
+	SecretName string `json:"secretName,omitempty"`
+	// Insecure allows an http url, which sends the ServiceAccount token in cleartext, e.g. to a sidecar on localhost
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+func (t *TokenExchangeConfig) validate() error {
+	u, err := url.Parse(t.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return fmt.Errorf("invalid url '%s'", t.URL)
+	}
+	if u.Scheme == "http" && !t.Insecure {
+		return fmt.Errorf("url '%s' would send the ServiceAccount token in cleartext, use https or set insecure", t.URL)
+	}
+	if t.Registry == "" {
+		return fmt.Errorf("registry is required")
+	}
+	if t.Audience == "" {
+		return fmt.Errorf("audience is required")
+	}
+	if t.ServiceAccount == "" {
+		return fmt.Errorf("serviceAccount is required")
+	}
+	if t.TokenExpiration != nil && t.TokenExpiration.Duration < minTokenExpiration {
+		return fmt.Errorf("tokenExpiration must be at least %s", minTokenExpiration)
+	}
+	return nil
+}
+
+func (t *TokenExchangeConfig) secretName() string {
+	if t.SecretName != "" {
+		return t.SecretName
+	}
+	return defaultTokenExchangeSecretName
+}
+
+func (t *TokenExchangeConfig) namespace() string {
+	if t.Namespace != "" {
+		return t.Namespace
+	}
+	return statusNamespace()
+}
+
+func (t *TokenExchangeConfig) expiration() time.Duration {
+	if t.TokenExpiration != nil {
+		return t.TokenExpiration.Duration
+	}
+	return minTokenExpiration
+}
+
+// tokenExchange returns the token-exchange provider's settings, nil if it is not configured
+func (cfg *Config) tokenExchange() *TokenExchangeConfig {
+	if p := cfg.provider(providerTokenExchange); p != nil {
+		return p.TokenExchange
+	}
+	return nil
+}
+
+// warnInsecureTokenExchange logs that the token-exchange provider of cfg sends its ServiceAccount token in cleartext
+func warnInsecureTokenExchange(cfg *Config) {
+	if settings := cfg.tokenExchange(); settings != nil && settings.Insecure && strings.HasPrefix(settings.URL, "http:") {
+		log.Warnf("The token-exchange provider sends the ServiceAccount token of %s/%s in cleartext to %s", settings.namespace(), settings.ServiceAccount, settings.URL)
+	}
+}
+
+// tokenExchangeTokens requests a ServiceAccount token through the TokenRequest API and exchanges it for the
+// registry's credentials, with the settings of the current config
+func (c *controller) tokenExchangeTokens(ctx context.Context) ([]AuthToken, error) {
+	cfg := c.currentConfig()
+	settings := cfg.tokenExchange()
+	if settings == nil {
+		return []AuthToken{}, fmt.Errorf("provider %s is no longer configured", providerTokenExchange)
+	}
+	client, err := newProviderHTTPClient(cfg.providerTLS(providerTokenExchange))
+	if err != nil {
+		return []AuthToken{}, err
+	}
+	defer client.CloseIdleConnections()
+
+	exchange := &providers.TokenExchange{
+		URL:      settings.URL,
+		Registry: settings.Registry,
+		Username: settings.Username,
+		SubjectToken: func(ctx context.Context) (string, error) {
+			status, err := c.k8sutil.CreateServiceAccountToken(ctx, settings.namespace(), settings.ServiceAccount, settings.Audience, settings.expiration())
+			if err != nil {
+				return "", err
+			}
+			return status.Token, nil
+		},
+		Client:  client,
+		Timeout: *argProviderTimeout,
+	}
+	return exchange.Tokens(ctx)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfigTokenExchange(t *testing.T) {
+	_, err := loadConfig(writeConfig(t, `
+providers:
+  - name: token-exchange
+`))
+	assert.ErrorContains(t, err, "needs tokenExchange settings")
+
+	_, err = loadConfig(writeConfig(t, `
+providers:
+  - name: ecr
+    tokenExchange:
+      url: https://token.example.com
+      registry: registry.example.com
+      audience: registry.example.com
+      serviceAccount: registry-creds
+  - name: token-exchange
+    tokenExchange:
+      url: token.example.com
+      tokenExpiration: 1m
+`))
+	assert.ErrorContains(t, err, "only supported by provider 'token-exchange'")
+	assert.ErrorContains(t, err, "invalid url 'token.example.com'")
+
+	const plain = `
+providers:
+  - name: token-exchange
+    tokenExchange:
+      url: http://localhost:8081/token
+      registry: registry.example.com
+      audience: registry.example.com
+      serviceAccount: registry-creds
+`
+	_, err = loadConfig(writeConfig(t, plain))
+	assert.ErrorContains(t, err, "cleartext")
+	_, err = loadConfig(writeConfig(t, plain+"      insecure: true\n"))
+	assert.Nil(t, err)
+
+	cfg, err := loadConfig(writeConfig(t, `
+providers:
+  - name: token-exchange
+    tokenExchange:
+      url: https://token.example.com
+      registry: registry.example.com
+      audience: registry.example.com
+      serviceAccount: registry-creds
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, defaultTokenExchangeSecretName, cfg.tokenExchange().secretName())
+	assert.Equal(t, minTokenExpiration, cfg.tokenExchange().expiration())
+}
+
+func TestTokenExchangeProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer default@registry.example.com" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"username": "robot", "password": "secret", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	cfg, err := loadConfig(writeConfig(t, `
+providers:
+  - name: token-exchange
+    tokenExchange:
+      url: `+server.URL+`
+      registry: registry.example.com
+      audience: registry.example.com
+      serviceAccount: default
+      namespace: namespace1
+      secretName: corp-registry
+      insecure: true
+`))
+	assert.Nil(t, err)
+	c := newFakeController()
+	c.config = cfg
+
+	generators := getSecretGenerators(c)
+	assert.Equal(t, providerTokenExchange, generators[len(generators)-1].Name)
+	assert.Equal(t, "corp-registry", generators[len(generators)-1].SecretName)
+
+	tokens, err := c.tokenExchangeTokens(context.TODO())
+	assert.Nil(t, err)
+	if assert.Len(t, tokens, 1) {
+		assert.Equal(t, "registry.example.com", tokens[0].Host())
+		assert.False(t, tokens[0].ExpiresAt.IsZero())
+	}
+
+	// the token is requested for a ServiceAccount that does not exist
+	cfg.tokenExchange().ServiceAccount = "missing"
+	_, err = c.tokenExchangeTokens(context.TODO())
+	assert.ErrorContains(t, err, "could not create token for service account missing")
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/doddle/registry-creds/k8sutil"
+)
+
+// --unmanaged-secrets values: what happens to an existing secret of the managed name that registry-creds did not write
+const (
+	// unmanagedOverwrite replaces it like a managed secret
+	unmanagedOverwrite = "overwrite"
+	// unmanagedAdopt replaces its data but keeps its labels and annotations, as if it had the adopt annotation
+	unmanagedAdopt = "adopt"
+	// unmanagedSkip leaves it and the namespace's ServiceAccounts alone
+	unmanagedSkip = "skip"
+
+	reasonUnmanagedSecret = "UnmanagedSecret"
+	reasonAdoptedSecret   = "AdoptedSecret"
+
+	// adoptAnnotation set to "true" on a secret of a managed name hands it to the controller, whatever
+	// --unmanaged-secrets says; the controller then keeps the secret's own labels and annotations on every write
+	adoptAnnotation = annotationPrefix + "adopt"
+)
+
+// managedSecret reports whether the controller wrote the secret, going by its managed-by label
+func managedSecret(meta metav1.Object) bool {
+	return meta.GetLabels()[managedByLabel] == managedLabels()[managedByLabel]
+}
+
+// legacySecret reports whether the secret was written by the registry-creds release from before the managed-by label,
+// which only knew ECR: a kubernetes.io/dockerconfigjson secret with nothing but .dockerconfigjson, whose entries all
+// have the "none" email, no username or password, and an AWS token as auth. kubectl and most other tools write the
+// username and password and no such email, so a secret created by hand does not pass.
+func legacySecret(secret *v1.Secret) bool {
+	if secret.Type != v1.SecretTypeDockerConfigJson || len(secret.Data) != 1 {
+		return false
+	}
+	registries := secretRegistries(secret)
+	if len(registries) == 0 {
+		return false
+	}
+	for _, entry := range registries {
+		if entry.Email != "none" || entry.Username != "" || entry.Password != "" {
+			return false
+		}
+		auth, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil || !strings.HasPrefix(string(auth), "AWS:") {
+			return false
+		}
+	}
+	return true
+}
+
+// sameRegistries reports whether both secrets hold docker config entries for the same registries
+func sameRegistries(a, b *v1.Secret) bool {
+	left, right := secretRegistries(a), secretRegistries(b)
+	if len(left) != len(right) {
+		return false
+	}
+	for registry := range left {
+		if _, ok := right[registry]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// legacySecretOf reads the secret of the name in namespace and reports whether it is a legacy secret for the registries
+// of secret, i.e. one an upgrade from the release before the managed-by label left behind. Such a secret is managed
+// whatever --unmanaged-secrets says, so upgrading does not stop its refresh.
+func (c *controller) legacySecretOf(ctx context.Context, namespace string, secret *v1.Secret) (bool, error) {
+	existing, err := c.k8sutil.GetSecret(ctx, namespace, secret.Name)
+	if k8sutil.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return legacySecret(existing) && sameRegistries(existing, secret), nil
+}
+
+// ownsSecret reports whether the controller may delete the existing secret: it carries the managed-by label or the
+// adopt annotation, or is a legacy secret. A secret of a managed name that someone else created is theirs to remove.
+func (c *controller) ownsSecret(ctx context.Context, namespace string, existing *metav1.PartialObjectMetadata) (bool, error) {
+	if managedSecret(existing) || existing.GetAnnotations()[adoptAnnotation] == "true" {
+		return true, nil
+	}
+	secret, err := c.k8sutil.GetSecret(ctx, namespace, existing.GetName())
+	if err != nil {
+		return false, err
+	}
+	return legacySecret(secret), nil
+}
+
+// claimSecret applies the adopt annotation and --unmanaged-secrets to the secret about to be written into namespace. It
+// returns the secret to write, with the existing labels and annotations when adopted, or nil if the existing secret is
+// to be left alone.
+func (c *controller) claimSecret(ctx context.Context, namespace string, secret *v1.Secret) (*v1.Secret, error) {
+	existing, err := c.k8sutil.GetSecretMetadata(ctx, namespace, secret.Name)
+	if k8sutil.IsNotFound(err) {
+		return secret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if existing.GetAnnotations()[adoptAnnotation] == "true" {
+		if !managedSecret(existing) {
+			unmanagedSecrets.WithLabelValues(unmanagedAdopt).Inc()
+			log.Infof("Adopting secret %s in namespace %s, it is annotated %s", secret.Name, namespace, adoptAnnotation)
+			c.secretEventf(existing, v1.EventTypeNormal, reasonAdoptedSecret, "Adopted secret %s as asked by its %s annotation; its data is now managed by registry-creds", secret.Name, adoptAnnotation)
+		}
+		return adoptSecret(existing, secret), nil
+	}
+	if managedSecret(existing) {
+		return secret, nil
+	}
+	legacy, err := c.legacySecretOf(ctx, namespace, secret)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		log.Infof("Secret %s in namespace %s predates the managed-by label; labelling it", secret.Name, namespace)
+		return secret, nil
+	}
+
+	unmanagedSecrets.WithLabelValues(*argUnmanagedSecrets).Inc()
+	switch *argUnmanagedSecrets {
+	case unmanagedSkip:
+		log.Warnf("Secret %s in namespace %s was not written by registry-creds; leaving it alone", secret.Name, namespace)
+		c.secretEventf(existing, v1.EventTypeWarning, reasonUnmanagedSecret, "Secret %s was not written by registry-creds, so its credentials are not kept up to date; delete it or rename it to let registry-creds manage it", secret.Name)
+		return nil, nil
+	case unmanagedAdopt:
+		log.Infof("Adopting secret %s in namespace %s, which was not written by registry-creds", secret.Name, namespace)
+		c.secretEventf(existing, v1.EventTypeNormal, reasonAdoptedSecret, "Adopted secret %s, keeping its labels and annotations; its data is now managed by registry-creds", secret.Name)
+		return adoptSecret(existing, secret), nil
+	}
+	log.Warnf("Overwriting secret %s in namespace %s, which was not written by registry-creds", secret.Name, namespace)
+	c.secretEventf(existing, v1.EventTypeWarning, reasonUnmanagedSecret, "Overwriting secret %s, which was not written by registry-creds; its data, labels and annotations are replaced", secret.Name)
+	return secret, nil
+}
+
+// adoptSecret returns the secret to write over an adopted one: the existing labels and annotations with the managed
+// ones and the adopt annotation added, so later writes keep them too
+func adoptSecret(existing *metav1.PartialObjectMetadata, secret *v1.Secret) *v1.Secret {
+	// the secret is shared by every namespace of the provider
+	adopted := secret.DeepCopy()
+	adopted.Labels = mergeStringMaps(mergeStringMaps(nil, existing.Labels), secret.Labels)
+	adopted.Annotations = mergeStringMaps(mergeStringMaps(nil, existing.Annotations), secret.Annotations)
+	adopted.Annotations = mergeStringMaps(adopted.Annotations, map[string]string{adoptAnnotation: "true"})
+	return adopted
+}
+
+// secretEventf records an Event on a secret in a managed namespace, for its owners to see
+func (c *controller) secretEventf(secret *metav1.PartialObjectMetadata, eventType, reason, messageFmt string, args ...interface{}) {
+	if c.recorder == nil {
+		return
+	}
+	c.recorder.Eventf(secret, eventType, reason, messageFmt, args...)
+}
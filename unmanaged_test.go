@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// newUnmanagedSecretController returns a controller whose namespace1 holds a user-created secret of the managed name
+func newUnmanagedSecretController() (*controller, *v1.Secret, *record.FakeRecorder) {
+	c := newFakeController()
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	secret := c.generateSecrets(context.TODO())[0]
+	c.k8sutil.Kclient.(*fakeKubeClient).secrets["namespace1"].store[secret.Name] = &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: secret.Name, Namespace: "namespace1", Labels: map[string]string{"team": "a"}},
+		Data:       map[string][]byte{v1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+	}
+	return c, secret, recorder
+}
+
+func TestUnmanagedSecrets(t *testing.T) {
+	defer func(action string) { *argUnmanagedSecrets = action }(*argUnmanagedSecrets)
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+
+	*argUnmanagedSecrets = unmanagedSkip
+	c, secret, recorder := newUnmanagedSecretController()
+	require.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	written, _ := c.k8sutil.GetSecret(context.TODO(), "namespace1", secret.Name)
+	assert.Equal(t, `{"auths":{}}`, string(written.Data[v1.DockerConfigJsonKey]))
+	sa, _ := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Empty(t, pullSecretNames(sa))
+	assert.Contains(t, <-recorder.Events, "Warning UnmanagedSecret")
+
+	*argUnmanagedSecrets = unmanagedAdopt
+	c, secret, recorder = newUnmanagedSecretController()
+	require.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	written, _ = c.k8sutil.GetSecret(context.TODO(), "namespace1", secret.Name)
+	assert.Equal(t, secret.Data, written.Data)
+	assert.Equal(t, "a", written.Labels["team"])
+	assert.True(t, managedSecret(written))
+	assert.NotContains(t, secret.Labels, "team", "the provider's secret is shared with the other namespaces")
+	assert.Contains(t, <-recorder.Events, "Normal AdoptedSecret")
+
+	// the adopted secret keeps its labels on later writes
+	require.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	written, _ = c.k8sutil.GetSecret(context.TODO(), "namespace1", secret.Name)
+	assert.Equal(t, "a", written.Labels["team"])
+	assert.Empty(t, recorder.Events)
+
+	*argUnmanagedSecrets = unmanagedOverwrite
+	c, secret, recorder = newUnmanagedSecretController()
+	require.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	written, _ = c.k8sutil.GetSecret(context.TODO(), "namespace1", secret.Name)
+	assert.Equal(t, secret.Data, written.Data)
+	assert.NotContains(t, written.Labels, "team")
+	assert.Contains(t, <-recorder.Events, "Warning UnmanagedSecret")
+
+	// once written, the secret is managed and no longer reported
+	require.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	assert.Empty(t, recorder.Events)
+}
+
+func TestAdoptAnnotation(t *testing.T) {
+	defer func(action string) { *argUnmanagedSecrets = action }(*argUnmanagedSecrets)
+	*argUnmanagedSecrets = unmanagedSkip
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+
+	c, secret, recorder := newUnmanagedSecretController()
+	existing := c.k8sutil.Kclient.(*fakeKubeClient).secrets["namespace1"].store[secret.Name]
+	existing.Annotations = map[string]string{adoptAnnotation: "true", "owner": "team-a"}
+	require.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+
+	written, _ := c.k8sutil.GetSecret(context.TODO(), "namespace1", secret.Name)
+	assert.Equal(t, secret.Data, written.Data)
+	assert.True(t, managedSecret(written))
+	assert.Equal(t, "team-a", written.Annotations["owner"])
+	assert.Equal(t, "a", written.Labels["team"])
+	sa, _ := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Equal(t, []string{secret.Name}, pullSecretNames(sa))
+	assert.Contains(t, <-recorder.Events, "Normal AdoptedSecret")
+}
+
+func TestValidateParamsUnmanagedSecrets(t *testing.T) {
+	defer func(action string) { *argUnmanagedSecrets = action }(*argUnmanagedSecrets)
+	*argUnmanagedSecrets = "ignore"
+
+	_, problems := validateParams()
+	assert.Contains(t, problemStrings(problems), `flag --unmanaged-secrets="ignore": must be overwrite, adopt or skip; defaulting to overwrite`)
+	assert.Equal(t, unmanagedOverwrite, *argUnmanagedSecrets)
+}
+
+// setExistingRegistries gives the secret of the managed name in namespace1 a docker config entry for every registry of
+// secret, as written by the release before the managed-by label or, with a username, by kubectl
+func setExistingRegistries(t *testing.T, c *controller, secret *v1.Secret, username string) {
+	auths := map[string]registryAuth{}
+	for registry := range secretRegistries(secret) {
+		entry := registryAuth{Auth: base64.StdEncoding.EncodeToString([]byte("AWS:old-token")), Email: "none"}
+		if username != "" {
+			entry = registryAuth{Auth: entry.Auth, Username: username, Password: "old-token"}
+		}
+		auths[registry] = entry
+	}
+	data, err := json.Marshal(dockerJSON{Auths: auths})
+	require.Nil(t, err)
+	existing := c.k8sutil.Kclient.(*fakeKubeClient).secrets["namespace1"].store[secret.Name]
+	existing.Type = v1.SecretTypeDockerConfigJson
+	existing.Data = map[string][]byte{v1.DockerConfigJsonKey: data}
+}
+
+func TestLegacySecretIsManaged(t *testing.T) {
+	defer func(action string) { *argUnmanagedSecrets = action }(*argUnmanagedSecrets)
+	*argUnmanagedSecrets = unmanagedSkip
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+
+	// written by the release before the managed-by label, with the credentials of an earlier refresh
+	c, secret, recorder := newUnmanagedSecretController()
+	setExistingRegistries(t, c, secret, "")
+	require.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+
+	written, _ := c.k8sutil.GetSecret(context.TODO(), "namespace1", secret.Name)
+	assert.Equal(t, secret.Data, written.Data)
+	assert.True(t, managedSecret(written))
+	sa, _ := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Equal(t, []string{secret.Name}, pullSecretNames(sa))
+	assert.Empty(t, recorder.Events)
+
+	// created by hand for the same registries, e.g. with kubectl create secret docker-registry
+	c, secret, recorder = newUnmanagedSecretController()
+	setExistingRegistries(t, c, secret, "AWS")
+	require.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+
+	written, _ = c.k8sutil.GetSecret(context.TODO(), "namespace1", secret.Name)
+	assert.NotEqual(t, secret.Data, written.Data)
+	assert.False(t, managedSecret(written))
+	assert.Contains(t, <-recorder.Events, "Warning UnmanagedSecret")
+}
+
+func TestLegacySecret(t *testing.T) {
+	config := func(entry string) *v1.Secret {
+		return &v1.Secret{
+			Type: v1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{v1.DockerConfigJsonKey: []byte(`{"auths":{"https://1234.dkr.ecr.us-east-1.amazonaws.com":` + entry + `}}`)},
+		}
+	}
+	awsAuth := base64.StdEncoding.EncodeToString([]byte("AWS:token"))
+
+	assert.True(t, legacySecret(config(`{"auth":"`+awsAuth+`","email":"none"}`)))
+	assert.False(t, legacySecret(config(`{"auth":"`+awsAuth+`","email":"none","username":"AWS","password":"token"}`)))
+	assert.False(t, legacySecret(config(`{"auth":"`+awsAuth+`","email":"ops@example.com"}`)))
+	assert.False(t, legacySecret(config(`{"auth":"`+base64.StdEncoding.EncodeToString([]byte("robot:token"))+`","email":"none"}`)))
+
+	opaque := config(`{"auth":"` + awsAuth + `","email":"none"}`)
+	opaque.Type = v1.SecretTypeOpaque
+	assert.False(t, legacySecret(opaque))
+	extra := config(`{"auth":"` + awsAuth + `","email":"none"}`)
+	extra.Data["token"] = []byte("token")
+	assert.False(t, legacySecret(extra))
+}
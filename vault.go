@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+const (
+	outputVault = "vault"
+
+	// serviceAccountTokenFile is the controller's own ServiceAccount token, presented to Vault's Kubernetes auth method
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	// vaultLoginMargin renews a Vault login this long before its lease ends
+	vaultLoginMargin = time.Minute
+)
+
+// credentialSink receives the secrets of every successful provider refresh once, for consumers outside the cluster
+type credentialSink interface {
+	name() string
+	writeCredentials(ctx context.Context, secrets []*v1.Secret) error
+}
+
+// writeSinks hands a provider's freshly generated secrets to every credential sink
+func (c *controller) writeSinks(ctx context.Context, secretGenerator SecretGenerator, secrets []*v1.Secret) error {
+	if writesPaused() {
+		return nil
+	}
+	var errs []error
+	for _, sink := range c.sinks {
+		if err := sink.writeCredentials(ctx, secrets); err != nil {
+			errs = append(errs, fmt.Errorf("could not write to %s: %w", sink.name(), err))
+			continue
+		}
+		log.Infof("Wrote the credentials of provider %s to %s", secretGenerator.Name, sink.name())
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// vaultSink writes every secret to the KV version 2 secret <mount>/<path>/<secret name> of a Vault server, one field
+// per secret key plus expiresAt, authenticating with a token file or else Vault's Kubernetes auth method
+type vaultSink struct {
+	addr      string
+	mount     string
+	path      string
+	tokenFile string
+	role      string
+	authMount string
+	jwtFile   string
+	client    *http.Client
+
+	mu      sync.Mutex
+	token   string
+	renewAt time.Time
+}
+
+func newVaultSink(addr, mount, path, tokenFile, role, authMount string) (*vaultSink, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("--vault-addr is required with --output=%s", outputVault)
+	}
+	if tokenFile == "" && role == "" {
+		return nil, fmt.Errorf("either --vault-token-file or --vault-role is required to authenticate to Vault")
+	}
+	client, err := newProviderHTTPClient(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &vaultSink{
+		addr:      strings.TrimSuffix(addr, "/"),
+		mount:     strings.Trim(mount, "/"),
+		path:      strings.Trim(path, "/"),
+		tokenFile: tokenFile,
+		role:      role,
+		authMount: strings.Trim(authMount, "/"),
+		jwtFile:   serviceAccountTokenFile,
+		client:    client,
+	}, nil
+}
+
+func (v *vaultSink) name() string {
+	return fmt.Sprintf("Vault %s/%s", v.mount, v.path)
+}
+
+func (v *vaultSink) writeCredentials(ctx context.Context, secrets []*v1.Secret) error {
+	var errs []error
+	for _, secret := range secrets {
+		if err := v.writeSecret(ctx, secret); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (v *vaultSink) writeSecret(ctx context.Context, secret *v1.Secret) error {
+	data := make(map[string]string, len(secret.Data)+1)
+	for key, value := range secret.Data {
+		data[key] = string(value)
+	}
+	if expiresAt := secret.Annotations[expiresAtAnnotation]; expiresAt != "" {
+		data["expiresAt"] = expiresAt
+	}
+	body, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("%s/data/%s/%s", v.mount, v.path, secret.Name)
+	err = v.request(ctx, path, body, nil)
+	if isVaultForbidden(err) && v.role != "" {
+		// the login was revoked before its lease ended
+		v.mu.Lock()
+		v.token = ""
+		v.mu.Unlock()
+		err = v.request(ctx, path, body, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write secret %s: %w", path, err)
+	}
+	return nil
+}
+
+// vaultError is a Vault API error response
+type vaultError struct {
+	status int
+	errors []string
+}
+
+func (e *vaultError) Error() string {
+	if len(e.errors) == 0 {
+		return fmt.Sprintf("Vault returned %d", e.status)
+	}
+	return fmt.Sprintf("Vault returned %d: %s", e.status, strings.Join(e.errors, "; "))
+}
+
+func isVaultForbidden(err error) bool {
+	e, ok := err.(*vaultError)
+	return ok && e.status == http.StatusForbidden
+}
+
+// request POSTs body to /v1/<path>, authenticated unless it is a login, and decodes the response into out if set
+func (v *vaultSink) request(ctx context.Context, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.addr+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
+	if !strings.HasPrefix(path, "auth/") {
+		token, err := v.currentToken(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&e)
+		return &vaultError{status: resp.StatusCode, errors: e.Errors}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// currentToken returns the token of --vault-token-file, read every time so a rotated file is picked up, or else a
+// Kubernetes auth login that is renewed shortly before its lease ends
+func (v *vaultSink) currentToken(ctx context.Context) (string, error) {
+	if v.tokenFile != "" {
+		token, err := readAPIToken(v.tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("could not read the Vault token: %v", err)
+		}
+		return token, nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.token != "" && time.Now().Before(v.renewAt) {
+		return v.token, nil
+	}
+	jwt, err := readAPIToken(v.jwtFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read the ServiceAccount token for the Vault login: %v", err)
+	}
+	body, err := json.Marshal(map[string]string{"role": v.role, "jwt": jwt})
+	if err != nil {
+		return "", err
+	}
+	var login struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	if err := v.request(ctx, fmt.Sprintf("auth/%s/login", v.authMount), body, &login); err != nil {
+		return "", fmt.Errorf("could not log in to Vault as role %s: %w", v.role, err)
+	}
+	v.token = login.Auth.ClientToken
+	v.renewAt = time.Now().Add(time.Duration(login.Auth.LeaseDuration)*time.Second - vaultLoginMargin)
+	log.Infof("Logged in to Vault as role %s", v.role)
+	return v.token, nil
+}
+
+// vaultOutput is --output=vault: the namespaces get no secrets, the credentials only go to the Vault sink
+type vaultOutput struct{}
+
+func (vaultOutput) write(context.Context, string, *v1.Secret) error {
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeVault records the KV writes it accepts from token, and logs role "builder" in as token
+type fakeVault struct {
+	token  string
+	logins int
+	writes map[string]map[string]string
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/auth/kubernetes/login" {
+		var login map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&login)
+		if login["role"] != "builder" || login["jwt"] != "sa-token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		f.logins++
+		_, _ = w.Write([]byte(`{"auth":{"client_token":"` + f.token + `","lease_duration":3600}}`))
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != f.token {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+	var body struct {
+		Data map[string]string `json:"data"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	f.writes[r.URL.Path] = body.Data
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func vaultTestSecret() *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "awsecr-cred", Annotations: map[string]string{expiresAtAnnotation: "2022-09-01T22:30:00Z"}},
+		Data:       map[string][]byte{v1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+	}
+}
+
+func TestVaultSinkTokenFile(t *testing.T) {
+	vault := &fakeVault{token: "s.root", writes: map[string]map[string]string{}}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("s.root\n"), 0o600))
+
+	sink, err := newVaultSink(server.URL+"/", "kv", "/ci/registry-creds/", tokenFile, "", "kubernetes")
+	assert.Nil(t, err)
+	assert.Nil(t, sink.writeCredentials(context.TODO(), []*v1.Secret{vaultTestSecret()}))
+	assert.Equal(t, map[string]string{v1.DockerConfigJsonKey: `{"auths":{}}`, "expiresAt": "2022-09-01T22:30:00Z"},
+		vault.writes["/v1/kv/data/ci/registry-creds/awsecr-cred"])
+
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("s.revoked"), 0o600))
+	err = sink.writeCredentials(context.TODO(), []*v1.Secret{vaultTestSecret()})
+	assert.ErrorContains(t, err, "could not write secret kv/data/ci/registry-creds/awsecr-cred: Vault returned 403: permission denied")
+}
+
+func TestVaultSinkKubernetesLogin(t *testing.T) {
+	vault := &fakeVault{token: "s.login", writes: map[string]map[string]string{}}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	sink, err := newVaultSink(server.URL, "secret", "registry-creds", "", "builder", "kubernetes")
+	assert.Nil(t, err)
+	sink.jwtFile = filepath.Join(t.TempDir(), "jwt")
+	assert.Nil(t, os.WriteFile(sink.jwtFile, []byte("sa-token"), 0o600))
+
+	assert.Nil(t, sink.writeCredentials(context.TODO(), []*v1.Secret{vaultTestSecret(), vaultTestSecret()}))
+	assert.Equal(t, 1, vault.logins)
+	assert.Contains(t, vault.writes, "/v1/secret/data/registry-creds/awsecr-cred")
+
+	// a revoked login is replaced
+	vault.token = "s.second"
+	assert.Nil(t, sink.writeCredentials(context.TODO(), []*v1.Secret{vaultTestSecret()}))
+	assert.Equal(t, 2, vault.logins)
+
+	sink.role = "other"
+	sink.token = ""
+	assert.ErrorContains(t, sink.writeCredentials(context.TODO(), []*v1.Secret{vaultTestSecret()}), "could not log in to Vault as role other")
+}
+
+func TestNewVaultSinkRequiresSettings(t *testing.T) {
+	_, err := newVaultSink("", "secret", "registry-creds", "token", "", "kubernetes")
+	assert.ErrorContains(t, err, "--vault-addr is required")
+	_, err = newVaultSink("https://vault.example.com", "secret", "registry-creds", "", "", "kubernetes")
+	assert.ErrorContains(t, err, "either --vault-token-file or --vault-role")
+}
+
+// recordingSink remembers the names of the secrets it was handed
+type recordingSink struct {
+	written []string
+}
+
+func (r *recordingSink) name() string {
+	return "recording"
+}
+
+func (r *recordingSink) writeCredentials(_ context.Context, secrets []*v1.Secret) error {
+	for _, secret := range secrets {
+		r.written = append(r.written, secret.Name)
+	}
+	return nil
+}
+
+func TestVaultOutputSkipsNamespaces(t *testing.T) {
+	c := newFakeController()
+	sink := &recordingSink{}
+	c.sinks = []credentialSink{sink}
+	c.output = vaultOutput{}
+
+	c.refreshProvider(context.TODO(), getSecretGenerators(c)[0])
+
+	// written once per refresh, not per namespace
+	assert.Equal(t, []string{*argAWSSecretName}, sink.written)
+	assert.Empty(t, c.k8sutil.Kclient.(*fakeKubeClient).secrets["namespace1"].store)
+	assert.False(t, c.writesSecrets())
+}
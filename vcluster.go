@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/doddle/registry-creds/k8sutil"
+)
+
+const (
+	// vclusterReleaseLabel names the vcluster instance on the pods of its control plane
+	vclusterReleaseLabel = "release"
+	// vclusterKubeconfigPrefix and vclusterKubeconfigKey locate the kubeconfig a vcluster writes into its host namespace
+	vclusterKubeconfigPrefix = "vc-"
+	vclusterKubeconfigKey    = "config"
+)
+
+// vcluster is a virtual cluster found on the host cluster
+type vcluster struct {
+	namespace string
+	name      string
+}
+
+func (v vcluster) String() string {
+	return v.namespace + "/" + v.name
+}
+
+// discoverVClusters returns the vclusters whose control plane pods match --vcluster-selector, in a stable order
+func (c *controller) discoverVClusters(ctx context.Context) ([]vcluster, error) {
+	pods, err := c.k8sutil.ListPodsMatching(ctx, "", *argVClusterSelector)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[vcluster]bool{}
+	var found []vcluster
+	for _, pod := range pods.Items {
+		name := pod.Labels[vclusterReleaseLabel]
+		if name == "" {
+			log.Warnf("Pod %s in namespace %s matches --vcluster-selector but has no %s label naming its vcluster", pod.Name, pod.Namespace, vclusterReleaseLabel)
+			continue
+		}
+		v := vcluster{namespace: pod.Namespace, name: name}
+		if !seen[v] {
+			seen[v] = true
+			found = append(found, v)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].String() < found[j].String() })
+	return found, nil
+}
+
+// vclusterRestConfig reads the kubeconfig of a vcluster from its host namespace. vcluster points that kubeconfig at
+// localhost, which is rewritten to the vcluster's Service so the controller can reach it from the host.
+func (c *controller) vclusterRestConfig(ctx context.Context, v vcluster) (*rest.Config, error) {
+	secret, err := c.k8sutil.GetSecret(ctx, v.namespace, vclusterKubeconfigPrefix+v.name)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := clientcmd.RESTConfigFromKubeConfig(secret.Data[vclusterKubeconfigKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig in secret %s%s: %w", vclusterKubeconfigPrefix, v.name, err)
+	}
+	if server, err := url.Parse(cfg.Host); err == nil {
+		if host := server.Hostname(); host == "localhost" || net.ParseIP(host).IsLoopback() {
+			cfg.Host = fmt.Sprintf("https://%s.%s.svc:443", v.name, v.namespace)
+		}
+	}
+	return cfg, nil
+}
+
+// newVClusterUtil connects to a vcluster's API server with the host's client options
+func newVClusterUtil(cfg *rest.Config) (*k8sutil.KubeUtilInterface, error) {
+	return k8sutil.NewForConfig(cfg, nil, k8sutil.ClientOptions{
+		QPS:        *argKubeAPIQPS,
+		Burst:      *argKubeAPIBurst,
+		Timeout:    *argKubeAPITimeout,
+		WriteRetry: newWriteRetry(),
+		UserAgent:  userAgent(),
+	})
+}
+
+// syncVCluster writes the secrets of every provider into each namespace of the vcluster and attaches them to its
+// ServiceAccounts, the way a namespace of the host is synced
+func (c *controller) syncVCluster(ctx context.Context, v vcluster, secrets []*v1.Secret) error {
+	cfg, err := c.vclusterRestConfig(ctx, v)
+	if err != nil {
+		return err
+	}
+	util, err := c.newVClusterUtil(cfg)
+	if err != nil {
+		return err
+	}
+	util.ExcludedNamespaces = c.k8sutil.ExcludedNamespaces
+	// the vcluster gets Secret objects whatever the host's --output; its ServiceAccounts are not probed
+	nested := newController(util, nil)
+	namespaces, err := util.GetNamespaces(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i := range namespaces.Items {
+		ns := &namespaces.Items[i]
+		if stringSliceContains(util.ExcludedNamespaces, ns.Name) || systemNamespace(ns.Name) {
+			continue
+		}
+		for _, secret := range secrets {
+			if err := nested.processNamespace(ctx, ns, secret); err != nil {
+				errs = append(errs, fmt.Errorf("namespace %s: %w", ns.Name, err))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// syncVClusters pushes the current secrets into every vcluster found on the host
+func (c *controller) syncVClusters(ctx context.Context) {
+	vclusters, err := c.discoverVClusters(ctx)
+	if err != nil {
+		log.Errorf("Could not discover the vclusters! [Err: %s]", err)
+		return
+	}
+	if len(vclusters) == 0 {
+		return
+	}
+	secrets := c.generateSecrets(ctx)
+	for _, v := range vclusters {
+		if err := c.syncVCluster(ctx, v, secrets); err != nil {
+			log.Errorf("Could not sync the secrets into vcluster %s! [Err: %s]", v, err)
+			continue
+		}
+		log.Infof("Synced %d secrets into vcluster %s", len(secrets), v)
+	}
+}
+
+// runVClusterSync syncs the vclusters every --vcluster-sync-interval, so new vclusters and rotated tokens reach them
+func (c *controller) runVClusterSync(ctx context.Context) {
+	if *argVClusterSelector == "" {
+		return
+	}
+	ticker := time.NewTicker(*argVClusterInterval)
+	defer ticker.Stop()
+	for {
+		if !writesPaused() {
+			c.syncVClusters(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
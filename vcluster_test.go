@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/doddle/registry-creds/k8sutil"
+)
+
+const vclusterKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: my-vcluster
+  cluster:
+    server: https://localhost:8443
+contexts:
+- name: my-vcluster
+  context:
+    cluster: my-vcluster
+    user: my-vcluster
+current-context: my-vcluster
+users:
+- name: my-vcluster
+  user:
+    token: secret-token
+`
+
+func vclusterPod(namespace, name, release string) v1.Pod {
+	return v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: map[string]string{"app": "vcluster", vclusterReleaseLabel: release}}}
+}
+
+func TestDiscoverVClusters(t *testing.T) {
+	defer func() { *argVClusterSelector = "" }()
+	*argVClusterSelector = "app=vcluster"
+	c := newFakeController()
+	c.k8sutil.Kclient.Pods("").(*fakePods).store = []v1.Pod{
+		vclusterPod("team-b", "dev-0", "dev"),
+		vclusterPod("team-a", "dev-0", "dev"),
+		vclusterPod("team-a", "dev-1", "dev"),
+		vclusterPod("team-a", "unnamed-0", ""),
+	}
+
+	vclusters, err := c.discoverVClusters(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, []vcluster{{namespace: "team-a", name: "dev"}, {namespace: "team-b", name: "dev"}}, vclusters)
+}
+
+func TestSyncVClusters(t *testing.T) {
+	defer func() { *argVClusterSelector = "" }()
+	*argVClusterSelector = "app=vcluster"
+	c := newFakeController()
+	c.k8sutil.Kclient.Pods("").(*fakePods).store = []v1.Pod{vclusterPod("namespace1", "dev-0", "dev")}
+	c.k8sutil.Kclient.(*fakeKubeClient).secrets["namespace1"].store["vc-dev"] = &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace1", Name: "vc-dev"},
+		Data:       map[string][]byte{vclusterKubeconfigKey: []byte(vclusterKubeconfig)},
+	}
+	nested := newKubeUtil()
+	c.newVClusterUtil = func(cfg *rest.Config) (*k8sutil.KubeUtilInterface, error) {
+		// the vcluster is reached through its Service instead of localhost
+		assert.Equal(t, "https://dev.namespace1.svc:443", cfg.Host)
+		assert.Equal(t, "secret-token", cfg.BearerToken)
+		return nested, nil
+	}
+
+	c.syncVClusters(context.TODO())
+
+	for _, ns := range []string{"namespace1", "namespace2"} {
+		secret, err := nested.GetSecret(context.TODO(), ns, *argAWSSecretName)
+		assert.Nil(t, err)
+		assertDockerJSONContains(t, "fakeEndpoint", "fakeToken", secret)
+		sa, err := nested.GetServiceAccount(context.TODO(), ns, "default")
+		assert.Nil(t, err)
+		assertAllSecretsPresent(t, sa.ImagePullSecrets)
+	}
+	_, err := nested.GetSecret(context.TODO(), "kube-system", *argAWSSecretName)
+	assert.NotNil(t, err)
+
+	// a vcluster without its kubeconfig secret is skipped
+	delete(c.k8sutil.Kclient.(*fakeKubeClient).secrets["namespace1"].store, "vc-dev")
+	c.syncVClusters(context.TODO())
+}
+
+func TestValidateParamsVCluster(t *testing.T) {
+	defer func() { *argVClusterSelector = "" }()
+	*argVClusterSelector = "app in (vcluster"
+	_, problems := validateParams()
+	assert.Contains(t, problemStrings(problems), `flag --vcluster-selector="app in (vcluster": unable to parse requirement: found '', expected: ',' or ')'; disabling the vcluster sync`)
+	assert.Equal(t, "", *argVClusterSelector)
+}
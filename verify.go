@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/doddle/registry-creds/k8sutil"
+	log "github.com/sirupsen/logrus"
+)
+
+// newVerifyKubeUtil returns a client of the cluster of the kubeconfig or the Pod, or nil if there is none, e.g. in a
+// CI pipeline: only the providers that read from the Kubernetes API need it
+func newVerifyKubeUtil() *k8sutil.KubeUtilInterface {
+	opts := k8sutil.ClientOptions{
+		QPS:           *argKubeAPIQPS,
+		Burst:         *argKubeAPIBurst,
+		Timeout:       *argKubeAPITimeout,
+		UserAgent:     userAgent(),
+		APIServerHost: *argAPIServerHost,
+		APIServerPort: *argAPIServerPort,
+		TLSServerName: *argAPIServerSNI,
+	}
+	restConfig, err := k8sutil.NewRestConfig(opts)
+	if err != nil {
+		log.Infof("Verifying without the Kubernetes API: %s", err)
+		return nil
+	}
+	util, err := k8sutil.NewForConfig(restConfig, nil, opts)
+	if err != nil {
+		log.Infof("Verifying without the Kubernetes API: %s", err)
+		return nil
+	}
+	return util
+}
+
+// verifyNeedsKubernetes returns true if the provider name reads its credentials from the Kubernetes API
+func verifyNeedsKubernetes(cfg *Config, name string) bool {
+	return name == providerTokenExchange || cfg.credentialsSecretRef(name) != nil
+}
+
+// runVerifyProvider fetches the tokens of the provider name like a refresh does and, with verify, logs in to each of
+// its registries; nothing is written
+func runVerifyProvider(ctx context.Context, c *controller, name string, verify registryVerifier) []checkResult {
+	var secretGenerator *SecretGenerator
+	for _, sg := range getSecretGenerators(c) {
+		if sg.Name == name {
+			sg := sg
+			secretGenerator = &sg
+			break
+		}
+	}
+	if secretGenerator == nil {
+		return []checkResult{{Name: fmt.Sprintf("Provider %s", name), Err: fmt.Errorf("provider %s is not configured", name)}}
+	}
+	if c.k8sutil == nil && verifyNeedsKubernetes(c.currentConfig(), name) {
+		return []checkResult{{Name: fmt.Sprintf("Provider %s", name), Err: fmt.Errorf("provider %s needs the Kubernetes API, which is not reachable", name)}}
+	}
+
+	tokens, err := fetchTokens(ctx, *secretGenerator)
+	results := []checkResult{{Name: fmt.Sprintf("Tokens of provider %s", name), Detail: fmt.Sprintf("%d registries", len(tokens)), Err: err}}
+	if err == nil && len(tokens) == 0 {
+		results[0].Err = fmt.Errorf("provider %s returned no tokens", name)
+	}
+
+	c.secretsLock.Lock()
+	failed := c.ecrFailedAccounts[name]
+	c.secretsLock.Unlock()
+	if len(failed) > 0 {
+		results = append(results, checkResult{Name: fmt.Sprintf("AWS accounts of provider %s", name), Err: fmt.Errorf("could not get the tokens of accounts %s", strings.Join(failed, ","))})
+	}
+
+	if verify == nil {
+		return results
+	}
+	for _, token := range tokens {
+		results = append(results, checkResult{Name: fmt.Sprintf("Registry login to %s", token.Host()), Err: verify(ctx, token)})
+	}
+	return results
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunVerifyProvider(t *testing.T) {
+	c := newFakeController()
+
+	results := runVerifyProvider(context.TODO(), c, providerECR, nil)
+	assert.True(t, printCheckReport(io.Discard, results))
+	assert.Equal(t, []checkResult{{Name: "Tokens of provider ecr", Detail: "1 registries"}}, results)
+
+	results = runVerifyProvider(context.TODO(), c, "missing", nil)
+	assert.False(t, printCheckReport(io.Discard, results))
+	assert.EqualError(t, results[0].Err, "provider missing is not configured")
+
+	rejecting := func(ctx context.Context, token AuthToken) error { return errors.New("rejected the credentials") }
+	results = runVerifyProvider(context.TODO(), c, providerECR, rejecting)
+	assert.False(t, printCheckReport(io.Discard, results))
+	assert.Len(t, results, 2)
+	assert.Equal(t, "Registry login to fakeEndpoint", results[1].Name)
+
+	c = newFakeFailingController()
+	results = runVerifyProvider(context.TODO(), c, providerECR, nil)
+	assert.False(t, printCheckReport(io.Discard, results))
+}
+
+func TestVerifyNeedsKubernetes(t *testing.T) {
+	cfg := &Config{}
+	assert.True(t, verifyNeedsKubernetes(cfg, providerTokenExchange))
+	assert.False(t, verifyNeedsKubernetes(cfg, providerECR))
+}
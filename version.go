@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// These are overridden at build time, e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.gitSHA=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	gitSHA    = "unknown"
+	buildDate = "unknown"
+)
+
+// userAgentProduct names the controller in the User-Agent of its Kubernetes and AWS requests
+const userAgentProduct = "registry-creds"
+
+// VersionInfo describes the build that is currently running
+type VersionInfo struct {
+	Version           string `json:"version"`
+	GitSHA            string `json:"gitSHA"`
+	BuildDate         string `json:"buildDate"`
+	GoVersion         string `json:"goVersion"`
+	KubeClientVersion string `json:"kubeClientVersion"`
+}
+
+func getVersionInfo() VersionInfo {
+	return VersionInfo{
+		Version:           version,
+		GitSHA:            gitSHA,
+		BuildDate:         buildDate,
+		GoVersion:         runtime.Version(),
+		KubeClientVersion: kubeClientVersion(),
+	}
+}
+
+// kubeClientVersion returns the version of k8s.io/client-go compiled into the binary
+func kubeClientVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "k8s.io/client-go" {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// userAgent identifies the controller's requests in the API server audit log and CloudTrail, e.g. "registry-creds/v1.2.3"
+func userAgent() string {
+	return userAgentProduct + "/" + version
+}
+
+func printVersion(w io.Writer) {
+	v := getVersionInfo()
+	fmt.Fprintf(w, "Version:             %s\n", v.Version)
+	fmt.Fprintf(w, "Git SHA:             %s\n", v.GitSHA)
+	fmt.Fprintf(w, "Build Date:          %s\n", v.BuildDate)
+	fmt.Fprintf(w, "Go Version:          %s\n", v.GoVersion)
+	fmt.Fprintf(w, "Kubernetes Client:   %s\n", v.KubeClientVersion)
+}
+
+func versionHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(getVersionInfo())
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/doddle/registry-creds/k8sutil"
+)
+
+// --workload-rollout values
+const (
+	workloadRolloutOff      = "off"
+	workloadRolloutAnnotate = "annotate"
+	workloadRolloutRestart  = "restart"
+)
+
+// credentialsAvailableAnnotation records when the pull secrets first reached the namespace of a workload whose pods
+// could not pull their images; on a pod template it restarts the workload, like kubectl rollout restart
+const credentialsAvailableAnnotation = annotationPrefix + "credentials-available-at"
+
+// workloadRef is the workload that owns a pod
+type workloadRef struct {
+	kind string
+	name string
+}
+
+// newWorkloadObject returns an empty object of the workload's kind, nil for kinds that are never patched
+func newWorkloadObject(kind string) client.Object {
+	switch kind {
+	case "Deployment":
+		return &appsv1.Deployment{}
+	case "StatefulSet":
+		return &appsv1.StatefulSet{}
+	case "DaemonSet":
+		return &appsv1.DaemonSet{}
+	case "ReplicaSet":
+		return &appsv1.ReplicaSet{}
+	case "Job":
+		return &batchv1.Job{}
+	case "CronJob":
+		return &batchv1.CronJob{}
+	}
+	return nil
+}
+
+// firstCredentials reports whether none of the secrets exist in the namespace yet, so writing them makes the
+// credentials available for the first time. Outputs that do not write the secrets into the namespace never count.
+func (c *controller) firstCredentials(ctx context.Context, namespace string, secrets []*v1.Secret) bool {
+	if !c.writesSecrets() {
+		return false
+	}
+	for _, secret := range secrets {
+		exists, err := c.k8sutil.SecretExists(ctx, namespace, secret.Name)
+		if err != nil || exists {
+			return false
+		}
+	}
+	return len(secrets) > 0
+}
+
+// rolloutWorkloads acts on the workloads whose pods failed to pull from one of the providers' registries before the
+// pull secrets existed. Those pods were admitted without the imagePullSecrets and keep failing until they are
+// recreated: with --workload-rollout=restart the Deployments, StatefulSets and DaemonSets are restarted through their
+// pod template and the pods of Jobs and bare ReplicaSets, whose templates do not restart anything, are deleted;
+// annotate only marks the workloads, for tooling that restarts them itself.
+func (c *controller) rolloutWorkloads(ctx context.Context, namespace string, secretGenerators []SecretGenerator) error {
+	if *argWorkloadRollout == workloadRolloutOff || c.workloads == nil {
+		return nil
+	}
+	var hosts []string
+	c.secretsLock.Lock()
+	for _, secretGenerator := range secretGenerators {
+		for _, token := range c.tokens[secretGenerator.SecretName] {
+			hosts = append(hosts, token.Host())
+		}
+	}
+	c.secretsLock.Unlock()
+
+	pods, err := c.k8sutil.ListPods(ctx, namespace)
+	if k8sutil.IsForbidden(err) {
+		log.Warnf("Not allowed to list pods; cannot find the workloads in namespace %s that failed to pull their images", namespace)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	done := map[workloadRef]bool{}
+	var errs []error
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if len(imagePullFailures([]v1.Pod{*pod}, hosts)) == 0 {
+			continue
+		}
+		ref, err := c.podWorkload(ctx, pod)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ref == nil {
+			log.Infof("Pod %s in namespace %s cannot pull its images and has no workload to restart; delete it to retry with the pull secrets", pod.Name, namespace)
+			continue
+		}
+		if *argWorkloadRollout == workloadRolloutRestart && (ref.kind == "Job" || ref.kind == "CronJob" || ref.kind == "ReplicaSet") {
+			if err := c.workloads.Delete(ctx, pod); client.IgnoreNotFound(err) != nil {
+				errs = append(errs, fmt.Errorf("could not delete pod %s: %w", pod.Name, err))
+				continue
+			}
+			log.Infof("Deleted pod %s of %s %s in namespace %s, which could not pull its images before the pull secrets existed", pod.Name, ref.kind, ref.name, namespace)
+			continue
+		}
+		if done[*ref] {
+			continue
+		}
+		done[*ref] = true
+		if err := c.patchWorkload(ctx, namespace, *ref, now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// podWorkload returns the workload that owns the pod, following ReplicaSets to their Deployment and, when only
+// annotating, Jobs to their CronJob; nil if the pod has no controller
+func (c *controller) podWorkload(ctx context.Context, pod *v1.Pod) (*workloadRef, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || newWorkloadObject(owner.Kind) == nil {
+		return nil, nil
+	}
+	ref := &workloadRef{kind: owner.Kind, name: owner.Name}
+	if ref.kind != "ReplicaSet" && (ref.kind != "Job" || *argWorkloadRollout != workloadRolloutAnnotate) {
+		return ref, nil
+	}
+	obj := newWorkloadObject(ref.kind)
+	if err := c.workloads.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: ref.name}, obj); err != nil {
+		if k8sutil.IsNotFound(err) {
+			return ref, nil
+		}
+		return nil, fmt.Errorf("could not get %s %s: %w", ref.kind, ref.name, err)
+	}
+	if parent := metav1.GetControllerOf(obj); parent != nil && newWorkloadObject(parent.Kind) != nil {
+		return &workloadRef{kind: parent.Kind, name: parent.Name}, nil
+	}
+	return ref, nil
+}
+
+// patchWorkload sets credentialsAvailableAnnotation on the workload, or on its pod template to restart it
+func (c *controller) patchWorkload(ctx context.Context, namespace string, ref workloadRef, now string) error {
+	annotations := map[string]interface{}{"annotations": map[string]string{credentialsAvailableAnnotation: now}}
+	patch := map[string]interface{}{"metadata": annotations}
+	if *argWorkloadRollout == workloadRolloutRestart {
+		patch = map[string]interface{}{"spec": map[string]interface{}{"template": map[string]interface{}{"metadata": annotations}}}
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	obj := newWorkloadObject(ref.kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(ref.name)
+	if err := c.workloads.Patch(ctx, obj, client.RawPatch(types.MergePatchType, data)); err != nil {
+		return fmt.Errorf("could not %s %s %s: %w", *argWorkloadRollout, ref.kind, ref.name, err)
+	}
+	if *argWorkloadRollout == workloadRolloutRestart {
+		log.Infof("Restarted %s %s in namespace %s, whose pods could not pull their images before the pull secrets existed", ref.kind, ref.name, namespace)
+	} else {
+		log.Infof("Annotated %s %s in namespace %s, whose pods could not pull their images before the pull secrets existed", ref.kind, ref.name, namespace)
+	}
+	return nil
+}
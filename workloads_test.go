@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doddle/registry-creds/pkg/providers"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// failingPod returns a pod of the owner that cannot pull its image from registry.example.com
+func failingPod(name string, owner *metav1.OwnerReference) v1.Pod {
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace1", Name: name},
+		Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{
+			Image: "registry.example.com/app:1",
+			State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "no basic auth credentials"}},
+		}}},
+	}
+	if owner != nil {
+		controller := true
+		owner.Controller = &controller
+		pod.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+	return pod
+}
+
+func newWorkloadController(objects ...client.Object) *controller {
+	c := newFakeController()
+	c.fake = &providers.Fake{Registries: []string{"https://registry.example.com"}, Expiry: time.Hour}
+	controller := true
+	objects = append(objects,
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "namespace1", Name: "web"}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "namespace1", Name: "web-5d4f",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "web", Controller: &controller}}}},
+		&batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{Namespace: "namespace1", Name: "nightly"}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "namespace1", Name: "nightly-1234",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "CronJob", Name: "nightly", Controller: &controller}}}},
+	)
+	pods := []v1.Pod{
+		failingPod("web-5d4f-a", &metav1.OwnerReference{Kind: "ReplicaSet", Name: "web-5d4f"}),
+		failingPod("web-5d4f-b", &metav1.OwnerReference{Kind: "ReplicaSet", Name: "web-5d4f"}),
+		failingPod("nightly-1234-x", &metav1.OwnerReference{Kind: "Job", Name: "nightly-1234"}),
+		failingPod("bare", nil),
+	}
+	for i := range pods {
+		objects = append(objects, &pods[i])
+	}
+	c.k8sutil.Kclient.Pods("namespace1").(*fakePods).store = pods
+	c.workloads = fake.NewClientBuilder().WithObjects(objects...).Build()
+	return c
+}
+
+func TestHandlerAnnotatesWorkloadsOnFirstCredentials(t *testing.T) {
+	defer func() { *argWorkloadRollout = workloadRolloutOff }()
+	*argWorkloadRollout = workloadRolloutAnnotate
+	c := newWorkloadController()
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	assert.Nil(t, handler(context.TODO(), c, ns))
+
+	deployment := &appsv1.Deployment{}
+	assert.Nil(t, c.workloads.Get(context.TODO(), types.NamespacedName{Namespace: "namespace1", Name: "web"}, deployment))
+	assert.Contains(t, deployment.Annotations, credentialsAvailableAnnotation)
+	assert.NotContains(t, deployment.Spec.Template.Annotations, credentialsAvailableAnnotation)
+	cronJob := &batchv1.CronJob{}
+	assert.Nil(t, c.workloads.Get(context.TODO(), types.NamespacedName{Namespace: "namespace1", Name: "nightly"}, cronJob))
+	assert.Contains(t, cronJob.Annotations, credentialsAvailableAnnotation)
+
+	// the secrets exist on later syncs, so the workloads are left alone
+	deployment.Annotations = nil
+	assert.Nil(t, c.workloads.Update(context.TODO(), deployment))
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	assert.Nil(t, c.workloads.Get(context.TODO(), types.NamespacedName{Namespace: "namespace1", Name: "web"}, deployment))
+	assert.NotContains(t, deployment.Annotations, credentialsAvailableAnnotation)
+}
+
+func TestHandlerRestartsWorkloadsOnFirstCredentials(t *testing.T) {
+	defer func() { *argWorkloadRollout = workloadRolloutOff }()
+	*argWorkloadRollout = workloadRolloutRestart
+	c := newWorkloadController()
+	assert.Nil(t, handler(context.TODO(), c, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}))
+
+	deployment := &appsv1.Deployment{}
+	assert.Nil(t, c.workloads.Get(context.TODO(), types.NamespacedName{Namespace: "namespace1", Name: "web"}, deployment))
+	assert.Contains(t, deployment.Spec.Template.Annotations, credentialsAvailableAnnotation)
+
+	// the Job's pod is recreated by deleting it, the bare pod is only logged
+	pods := &v1.PodList{}
+	assert.Nil(t, c.workloads.List(context.TODO(), pods, client.InNamespace("namespace1")))
+	var names []string
+	for _, pod := range pods.Items {
+		names = append(names, pod.Name)
+	}
+	assert.ElementsMatch(t, []string{"web-5d4f-a", "web-5d4f-b", "bare"}, names)
+}
+
+func TestHandlerRestartsWorkloadsAfterFailedFirstSync(t *testing.T) {
+	defer func() { *argWorkloadRollout = workloadRolloutOff }()
+	*argWorkloadRollout = workloadRolloutRestart
+	c := newWorkloadController()
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+
+	// the secrets are written, but attaching them to the ServiceAccount fails
+	serviceAccounts := c.k8sutil.Kclient.ServiceAccounts("namespace1").(*fakeServiceAccounts)
+	serviceAccounts.conflicts = 1000
+	assert.NotNil(t, handler(context.TODO(), c, ns))
+	deployment := &appsv1.Deployment{}
+	assert.Nil(t, c.workloads.Get(context.TODO(), types.NamespacedName{Namespace: "namespace1", Name: "web"}, deployment))
+	assert.NotContains(t, deployment.Spec.Template.Annotations, credentialsAvailableAnnotation)
+
+	// the retry finds the secrets in place and still restarts the workloads
+	serviceAccounts.conflicts = 0
+	assert.Nil(t, handler(context.TODO(), c, ns))
+	assert.Nil(t, c.workloads.Get(context.TODO(), types.NamespacedName{Namespace: "namespace1", Name: "web"}, deployment))
+	assert.Contains(t, deployment.Spec.Template.Annotations, credentialsAvailableAnnotation)
+	assert.Empty(t, c.pendingRollouts)
+}
+
+func TestHandlerWorkloadRolloutOff(t *testing.T) {
+	c := newWorkloadController()
+	assert.Nil(t, handler(context.TODO(), c, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}))
+
+	deployment := &appsv1.Deployment{}
+	assert.Nil(t, c.workloads.Get(context.TODO(), types.NamespacedName{Namespace: "namespace1", Name: "web"}, deployment))
+	assert.NotContains(t, deployment.Annotations, credentialsAvailableAnnotation)
+}
+
+func TestValidateParamsWorkloadRollout(t *testing.T) {
+	defer func() { *argWorkloadRollout = workloadRolloutOff }()
+	*argWorkloadRollout = "always"
+	_, problems := validateParams()
+	assert.Contains(t, problemStrings(problems), `flag --workload-rollout="always": must be off, annotate or restart; defaulting to off`)
+	assert.Equal(t, workloadRolloutOff, *argWorkloadRollout)
+}
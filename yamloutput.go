@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/doddle/registry-creds/k8sutil"
+)
+
+// outputYAML is --output=yaml: the Secret and ServiceAccount manifests are written to --output-dir for a GitOps tool
+// to apply, and nothing is written through the Kubernetes API
+const outputYAML = "yaml"
+
+// yamlOutput writes every namespace's pull secret as <dir>/<namespace>/secret-<name>.yaml. It is also the
+// ServiceAccount client of the sync, so the ServiceAccounts the controller would patch are written as
+// <dir>/<namespace>/serviceaccount-<name>.yaml with their resulting imagePullSecrets instead.
+type yamlOutput struct {
+	util *k8sutil.KubeUtilInterface
+	dir  string
+	// managed returns the names of the secrets the controller distributes, see GetServiceAccount
+	managed func() []string
+}
+
+func newYAMLOutput(util *k8sutil.KubeUtilInterface, dir string, managed func() []string) (*yamlOutput, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("--output-dir is required with --output=%s", outputYAML)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create output directory: %v", err)
+	}
+	return &yamlOutput{util: util, dir: dir, managed: managed}, nil
+}
+
+// disableClusterWrites switches off what the controller would write through the Kubernetes API besides the manifests,
+// so the tool applying them stays the only writer of the cluster
+func (c *controller) disableClusterWrites() {
+	log.Infof("Writing nothing through the Kubernetes API with --output=%s: no status ConfigMap, Events, namespace annotations or workload rollouts", outputYAML)
+	*argStatusConfigMap = ""
+	*argStatusShutdownReport = false
+	*argWorkloadRollout = workloadRolloutOff
+	c.recorder = nil
+	c.workloads = nil
+	c.caps.annotateNamespaces = false
+}
+
+func (o *yamlOutput) path(namespace, kind, name string) string {
+	return filepath.Join(o.dir, namespace, kind+"-"+name+".yaml")
+}
+
+func (o *yamlOutput) write(ctx context.Context, namespace string, secret *v1.Secret) error {
+	manifest := &v1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secret.Name,
+			Namespace:   namespace,
+			Labels:      secret.Labels,
+			Annotations: secret.Annotations,
+		},
+		Type: secret.Type,
+		Data: secret.Data,
+	}
+	return o.writeManifest(o.path(namespace, "secret", secret.Name), manifest)
+}
+
+// GetServiceAccount returns the ServiceAccount as it is in the cluster, with the imagePullSecrets entries of the
+// managed secrets as last written to the output directory: those only reach the cluster once the manifest is applied,
+// and the secrets of several providers add up in one manifest. The other entries are always taken from the cluster,
+// so changes made there are kept. A missing ServiceAccount is created by the manifest with --create-service-accounts.
+func (o *yamlOutput) GetServiceAccount(ctx context.Context, namespace, name string) (*v1.ServiceAccount, error) {
+	written, err := o.readServiceAccount(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	sa, err := o.util.GetServiceAccount(ctx, namespace, name)
+	switch {
+	case k8sutil.IsNotFound(err) && written != nil:
+		// created by the manifest, which was not applied yet
+		return written, nil
+	case k8sutil.IsNotFound(err) && *argCreateServiceAccounts:
+		sa = &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+		setManagedMetadata(&sa.ObjectMeta)
+		return sa, nil
+	case err != nil:
+		return nil, err
+	}
+	// the sync modifies the ServiceAccount, which must not reach a shared cache
+	sa = sa.DeepCopy()
+	if written != nil {
+		sa.ImagePullSecrets = mergeManagedPullSecrets(sa.ImagePullSecrets, written.ImagePullSecrets, o.managed())
+	}
+	return sa, nil
+}
+
+// readServiceAccount returns the ServiceAccount manifest last written, nil if there is none
+func (o *yamlOutput) readServiceAccount(namespace, name string) (*v1.ServiceAccount, error) {
+	data, err := os.ReadFile(o.path(namespace, "serviceaccount", name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sa := &v1.ServiceAccount{}
+	if err := yaml.Unmarshal(data, sa); err != nil {
+		return nil, fmt.Errorf("could not read the ServiceAccount manifest %s/%s: %v", namespace, name, err)
+	}
+	return sa, nil
+}
+
+// mergeManagedPullSecrets returns the live entries with those of the managed secrets replaced by the written ones,
+// keeping the order of the live list and appending the written entries it lacks
+func mergeManagedPullSecrets(live, written []v1.LocalObjectReference, managed []string) []v1.LocalObjectReference {
+	isManaged := map[string]bool{}
+	for _, name := range managed {
+		isManaged[name] = true
+	}
+	inWritten := map[string]bool{}
+	for _, ref := range written {
+		inWritten[ref.Name] = true
+	}
+	var merged []v1.LocalObjectReference
+	seen := map[string]bool{}
+	for _, ref := range live {
+		if isManaged[ref.Name] && !inWritten[ref.Name] {
+			continue
+		}
+		merged = append(merged, ref)
+		seen[ref.Name] = true
+	}
+	for _, ref := range written {
+		if isManaged[ref.Name] && !seen[ref.Name] {
+			merged = append(merged, ref)
+			seen[ref.Name] = true
+		}
+	}
+	return merged
+}
+
+// UpdateServiceAccount writes the ServiceAccount's identity, labels, annotations and imagePullSecrets; the
+// imagePullSecrets of a ServiceAccount are replaced as a whole when the manifest is applied
+func (o *yamlOutput) UpdateServiceAccount(ctx context.Context, namespace string, sa *v1.ServiceAccount) error {
+	manifest := &v1.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        sa.Name,
+			Namespace:   namespace,
+			Labels:      sa.Labels,
+			Annotations: sa.Annotations,
+		},
+		ImagePullSecrets: sa.ImagePullSecrets,
+	}
+	return o.writeManifest(o.path(namespace, "serviceaccount", sa.Name), manifest)
+}
+
+// writeRendered writes the ConfigMap or Secret of a renderer as <dir>/<namespace>/<kind>-<name>.yaml
+func (o *yamlOutput) writeRendered(r RendererConfig, meta metav1.ObjectMeta, data map[string]string) error {
+	if r.kind() == renderKindSecret {
+		manifest := &v1.Secret{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+			ObjectMeta: meta,
+			Type:       v1.SecretTypeOpaque,
+			StringData: data,
+		}
+		return o.writeManifest(o.path(r.Namespace, "secret", r.Name), manifest)
+	}
+	manifest := &v1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: meta,
+		Data:       data,
+	}
+	return o.writeManifest(o.path(r.Namespace, "configmap", r.Name), manifest)
+}
+
+// prune removes the directories of namespaces that no longer exist. A directory changed since the namespaces were
+// listed at listed belongs to a namespace created in the meantime and is kept.
+func (o *yamlOutput) prune(namespaces []v1.Namespace, listed time.Time) {
+	existing := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		existing[ns.Name] = true
+	}
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		log.Warnf("Could not list the output directory %s! [Err: %s]", o.dir, err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || existing[entry.Name()] || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if info, err := entry.Info(); err != nil || info.ModTime().After(listed) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(o.dir, entry.Name())); err != nil {
+			log.Warnf("Could not remove the manifests of deleted namespace %s! [Err: %s]", entry.Name(), err)
+			continue
+		}
+		log.Infof("Removed the manifests of deleted namespace %s", entry.Name())
+	}
+}
+
+// writeManifest replaces the file at path with the YAML of obj through a rename, so a GitOps tool reading the
+// directory never sees a partial manifest
+func (o *yamlOutput) writeManifest(path string, obj interface{}) error {
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".manifest-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/yaml"
+)
+
+func TestProcessNamespaceWithYAMLOutput(t *testing.T) {
+	dir := t.TempDir()
+	c := newFakeController()
+	output, err := newYAMLOutput(c.k8sutil, dir, c.managedSecretNames)
+	require.Nil(t, err)
+	c.output = output
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: *argAWSSecretName},
+		Type:       v1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{v1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+	}
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+	other := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "other-cred"}}
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, other))
+
+	data, err := os.ReadFile(filepath.Join(dir, "namespace1", "secret-"+*argAWSSecretName+".yaml"))
+	require.Nil(t, err)
+	written := &v1.Secret{}
+	require.Nil(t, yaml.Unmarshal(data, written))
+	assert.Equal(t, "Secret", written.Kind)
+	assert.Equal(t, "namespace1", written.Namespace)
+	assert.Equal(t, secret.Data, written.Data)
+
+	// the ServiceAccount manifest adds up the secrets of both syncs
+	data, err = os.ReadFile(filepath.Join(dir, "namespace1", "serviceaccount-default.yaml"))
+	require.Nil(t, err)
+	sa := &v1.ServiceAccount{}
+	require.Nil(t, yaml.Unmarshal(data, sa))
+	assert.Equal(t, "ServiceAccount", sa.Kind)
+	assert.Equal(t, []string{*argAWSSecretName, "other-cred"}, pullSecretNames(sa))
+
+	// nothing is applied
+	exists, err := c.k8sutil.SecretExists(context.TODO(), "namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	defaultSA, err := c.k8sutil.GetServiceAccount(context.TODO(), "namespace1", "default")
+	assert.Nil(t, err)
+	assert.Empty(t, pullSecretNames(defaultSA))
+}
+
+func TestYAMLOutputNeedsDir(t *testing.T) {
+	_, err := newYAMLOutput(newKubeUtil(), "", nil)
+	assert.NotNil(t, err)
+}
+
+func TestYAMLOutputKeepsClusterChangesOfServiceAccounts(t *testing.T) {
+	dir := t.TempDir()
+	c := newFakeController()
+	output, err := newYAMLOutput(c.k8sutil, dir, c.managedSecretNames)
+	require.Nil(t, err)
+	c.output = output
+
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: *argAWSSecretName}}
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+
+	// someone else adds an entry in the cluster after the manifest was written
+	live := c.k8sutil.Kclient.ServiceAccounts("namespace1").(*fakeServiceAccounts).store["default"]
+	live.ImagePullSecrets = []v1.LocalObjectReference{{Name: "team-cred"}}
+	assert.Nil(t, c.processNamespace(context.TODO(), ns, secret))
+
+	data, err := os.ReadFile(filepath.Join(dir, "namespace1", "serviceaccount-default.yaml"))
+	require.Nil(t, err)
+	sa := &v1.ServiceAccount{}
+	require.Nil(t, yaml.Unmarshal(data, sa))
+	assert.Equal(t, []string{"team-cred", *argAWSSecretName}, pullSecretNames(sa))
+}
+
+func TestMergeManagedPullSecrets(t *testing.T) {
+	refs := func(names ...string) []v1.LocalObjectReference {
+		var result []v1.LocalObjectReference
+		for _, name := range names {
+			result = append(result, v1.LocalObjectReference{Name: name})
+		}
+		return result
+	}
+	managed := []string{"a-cred", "b-cred"}
+
+	// a managed entry only in the cluster was removed by the manifest, the written ones are appended
+	merged := mergeManagedPullSecrets(refs("other", "a-cred"), refs("b-cred", "stale"), managed)
+	assert.Equal(t, refs("other", "b-cred"), merged)
+	assert.Equal(t, refs("a-cred", "other"), mergeManagedPullSecrets(refs("a-cred", "other"), refs("a-cred"), managed))
+}
+
+func TestYAMLOutputPrunesDeletedNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	output, err := newYAMLOutput(newKubeUtil(), dir, nil)
+	require.Nil(t, err)
+	for _, ns := range []string{"namespace1", "deleted"} {
+		require.Nil(t, output.write(context.TODO(), ns, &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "awsecr-cred"}}))
+	}
+
+	// a namespace created after the list was taken is kept
+	output.prune([]v1.Namespace{{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}}, time.Now().Add(-time.Hour))
+	assert.DirExists(t, filepath.Join(dir, "deleted"))
+
+	output.prune([]v1.Namespace{{ObjectMeta: metav1.ObjectMeta{Name: "namespace1"}}}, time.Now().Add(time.Second))
+	assert.DirExists(t, filepath.Join(dir, "namespace1"))
+	assert.NoDirExists(t, filepath.Join(dir, "deleted"))
+}
+
+func TestYAMLOutputWritesRenderers(t *testing.T) {
+	dir := t.TempDir()
+	c := newFakeController()
+	output, err := newYAMLOutput(c.k8sutil, dir, c.managedSecretNames)
+	require.Nil(t, err)
+	c.output = output
+
+	r := RendererConfig{Kind: renderKindConfigMap, Name: "node-creds", Namespace: "kube-system"}
+	assert.Nil(t, c.writeRendered(context.TODO(), r, map[string]string{"config.json": "{}"}))
+	data, err := os.ReadFile(filepath.Join(dir, "kube-system", "configmap-node-creds.yaml"))
+	require.Nil(t, err)
+	cm := &v1.ConfigMap{}
+	require.Nil(t, yaml.Unmarshal(data, cm))
+	assert.Equal(t, "{}", cm.Data["config.json"])
+	_, err = c.k8sutil.GetConfigMap(context.TODO(), "kube-system", "node-creds")
+	assert.NotNil(t, err)
+}
+
+func TestDisableClusterWrites(t *testing.T) {
+	defer func(status string) { *argStatusConfigMap = status }(*argStatusConfigMap)
+	c := newFakeController()
+	c.recorder = record.NewFakeRecorder(10)
+	c.disableClusterWrites()
+	assert.Empty(t, *argStatusConfigMap)
+	assert.Nil(t, c.recorder)
+	assert.False(t, c.caps.annotateNamespaces)
+	assert.Equal(t, workloadRolloutOff, *argWorkloadRollout)
+}